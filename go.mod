@@ -2,9 +2,10 @@ module BitTorrent
 
 go 1.24.2
 
+require github.com/jackpal/bencode-go v1.0.2
+
 require (
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/jackpal/bencode-go v1.0.2 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/schollz/progressbar/v3 v3.18.0 // indirect
@@ -2,39 +2,309 @@ package main
 
 import (
 	"BitTorrent/torrent"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
 )
 
+// --------------------------------------------------------------------------------------------- //
+
+// closers hold the listener and port mapping, closed by closeAll on every way out of main.
+var (
+	closers   []io.Closer
+	closeOnce sync.Once
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+closeAll closes the registered closers, last registered first. Deferred calls do not run on
+os.Exit, so it is called explicitly before exiting on Ctrl+C or a fatal error; only the first
+call has an effect.
+*/
+func closeAll() {
+	closeOnce.Do(func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fatalf closes the registered closers, then logs the message and exits like log.Fatalf.
+
+Parameters:
+  - format: fmt format of the message.
+  - args: Format arguments.
+*/
+func fatalf(format string, args ...any) {
+	closeAll()
+	log.Fatalf(format, args...)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 func main() {
 	logFile, err := os.OpenFile("torrent.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v\n", err)
 	}
-	log.SetOutput(logFile)
 	defer logFile.Close()
 
-	if len(os.Args) < 3 {
-		fmt.Fprintf(os.Stderr, "Usage: ./BitTorrent <path-to-torrent-file> <output-path>\n")
+	listenPort := flag.Uint("port", 6881, "local TCP port to accept peer connections on")
+	announcePort := flag.Uint("announce-port", 0, "port advertised to trackers if it differs from -port (0 = same)")
+	metricsAddr := flag.String("metrics", "", "serve Prometheus metrics on this address (e.g. :9090)")
+	skipVerify := flag.Bool("skip-verify", false, "skip the final re-hash of all pieces from disk")
+	seed := flag.Bool("seed", false, "keep seeding after the download completes (until interrupted)")
+	seedRatio := flag.Float64("seed-ratio", 0, "stop seeding at this upload/download ratio (0 = no limit)")
+	benchmark := flag.Bool("benchmark", false, "discard downloaded data and report throughput (hashes are still checked)")
+	seedTime := flag.Duration("seed-time", 0, "stop seeding after this duration (0 = no limit)")
+	portForward := flag.Bool("port-forward", true, "map the listen port on the router with PCP, NAT-PMP or UPnP")
+	lsd := flag.Bool("lsd", false, "announce to and find peers on the local network while seeding")
+	lsdInterface := flag.String("lsd-interface", "", "network interface for local peer discovery (default: the default-route interface)")
+	repair := flag.Bool("repair", false, "recheck an existing download and re-download only corrupt or missing pieces")
+	encryption := flag.String("encryption", "prefer", "peer connection encryption: disabled, prefer or require")
+	progress := flag.String("progress", "auto", "progress output: auto, bar, lines or none")
+	logFormat := flag.String("log-format", "text", "format of torrent.log: text or json")
+	blobStore := flag.String("blob-store", "", "keep verified pieces in this content-addressable store instead of the output files")
+	export := flag.String("export", "", "with -blob-store: copy the files out of the store into this directory once the download is complete")
+	signatures := flag.String("signatures", "ignore", "publisher signature policy: ignore, check or require")
+	trustedKeys := flag.String("trusted-keys", "", "comma-separated PEM files of trusted publisher keys or certificates")
+	publicTrackers := flag.String("public-trackers", "default", "public trackers to announce to: default, none or a comma-separated list replacing the built-in one")
+	trackers := flag.String("trackers", "", "comma-separated extra trackers to announce this torrent to")
+	numWant := flag.Int("numwant", 0, "peers to request per tracker announce (0 = tracker default)")
+	trackerCA := flag.String("tracker-ca", "", "PEM file of additional CA certificates trusted for HTTPS trackers")
+	trackerCert := flag.String("tracker-cert", "", "PEM file of the client certificate presented to HTTPS trackers")
+	trackerKey := flag.String("tracker-key", "", "PEM file of the key of -tracker-cert (default: read from -tracker-cert)")
+	trackerInsecure := flag.Bool("tracker-insecure", false, "do not verify HTTPS tracker certificates (testing only)")
+	flag.Parse()
+
+	switch *logFormat {
+	case "text":
+		torrent.SetLogOutput(logFile, torrent.LogText)
+	case "json":
+		torrent.SetLogOutput(logFile, torrent.LogJSON)
+	default:
+		log.Fatalf("Unknown log format %q\n", *logFormat)
+	}
+
+	if flag.Arg(0) == "selftest" {
+		err = torrent.SelfTest(os.Stdout)
+		if err != nil {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if flag.NArg() < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: ./BitTorrent [flags] <path-to-torrent-file | magnet-link> <output-path>\n       ./BitTorrent selftest\n")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	Torrent, err := torrent.SetTorrentFile(os.Args[1])
+	var Torrent *torrent.TorrentFile
+	if strings.HasPrefix(flag.Arg(0), "magnet:") {
+		Torrent, err = torrent.OpenMagnet(flag.Arg(0))
+	} else {
+		Torrent, err = torrent.SetTorrentFile(flag.Arg(0))
+	}
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
 
-	peers, err := torrent.FindConnections(Torrent)
+	if *listenPort > 65535 || *announcePort > 65535 {
+		log.Fatalf("Port out of range\n")
+	}
+
+	Torrent.Config.ListenPort = uint16(*listenPort)
+	Torrent.Config.AnnouncePort = uint16(*announcePort)
+	Torrent.Config.MetricsAddr = *metricsAddr
+	Torrent.Config.SkipVerify = *skipVerify
+	Torrent.Config.SeedAfterComplete = *seed
+	Torrent.Config.SeedRatioLimit = *seedRatio
+	Torrent.Config.SeedTimeLimit = *seedTime
+	Torrent.Config.Benchmark = *benchmark
+	Torrent.Config.PortForwarding = *portForward
+	Torrent.Config.LSD = *lsd
+	Torrent.Config.LSDInterface = *lsdInterface
+	Torrent.Config.BlobStore = *blobStore
+
+	switch *progress {
+	case "auto":
+		Torrent.Config.ProgressMode = torrent.ProgressAuto
+	case "bar":
+		Torrent.Config.ProgressMode = torrent.ProgressBar
+	case "lines":
+		Torrent.Config.ProgressMode = torrent.ProgressLines
+	case "none":
+		Torrent.Config.ProgressMode = torrent.ProgressNone
+	default:
+		log.Fatalf("Unknown progress mode %q\n", *progress)
+	}
+
+	switch *encryption {
+	case "disabled":
+		Torrent.Config.Encryption = torrent.EncryptionDisabled
+	case "prefer":
+		Torrent.Config.Encryption = torrent.EncryptionPrefer
+	case "require":
+		Torrent.Config.Encryption = torrent.EncryptionRequire
+	default:
+		log.Fatalf("Unknown encryption mode %q\n", *encryption)
+	}
+
+	switch *signatures {
+	case "ignore":
+		Torrent.Config.Signatures = torrent.SignaturesIgnore
+	case "check":
+		Torrent.Config.Signatures = torrent.SignaturesCheck
+	case "require":
+		Torrent.Config.Signatures = torrent.SignaturesRequire
+	default:
+		log.Fatalf("Unknown signature policy %q\n", *signatures)
+	}
+
+	switch *publicTrackers {
+	case "default":
+	case "none":
+		Torrent.Config.DefaultTrackers = nil
+	default:
+		Torrent.Config.DefaultTrackers = strings.Split(*publicTrackers, ",")
+	}
+
+	if *trackers != "" {
+		Torrent.Config.ExtraTrackers = strings.Split(*trackers, ",")
+	}
+
+	Torrent.Config.NumWant = *numWant
+
+	if *trackerCA != "" || *trackerCert != "" || *trackerKey != "" || *trackerInsecure {
+		Torrent.Config.TrackerTLS, err = torrent.LoadTrackerTLS(*trackerCA, *trackerCert, *trackerKey, *trackerInsecure)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	if *trustedKeys != "" {
+		for _, path := range strings.Split(*trustedKeys, ",") {
+			key, err := torrent.LoadPublisherKey(path)
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+
+			Torrent.Config.TrustedPublishers = append(Torrent.Config.TrustedPublishers, key)
+		}
+	}
+
+	err = Torrent.Config.Validate()
 	if err != nil {
 		log.Fatalf("%v\n", err)
 	}
 
-	Torrent.ConnectToPeers(peers)
+	Torrent.ServeMetrics()
+
+	defer closeAll()
+
+	listener, err := Torrent.Listen()
+	if err != nil {
+		log.Printf("[ERROR]\t%v", err)
+	} else {
+		closers = append(closers, listener)
+
+		if Torrent.Config.PortForwarding {
+			mapping, err := Torrent.ForwardPort()
+			if err != nil {
+				log.Printf("[ERROR]\t%v", err)
+			} else {
+				closers = append(closers, mapping)
+			}
+		}
+	}
+
+	if !Torrent.Config.Benchmark && Torrent.HasMetadata() {
+		err = Torrent.LoadResume(flag.Arg(1))
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	}
+
+	_, err = torrent.FindConnections(Torrent)
+	if err != nil && len(Torrent.KnownPeers) == 0 && len(Torrent.WebSeeds()) == 0 {
+		fatalf("%v\n", err)
+	}
+
+	Torrent.ConnectToPeers(Torrent.KnownPeers)
+
+	err = Torrent.FetchMetadata()
+	if err != nil {
+		Torrent.AnnounceStopped()
+		fatalf("%v\n", err)
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	go func() {
+		<-interrupts
+		fmt.Println("\nInterrupted, leaving the swarm...")
+		Torrent.AnnounceStopped()
+		closeAll()
+		os.Exit(130)
+	}()
 
 	Torrent.RefreshPeer()
-	err = Torrent.StartDownload(os.Args[2])
+	started := time.Now()
+	if *repair {
+		err = Torrent.Repair(flag.Arg(1))
+	} else {
+		err = Torrent.StartDownload(flag.Arg(1))
+	}
 	if err != nil {
-		log.Fatalf("%v\n", err)
+		Torrent.AnnounceStopped()
+		fatalf("%v\n", err)
+	}
+
+	if *export != "" {
+		err = Torrent.ExportFromStore(*export)
+		if err != nil {
+			Torrent.AnnounceStopped()
+			fatalf("%v\n", err)
+		}
+	}
+
+	if Torrent.Config.Benchmark {
+		Torrent.WriteBenchmarkReport(os.Stdout, time.Since(started))
+		Torrent.AnnounceStopped()
+		return
+	}
+
+	if !Torrent.Config.SeedAfterComplete {
+		Torrent.AnnounceStopped()
+		return
+	}
+
+	signal.Stop(interrupts)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Println("Seeding, press Ctrl+C to stop...")
+
+	err = Torrent.Seed(ctx)
+	if err != nil {
+		fatalf("%v\n", err)
 	}
+
+	stats := Torrent.Stats()
+	fmt.Printf("Seeded for %s, ratio %.2f\n", stats.SeedTime.Round(time.Second), stats.Ratio)
 }
@@ -0,0 +1,364 @@
+package torrent
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// addressCheckInterval is how often the announcer looks for new trackers and, for private
+// torrents, checks whether our address changed; trackerStandbyPoll is how often a tracker's
+// goroutine checks whether it is due or its turn has come.
+const (
+	addressCheckInterval = time.Minute
+	trackerStandbyPoll   = 15 * time.Second
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+runAnnouncer supervises the announcer goroutines started by RefreshPeer: every tracker of the
+torrent that can be announced to gets one (see runTracker), including trackers added later,
+e.g. once metadata arrives. Private trackers identify us by address, so for private torrents
+(BEP-27) every tracker is re-announced to as soon as our address changes, within its min
+interval, instead of at the next interval.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being refreshed.
+  - stop: Channel closed by stopAnnouncer.
+*/
+func (Torrent *TorrentFile) runAnnouncer(stop chan struct{}) {
+	address := Torrent.currentAddress()
+
+	for {
+		for _, announce := range Torrent.trackerURLs() {
+			if !isUDP(announce) && !isHTTP(announce) {
+				continue
+			}
+
+			Torrent.TrackersMutex.Lock()
+			start := Torrent.announceStop == stop && !Torrent.announcing[announce]
+			if start {
+				Torrent.announcing[announce] = true
+			}
+			Torrent.TrackersMutex.Unlock()
+
+			if start {
+				go Torrent.runTracker(announce, stop)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(addressCheckInterval):
+		}
+
+		if Torrent.Info.Private != 1 {
+			continue
+		}
+
+		if now := Torrent.currentAddress(); now != address {
+			log.Printf("[INFO]\tOur address changed from %s to %s, re-announcing\n", address, now)
+			address = now
+			Torrent.announceSoon()
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+runTracker is the announcer goroutine of one tracker. It sleeps until the tracker's
+NextAnnounce, announces and connects to the peers it returns, then schedules the next
+announce from the response, or from the backoff set by recordTrackerResult if it failed.
+Within a tier only one tracker announces (BEP-12), unless peers are scarce and it returns
+few of them (see trackerActive); the others stand by until it fails. The goroutine ends when
+the announcer stops, the tracker dies or it is no longer listed by the torrent.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being refreshed.
+  - announceURL: Announce URL of the tracker.
+  - stop: Channel closed by stopAnnouncer.
+*/
+func (Torrent *TorrentFile) runTracker(announceURL string, stop chan struct{}) {
+	defer func() {
+		Torrent.TrackersMutex.Lock()
+		if Torrent.announceStop == stop {
+			delete(Torrent.announcing, announceURL)
+		}
+		Torrent.TrackersMutex.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wait time.Duration
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		wait = trackerStandbyPoll
+
+		due, listed := Torrent.trackerDue(announceURL)
+		if !listed {
+			return
+		}
+
+		if due > 0 {
+			wait = min(due, trackerStandbyPoll)
+			continue
+		}
+
+		if !Torrent.trackerActive(announceURL) {
+			continue
+		}
+
+		wait = 0
+
+		resp, ok := Torrent.announceTracker(ctx, announceURL, EventNone)
+		if !ok {
+			Torrent.scheduleTracker(announceURL, trackerStandbyPoll)
+			continue
+		}
+
+		Torrent.promoteTracker(announceURL)
+
+		peers, err := Torrent.responsePeers(resp)
+		if err == nil {
+			Torrent.ConnectToPeers(peers)
+		}
+
+		delay := Torrent.nextAnnounceDelay(resp)
+		if Torrent.numWant.Load() > 0 && Torrent.trackerPeerPoor(announceURL) {
+			// Asking a tracker that had few peers again early only returns the same few;
+			// trackerActive lets the next best tracker of its tier announce instead
+			delay = max(delay, announceInterval(resp))
+		}
+
+		Torrent.scheduleTracker(announceURL, delay)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+stopAnnouncer ends the announcer goroutines started by RefreshPeer, if any. Announces in
+progress are completed, no new ones are started.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being refreshed.
+*/
+func (Torrent *TorrentFile) stopAnnouncer() {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	if Torrent.announceStop != nil {
+		close(Torrent.announceStop)
+		Torrent.announceStop = nil
+		Torrent.announcing = nil
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerDue reports how long a tracker's goroutine still has to wait before announcing.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+
+Returns:
+  - time.Duration: Time until NextAnnounce (0 or less if the announce is due).
+  - bool: False if the tracker is dead or no longer one of the torrent's trackers.
+*/
+func (Torrent *TorrentFile) trackerDue(announceURL string) (time.Duration, bool) {
+	listed := slices.Contains(Torrent.trackerURLs(), announceURL)
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	state := Torrent.trackerState(announceURL)
+
+	return time.Until(state.NextAnnounce), listed && state.Status != TrackerDead
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerActive reports whether it is a tracker's turn to announce within its tier. Of the
+trackers of the tier that have not failed, the one with the highest Yield announces (the
+first in tier order on a tie, so untried trackers are taken in order); the others stand by.
+While peers are scarce (see nextAnnounceDelay), a working tracker that returned few peers
+keeps announcing at its interval but no longer holds the others back, so the best of them
+is asked early as well. Trackers that cannot be announced to (e.g. WebTorrent trackers)
+are not waited for.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+
+Returns:
+  - bool: True if the tracker should announce.
+*/
+func (Torrent *TorrentFile) trackerActive(announceURL string) bool {
+	tiers := Torrent.trackerTiers()
+	scarce := Torrent.numWant.Load() > 0
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	for _, tier := range tiers {
+		if !slices.Contains(tier, announceURL) {
+			continue
+		}
+
+		best := ""
+		bestYield := -1.0
+
+		for _, announce := range tier {
+			if !isUDP(announce) && !isHTTP(announce) {
+				continue
+			}
+
+			state := Torrent.trackerState(announce)
+			if state.Status != TrackerUnknown && state.Status != TrackerWorking {
+				continue
+			}
+
+			if scarce && state.Status == TrackerWorking && state.peerPoor {
+				if announce == announceURL {
+					return true
+				}
+
+				continue
+			}
+
+			if state.Yield > bestYield {
+				best = announce
+				bestYield = state.Yield
+			}
+		}
+
+		// With every tracker of the tier failing, each retries once its backoff ends
+		return best == "" || best == announceURL
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+scheduleTracker sets when a tracker is announced to next: after the given delay, but not
+before its backoff ends or its min interval has passed.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+  - delay: Requested time until the next announce.
+*/
+func (Torrent *TorrentFile) scheduleTracker(announceURL string, delay time.Duration) {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	state := Torrent.trackerState(announceURL)
+	next := time.Now().Add(delay)
+
+	if minimum := state.LastAnnounce.Add(state.MinInterval); next.Before(minimum) {
+		next = minimum
+	}
+
+	if next.Before(state.RetryAt) {
+		next = state.RetryAt
+	}
+
+	state.NextAnnounce = next
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceSoon moves every tracker's next announce forward to the earliest time its min
+interval allows.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+*/
+func (Torrent *TorrentFile) announceSoon() {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	for _, state := range Torrent.trackers {
+		next := state.LastAnnounce.Add(state.MinInterval)
+		if next.Before(state.NextAnnounce) {
+			state.NextAnnounce = next
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerPeerPoor reports whether a tracker's last answer had far fewer peers than we asked for.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+
+Returns:
+  - bool: True if the tracker is peer-poor.
+*/
+func (Torrent *TorrentFile) trackerPeerPoor(announceURL string) bool {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	return Torrent.trackerState(announceURL).peerPoor
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Trackers returns the state of every tracker of the torrent, in the order they are tried:
+tier by tier (see trackerTiers), the tracker that last answered first in its tier. Trackers
+that have not been contacted yet are included with status TrackerUnknown.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+
+Returns:
+  - []TrackerStat: Copy of the per-tracker state.
+*/
+func (Torrent *TorrentFile) Trackers() []TrackerStat {
+	tiers := Torrent.trackerTiers()
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	var stats []TrackerStat
+	for _, tier := range tiers {
+		for _, announce := range tier {
+			stats = append(stats, *Torrent.trackerState(announce))
+		}
+	}
+
+	return stats
+}
+
+// --------------------------------------------------------------------------------------------- //
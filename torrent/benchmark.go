@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+discardHandle is the FileHandle used in benchmark mode.
+Writes succeed without storing anything; reads fail because no data is kept.
+*/
+type discardHandle struct{}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WriteAt discards the data.
+
+Parameters:
+  - data: Bytes to write.
+  - offset: Ignored.
+
+Returns:
+  - int: len(data).
+  - error: Always nil.
+*/
+func (Handle discardHandle) WriteAt(data []byte, offset int64) (int, error) {
+	return len(data), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadAt always fails, since benchmark mode keeps no data.
+
+Parameters:
+  - data: Destination buffer.
+  - offset: Ignored.
+
+Returns:
+  - int: Always 0.
+  - error: Always non-nil.
+*/
+func (Handle discardHandle) ReadAt(data []byte, offset int64) (int, error) {
+	return 0, fmt.Errorf("Benchmark mode keeps no data to read\n")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close does nothing.
+
+Returns:
+  - error: Always nil.
+*/
+func (Handle discardHandle) Close() error {
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PeerTransfer summarizes how much a peer delivered and how long it took.
+
+Fields:
+  - Addr: Address of the peer ("host:port").
+  - Client: Client name from the extension handshake, if any.
+  - Bytes: Piece bytes received from the peer.
+  - Duration: Time spent waiting for the peer's blocks.
+*/
+type PeerTransfer struct {
+	Addr     string
+	Client   string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Rate returns the peer's average download rate while pieces were being received.
+
+Returns:
+  - float64: Bytes per second (0 if nothing was timed).
+*/
+func (Transfer PeerTransfer) Rate() float64 {
+	if Transfer.Duration <= 0 {
+		return 0
+	}
+
+	return float64(Transfer.Bytes) / Transfer.Duration.Seconds()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+recordPeerTransfer remembers a disconnecting peer's download totals for PeerTransfers.
+Peers that delivered nothing are not recorded.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer whose download goroutine is finishing.
+*/
+func (Torrent *TorrentFile) recordPeerTransfer(peer *Peer) {
+	if peer.BytesReceived == 0 {
+		return
+	}
+
+	Torrent.PeersMutex.Lock()
+	defer Torrent.PeersMutex.Unlock()
+
+	Torrent.transfers = append(Torrent.transfers, PeerTransfer{
+		Addr:     peer.ListenAddr(),
+		Client:   peer.Client,
+		Bytes:    peer.BytesReceived,
+		Duration: peer.ReceiveTime,
+	})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PeerTransfers returns the download totals of every peer that has finished downloading,
+fastest first.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []PeerTransfer: Copy of the recorded transfers.
+*/
+func (Torrent *TorrentFile) PeerTransfers() []PeerTransfer {
+	Torrent.PeersMutex.Lock()
+	transfers := append([]PeerTransfer(nil), Torrent.transfers...)
+	Torrent.PeersMutex.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].Rate() > transfers[j].Rate()
+	})
+
+	return transfers
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WriteBenchmarkReport writes throughput statistics for a finished download:
+overall rate, time spent hashing versus receiving, and the rate of every peer.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile that was downloaded.
+  - w: Destination of the report.
+  - elapsed: Wall-clock duration of the download.
+
+Returns:
+  - error: Non-nil if writing fails.
+*/
+func (Torrent *TorrentFile) WriteBenchmarkReport(w io.Writer, elapsed time.Duration) error {
+	const mb = 1024 * 1024
+
+	stats := Torrent.Stats()
+	transfers := Torrent.PeerTransfers()
+
+	var received int64
+	for _, transfer := range transfers {
+		received += transfer.Bytes
+	}
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(received) / elapsed.Seconds()
+	}
+
+	_, err := fmt.Fprintf(w, "Benchmark: %.2f MB in %s (%.2f MB/s)\n", float64(received)/mb, elapsed.Round(time.Millisecond), rate/mb)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "Hashing time: %s, network time (summed over peers): %s, hash failures: %d\n",
+		stats.HashTime.Round(time.Millisecond), stats.NetworkTime.Round(time.Millisecond), stats.HashFailures)
+	if err != nil {
+		return err
+	}
+
+	for _, transfer := range transfers {
+		_, err = fmt.Fprintf(w, "  %-22s %-20q %10.2f MB %8.2f MB/s\n",
+			transfer.Addr, transfer.Client, float64(transfer.Bytes)/mb, transfer.Rate()/mb)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
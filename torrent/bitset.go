@@ -0,0 +1,133 @@
+package torrent
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+BitSet is a fixed-size set of piece indices.
+Bits are stored in BitTorrent wire order (most significant bit of the first byte is index 0),
+so the raw bytes can be sent directly as a Bitfield message.
+
+Fields:
+  - bits: Backing byte slice in wire order.
+  - size: Number of valid bits in the set.
+*/
+type BitSet struct {
+	bits []byte
+	size int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+NewBitSet allocates an empty BitSet able to hold n indices.
+
+Parameters:
+  - n: Number of bits in the set.
+
+Returns:
+  - BitSet: An empty set of size n.
+*/
+func NewBitSet(n int) BitSet {
+	return BitSet{
+		bits: make([]byte, (n+7)/8),
+		size: n,
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Len returns the number of indices the set can hold.
+
+Returns:
+  - int: Size of the set in bits.
+*/
+func (Bits BitSet) Len() int {
+	return Bits.size
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Has reports whether index i is set. Out-of-range indices are reported as unset.
+
+Parameters:
+  - i: Index to check.
+
+Returns:
+  - bool: True if the bit is set.
+*/
+func (Bits BitSet) Has(i int) bool {
+	if i < 0 || i >= Bits.size {
+		return false
+	}
+
+	return Bits.bits[i/8]>>(7-uint(i%8))&1 == 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Set marks index i as present. Out-of-range indices are ignored.
+
+Parameters:
+  - i: Index to set.
+*/
+func (Bits BitSet) Set(i int) {
+	if i < 0 || i >= Bits.size {
+		return
+	}
+
+	Bits.bits[i/8] |= 1 << (7 - uint(i%8))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Clear marks index i as absent. Out-of-range indices are ignored.
+
+Parameters:
+  - i: Index to clear.
+*/
+func (Bits BitSet) Clear(i int) {
+	if i < 0 || i >= Bits.size {
+		return
+	}
+
+	Bits.bits[i/8] &^= 1 << (7 - uint(i%8))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Count returns the number of set indices.
+
+Returns:
+  - int: Population count of the set.
+*/
+func (Bits BitSet) Count() int {
+	count := 0
+
+	for i := 0; i < Bits.size; i++ {
+		if Bits.Has(i) {
+			count++
+		}
+	}
+
+	return count
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Bytes returns the wire-format representation of the set.
+The returned slice shares memory with the set.
+
+Returns:
+  - []byte: Bitfield bytes with spare trailing bits zeroed.
+*/
+func (Bits BitSet) Bytes() []byte {
+	return Bits.bits
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+recordBlockSource remembers which peer delivered a block of an in-progress piece, so a hash
+failure can be attributed to the peers that actually contributed to the piece.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - index: Index of the piece.
+  - block: Index of the block within the piece.
+  - numBlocks: Number of blocks in the piece.
+  - peer: Peer the block came from.
+*/
+func (Torrent *TorrentFile) recordBlockSource(index, block, numBlocks int, peer *Peer) {
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	if Torrent.blockSources == nil {
+		Torrent.blockSources = make(map[int][]*Peer)
+	}
+
+	sources := Torrent.blockSources[index]
+	if len(sources) != numBlocks {
+		sources = make([]*Peer, numBlocks)
+		Torrent.blockSources[index] = sources
+	}
+
+	sources[block] = peer
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+takeBlockSources returns the distinct peers that delivered blocks of a piece and forgets
+the piece's block-source mapping.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - index: Index of the piece.
+
+Returns:
+  - []*Peer: Contributing peers, in block order of their first block.
+*/
+func (Torrent *TorrentFile) takeBlockSources(index int) []*Peer {
+	Torrent.DownloadMutex.Lock()
+	sources := Torrent.blockSources[index]
+	delete(Torrent.blockSources, index)
+	Torrent.DownloadMutex.Unlock()
+
+	seen := make(map[*Peer]bool)
+	var peers []*Peer
+
+	for _, peer := range sources {
+		if peer != nil && !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+blameHashFailure attributes a failed piece to the peers that delivered its blocks.
+Every contributing IP gets one more hash failure; an IP reaching Config.MaxHashFailures is
+banned and no longer connected to.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - index: Index of the piece that failed its hash check.
+
+Returns:
+  - []*Peer: Contributing peers that are now banned (to be disconnected by the caller).
+*/
+func (Torrent *TorrentFile) blameHashFailure(index int) []*Peer {
+	sources := Torrent.takeBlockSources(index)
+
+	addrs := make([]string, 0, len(sources))
+	for _, peer := range sources {
+		addrs = append(addrs, peer.ListenAddr())
+	}
+
+	logPeerf(nil, index, "[ERROR]\tPiece %d failed, blocks from peers %s\n", index, strings.Join(addrs, ", "))
+
+	Torrent.PeersMutex.Lock()
+	defer Torrent.PeersMutex.Unlock()
+
+	if Torrent.peerFailures == nil {
+		Torrent.peerFailures = make(map[string]int)
+	}
+
+	var banned []*Peer
+	blamed := make(map[string]bool)
+
+	for _, peer := range sources {
+		if blamed[peer.IP] {
+			continue
+		}
+
+		blamed[peer.IP] = true
+		Torrent.peerFailures[peer.IP]++
+
+		limit := Torrent.Config.MaxHashFailures
+		if limit > 0 && Torrent.peerFailures[peer.IP] >= limit {
+			log.Printf("[INFO]\tBanning %s after %d hash failures\n", peer.IP, Torrent.peerFailures[peer.IP])
+			banned = append(banned, peer)
+		}
+	}
+
+	return banned
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isBanned reports whether an IP has been banned for sending corrupt data.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - ip: IP address of the peer.
+
+Returns:
+  - bool: True if the IP reached Config.MaxHashFailures.
+*/
+func (Torrent *TorrentFile) isBanned(ip string) bool {
+	Torrent.PeersMutex.Lock()
+	defer Torrent.PeersMutex.Unlock()
+
+	limit := Torrent.Config.MaxHashFailures
+
+	return limit > 0 && Torrent.peerFailures[ip] >= limit
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+BannedPeers returns the IPs banned for sending corrupt data, sorted.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Banned IP addresses.
+*/
+func (Torrent *TorrentFile) BannedPeers() []string {
+	Torrent.PeersMutex.Lock()
+	defer Torrent.PeersMutex.Unlock()
+
+	var ips []string
+	for ip, failures := range Torrent.peerFailures {
+		if Torrent.Config.MaxHashFailures > 0 && failures >= Torrent.Config.MaxHashFailures {
+			ips = append(ips, ip)
+		}
+	}
+
+	sort.Strings(ips)
+
+	return ips
+}
+
+// --------------------------------------------------------------------------------------------- //
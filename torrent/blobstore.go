@@ -0,0 +1,287 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+blobPath returns where a piece is kept in the content-addressable store of Config.BlobStore:
+"<store>/<first two hex digits>/<hex SHA-1 of the piece>". Torrents sharing a piece (same data
+at the same piece alignment, e.g. one file in two torrents with the same piece length) share
+its blob.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - index: Index of the piece.
+
+Returns:
+  - string: Path of the piece's blob.
+*/
+func (Torrent *TorrentFile) blobPath(index int) string {
+	name := hex.EncodeToString(Torrent.PieceHashes[index][:])
+	return filepath.Join(Torrent.Config.BlobStore, name[:2], name)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+blobHandle is the FileHandle of a torrent file in blob-store mode. Instead of a file on
+disk, the data lives in the blobs of the pieces it overlaps; reads and writes are split at
+piece boundaries and directed at the matching blob.
+
+Fields:
+  - torrent: Torrent the file belongs to.
+  - offset: Offset of the file in the piece space.
+*/
+type blobHandle struct {
+	torrent *TorrentFile
+	offset  int64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WriteAt writes file data into the blobs of the pieces it covers, creating them as needed.
+
+Parameters:
+  - data: Bytes to write.
+  - offset: Offset within the file.
+
+Returns:
+  - int: Number of bytes written.
+  - error: Non-nil if a blob cannot be created or written.
+*/
+func (Handle blobHandle) WriteAt(data []byte, offset int64) (int, error) {
+	return Handle.each(data, offset, func(path string, part []byte, at int64) error {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+
+		blob, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		_, err = blob.WriteAt(part, at)
+
+		return err
+	})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadAt reads file data back from the blobs of the pieces it covers.
+
+Parameters:
+  - data: Destination buffer.
+  - offset: Offset within the file.
+
+Returns:
+  - int: Number of bytes read.
+  - error: Non-nil if a blob is missing or short.
+*/
+func (Handle blobHandle) ReadAt(data []byte, offset int64) (int, error) {
+	return Handle.each(data, offset, func(path string, part []byte, at int64) error {
+		blob, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		_, err = blob.ReadAt(part, at)
+		if err == io.EOF {
+			return fmt.Errorf("Blob %s is incomplete\n", path)
+		}
+
+		return err
+	})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close does nothing; blobs are opened per access.
+
+Returns:
+  - error: Always nil.
+*/
+func (Handle blobHandle) Close() error {
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+each splits a file range at piece boundaries and calls access for every part.
+
+Parameters:
+  - data: Buffer covering the range.
+  - offset: Offset of the range within the file.
+  - access: Called with the blob path, the part of data and the offset within the blob.
+
+Returns:
+  - int: Number of bytes handled before the first failure.
+  - error: First error returned by access.
+*/
+func (Handle blobHandle) each(data []byte, offset int64, access func(path string, part []byte, at int64) error) (int, error) {
+	Torrent := Handle.torrent
+	done := 0
+
+	for done < len(data) {
+		pos := Handle.offset + offset + int64(done)
+		index := int(pos / Torrent.PieceLength)
+		if index >= Torrent.NumPieces {
+			return done, fmt.Errorf("Offset %d is past the last piece\n", pos)
+		}
+
+		at := pos - int64(index)*Torrent.PieceLength
+		n := int(min(int64(len(data)-done), Torrent.PieceSize(index)-at))
+
+		err := access(Torrent.blobPath(index), data[done:done+n], at)
+		if err != nil {
+			return done, err
+		}
+
+		done += n
+	}
+
+	return done, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+openBlobStore gives every file a blobHandle and marks the pieces already present in the
+store (e.g. downloaded for another torrent) as downloaded once they pass their hash check.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose Files have been built.
+*/
+func (Torrent *TorrentFile) openBlobStore() {
+	for i := range Torrent.Files {
+		Torrent.Files[i].Handle = blobHandle{torrent: Torrent, offset: Torrent.Files[i].Offset}
+	}
+
+	reused := 0
+
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.HasPieceLocal(i) {
+			continue
+		}
+
+		stat, err := os.Stat(Torrent.blobPath(i))
+		if err != nil || stat.Size() != Torrent.PieceSize(i) {
+			continue
+		}
+
+		ok, err := Torrent.VerifyPiece(i)
+		if err != nil || !ok {
+			continue
+		}
+
+		Torrent.DownloadMutex.Lock()
+		Torrent.Downloaded.Set(i)
+		Torrent.DownloadMutex.Unlock()
+
+		reused++
+	}
+
+	if reused > 0 {
+		log.Printf("[INFO]\tReusing %d pieces of %s from the blob store\n", reused, Torrent.Info.Name)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ExportFromStore reconstructs the torrent's files in outputDir from the blob store, so they
+can be used outside the client. Every piece must be in the store. Padding files are skipped,
+symlinks recreated and executable files given their execute bits.
+
+Export is a full copy: a blob holds one piece, and files start and end anywhere within
+pieces, so a file can be neither hardlinked to nor reflinked from its blobs. outputDir needs
+room for the whole torrent next to the store.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile downloaded with Config.BlobStore set.
+  - outputDir: Directory to write the files to (the usual layout below the torrent name).
+
+Returns:
+  - error: Non-nil if a piece is missing from the store or a file cannot be written.
+*/
+func (Torrent *TorrentFile) ExportFromStore(outputDir string) error {
+	if Torrent.Config.BlobStore == "" {
+		return fmt.Errorf("No blob store configured\n")
+	}
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize pieces: %v", err)
+	}
+
+	err = Torrent.BuildFileInfo(outputDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range Torrent.Files {
+		if file.Pad || file.Symlink {
+			continue
+		}
+
+		source := io.NewSectionReader(blobHandle{torrent: Torrent, offset: file.Offset}, 0, file.Length)
+
+		err := os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory for %s: %v\n", file.Path, err)
+		}
+
+		tmp := file.Path + ".part"
+
+		out, err := os.Create(tmp)
+		if err != nil {
+			return fmt.Errorf("Failed to create %s: %v\n", tmp, err)
+		}
+
+		_, err = io.Copy(out, source)
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("Exporting %s: %v\n", file.Path, err)
+		}
+
+		err = os.Rename(tmp, file.Path)
+		if err != nil {
+			return fmt.Errorf("Renaming %s: %v\n", tmp, err)
+		}
+
+		if file.Executable {
+			err = setExecutable(file.Path)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("[INFO]\tExported %s from the blob store\n", file.Path)
+	}
+
+	var created []string
+
+	return Torrent.createSymlinks(outputDir, &created)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,293 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+touchPiece records that a piece was just read or written, for the eviction order of cache mode.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - index: Index of the piece.
+*/
+func (Torrent *TorrentFile) touchPiece(index int) {
+	if index >= 0 && index < len(Torrent.pieceAccess) {
+		Torrent.pieceAccess[index].Store(time.Now().UnixNano())
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+evictPieces enforces Config.MaxDiskCache: while the verified pieces on disk exceed the limit,
+the least recently accessed one is dropped. Its data is released from the file (see punchHole),
+and it is cleared from Downloaded and Wanted so the download does not fetch it straight back;
+ReadRange and WantRange want it again. With Config.ExtraDestinations, pieces of complete files
+are never evicted: the destinations may be hardlinks sharing the data, which punching holes
+would destroy. It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+
+Returns:
+  - []int: Indices of the evicted pieces.
+*/
+func (Torrent *TorrentFile) evictPieces() []int {
+	limit := Torrent.Config.MaxDiskCache
+	if limit <= 0 || Torrent.Config.Benchmark || len(Torrent.pieceAccess) != Torrent.NumPieces {
+		return nil
+	}
+
+	var cached int64
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.Downloaded.Has(i) {
+			cached += Torrent.PieceSize(i)
+		}
+	}
+
+	pinned := Torrent.linkedPieces()
+
+	var evicted []int
+
+	for cached > limit {
+		oldest := -1
+		for i := 0; i < Torrent.NumPieces; i++ {
+			if !Torrent.Downloaded.Has(i) || pinned.Has(i) {
+				continue
+			}
+
+			if oldest == -1 || Torrent.pieceAccess[i].Load() < Torrent.pieceAccess[oldest].Load() {
+				oldest = i
+			}
+		}
+
+		if oldest == -1 {
+			break
+		}
+
+		size := Torrent.PieceSize(oldest)
+		Torrent.discardRange(int64(oldest)*Torrent.PieceLength, size)
+		Torrent.Downloaded.Clear(oldest)
+		Torrent.Wanted.Clear(oldest)
+
+		cached -= size
+		evicted = append(evicted, oldest)
+	}
+
+	if len(evicted) > 0 {
+		log.Printf("[INFO]\tEvicted %d pieces to stay within the %d byte disk cache\n", len(evicted), limit)
+		Torrent.notifyPieces()
+	}
+
+	return evicted
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+linkedPieces returns the pieces evictPieces must keep because they belong to a file that is
+or is about to be linked into Config.ExtraDestinations: every file whose pieces are all
+downloaded. It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+
+Returns:
+  - BitSet: Pieces not to evict (empty without extra destinations).
+*/
+func (Torrent *TorrentFile) linkedPieces() BitSet {
+	pinned := NewBitSet(Torrent.NumPieces)
+	if len(Torrent.Config.ExtraDestinations) == 0 {
+		return pinned
+	}
+
+	for i, entry := range Torrent.ListFiles() {
+		if entry.FirstPiece < 0 || entry.Pad {
+			continue
+		}
+
+		complete := i < len(Torrent.fileDone) && Torrent.fileDone[i]
+		for p := entry.FirstPiece; !complete && p <= entry.LastPiece; p++ {
+			if !Torrent.Downloaded.Has(p) {
+				break
+			}
+
+			complete = p == entry.LastPiece
+		}
+
+		for p := entry.FirstPiece; complete && p <= entry.LastPiece; p++ {
+			pinned.Set(p)
+		}
+	}
+
+	return pinned
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+discardRange releases the disk space of a range of the piece space in every file it covers.
+Failures are only logged; the range is treated as missing either way.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - offset: Offset of the range in the piece space.
+  - length: Length of the range in bytes.
+*/
+func (Torrent *TorrentFile) discardRange(offset, length int64) {
+	end := offset + length
+
+	for _, file := range Torrent.Files {
+		start := max(offset, file.Offset)
+		stop := min(end, file.Offset+file.Length)
+
+		if start >= stop || file.Handle == nil {
+			continue
+		}
+
+		err := punchHole(file.Handle, start-file.Offset, stop-start)
+		if err != nil {
+			log.Printf("[ERROR]\tFailed to release %d bytes of %s: %v", stop-start, file.Path, err)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WantRange marks the pieces covering [start, end) of the piece space as wanted again, so a
+running download fetches those of them that are missing, e.g. after cache mode evicted them.
+ReadRange calls it and waits for the range; other readers can wait on HasByteRange.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - start: Offset of the first byte.
+  - end: Offset one past the last byte.
+
+Returns:
+  - int: Number of pieces in the range that still have to be downloaded.
+*/
+func (Torrent *TorrentFile) WantRange(start, end int64) int {
+	if start >= end || start < 0 {
+		return 0
+	}
+
+	first, last := pieceRange(start, end-start, Torrent.PieceLength)
+	if first < 0 {
+		return 0
+	}
+
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	missing, added := 0, 0
+	for i := first; i <= last && i < Torrent.NumPieces; i++ {
+		if Torrent.Downloaded.Has(i) {
+			continue
+		}
+
+		if !Torrent.Wanted.Has(i) {
+			Torrent.Wanted.Set(i)
+			added++
+		}
+
+		missing++
+	}
+
+	if added > 0 {
+		Torrent.notifyPieces()
+	}
+
+	return missing
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadRange reads [start, end) of the torrent's piece space while a download is running. Pieces
+of the range that are missing, e.g. because cache mode evicted them, are wanted again with
+WantRange, and the call waits until the download has fetched them. The range is read with
+Torrent.DownloadMutex held, so it cannot be evicted halfway, and counts as accessed for the
+eviction order.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - ctx: Context ending the wait for missing pieces.
+  - start: Offset of the first byte.
+  - end: Offset one past the last byte.
+
+Returns:
+  - []byte: The bytes of the range.
+  - error: ctx.Err() if ctx ends first, other non-nil errors if the range is out of bounds or
+    cannot be read.
+*/
+func (Torrent *TorrentFile) ReadRange(ctx context.Context, start, end int64) ([]byte, error) {
+	total, _ := Torrent.GetTotalSize()
+	if start < 0 || start > end || end > int64(total) {
+		return nil, fmt.Errorf("Range %d-%d is outside the torrent's %d bytes\n", start, end, total)
+	}
+
+	for {
+		Torrent.WantRange(start, end)
+
+		Torrent.DownloadMutex.Lock()
+
+		if Torrent.hasByteRangeLocked(start, end) {
+			data, err := Torrent.readRange(start, end)
+			Torrent.DownloadMutex.Unlock()
+
+			return data, err
+		}
+
+		changed := Torrent.piecesSignal()
+		Torrent.DownloadMutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+readRange reads [start, end) of the piece space block by block with ReadBlock. The pieces
+must be on disk.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - start: Offset of the first byte.
+  - end: Offset one past the last byte.
+
+Returns:
+  - []byte: The bytes of the range.
+  - error: Non-nil if a block cannot be read.
+*/
+func (Torrent *TorrentFile) readRange(start, end int64) ([]byte, error) {
+	data := make([]byte, 0, end-start)
+
+	for offset := start; offset < end; {
+		index := int(offset / Torrent.PieceLength)
+		pieceEnd := min(end, int64(index+1)*Torrent.PieceLength)
+
+		block, err := Torrent.ReadBlock(index, offset-int64(index)*Torrent.PieceLength, pieceEnd-offset)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, block...)
+		offset = pieceEnd
+	}
+
+	return data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,190 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newCacheTorrent returns a torrent of two files of two pieces each, with every piece
+downloaded and the files open below a temporary directory.
+
+Parameters:
+  - t: Test the torrent belongs to; the files are closed when it ends.
+
+Returns:
+  - *TorrentFile: Torrent with open file handles.
+*/
+func newCacheTorrent(t *testing.T) *TorrentFile {
+	t.Helper()
+
+	Torrent := newTestTorrent()
+	Torrent.Info.Name = "content"
+	Torrent.Info.Length = 0
+	Torrent.Info.Files = []TorrentFileEntry{
+		{Length: 2 * 16384, Path: []string{"a.bin"}},
+		{Length: 2 * 16384, Path: []string{"b.bin"}},
+	}
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	err = Torrent.BuildFileInfo(t.TempDir())
+	if err != nil {
+		t.Fatalf("BuildFileInfo: %v", err)
+	}
+
+	for i := range Torrent.Files {
+		file := &Torrent.Files[i]
+
+		err = os.MkdirAll(filepath.Dir(file.Path), 0755)
+		if err != nil {
+			t.Fatalf("creating directory: %v", err)
+		}
+
+		handle, err := os.OpenFile(file.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatalf("opening %s: %v", file.Path, err)
+		}
+		t.Cleanup(func() { handle.Close() })
+
+		_, err = handle.Write(bytes.Repeat([]byte{byte('a' + i)}, int(file.Length)))
+		if err != nil {
+			t.Fatalf("writing %s: %v", file.Path, err)
+		}
+
+		file.Handle = handle
+	}
+
+	for i := 0; i < Torrent.NumPieces; i++ {
+		Torrent.Downloaded.Set(i)
+		Torrent.pieceAccess[i].Store(int64(i + 1))
+	}
+
+	return Torrent
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestEvictPiecesOldestFirst(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	Torrent.Config.MaxDiskCache = 2 * 16384
+
+	Torrent.DownloadMutex.Lock()
+	evicted := Torrent.evictPieces()
+	Torrent.DownloadMutex.Unlock()
+
+	if len(evicted) != 2 || evicted[0] != 0 || evicted[1] != 1 {
+		t.Fatalf("evicted %v, want [0 1]", evicted)
+	}
+
+	if Torrent.Downloaded.Has(0) || Torrent.Wanted.Has(0) || !Torrent.Downloaded.Has(2) {
+		t.Errorf("piece states after eviction: downloaded %v %v, wanted %v", Torrent.Downloaded.Has(0), Torrent.Downloaded.Has(2), Torrent.Wanted.Has(0))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestEvictPiecesKeepsLinkedFiles(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	Torrent.Config.MaxDiskCache = 16384
+	Torrent.Config.ExtraDestinations = []string{t.TempDir()}
+
+	// b.bin lost a piece, so only a.bin may be linked into the extra destinations
+	Torrent.Downloaded.Clear(3)
+
+	Torrent.DownloadMutex.Lock()
+	evicted := Torrent.evictPieces()
+	Torrent.DownloadMutex.Unlock()
+
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Fatalf("evicted %v, want [2]", evicted)
+	}
+
+	data, err := os.ReadFile(Torrent.Files[0].Path)
+	if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{'a'}, 2*16384)) {
+		t.Errorf("linked file changed by eviction (%v)", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestReadRangeRefetchesEvicted(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	Torrent.Config.MaxDiskCache = 3 * 16384
+
+	Torrent.DownloadMutex.Lock()
+	evicted := Torrent.evictPieces()
+	Torrent.DownloadMutex.Unlock()
+
+	if len(evicted) != 1 || evicted[0] != 0 {
+		t.Fatalf("evicted %v, want [0]", evicted)
+	}
+
+	// Stands in for the download: fetch the piece as soon as it is wanted again
+	go func() {
+		for {
+			Torrent.DownloadMutex.Lock()
+			if Torrent.Wanted.Has(0) {
+				Torrent.Files[0].Handle.WriteAt(bytes.Repeat([]byte{'a'}, 16384), 0)
+				Torrent.Downloaded.Set(0)
+				Torrent.notifyPieces()
+				Torrent.DownloadMutex.Unlock()
+
+				return
+			}
+
+			changed := Torrent.piecesSignal()
+			Torrent.DownloadMutex.Unlock()
+			<-changed
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := Torrent.ReadRange(ctx, 16000, 2*16384+10)
+	if err != nil {
+		t.Fatalf("ReadRange: %v", err)
+	}
+
+	want := append(bytes.Repeat([]byte{'a'}, 2*16384-16000), bytes.Repeat([]byte{'b'}, 10)...)
+	if !bytes.Equal(data, want) {
+		t.Errorf("ReadRange returned %d bytes not matching the files", len(data))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestReadRangeCanceled(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	Torrent.Downloaded.Clear(1)
+	Torrent.Wanted.Clear(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := Torrent.ReadRange(ctx, 0, 2*16384)
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReadRange of a missing piece = %v, want context.DeadlineExceeded", err)
+	}
+
+	if !Torrent.Wanted.Has(1) {
+		t.Errorf("missing piece not wanted again")
+	}
+
+	_, err = Torrent.ReadRange(context.Background(), 0, 5*16384)
+	if err == nil {
+		t.Errorf("ReadRange accepted a range past the end")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,424 @@
+package torrent
+
+import (
+	"crypto"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+DuplicatePathPolicy selects how BuildFileInfo treats two file entries that resolve to the same path.
+
+Values:
+  - DuplicatePathsError: Refuse to build the file layout and return an error.
+  - DuplicatePathsRename: Keep the first entry and give later ones a numeric suffix ("name (1).ext").
+*/
+type DuplicatePathPolicy int
+
+const (
+	DuplicatePathsError DuplicatePathPolicy = iota
+	DuplicatePathsRename
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ProgressMode selects how StartDownload, VerifyDownload and Repair report progress on stdout.
+
+Values:
+  - ProgressAuto: ProgressBar when stdout is a terminal, ProgressLines otherwise.
+  - ProgressBar: Redraw a single progress bar line using carriage returns.
+  - ProgressLines: Print a plain line ("50.0% 12.30 MB/s") every few seconds, for logs and pipes.
+  - ProgressNone: Print no progress at all.
+*/
+type ProgressMode int
+
+const (
+	ProgressAuto ProgressMode = iota
+	ProgressBar
+	ProgressLines
+	ProgressNone
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+resolve turns ProgressAuto into a concrete mode by checking whether stdout is a terminal.
+
+Parameters:
+  - Mode: Configured progress mode.
+
+Returns:
+  - ProgressMode: Mode to use; never ProgressAuto.
+*/
+func (Mode ProgressMode) resolve() ProgressMode {
+	if Mode != ProgressAuto {
+		return Mode
+	}
+
+	info, err := os.Stdout.Stat()
+	if err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return ProgressBar
+	}
+
+	return ProgressLines
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// PublicTrackers are the built-in public trackers, Config.DefaultTrackers unless replaced.
+var PublicTrackers = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"udp://tracker.torrent.eu.org:451/announce",
+	"udp://open.tracker.cl:1337/announce",
+	"udp://open.stealth.si:80/announce",
+	"udp://tracker.tiny-vps.com:6969/announce",
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Config holds user-tunable settings for a torrent download.
+A zero Config is not meant to be used directly; start from DefaultConfig and override fields.
+
+Fields:
+  - ListenPort: Local TCP port we accept peer connections on.
+  - AnnouncePort: Externally visible port advertised to trackers and peers, for routers that
+    map a different external port to ListenPort (0 advertises ListenPort).
+  - BindTrackerPort: Send UDP tracker announces from ListenPort instead of an ephemeral port,
+    for firewalls and trackers expecting announces from the advertised port. UDP and TCP ports
+    are independent, so this does not clash with the peer listener. Announces then go out one
+    at a time, as only one socket can own the port.
+  - DefaultTrackers: Public trackers announced to in addition to those listed in the torrent
+    (PublicTrackers by default). Append to extend the list, assign to replace it, or set it
+    to nil to announce only to the torrent's own trackers.
+  - ExtraTrackers: Trackers added for this torrent specifically, on top of DefaultTrackers.
+  - ExtraAnnounceParams: Additional query parameters sent with every HTTP announce, for
+    trackers requiring e.g. "supportcrypto" or an auth token. They cannot replace the
+    parameters the protocol defines (info_hash, peer_id, ...). UDP trackers ignore them.
+  - NumWant: Peers requested per announce (0 leaves it to the tracker, usually 50). While fewer
+    than MinHealthyPeers are connected, more are requested.
+  - UDPTrackerRetries: Retransmissions of an unanswered UDP tracker request before giving up.
+    The n-th waits 15·2^n seconds (BEP-15); the spec allows up to 8, which takes over an hour.
+  - AnnounceTimeout: Deadline of one-off announces to all trackers, such as the first one or
+    the stopped announce on exit; trackers that have not answered by then are given up on.
+  - TrackerTLS: TLS settings for HTTPS trackers and scrapes, e.g. from LoadTrackerTLS, for
+    private trackers behind internal CAs or requiring client certificates (nil uses the
+    system defaults). Sessions can set it for all their torrents (see Session.SetTrackerTLS).
+  - MaxHalfOpen: Maximum number of outgoing peer connections being dialed at the same time,
+    separate from the number of established connections (0 disables the limit).
+  - MaxInboundPeers: Maximum number of peers that connected to us kept at the same time; further
+    inbound handshakes are refused (0 disables the limit).
+  - PortForwarding: Map ListenPort on the local gateway with PCP, NAT-PMP or UPnP while the
+    listener is open, so peers behind other NATs can connect to us (see ForwardPort).
+  - FilterSelfPeers: Drop peers matching our own endpoint before connecting (disable for
+    loopback testing where connecting to ourselves is intended).
+  - Encryption: Whether peer connections use Message Stream Encryption (preferred by default,
+    falling back to plaintext for peers without it).
+  - ReservedBits: Reserved bytes sent in our handshakes (BEP-10 support by default). Clearing
+    the BEP-10 bit keeps strict peers that reject unknown bits talking to us; extensions are
+    only used when both sides set a bit, and unknown bits from peers are ignored.
+  - DHT: Use the Mainline DHT: announce while seeding and look up peers when trackers give
+    none (never done for private torrents).
+  - DHTIPv6: Also run the DHT over IPv6 (BEP-32), with its own routing table, so peers of
+    IPv6-only swarms are found; skipped if the host has no IPv6.
+  - DHTBootstrap: DHT contacts ("host:port") to start lookups from (empty uses dht.DefaultBootstrap).
+  - DHTNodeCache: File the DHT nodes that answered are saved to after a lookup, and bootstrapped
+    from on the next run after the torrent's own "nodes" (empty disables).
+  - PEX: Exchange peer lists with connected peers using Peer Exchange (never done for
+    private torrents).
+  - Holepunch: Relay ut_holepunch rendezvous (BEP-55) between connected peers, and ask a peer
+    to relay one when a peer cannot be dialed (never done for private torrents).
+  - WebSeeds: Download pieces from the torrent's HTTP(S) web seeds (BEP-19) alongside peers.
+  - LSD: Announce the torrent on the local network with Local Service Discovery while seeding
+    and connect to local peers announcing it (never done for private torrents).
+  - LSDInterface: Name of the interface LSD multicasts on (empty uses the default-route interface).
+  - MinHealthyPeers: Below this many connected peers, re-announce early asking for more peers
+    (0 disables adaptive announcing).
+  - MetricsAddr: Listen address of the built-in Prometheus endpoint (empty disables it).
+  - ProgressMode: How download progress is printed (ProgressAuto picks by terminal detection).
+  - SkipVerify: Skip re-hashing all pieces from disk before reporting a download as complete.
+  - VerifyWorkers: Number of pieces read and hashed concurrently during verification.
+  - Benchmark: Discard downloaded data instead of writing it, to measure network and hashing
+    throughput. Pieces are still hash-checked; resume data is neither loaded nor saved.
+  - DuplicatePaths: How to handle multi-file torrents listing the same path twice.
+  - DeletePartialOnFailure: Remove the files and directories created by StartDownload if it
+    fails; files that existed before (e.g. a download being resumed) are kept, and so is
+    everything when the download is stopped with CancelDownload.
+  - ExtraDestinations: Directories that receive a hardlink (or a copy across filesystems) of
+    every file as soon as it completes, at the same relative path.
+  - OnFileComplete: Called once for every file whose pieces have all been written.
+  - MaxConcurrentPieces: Maximum number of pieces downloaded at once across all peers,
+    bounding the memory held in piece buffers (0 disables the limit).
+  - StreamPieces: Write blocks to disk as they arrive and hash them incrementally instead of
+    buffering whole pieces; a piece failing its hash check is simply not marked downloaded.
+  - MaxHashFailures: Ban a peer IP once this many failed pieces contained its blocks (0 disables).
+  - HaveBatchInterval: How long completed pieces are collected before their Have messages are
+    sent to peers together (0 sends a Have as soon as each piece is written).
+  - MaxDiskCache: Cache mode: bound the bytes of verified pieces kept on disk, evicting the
+    least recently read or written pieces (0 keeps everything). Evicted pieces are no longer
+    wanted; ReadRange and WantRange make the running download fetch them again. Pieces of
+    complete files are kept when ExtraDestinations is set, as those may be hardlinks.
+  - SnubTimeout: How long an unchoked peer may go without delivering a requested block before
+    it is considered snubbing us and its piece is handed to other peers (0 disables).
+  - SeedAfterComplete: Keep serving pieces to peers after the download finishes.
+  - UploadSlots: Maximum number of peers unchoked at the same time while seeding.
+  - SeedRatioLimit: Stop seeding once uploaded/downloaded reaches this ratio (0 disables).
+  - SeedTimeLimit: Stop seeding after this much time (0 disables).
+  - OnSeedingComplete: Called once when a seed limit is reached, before the stopped announce.
+  - MaxMetadataSize: Largest info dictionary accepted from peers via ut_metadata, in bytes.
+  - BlobStore: Directory of a content-addressable store: verified pieces are kept there as blobs
+    named by their hash instead of in files below the output directory, so torrents sharing
+    data store it once (empty disables). ExportFromStore copies the files out.
+  - ResumeFile: Path of the resume file (empty uses "<output>/.<name>.resume").
+  - MetadataCacheDir: Directory where metadata fetched from peers is cached as
+    "<info hash>.torrent", so later runs of the same magnet skip the exchange (empty disables).
+  - Signatures: What to do with torrents that are unsigned or not signed by a trusted
+    publisher (BEP-35, see SignaturePolicy).
+  - TrustedPublishers: Public keys whose signatures are trusted (see LoadPublisherKey).
+*/
+type Config struct {
+	ListenPort          uint16
+	AnnouncePort        uint16
+	BindTrackerPort     bool
+	DefaultTrackers     []string
+	ExtraTrackers       []string
+	ExtraAnnounceParams map[string]string
+	NumWant             int
+	UDPTrackerRetries   int
+	AnnounceTimeout     time.Duration
+	TrackerTLS          *tls.Config
+	MaxHalfOpen         int
+	MaxInboundPeers     int
+	PortForwarding      bool
+	FilterSelfPeers     bool
+	Encryption          EncryptionMode
+	ReservedBits        [8]byte
+	DHT                 bool
+	DHTIPv6             bool
+	DHTBootstrap        []string
+	DHTNodeCache        string
+	PEX                 bool
+	Holepunch           bool
+	WebSeeds            bool
+	LSD                 bool
+	LSDInterface        string
+	MinHealthyPeers     int
+	MetricsAddr         string
+	ProgressMode        ProgressMode
+	SkipVerify          bool
+	VerifyWorkers       int
+	Benchmark           bool
+	DuplicatePaths      DuplicatePathPolicy
+
+	DeletePartialOnFailure bool
+	ExtraDestinations      []string
+	OnFileComplete         func(file FileEntry)
+
+	MaxConcurrentPieces int
+	StreamPieces        bool
+	MaxHashFailures     int
+	HaveBatchInterval   time.Duration
+	MaxDiskCache        int64
+	SnubTimeout         time.Duration
+
+	SeedAfterComplete bool
+	UploadSlots       int
+	SeedRatioLimit    float64
+	SeedTimeLimit     time.Duration
+	OnSeedingComplete func(stats Stats)
+
+	MaxMetadataSize  int64
+	BlobStore        string
+	ResumeFile       string
+	MetadataCacheDir string
+
+	Signatures        SignaturePolicy
+	TrustedPublishers []crypto.PublicKey
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+DefaultConfig returns the configuration used when the caller does not supply one.
+
+Returns:
+  - Config: Configuration populated with default values.
+*/
+func DefaultConfig() Config {
+	return Config{
+		ListenPort:          6881,
+		AnnouncePort:        0,
+		BindTrackerPort:     false,
+		DefaultTrackers:     append([]string(nil), PublicTrackers...),
+		ExtraTrackers:       nil,
+		ExtraAnnounceParams: nil,
+		NumWant:             0,
+		UDPTrackerRetries:   2,
+		AnnounceTimeout:     30 * time.Second,
+		TrackerTLS:          nil,
+		MaxHalfOpen:         4,
+		MaxInboundPeers:     50,
+		PortForwarding:      true,
+		FilterSelfPeers:     true,
+		Encryption:          EncryptionPrefer,
+		ReservedBits:        [8]byte{extensionReservedByte: extensionReservedBit},
+		DHT:                 true,
+		DHTIPv6:             true,
+		DHTBootstrap:        nil,
+		DHTNodeCache:        defaultDHTNodeCache(),
+		PEX:                 true,
+		Holepunch:           true,
+		WebSeeds:            true,
+		LSD:                 false,
+		LSDInterface:        "",
+		MinHealthyPeers:     10,
+		MetricsAddr:         "",
+		ProgressMode:        ProgressAuto,
+		SkipVerify:          false,
+		VerifyWorkers:       runtime.NumCPU(),
+		Benchmark:           false,
+		DuplicatePaths:      DuplicatePathsError,
+
+		DeletePartialOnFailure: false,
+		ExtraDestinations:      nil,
+		OnFileComplete:         nil,
+
+		MaxConcurrentPieces: 64,
+		StreamPieces:        false,
+		MaxHashFailures:     3,
+		HaveBatchInterval:   time.Second,
+		MaxDiskCache:        0,
+		SnubTimeout:         30 * time.Second,
+
+		SeedAfterComplete: false,
+		UploadSlots:       4,
+		SeedRatioLimit:    0,
+		SeedTimeLimit:     0,
+		OnSeedingComplete: nil,
+
+		MaxMetadataSize:  10 << 20,
+		BlobStore:        "",
+		ResumeFile:       "",
+		MetadataCacheDir: defaultMetadataCacheDir(),
+
+		Signatures:        SignaturesIgnore,
+		TrustedPublishers: nil,
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Validate checks that the configuration can be used for a download.
+
+Parameters:
+  - Settings: Configuration to check.
+
+Returns:
+  - error: Non-nil describing the first invalid setting.
+*/
+func (Settings Config) Validate() error {
+	switch {
+	case Settings.ListenPort == 0 && Settings.AnnouncePort != 0:
+		return fmt.Errorf("Invalid config: announce port %d set without a listen port it maps to\n", Settings.AnnouncePort)
+	case Settings.ListenPort == 0 && Settings.BindTrackerPort:
+		return fmt.Errorf("Invalid config: tracker announces cannot be bound to listen port 0\n")
+	case Settings.ListenPort == 0:
+		return fmt.Errorf("Invalid config: listen port must be set\n")
+	}
+
+	for name := range Settings.ExtraAnnounceParams {
+		if announceParams[strings.ToLower(name)] {
+			return fmt.Errorf("Invalid config: extra announce parameter %q is set by the client\n", name)
+		}
+	}
+
+	if Settings.MaxHalfOpen < 0 {
+		return fmt.Errorf("Invalid config: max half-open connections must not be negative\n")
+	}
+
+	if Settings.MaxInboundPeers < 0 {
+		return fmt.Errorf("Invalid config: max inbound peers must not be negative\n")
+	}
+
+	if Settings.Encryption < EncryptionDisabled || Settings.Encryption > EncryptionRequire {
+		return fmt.Errorf("Invalid config: unknown encryption mode %d\n", Settings.Encryption)
+	}
+
+	if Settings.MaxConcurrentPieces < 0 {
+		return fmt.Errorf("Invalid config: max concurrent pieces must not be negative\n")
+	}
+
+	if Settings.NumWant < 0 {
+		return fmt.Errorf("Invalid config: numwant must not be negative\n")
+	}
+
+	if Settings.VerifyWorkers <= 0 {
+		return fmt.Errorf("Invalid config: verify workers must be positive\n")
+	}
+
+	if Settings.UploadSlots <= 0 {
+		return fmt.Errorf("Invalid config: upload slots must be positive\n")
+	}
+
+	if Settings.SeedRatioLimit < 0 {
+		return fmt.Errorf("Invalid config: seed ratio limit must not be negative\n")
+	}
+
+	if Settings.SeedTimeLimit < 0 {
+		return fmt.Errorf("Invalid config: seed time limit must not be negative\n")
+	}
+
+	if Settings.BlobStore != "" && (Settings.StreamPieces || len(Settings.ExtraDestinations) > 0) {
+		return fmt.Errorf("Invalid config: a blob store cannot be combined with streamed pieces or extra destinations\n")
+	}
+
+	if Settings.MaxDiskCache < 0 {
+		return fmt.Errorf("Invalid config: max disk cache must not be negative\n")
+	}
+
+	if Settings.Signatures < SignaturesIgnore || Settings.Signatures > SignaturesRequire {
+		return fmt.Errorf("Invalid config: unknown signature policy %d\n", Settings.Signatures)
+	}
+
+	if Settings.Signatures != SignaturesIgnore && len(Settings.TrustedPublishers) == 0 {
+		return fmt.Errorf("Invalid config: checking signatures needs trusted publisher keys\n")
+	}
+
+	if Settings.LSD && Settings.LSDInterface != "" {
+		_, err := lsdInterface(Settings.LSDInterface)
+		if err != nil {
+			return fmt.Errorf("Invalid config: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announcePort returns the port to advertise to trackers and peers.
+
+Parameters:
+  - Settings: Configuration to read.
+
+Returns:
+  - uint16: AnnouncePort if set, otherwise ListenPort.
+*/
+func (Settings Config) announcePort() uint16 {
+	if Settings.AnnouncePort != 0 {
+		return Settings.AnnouncePort
+	}
+
+	return Settings.ListenPort
+}
+
+// --------------------------------------------------------------------------------------------- //
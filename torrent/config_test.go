@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		name         string
+		listenPort   uint16
+		announcePort uint16
+		bind         bool
+		wantErr      string
+	}{
+		{"default announce port", 6881, 0, false, ""},
+		{"forwarded port", 6881, 40000, true, ""},
+		{"announce without listener", 0, 40000, false, "announce port 40000"},
+		{"bound without listener", 0, 0, true, "cannot be bound"},
+		{"no listener", 0, 0, false, "listen port must be set"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DefaultConfig()
+			settings.ListenPort = test.listenPort
+			settings.AnnouncePort = test.announcePort
+			settings.BindTrackerPort = test.bind
+
+			err := settings.Validate()
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("Validate = %v, want nil", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, test.wantErr)
+			}
+
+			want := test.announcePort
+			if want == 0 {
+				want = test.listenPort
+			}
+
+			if err == nil && settings.announcePort() != want {
+				t.Errorf("announcePort = %d, want %d", settings.announcePort(), want)
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestValidateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(settings *Config)
+		wantErr string
+	}{
+		{"defaults", func(settings *Config) {}, ""},
+		{"limits set", func(settings *Config) {
+			settings.NumWant = 200
+			settings.SeedRatioLimit = 2
+			settings.SeedTimeLimit = time.Hour
+		}, ""},
+		{"negative numwant", func(settings *Config) { settings.NumWant = -1 }, "numwant must not be negative"},
+		{"negative inbound peers", func(settings *Config) { settings.MaxInboundPeers = -1 }, "max inbound peers must not be negative"},
+		{"no verify workers", func(settings *Config) { settings.VerifyWorkers = 0 }, "verify workers must be positive"},
+		{"negative verify workers", func(settings *Config) { settings.VerifyWorkers = -2 }, "verify workers must be positive"},
+		{"no upload slots", func(settings *Config) { settings.UploadSlots = 0 }, "upload slots must be positive"},
+		{"negative seed ratio", func(settings *Config) { settings.SeedRatioLimit = -0.5 }, "seed ratio limit must not be negative"},
+		{"negative seed time", func(settings *Config) { settings.SeedTimeLimit = -time.Minute }, "seed time limit must not be negative"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DefaultConfig()
+			test.change(&settings)
+
+			err := settings.Validate()
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("Validate = %v, want nil", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,92 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+CreateTorrent builds the bencoded metainfo of a single-file torrent.
+
+Parameters:
+  - path: File to share.
+  - announce: Tracker URL (may be empty for trackerless torrents).
+  - pieceLength: Length of each piece in bytes.
+
+Returns:
+  - []byte: Contents of the .torrent file.
+  - error: Non-nil if the piece length is invalid or the file cannot be read.
+*/
+func CreateTorrent(path, announce string, pieceLength int64) ([]byte, error) {
+	if pieceLength <= 0 {
+		return nil, fmt.Errorf("Invalid piece length: %d\n", pieceLength)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Opening %s: %v\n", path, err)
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Reading %s: %v\n", path, err)
+	}
+
+	if !stat.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file\n", path)
+	}
+
+	var pieces bytes.Buffer
+	buf := make([]byte, pieceLength)
+
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			hash := sha1.Sum(buf[:n])
+			pieces.Write(hash[:])
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Reading %s: %v\n", path, err)
+		}
+	}
+
+	meta := map[string]interface{}{
+		"created by":    "BitTorrent",
+		"creation date": time.Now().Unix(),
+		"info": map[string]interface{}{
+			"name":         filepath.Base(path),
+			"length":       stat.Size(),
+			"piece length": pieceLength,
+			"pieces":       pieces.String(),
+		},
+	}
+
+	if announce != "" {
+		meta["announce"] = announce
+	}
+
+	var out bytes.Buffer
+	err = bencode.Marshal(&out, meta)
+	if err != nil {
+		return nil, fmt.Errorf("Encoding torrent: %v\n", err)
+	}
+
+	return out.Bytes(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
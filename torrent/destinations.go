@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+completedFiles returns the files that became complete with a newly written piece and marks
+them as handled. It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - entries: Files in ListFiles order.
+  - piece: Index of the piece just written, or -1 to check every file.
+
+Returns:
+  - []int: Indexes of the files whose pieces are now all downloaded.
+*/
+func (Torrent *TorrentFile) completedFiles(entries []FileEntry, piece int) []int {
+	if len(Torrent.fileDone) != len(entries) {
+		Torrent.fileDone = make([]bool, len(entries))
+	}
+
+	var done []int
+
+	for i, entry := range entries {
+		if Torrent.fileDone[i] || entry.FirstPiece < 0 || entry.Pad {
+			continue
+		}
+
+		if piece >= 0 && (piece < entry.FirstPiece || piece > entry.LastPiece) {
+			continue
+		}
+
+		complete := true
+		for p := entry.FirstPiece; p <= entry.LastPiece; p++ {
+			if !Torrent.Downloaded.Has(p) {
+				complete = false
+				break
+			}
+		}
+
+		if complete {
+			Torrent.fileDone[i] = true
+			done = append(done, i)
+		}
+	}
+
+	return done
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+finishFile runs the per-file completion steps: it makes BEP-47 executable files executable,
+links the file into every Config.ExtraDestinations directory and then calls Config.OnFileComplete.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - outputDir: Directory the torrent is downloaded to.
+  - entry: The completed file as reported by ListFiles.
+*/
+func (Torrent *TorrentFile) finishFile(outputDir string, entry FileEntry) {
+	source := filepath.Join(outputDir, entry.Path)
+
+	if entry.Executable && Torrent.Config.BlobStore == "" {
+		err := setExecutable(source)
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	}
+
+	for _, destination := range Torrent.Config.ExtraDestinations {
+		target := filepath.Join(destination, entry.Path)
+
+		err := linkOrCopy(source, target)
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+			continue
+		}
+
+		log.Printf("[INFO]\tLinked %s to %s\n", source, target)
+	}
+
+	if Torrent.Config.OnFileComplete != nil {
+		Torrent.Config.OnFileComplete(entry)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+linkOrCopy makes target a hardlink of source, copying the data instead when no hardlink can be
+made (e.g. across filesystems). The link or copy is created under a temporary name and renamed into
+place, so target never holds a partial file.
+
+Parameters:
+  - source: Completed file.
+  - target: Path to create; missing parent directories are created.
+
+Returns:
+  - error: Non-nil if neither a link nor a copy could be made.
+*/
+func linkOrCopy(source, target string) error {
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v\n", filepath.Dir(target), err)
+	}
+
+	tmp := target + ".part"
+	os.Remove(tmp)
+
+	err = os.Link(source, tmp)
+	if err != nil {
+		log.Printf("[INFO]\tCannot hardlink %s (%v), copying instead\n", target, err)
+
+		err = copyFile(source, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("Failed to copy %s to %s: %v\n", source, target, err)
+		}
+	}
+
+	err = os.Rename(tmp, target)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed to rename %s: %v\n", tmp, err)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+copyFile copies the contents of source into a new file at target.
+
+Parameters:
+  - source: File to read.
+  - target: File to create.
+
+Returns:
+  - error: Non-nil if reading, writing or syncing fails.
+*/
+func copyFile(source, target string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setExecutable adds the execute bits to a file wherever it has read bits, as for chmod +x
+under the default umask.
+
+Parameters:
+  - path: Path of the file.
+
+Returns:
+  - error: Non-nil if the file cannot be inspected or its mode changed.
+*/
+func setExecutable(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Failed to make %s executable: %v\n", path, err)
+	}
+
+	mode := stat.Mode().Perm()
+
+	err = os.Chmod(path, mode|(mode&0444)>>2)
+	if err != nil {
+		return fmt.Errorf("Failed to make %s executable: %v\n", path, err)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,973 @@
+/*
+Package dht implements a Mainline DHT (BEP-5) node: it keeps a routing table of the nodes it
+talks to, answers ping, find_node, get_peers, announce_peer, sample_infohashes, get and put
+queries, looks up, announces and scrapes info hashes (BEP-33, BEP-51), and stores and
+retrieves immutable and mutable items (BEP-44). Node IDs are tied to our external IP address and nodes whose IDs
+are tied to theirs are preferred in the routing table (BEP-42). A client runs over either
+IPv4 or IPv6 (BEP-32); a dual-stack node runs one of each, with separate routing tables.
+*/
+package dht
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// DefaultBootstrap lists well-known DHT routers used when no other contacts are known.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+const (
+	queryTimeout   = 3 * time.Second // How long to wait for a KRPC response
+	lookupAlpha    = 8               // Queries sent in parallel per lookup round
+	lookupRounds   = 6               // Maximum number of lookup rounds
+	announceCount  = 8               // Number of closest nodes announced to
+	tokenRotation  = 5 * time.Minute // How often the secret behind announce tokens changes
+	maxValues      = 50              // Most peers returned in a get_peers response
+	maxSamples     = 20              // Most info hashes returned in a sample_infohashes response
+	sampleInterval = 6 * time.Hour   // How long sample_infohashes callers should wait before asking again
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Node is a DHT node learned during a lookup.
+
+Fields:
+  - ID: Node ID (zero for bootstrap contacts whose ID is not known yet).
+  - Addr: UDP address of the node.
+*/
+type Node struct {
+	ID   [20]byte
+	Addr *net.UDPAddr
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Client is a DHT node. It sends KRPC queries over a single UDP socket, remembers the announce
+tokens handed out by the nodes it queried, and answers the queries of other nodes from its
+routing table and the peers announced to it. All nodes and peers it handles belong to the
+address family of its socket.
+
+Fields:
+  - ID: Our node ID.
+  - network: "udp4" or "udp6", the address family of the socket.
+  - conn: UDP socket used for all queries and responses.
+  - table: Routing table of the nodes we have heard from.
+  - store: Peers announced to us.
+  - items: Items put to us (BEP-44).
+  - mutex: Guards ID once the client runs, pending, tokens, nextTx, ipVotes and the token secrets.
+  - pending: Response channels keyed by transaction ID.
+  - tokens: Latest get_peers token per node address.
+  - nextTx: Next transaction ID.
+  - secret: Current secret the tokens we hand out are derived from.
+  - previousSecret: Secret before the last rotation, still accepted.
+  - secretTime: When secret was generated.
+  - ipVotes: Number of responses reporting each address as our external IP.
+*/
+type Client struct {
+	ID [20]byte
+
+	network        string
+	conn           *net.UDPConn
+	table          *routingTable
+	store          peerStore
+	items          itemStore
+	mutex          sync.Mutex
+	pending        map[string]chan map[string]interface{}
+	tokens         map[string]string
+	nextTx         uint16
+	secret         [8]byte
+	previousSecret [8]byte
+	secretTime     time.Time
+	ipVotes        map[string]int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+NewClient opens an IPv4 UDP socket on an ephemeral port and starts serving queries and
+reading responses.
+
+Returns:
+  - *Client: Ready client; call Close when done.
+  - error: Non-nil if the socket cannot be opened or no node ID can be generated.
+*/
+func NewClient() (*Client, error) {
+	return Listen(0)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+NewClient6 is NewClient over IPv6 (BEP-32).
+
+Returns:
+  - *Client: Ready client; call Close when done.
+  - error: Non-nil if the socket cannot be opened (e.g. IPv6 is disabled) or no node ID can be
+    generated.
+*/
+func NewClient6() (*Client, error) {
+	return Listen6(0)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Listen opens an IPv4 DHT node on a UDP port, so other nodes can reach it at a known address.
+
+Parameters:
+  - port: UDP port to listen on (0 picks an ephemeral port).
+
+Returns:
+  - *Client: Ready node; call Close when done.
+  - error: Non-nil if the socket cannot be opened or no node ID can be generated.
+*/
+func Listen(port int) (*Client, error) {
+	return listen("udp4", port)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Listen6 is Listen over IPv6 (BEP-32). The node only talks to IPv6 nodes.
+
+Parameters:
+  - port: UDP port to listen on (0 picks an ephemeral port).
+
+Returns:
+  - *Client: Ready node; call Close when done.
+  - error: Non-nil if the socket cannot be opened or no node ID can be generated.
+*/
+func Listen6(port int) (*Client, error) {
+	return listen("udp6", port)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+listen opens a DHT node on a UDP port of an address family.
+
+Parameters:
+  - network: "udp4" or "udp6".
+  - port: UDP port to listen on (0 picks an ephemeral port).
+
+Returns:
+  - *Client: Ready node; call Close when done.
+  - error: Non-nil if the socket cannot be opened or no node ID can be generated.
+*/
+func listen(network string, port int) (*Client, error) {
+	conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, fmt.Errorf("Opening DHT socket: %v\n", err)
+	}
+
+	client := &Client{
+		network: network,
+		conn:    conn,
+		pending: make(map[string]chan map[string]interface{}),
+		tokens:  make(map[string]string),
+		ipVotes: make(map[string]int),
+	}
+
+	_, err = crand.Read(client.ID[:])
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Generating DHT node ID: %v\n", err)
+	}
+
+	client.table = &routingTable{self: client.ID}
+
+	go client.readLoop()
+
+	return client, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close closes the client's socket. Outstanding queries fail with a timeout.
+
+Returns:
+  - error: Non-nil if closing the socket fails.
+*/
+func (Client *Client) Close() error {
+	return Client.conn.Close()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+nodeID returns our node ID, which SetExternalIP may change while the client runs.
+
+Returns:
+  - [20]byte: Our node ID.
+*/
+func (Client *Client) nodeID() [20]byte {
+	Client.mutex.Lock()
+	defer Client.mutex.Unlock()
+
+	return Client.ID
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Addr returns the local address of the node's socket.
+
+Returns:
+  - *net.UDPAddr: Local address.
+*/
+func (Client *Client) Addr() *net.UDPAddr {
+	return Client.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+IPv6 reports whether the node runs over IPv6.
+
+Returns:
+  - bool: True for nodes opened with Listen6 or NewClient6.
+*/
+func (Client *Client) IPv6() bool {
+	return Client.network == "udp6"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Nodes returns the number of nodes in the routing table.
+
+Returns:
+  - int: Node count.
+*/
+func (Client *Client) Nodes() int {
+	return Client.table.size()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GoodNodes returns the addresses of routing table nodes that answered their last query and
+were heard from recently, most recently seen first, e.g. to bootstrap a later run from.
+
+Parameters:
+  - count: Maximum number of nodes.
+
+Returns:
+  - []string: Node addresses ("ip:port").
+*/
+func (Client *Client) GoodNodes(count int) []string {
+	var addrs []string
+
+	for _, node := range Client.table.good(count) {
+		addrs = append(addrs, node.Addr.String())
+	}
+
+	return addrs
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+readLoop answers incoming KRPC queries and dispatches responses and errors to the queries
+waiting for them.
+*/
+func (Client *Client) readLoop() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := Client.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		raw, err := bencode.Decode(bytes.NewReader(buf[:n]))
+		if err != nil {
+			continue
+		}
+
+		msg, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		tx, _ := msg["t"].(string)
+
+		if y, _ := msg["y"].(string); y == "q" {
+			Client.handleQuery(tx, msg, from)
+			continue
+		}
+
+		Client.mutex.Lock()
+		ch, ok := Client.pending[tx]
+		delete(Client.pending, tx)
+		Client.mutex.Unlock()
+
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+query sends a KRPC query and waits for its response.
+
+Parameters:
+  - addr: Node to query.
+  - method: Query name ("get_peers", "announce_peer", ...).
+  - args: Query arguments; our node ID is added automatically.
+
+Returns:
+  - map[string]interface{}: The "r" dictionary of the response.
+  - error: Non-nil on timeout, a KRPC error, or a malformed response.
+*/
+func (Client *Client) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	id := Client.nodeID()
+	args["id"] = string(id[:])
+
+	ch := make(chan map[string]interface{}, 1)
+
+	Client.mutex.Lock()
+	Client.nextTx++
+	var txBytes [2]byte
+	binary.BigEndian.PutUint16(txBytes[:], Client.nextTx)
+	tx := string(txBytes[:])
+	Client.pending[tx] = ch
+	Client.mutex.Unlock()
+
+	defer func() {
+		Client.mutex.Lock()
+		delete(Client.pending, tx)
+		Client.mutex.Unlock()
+	}()
+
+	var buf bytes.Buffer
+	err := bencode.Marshal(&buf, map[string]interface{}{
+		"t": tx,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Encoding %s query: %v\n", method, err)
+	}
+
+	_, err = Client.conn.WriteToUDP(buf.Bytes(), addr)
+	if err != nil {
+		return nil, fmt.Errorf("Sending %s to %s: %v\n", method, addr, err)
+	}
+
+	select {
+	case msg := <-ch:
+		if y, _ := msg["y"].(string); y == "e" {
+			return nil, fmt.Errorf("%s to %s failed: %v\n", method, addr, msg["e"])
+		}
+
+		r, ok := msg["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Malformed %s response from %s\n", method, addr)
+		}
+
+		if ip, ok := msg["ip"].(string); ok {
+			Client.recordIPVote(ip)
+		}
+
+		if id, _ := r["id"].(string); len(id) == 20 {
+			var node Node
+			copy(node.ID[:], id)
+			node.Addr = addr
+			Client.table.insert(node)
+		}
+
+		return r, nil
+
+	case <-time.After(queryTimeout):
+		Client.table.failed(addr)
+		return nil, fmt.Errorf("%s to %s timed out\n", method, addr)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GetPeersResult is the answer of a node to a get_peers query.
+
+Fields:
+  - ID: ID of the responding node.
+  - Peers: Peers ("ip:port") the node knows for the info hash.
+  - Nodes: Nodes closer to the info hash.
+  - Token: Token required to announce to this node.
+  - seeds: Bloom filter of the seeds the node knows, for scrape queries (BEP-33).
+  - peers: Bloom filter of the other peers the node knows, for scrape queries.
+*/
+type GetPeersResult struct {
+	ID    [20]byte
+	Peers []string
+	Nodes []Node
+	Token string
+
+	seeds *bloomFilter
+	peers *bloomFilter
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GetPeers asks a node for peers of an info hash and remembers the token it returns.
+
+Parameters:
+  - addr: Node to query.
+  - infoHash: Info hash to look up.
+
+Returns:
+  - *GetPeersResult: Peers, closer nodes and token.
+  - error: Non-nil if the query fails.
+*/
+func (Client *Client) GetPeers(addr *net.UDPAddr, infoHash [20]byte) (*GetPeersResult, error) {
+	return Client.getPeers(addr, infoHash, false)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+getPeers sends a get_peers query, optionally asking for the node's scrape bloom filters.
+
+Parameters:
+  - addr: Node to query.
+  - infoHash: Info hash to look up.
+  - scrape: Ask for the "BFsd" and "BFpe" filters (BEP-33).
+
+Returns:
+  - *GetPeersResult: Peers, closer nodes, token and filters if the node returned them.
+  - error: Non-nil if the query fails.
+*/
+func (Client *Client) getPeers(addr *net.UDPAddr, infoHash [20]byte, scrape bool) (*GetPeersResult, error) {
+	args := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"want":      Client.want(),
+	}
+
+	if scrape {
+		args["scrape"] = 1
+	}
+
+	r, err := Client.query(addr, "get_peers", args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GetPeersResult{}
+
+	id, _ := r["id"].(string)
+	copy(result.ID[:], id)
+
+	result.Token, _ = r["token"].(string)
+	if result.Token != "" {
+		Client.mutex.Lock()
+		Client.tokens[addr.String()] = result.Token
+		Client.mutex.Unlock()
+	}
+
+	values, _ := r["values"].([]interface{})
+	for _, value := range values {
+		compact, ok := value.(string)
+		if !ok || (len(compact) != 6 && len(compact) != 18) {
+			continue
+		}
+
+		ip := net.IP([]byte(compact[:len(compact)-2]))
+		port := binary.BigEndian.Uint16([]byte(compact[len(compact)-2:]))
+		result.Peers = append(result.Peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+
+	result.Nodes = Client.responseNodes(r)
+	result.seeds = decodeBloomFilter(r, "BFsd")
+	result.peers = decodeBloomFilter(r, "BFpe")
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+AnnouncePeer tells a node that we have the torrent, using the token from an earlier get_peers.
+
+Parameters:
+  - addr: Node to announce to.
+  - infoHash: Info hash being announced.
+  - port: TCP port peers should connect to.
+  - seed: We have the whole torrent, so the node counts us among the seeds in scrapes (BEP-33).
+
+Returns:
+  - error: Non-nil if no token is known for the node or the query fails.
+*/
+func (Client *Client) AnnouncePeer(addr *net.UDPAddr, infoHash [20]byte, port uint16, seed bool) error {
+	Client.mutex.Lock()
+	token, ok := Client.tokens[addr.String()]
+	Client.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("No announce token for %s\n", addr)
+	}
+
+	args := map[string]interface{}{
+		"info_hash":    string(infoHash[:]),
+		"port":         int(port),
+		"token":        token,
+		"implied_port": 0,
+	}
+
+	if seed {
+		args["seed"] = 1
+	}
+
+	_, err := Client.query(addr, "announce_peer", args)
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Ping checks that a node is alive; an answer adds it to the routing table.
+
+Parameters:
+  - addr: Node to ping.
+
+Returns:
+  - error: Non-nil if the node does not answer.
+*/
+func (Client *Client) Ping(addr *net.UDPAddr) error {
+	_, err := Client.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+FindNode asks a node for the nodes it knows closest to a target ID.
+
+Parameters:
+  - addr: Node to query.
+  - target: ID to find nodes near.
+
+Returns:
+  - []Node: Nodes returned by the node.
+  - error: Non-nil if the query fails.
+*/
+func (Client *Client) FindNode(addr *net.UDPAddr, target [20]byte) ([]Node, error) {
+	r, err := Client.query(addr, "find_node", map[string]interface{}{
+		"target": string(target[:]),
+		"want":   Client.want(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return Client.responseNodes(r), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+want returns the "want" argument of find_node and get_peers queries (BEP-32), asking
+dual-stack nodes for nodes of our address family only.
+
+Returns:
+  - []interface{}: "n4" or "n6".
+*/
+func (Client *Client) want() []interface{} {
+	if Client.IPv6() {
+		return []interface{}{"n6"}
+	}
+
+	return []interface{}{"n4"}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+responseNodes decodes the nodes of a find_node or get_peers response: "nodes" for IPv4
+clients, "nodes6" for IPv6 clients (BEP-32). Nodes of the other family cannot be reached
+from our socket and are ignored.
+
+Parameters:
+  - r: The "r" dictionary of the response.
+
+Returns:
+  - []Node: Nodes of our address family.
+*/
+func (Client *Client) responseNodes(r map[string]interface{}) []Node {
+	if Client.IPv6() {
+		nodes, _ := r["nodes6"].(string)
+		return decodeNodes6(nodes)
+	}
+
+	nodes, _ := r["nodes"].(string)
+
+	return decodeNodes(nodes)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Bootstrap fills the routing table by looking up our own ID with find_node queries,
+starting from the given contacts.
+
+Parameters:
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - int: Number of nodes in the routing table afterwards.
+  - error: Non-nil if no contact could be resolved.
+*/
+func (Client *Client) Bootstrap(bootstrap []string) (int, error) {
+	candidates := Client.resolveContacts(bootstrap)
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("No DHT bootstrap node could be resolved\n")
+	}
+
+	queried := make(map[string]bool)
+
+	for round := 0; round < lookupRounds; round++ {
+		var batch []Node
+		for _, candidate := range candidates {
+			if len(batch) == lookupAlpha {
+				break
+			}
+
+			if !queried[candidate.Addr.String()] {
+				queried[candidate.Addr.String()] = true
+				batch = append(batch, candidate)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		self := Client.nodeID()
+
+		var wg sync.WaitGroup
+		var foundMutex sync.Mutex
+		var found []Node
+
+		for _, target := range batch {
+			wg.Add(1)
+
+			go func(target Node) {
+				defer wg.Done()
+
+				nodes, err := Client.FindNode(target.Addr, self)
+				if err != nil {
+					return
+				}
+
+				foundMutex.Lock()
+				found = append(found, nodes...)
+				foundMutex.Unlock()
+			}(target)
+		}
+
+		wg.Wait()
+
+		candidates = append(candidates, found...)
+		sortByDistance(candidates, self)
+	}
+
+	log.Printf("[INFO]\tDHT bootstrap: %d nodes queried, %d in the routing table\n", len(queried), Client.table.size())
+
+	return Client.table.size(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+resolveContacts resolves "host:port" contacts to nodes with unknown IDs in our address
+family. Contacts that are IP addresses of the other family are skipped silently, so one
+contact list serves both stacks; other contacts that do not resolve are logged and skipped.
+
+Parameters:
+  - contacts: Contacts to resolve.
+
+Returns:
+  - []Node: Resolved nodes.
+*/
+func (Client *Client) resolveContacts(contacts []string) []Node {
+	var nodes []Node
+
+	for _, contact := range contacts {
+		host, _, err := net.SplitHostPort(contact)
+		if ip := net.ParseIP(host); err == nil && ip != nil && (ip.To4() == nil) != Client.IPv6() {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr(Client.network, contact)
+		if err != nil {
+			log.Printf("[ERROR]\tResolving DHT bootstrap node %s: %v\n", contact, err)
+			continue
+		}
+
+		nodes = append(nodes, Node{Addr: addr})
+	}
+
+	return nodes
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Announce looks up the nodes closest to an info hash with iterative get_peers queries,
+starting from the bootstrap contacts, and announces our port to the closest ones.
+
+Parameters:
+  - infoHash: Info hash to announce.
+  - port: TCP port peers should connect to.
+  - seed: We have the whole torrent (see AnnouncePeer).
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - []string: Peers learned during the lookup.
+  - int: Number of nodes that accepted the announce.
+  - error: Non-nil if no bootstrap contact could be resolved.
+*/
+func (Client *Client) Announce(infoHash [20]byte, port uint16, seed bool, bootstrap []string) ([]string, int, error) {
+	peers, responders, queried, err := Client.lookup(infoHash, bootstrap)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	announced := 0
+	for i := 0; i < len(responders) && i < announceCount; i++ {
+		err := Client.AnnouncePeer(responders[i].Addr, infoHash, port, seed)
+		if err != nil {
+			log.Printf("[FAIL]\tDHT announce to %s: %v", responders[i].Addr, err)
+			continue
+		}
+
+		announced++
+	}
+
+	log.Printf("[INFO]\tDHT announce for %x: %d nodes queried, %d announced, %d peers seen\n",
+		infoHash, queried, announced, len(peers))
+
+	return peers, announced, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+FindPeers looks up peers of an info hash without announcing ourselves, for torrents that
+have no working tracker.
+
+Parameters:
+  - infoHash: Info hash to look up.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - []string: Distinct peers ("ip:port") learned during the lookup.
+  - error: Non-nil if no bootstrap contact could be resolved.
+*/
+func (Client *Client) FindPeers(infoHash [20]byte, bootstrap []string) ([]string, error) {
+	peers, _, queried, err := Client.lookup(infoHash, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var unique []string
+
+	for _, peer := range peers {
+		if !seen[peer] {
+			seen[peer] = true
+			unique = append(unique, peer)
+		}
+	}
+
+	log.Printf("[INFO]\tDHT lookup for %x: %d nodes queried, %d peers found\n", infoHash, queried, len(unique))
+
+	return unique, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+lookup runs iterative get_peers queries towards an info hash, starting from the closest
+nodes of the routing table and the bootstrap contacts, remembering the announce tokens of
+the nodes that answer.
+
+Parameters:
+  - infoHash: Info hash to look up.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - []string: Peers learned during the lookup (may contain duplicates).
+  - []Node: Nodes that returned a token, closest first.
+  - int: Number of nodes queried.
+  - error: Non-nil if the routing table is empty and no bootstrap contact could be resolved.
+*/
+func (Client *Client) lookup(infoHash [20]byte, bootstrap []string) ([]string, []Node, int, error) {
+	var peers []string
+	var peersMutex sync.Mutex
+
+	responders, queried, err := Client.walk(infoHash, bootstrap, func(addr *net.UDPAddr) (*lookupStep, error) {
+		result, err := Client.GetPeers(addr, infoHash)
+		if err != nil {
+			return nil, err
+		}
+
+		peersMutex.Lock()
+		peers = append(peers, result.Peers...)
+		peersMutex.Unlock()
+
+		return &lookupStep{ID: result.ID, Nodes: result.Nodes, Token: result.Token}, nil
+	})
+
+	return peers, responders, queried, err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+lookupStep is what an iterative lookup learns from one node.
+
+Fields:
+  - ID: ID of the responding node.
+  - Nodes: Nodes closer to the target.
+  - Token: Write token the node handed out (empty if none).
+*/
+type lookupStep struct {
+	ID    [20]byte
+	Nodes []Node
+	Token string
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+walk runs an iterative lookup towards a target, starting from the closest nodes of the
+routing table and the bootstrap contacts: each round queries the lookupAlpha closest nodes
+not queried yet, in parallel, and adds the nodes they return to the candidates.
+
+Parameters:
+  - target: ID or info hash to walk towards.
+  - bootstrap: Initial contacts ("host:port").
+  - visit: Queries one node; called concurrently.
+
+Returns:
+  - []Node: Nodes that returned a token, closest first.
+  - int: Number of nodes queried.
+  - error: Non-nil if the routing table is empty and no bootstrap contact could be resolved.
+*/
+func (Client *Client) walk(target [20]byte, bootstrap []string, visit func(addr *net.UDPAddr) (*lookupStep, error)) ([]Node, int, error) {
+	candidates := Client.table.closest(target, 2*lookupAlpha)
+	candidates = append(candidates, Client.resolveContacts(bootstrap)...)
+
+	if len(candidates) == 0 {
+		return nil, 0, fmt.Errorf("No DHT bootstrap node could be resolved\n")
+	}
+
+	queried := make(map[string]bool)
+	var responders []Node
+	var resultMutex sync.Mutex
+
+	for round := 0; round < lookupRounds; round++ {
+		sortByDistance(candidates, target)
+
+		var batch []Node
+		for _, candidate := range candidates {
+			if len(batch) == lookupAlpha {
+				break
+			}
+
+			if !queried[candidate.Addr.String()] {
+				queried[candidate.Addr.String()] = true
+				batch = append(batch, candidate)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		var found []Node
+
+		for _, node := range batch {
+			wg.Add(1)
+
+			go func(node Node) {
+				defer wg.Done()
+
+				step, err := visit(node.Addr)
+				if err != nil {
+					return
+				}
+
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+
+				if step.Token != "" {
+					responders = append(responders, Node{ID: step.ID, Addr: node.Addr})
+				}
+
+				found = append(found, step.Nodes...)
+			}(node)
+		}
+
+		wg.Wait()
+		candidates = append(candidates, found...)
+	}
+
+	sortByDistance(responders, target)
+
+	return responders, len(queried), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sortByDistance orders nodes by XOR distance of their ID to a target, closest first.
+
+Parameters:
+  - nodes: Nodes to sort in place.
+  - target: Target ID (an info hash).
+*/
+func sortByDistance(nodes []Node, target [20]byte) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		for k := 0; k < 20; k++ {
+			a := nodes[i].ID[k] ^ target[k]
+			b := nodes[j].ID[k] ^ target[k]
+
+			if a != b {
+				return a < b
+			}
+		}
+
+		return false
+	})
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,599 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+const (
+	maxItemSize = 1000          // Largest bencoded value of a BEP-44 item
+	maxSaltSize = 64            // Largest salt of a mutable item
+	itemTTL     = 2 * time.Hour // How long a stored item lives without being put again
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Item is a value stored in the DHT (BEP-44). Immutable items are addressed by the SHA-1 of
+their bencoded value; mutable items by the SHA-1 of their ed25519 public key and salt, and
+carry a sequence number and a signature so only the key holder can update them.
+
+Fields:
+  - Value: Any bencodable value, at most 1000 bytes once bencoded.
+  - PublicKey: ed25519 public key of a mutable item (nil for immutable items).
+  - Salt: Salt of a mutable item, letting one key publish several items.
+  - Seq: Sequence number of a mutable item; higher numbers replace lower ones.
+  - Sig: ed25519 signature of a mutable item over its salt, sequence number and value.
+  - raw: Bencoded value.
+
+Methods:
+  - Mutable: Reports whether the item is mutable.
+  - Target: Returns the key the item is stored under.
+*/
+type Item struct {
+	Value     interface{}
+	PublicKey ed25519.PublicKey
+	Salt      string
+	Seq       int64
+	Sig       []byte
+
+	raw []byte
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+NewImmutableItem creates an immutable item.
+
+Parameters:
+  - value: Bencodable value.
+
+Returns:
+  - *Item: The item, ready for Put.
+  - error: Non-nil if the value cannot be bencoded or is too large.
+*/
+func NewImmutableItem(value interface{}) (*Item, error) {
+	raw, err := encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Item{Value: value, raw: raw}, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+NewMutableItem creates and signs a mutable item.
+
+Parameters:
+  - key: ed25519 private key of the publisher.
+  - salt: Salt distinguishing items of the same key (may be empty).
+  - seq: Sequence number, higher than that of the version being replaced.
+  - value: Bencodable value.
+
+Returns:
+  - *Item: The signed item, ready for Put.
+  - error: Non-nil if the value cannot be bencoded or the value or salt is too large.
+*/
+func NewMutableItem(key ed25519.PrivateKey, salt string, seq int64, value interface{}) (*Item, error) {
+	if len(salt) > maxSaltSize {
+		return nil, fmt.Errorf("DHT item salt too long: %d bytes\n", len(salt))
+	}
+
+	raw, err := encodeValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Item{
+		Value:     value,
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Sig:       ed25519.Sign(key, signedData(salt, seq, raw)),
+		raw:       raw,
+	}, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+MutableTarget returns the key a mutable item is stored under.
+
+Parameters:
+  - publicKey: ed25519 public key of the publisher.
+  - salt: Salt of the item.
+
+Returns:
+  - [20]byte: SHA-1 of the public key followed by the salt.
+*/
+func MutableTarget(publicKey ed25519.PublicKey, salt string) [20]byte {
+	return sha1.Sum(append(append([]byte(nil), publicKey...), salt...))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Mutable reports whether the item is mutable.
+
+Returns:
+  - bool: True if the item has a public key.
+*/
+func (Item *Item) Mutable() bool {
+	return Item.PublicKey != nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Target returns the key the item is stored under.
+
+Returns:
+  - [20]byte: SHA-1 of the bencoded value, or MutableTarget for mutable items.
+*/
+func (Item *Item) Target() [20]byte {
+	if Item.Mutable() {
+		return MutableTarget(Item.PublicKey, Item.Salt)
+	}
+
+	return sha1.Sum(Item.raw)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+validSignature reports whether a mutable item is signed by its public key.
+
+Returns:
+  - bool: True if the key and signature have valid sizes and the signature checks out.
+*/
+func (Item *Item) validSignature() bool {
+	return len(Item.PublicKey) == ed25519.PublicKeySize && len(Item.Sig) == ed25519.SignatureSize &&
+		len(Item.Salt) <= maxSaltSize && ed25519.Verify(Item.PublicKey, signedData(Item.Salt, Item.Seq, Item.raw), Item.Sig)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+encodeValue bencodes the value of an item.
+
+Parameters:
+  - value: Bencodable value.
+
+Returns:
+  - []byte: Bencoded value.
+  - error: Non-nil if the value cannot be bencoded or exceeds maxItemSize.
+*/
+func encodeValue(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, value)
+	if err != nil {
+		return nil, fmt.Errorf("Encoding DHT item: %v\n", err)
+	}
+
+	if buf.Len() > maxItemSize {
+		return nil, fmt.Errorf("DHT item too large: %d bytes\n", buf.Len())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+signedData builds the buffer a mutable item's signature covers: the salt (if any), the
+sequence number and the value, as the bencoded key-value pairs of the put query.
+
+Parameters:
+  - salt: Salt of the item.
+  - seq: Sequence number.
+  - raw: Bencoded value.
+
+Returns:
+  - []byte: Data to sign.
+*/
+func signedData(salt string, seq int64, raw []byte) []byte {
+	var buf bytes.Buffer
+
+	if salt != "" {
+		fmt.Fprintf(&buf, "4:salt%d:%s", len(salt), salt)
+	}
+
+	fmt.Fprintf(&buf, "3:seqi%de1:v", seq)
+	buf.Write(raw)
+
+	return buf.Bytes()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GetImmutable looks up an immutable item in the DHT.
+
+Parameters:
+  - target: SHA-1 of the item's bencoded value.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - *Item: The item.
+  - error: Non-nil if no node returned a value matching the target.
+*/
+func (Client *Client) GetImmutable(target [20]byte, bootstrap []string) (*Item, error) {
+	item, _, err := Client.get(target, bootstrap, func(item *Item) bool {
+		return !item.Mutable() && item.Target() == target
+	})
+
+	return item, err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GetMutable looks up the latest version of a mutable item in the DHT: of the validly signed
+versions the nodes return, the one with the highest sequence number.
+
+Parameters:
+  - publicKey: ed25519 public key of the publisher.
+  - salt: Salt of the item.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - *Item: The item.
+  - error: Non-nil if no node returned a validly signed version.
+*/
+func (Client *Client) GetMutable(publicKey ed25519.PublicKey, salt string, bootstrap []string) (*Item, error) {
+	item, _, err := Client.get(MutableTarget(publicKey, salt), bootstrap, func(item *Item) bool {
+		item.Salt = salt
+		return bytes.Equal(item.PublicKey, publicKey) && item.validSignature()
+	})
+
+	return item, err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Put stores an item on the nodes closest to its target: a lookup with get queries collects
+their write tokens, then the closest ones are sent put queries.
+
+Parameters:
+  - item: Item from NewImmutableItem, NewMutableItem or a Get.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - int: Number of nodes that stored the item.
+  - error: Non-nil if no bootstrap contact could be resolved or no node stored the item.
+*/
+func (Client *Client) Put(item *Item, bootstrap []string) (int, error) {
+	target := item.Target()
+
+	_, responders, err := Client.get(target, bootstrap, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	stored := 0
+	for i := 0; i < len(responders) && i < announceCount; i++ {
+		err := Client.putItem(responders[i].Addr, item)
+		if err != nil {
+			log.Printf("[FAIL]\tDHT put to %s: %v", responders[i].Addr, err)
+			continue
+		}
+
+		stored++
+	}
+
+	if stored == 0 {
+		return 0, fmt.Errorf("No DHT node stored item %x\n", target)
+	}
+
+	log.Printf("[INFO]\tDHT put of %x: stored on %d nodes\n", target, stored)
+
+	return stored, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+get runs an iterative lookup with get queries towards a target, collecting write tokens.
+Returned items are checked with accept; of the accepted ones, the one with the highest
+sequence number is kept.
+
+Parameters:
+  - target: Key of the item.
+  - bootstrap: Initial contacts ("host:port").
+  - accept: Validates an item returned by a node (nil only collects tokens).
+
+Returns:
+  - *Item: Best accepted item.
+  - []Node: Nodes that returned a token, closest first.
+  - error: Non-nil if no bootstrap contact could be resolved or no item was accepted.
+*/
+func (Client *Client) get(target [20]byte, bootstrap []string, accept func(item *Item) bool) (*Item, []Node, error) {
+	var best *Item
+	var bestMutex sync.Mutex
+
+	responders, queried, err := Client.walk(target, bootstrap, func(addr *net.UDPAddr) (*lookupStep, error) {
+		step, item, err := Client.getItem(addr, target)
+		if err != nil {
+			return nil, err
+		}
+
+		if item != nil && accept != nil && accept(item) {
+			bestMutex.Lock()
+			if best == nil || item.Seq > best.Seq {
+				best = item
+			}
+			bestMutex.Unlock()
+		}
+
+		return step, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if accept == nil {
+		return nil, responders, nil
+	}
+
+	if best == nil {
+		return nil, responders, fmt.Errorf("No DHT node returned item %x (%d nodes queried)\n", target, queried)
+	}
+
+	return best, responders, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+getItem sends a get query and remembers the write token it returns.
+
+Parameters:
+  - addr: Node to query.
+  - target: Key of the item.
+
+Returns:
+  - *lookupStep: Node ID, closer nodes and token.
+  - *Item: Item the node stores under the target, or nil (not validated).
+  - error: Non-nil if the query fails.
+*/
+func (Client *Client) getItem(addr *net.UDPAddr, target [20]byte) (*lookupStep, *Item, error) {
+	r, err := Client.query(addr, "get", map[string]interface{}{
+		"target": string(target[:]),
+		"want":   Client.want(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	step := &lookupStep{Nodes: Client.responseNodes(r)}
+
+	id, _ := r["id"].(string)
+	copy(step.ID[:], id)
+
+	step.Token, _ = r["token"].(string)
+	if step.Token != "" {
+		Client.mutex.Lock()
+		Client.tokens[addr.String()] = step.Token
+		Client.mutex.Unlock()
+	}
+
+	value, ok := r["v"]
+	if !ok {
+		return step, nil, nil
+	}
+
+	raw, err := encodeValue(value)
+	if err != nil {
+		return step, nil, nil
+	}
+
+	item := &Item{Value: value, raw: raw}
+
+	if key, ok := r["k"].(string); ok {
+		sig, _ := r["sig"].(string)
+		item.PublicKey = ed25519.PublicKey(key)
+		item.Sig = []byte(sig)
+		item.Seq, _ = r["seq"].(int64)
+	}
+
+	return step, item, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+putItem sends a put query, using the token from an earlier get.
+
+Parameters:
+  - addr: Node to store the item on.
+  - item: Item to store.
+
+Returns:
+  - error: Non-nil if no token is known for the node or the query fails.
+*/
+func (Client *Client) putItem(addr *net.UDPAddr, item *Item) error {
+	Client.mutex.Lock()
+	token, ok := Client.tokens[addr.String()]
+	Client.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("No write token for %s\n", addr)
+	}
+
+	args := map[string]interface{}{
+		"token": token,
+		"v":     item.Value,
+	}
+
+	if item.Mutable() {
+		args["k"] = string(item.PublicKey)
+		args["sig"] = string(item.Sig)
+		args["seq"] = item.Seq
+
+		if item.Salt != "" {
+			args["salt"] = item.Salt
+		}
+	}
+
+	_, err := Client.query(addr, "put", args)
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+storeItem validates the item of a put query and stores it.
+
+Parameters:
+  - args: Arguments of the put query.
+
+Returns:
+  - int: KRPC error code, 0 if the item was stored.
+  - string: Error message.
+*/
+func (Client *Client) storeItem(args map[string]interface{}) (int, string) {
+	value, ok := args["v"]
+	if !ok {
+		return errorProtocol, "Missing value"
+	}
+
+	raw, err := encodeValue(value)
+	if err != nil {
+		return errorTooBig, "Message too big"
+	}
+
+	item := &Item{Value: value, raw: raw}
+
+	if key, ok := args["k"].(string); ok {
+		sig, _ := args["sig"].(string)
+		item.PublicKey = ed25519.PublicKey(key)
+		item.Sig = []byte(sig)
+		item.Seq, _ = args["seq"].(int64)
+		item.Salt, _ = args["salt"].(string)
+
+		if len(item.Salt) > maxSaltSize {
+			return errorSaltTooBig, "Salt too big"
+		}
+
+		if !item.validSignature() {
+			return errorSignature, "Invalid signature"
+		}
+	}
+
+	cas, hasCAS := args["cas"].(int64)
+
+	return Client.items.put(item, cas, hasCAS)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+itemStore keeps the BEP-44 items put to us, so we can answer get queries.
+
+Fields:
+  - mutex: Guards items.
+  - items: Stored items by target.
+*/
+type itemStore struct {
+	mutex sync.Mutex
+	items map[[20]byte]storedItem
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+storedItem is an item put to us.
+
+Fields:
+  - item: The item.
+  - expiry: When the item is dropped unless put again.
+*/
+type storedItem struct {
+	item   *Item
+	expiry time.Time
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+put stores an item. A mutable item only replaces a stored version with a sequence number
+not higher than its own, and with a compare-and-swap only the version it names.
+
+Parameters:
+  - item: Validated item.
+  - cas: Sequence number the stored version must have.
+  - hasCAS: Whether the put query carried cas.
+
+Returns:
+  - int: KRPC error code, 0 if the item was stored.
+  - string: Error message.
+*/
+func (Store *itemStore) put(item *Item, cas int64, hasCAS bool) (int, string) {
+	target := item.Target()
+
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	if Store.items == nil {
+		Store.items = make(map[[20]byte]storedItem)
+	}
+
+	if current, ok := Store.items[target]; ok && item.Mutable() && time.Now().Before(current.expiry) {
+		if hasCAS && cas != current.item.Seq {
+			return errorCAS, "CAS mismatch"
+		}
+
+		if item.Seq < current.item.Seq {
+			return errorSequence, "Sequence number less than current"
+		}
+	}
+
+	Store.items[target] = storedItem{item: item, expiry: time.Now().Add(itemTTL)}
+
+	return 0, ""
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+get returns the item stored under a target, dropping it if expired.
+
+Parameters:
+  - target: Key of the item.
+
+Returns:
+  - *Item: The item, or nil if none is stored.
+*/
+func (Store *itemStore) get(target [20]byte) *Item {
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	stored, ok := Store.items[target]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(stored.expiry) {
+		delete(Store.items, target)
+		return nil
+	}
+
+	return stored.item
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,617 @@
+package dht
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+const (
+	bucketSize   = 8                // Nodes kept per routing table bucket (K in BEP-5)
+	maxFailures  = 2                // Unanswered queries after which a node is dropped
+	staleTimeout = 15 * time.Minute // Nodes not heard from for this long are questionable
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+tableEntry is a node in the routing table together with its liveness.
+
+Fields:
+  - node: The node.
+  - lastSeen: When the node last answered or queried us.
+  - failures: Consecutive queries it did not answer.
+  - secure: Whether the node's ID complies with BEP-42 for its address.
+*/
+type tableEntry struct {
+	node     Node
+	lastSeen time.Time
+	failures int
+	secure   bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+routingTable is a BEP-5 routing table: one bucket per length of the ID prefix shared with
+our own ID, each holding at most bucketSize nodes. Good nodes are never replaced by new
+ones, except that a node with a BEP-42 compliant ID may replace one without; otherwise a
+full bucket only takes a new node in place of a questionable or failing one.
+
+Fields:
+  - self: Our node ID.
+  - mutex: Guards self and buckets.
+  - buckets: Nodes per shared prefix length (0-159).
+*/
+type routingTable struct {
+	self    [20]byte
+	mutex   sync.Mutex
+	buckets [160][]tableEntry
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+bucketIndex returns the bucket of an ID: the number of leading bits it shares with our ID.
+The caller must hold mutex.
+
+Parameters:
+  - id: Node ID.
+
+Returns:
+  - int: Bucket index, or -1 for our own ID.
+*/
+func (Table *routingTable) bucketIndex(id [20]byte) int {
+	for i := 0; i < 20; i++ {
+		x := Table.self[i] ^ id[i]
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return -1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+insert records that a node is alive, adding it to its bucket if there is room.
+
+Parameters:
+  - node: Node that answered or queried us.
+*/
+func (Table *routingTable) insert(node Node) {
+	if node.Addr == nil {
+		return
+	}
+
+	Table.mutex.Lock()
+	defer Table.mutex.Unlock()
+
+	index := Table.bucketIndex(node.ID)
+	if index < 0 {
+		return
+	}
+
+	bucket := Table.buckets[index]
+	now := time.Now()
+
+	for i := range bucket {
+		if bucket[i].node.ID == node.ID {
+			bucket[i].node.Addr = node.Addr
+			bucket[i].lastSeen = now
+			bucket[i].failures = 0
+
+			return
+		}
+	}
+
+	entry := tableEntry{node: node, lastSeen: now, secure: SecureIDValid(node.ID, node.Addr.IP)}
+
+	if len(bucket) < bucketSize {
+		Table.buckets[index] = append(bucket, entry)
+		return
+	}
+
+	for i := range bucket {
+		if bucket[i].failures > 0 || now.Sub(bucket[i].lastSeen) > staleTimeout {
+			bucket[i] = entry
+			return
+		}
+	}
+
+	if !entry.secure {
+		return
+	}
+
+	for i := range bucket {
+		if !bucket[i].secure {
+			bucket[i] = entry
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+rebase moves the table to a new node ID of ours, re-sorting every node into the bucket of its
+prefix shared with the new ID. Nodes that no longer fit a full bucket are dropped.
+
+Parameters:
+  - self: Our new node ID.
+*/
+func (Table *routingTable) rebase(self [20]byte) {
+	Table.mutex.Lock()
+	defer Table.mutex.Unlock()
+
+	var entries []tableEntry
+	for i := range Table.buckets {
+		entries = append(entries, Table.buckets[i]...)
+		Table.buckets[i] = nil
+	}
+
+	Table.self = self
+
+	for _, entry := range entries {
+		index := Table.bucketIndex(entry.node.ID)
+		if index >= 0 && len(Table.buckets[index]) < bucketSize {
+			Table.buckets[index] = append(Table.buckets[index], entry)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+failed records an unanswered query, dropping the node after maxFailures in a row.
+
+Parameters:
+  - addr: Address of the node that did not answer.
+*/
+func (Table *routingTable) failed(addr *net.UDPAddr) {
+	Table.mutex.Lock()
+	defer Table.mutex.Unlock()
+
+	key := addr.String()
+
+	for b := range Table.buckets {
+		bucket := Table.buckets[b]
+
+		for i := range bucket {
+			if bucket[i].node.Addr.String() != key {
+				continue
+			}
+
+			bucket[i].failures++
+			if bucket[i].failures >= maxFailures {
+				Table.buckets[b] = append(bucket[:i], bucket[i+1:]...)
+			}
+
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+closest returns up to count known nodes closest to a target by XOR distance.
+
+Parameters:
+  - target: Target ID.
+  - count: Maximum number of nodes.
+
+Returns:
+  - []Node: Nodes, closest first.
+*/
+func (Table *routingTable) closest(target [20]byte, count int) []Node {
+	Table.mutex.Lock()
+	var nodes []Node
+	for _, bucket := range Table.buckets {
+		for _, entry := range bucket {
+			nodes = append(nodes, entry.node)
+		}
+	}
+	Table.mutex.Unlock()
+
+	sortByDistance(nodes, target)
+
+	return nodes[:min(len(nodes), count)]
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+good returns the nodes that answered their last query and were heard from recently, most
+recently seen first.
+
+Parameters:
+  - count: Maximum number of nodes.
+
+Returns:
+  - []Node: Good nodes.
+*/
+func (Table *routingTable) good(count int) []Node {
+	Table.mutex.Lock()
+	var entries []tableEntry
+	for _, bucket := range Table.buckets {
+		for _, entry := range bucket {
+			if entry.failures == 0 && time.Since(entry.lastSeen) <= staleTimeout {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	Table.mutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastSeen.After(entries[j].lastSeen)
+	})
+
+	var nodes []Node
+	for i := 0; i < len(entries) && i < count; i++ {
+		nodes = append(nodes, entries[i].node)
+	}
+
+	return nodes
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+size returns the number of nodes in the table.
+
+Returns:
+  - int: Node count.
+*/
+func (Table *routingTable) size() int {
+	Table.mutex.Lock()
+	defer Table.mutex.Unlock()
+
+	total := 0
+	for _, bucket := range Table.buckets {
+		total += len(bucket)
+	}
+
+	return total
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+encodeNodes encodes nodes in the compact "nodes" format: 20-byte ID, 4-byte IPv4 address
+and 2-byte port per node. Nodes without an IPv4 address are skipped.
+
+Parameters:
+  - nodes: Nodes to encode.
+
+Returns:
+  - string: Compact node info.
+*/
+func encodeNodes(nodes []Node) string {
+	buf := make([]byte, 0, len(nodes)*26)
+
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, node.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(node.Addr.Port))
+	}
+
+	return string(buf)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeNodes decodes compact node info as produced by encodeNodes.
+
+Parameters:
+  - nodes: Compact node info.
+
+Returns:
+  - []Node: Decoded nodes.
+*/
+func decodeNodes(nodes string) []Node {
+	var result []Node
+
+	for i := 0; i+26 <= len(nodes); i += 26 {
+		var n Node
+		copy(n.ID[:], nodes[i:i+20])
+		n.Addr = &net.UDPAddr{
+			IP:   net.IP([]byte(nodes[i+20 : i+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(nodes[i+24 : i+26]))),
+		}
+
+		result = append(result, n)
+	}
+
+	return result
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+encodeNodes6 encodes nodes in the compact "nodes6" format (BEP-32): 20-byte ID, 16-byte IPv6
+address and 2-byte port per node. Nodes with an IPv4 address are skipped.
+
+Parameters:
+  - nodes: Nodes to encode.
+
+Returns:
+  - string: Compact node info.
+*/
+func encodeNodes6(nodes []Node) string {
+	buf := make([]byte, 0, len(nodes)*38)
+
+	for _, node := range nodes {
+		if node.Addr.IP.To4() != nil || len(node.Addr.IP) != net.IPv6len {
+			continue
+		}
+
+		buf = append(buf, node.ID[:]...)
+		buf = append(buf, node.Addr.IP...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(node.Addr.Port))
+	}
+
+	return string(buf)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeNodes6 decodes compact node info as produced by encodeNodes6.
+
+Parameters:
+  - nodes: Compact node info.
+
+Returns:
+  - []Node: Decoded nodes.
+*/
+func decodeNodes6(nodes string) []Node {
+	var result []Node
+
+	for i := 0; i+38 <= len(nodes); i += 38 {
+		var n Node
+		copy(n.ID[:], nodes[i:i+20])
+		n.Addr = &net.UDPAddr{
+			IP:   net.IP([]byte(nodes[i+20 : i+36])),
+			Port: int(binary.BigEndian.Uint16([]byte(nodes[i+36 : i+38]))),
+		}
+
+		result = append(result, n)
+	}
+
+	return result
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+peerStore keeps the peers announced to us with announce_peer, so we can answer get_peers.
+
+Fields:
+  - mutex: Guards peers.
+  - peers: Compact peer ("ip:port" as 6 bytes, or 18 for IPv6) to its entry, per info hash.
+*/
+type peerStore struct {
+	mutex sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+storedPeer is an announced peer.
+
+Fields:
+  - expiry: When the announce stops being handed out.
+  - seed: The peer announced itself as a seed (BEP-33).
+*/
+type storedPeer struct {
+	expiry time.Time
+	seed   bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+const (
+	peerTTL             = 30 * time.Minute // How long an announced peer is handed out without being announced again
+	maxStoredInfoHashes = 5000             // Info hashes peers are stored for; announces for new ones are dropped beyond it
+	maxStoredPeers      = 500              // Peers stored per info hash; the one expiring first is replaced beyond it
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+add stores an announced peer. The store holds at most maxStoredInfoHashes info hashes and
+maxStoredPeers peers per info hash, so announces cannot grow it without bound: once expired
+entries are dropped, an announce for a new info hash beyond the limit is ignored and a new
+peer beyond the limit replaces the one expiring first.
+
+Parameters:
+  - infoHash: Info hash the peer announced.
+  - ip: IPv4 or IPv6 address of the peer.
+  - port: TCP port of the peer.
+  - seed: The peer announced itself as a seed.
+*/
+func (Store *peerStore) add(infoHash [20]byte, ip net.IP, port int, seed bool) {
+	if ip.To16() == nil || port <= 0 || port > 65535 {
+		return
+	}
+
+	compact := compactAddr(&net.UDPAddr{IP: ip, Port: port})
+
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	if Store.peers == nil {
+		Store.peers = make(map[[20]byte]map[string]storedPeer)
+	}
+
+	if Store.peers[infoHash] == nil {
+		if len(Store.peers) >= maxStoredInfoHashes {
+			for stored := range Store.peers {
+				Store.live(stored)
+			}
+
+			if len(Store.peers) >= maxStoredInfoHashes {
+				return
+			}
+		}
+
+		Store.peers[infoHash] = make(map[string]storedPeer)
+	}
+
+	peers := Store.peers[infoHash]
+
+	if _, known := peers[compact]; !known && len(peers) >= maxStoredPeers {
+		var oldest string
+		for stored, peer := range peers {
+			if oldest == "" || peer.expiry.Before(peers[oldest].expiry) {
+				oldest = stored
+			}
+		}
+
+		delete(peers, oldest)
+	}
+
+	peers[compact] = storedPeer{expiry: time.Now().Add(peerTTL), seed: seed}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+live returns the unexpired peers of an info hash, dropping expired ones.
+The caller must hold Store.mutex.
+
+Parameters:
+  - infoHash: Info hash to look up.
+
+Returns:
+  - map[string]storedPeer: Unexpired peers by compact address.
+*/
+func (Store *peerStore) live(infoHash [20]byte) map[string]storedPeer {
+	now := time.Now()
+
+	for compact, peer := range Store.peers[infoHash] {
+		if now.After(peer.expiry) {
+			delete(Store.peers[infoHash], compact)
+		}
+	}
+
+	if len(Store.peers[infoHash]) == 0 {
+		delete(Store.peers, infoHash)
+	}
+
+	return Store.peers[infoHash]
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+get returns up to count unexpired peers of an info hash in compact form.
+
+Parameters:
+  - infoHash: Info hash to look up.
+  - count: Maximum number of peers.
+  - noseed: Leave out peers that announced themselves as seeds (BEP-33).
+
+Returns:
+  - []string: Compact peers (6 bytes each, 18 for IPv6).
+*/
+func (Store *peerStore) get(infoHash [20]byte, count int, noseed bool) []string {
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	var values []string
+
+	for compact, peer := range Store.live(infoHash) {
+		if noseed && peer.seed {
+			continue
+		}
+
+		values = append(values, compact)
+	}
+
+	sort.Strings(values)
+
+	return values[:min(len(values), count)]
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+filters returns the bloom filters of the seeds and of the other peers of an info hash
+(BEP-33), as sent in scrape responses.
+
+Parameters:
+  - infoHash: Info hash to look up.
+
+Returns:
+  - bloomFilter: Addresses of the seeds ("BFsd").
+  - bloomFilter: Addresses of the other peers ("BFpe").
+*/
+func (Store *peerStore) filters(infoHash [20]byte) (bloomFilter, bloomFilter) {
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	var seeds, peers bloomFilter
+
+	for compact, peer := range Store.live(infoHash) {
+		ip := net.IP(compact[:len(compact)-2])
+
+		if peer.seed {
+			seeds.add(ip)
+		} else {
+			peers.add(ip)
+		}
+	}
+
+	return seeds, peers
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sample returns up to count of the info hashes peers are announced for, chosen at random,
+to answer sample_infohashes (BEP-51).
+
+Parameters:
+  - count: Maximum number of info hashes.
+
+Returns:
+  - [][20]byte: Sampled info hashes.
+  - int: Number of info hashes with unexpired peers.
+*/
+func (Store *peerStore) sample(count int) ([][20]byte, int) {
+	Store.mutex.Lock()
+	defer Store.mutex.Unlock()
+
+	for infoHash := range Store.peers {
+		Store.live(infoHash)
+	}
+
+	var hashes [][20]byte
+	for infoHash := range Store.peers {
+		hashes = append(hashes, infoHash)
+	}
+
+	rand.Shuffle(len(hashes), func(i, j int) {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	})
+
+	return hashes[:min(len(hashes), count)], len(Store.peers)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestPeerStoreLimits(t *testing.T) {
+	var store peerStore
+
+	for i := 0; i < maxStoredInfoHashes+10; i++ {
+		var infoHash [20]byte
+		infoHash[0], infoHash[1] = byte(i>>8), byte(i)
+		store.add(infoHash, net.IPv4(10, 0, 0, 1), 6881, false)
+	}
+
+	if len(store.peers) != maxStoredInfoHashes {
+		t.Errorf("stored %d info hashes, want %d", len(store.peers), maxStoredInfoHashes)
+	}
+
+	var infoHash [20]byte
+
+	for i := 0; i < maxStoredPeers+10; i++ {
+		store.add(infoHash, net.IPv4(10, 1, byte(i>>8), byte(i)), 6881, false)
+	}
+
+	if len(store.peers[infoHash]) != maxStoredPeers {
+		t.Errorf("stored %d peers, want %d", len(store.peers[infoHash]), maxStoredPeers)
+	}
+
+	// The latest announce replaced an earlier one
+	last := maxStoredPeers + 9
+	latest := compactAddr(&net.UDPAddr{IP: net.IPv4(10, 1, byte(last>>8), byte(last)), Port: 6881})
+	if _, ok := store.peers[infoHash][latest]; !ok {
+		t.Errorf("latest peer not stored")
+	}
+
+	// Expired entries make room for new info hashes
+	for stored := range store.peers {
+		for compact := range store.peers[stored] {
+			store.peers[stored][compact] = storedPeer{expiry: time.Now().Add(-time.Second)}
+		}
+	}
+
+	infoHash[19] = 1
+	store.add(infoHash, net.IPv4(10, 0, 0, 1), 6881, false)
+
+	if len(store.get(infoHash, 10, false)) != 1 || len(store.peers) != 1 {
+		t.Errorf("new info hash not stored after expiry (%d info hashes)", len(store.peers))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
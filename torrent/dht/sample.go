@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SampleResult is the answer of a node to a sample_infohashes query (BEP-51).
+
+Fields:
+  - ID: ID of the responding node.
+  - Samples: Random info hashes the node stores peers for.
+  - Num: Total number of info hashes the node stores peers for.
+  - Interval: How long to wait before querying the node again, as new samples are unlikely
+    before then.
+  - Nodes: Nodes closer to the target, to continue a crawl with.
+*/
+type SampleResult struct {
+	ID       [20]byte
+	Samples  [][20]byte
+	Num      int
+	Interval time.Duration
+	Nodes    []Node
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SampleInfohashes asks a node for a sample of the info hashes it stores peers for, to discover
+content without trackers (BEP-51). Crawlers walk the keyspace by querying the returned nodes
+with other targets, honouring each node's interval.
+
+Parameters:
+  - addr: Node to query.
+  - target: ID the returned nodes should be close to.
+
+Returns:
+  - *SampleResult: Samples, total count, interval and closer nodes.
+  - error: Non-nil if the query fails, e.g. because the node does not support BEP-51.
+*/
+func (Client *Client) SampleInfohashes(addr *net.UDPAddr, target [20]byte) (*SampleResult, error) {
+	r, err := Client.query(addr, "sample_infohashes", map[string]interface{}{
+		"target": string(target[:]),
+		"want":   Client.want(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SampleResult{}
+
+	id, _ := r["id"].(string)
+	copy(result.ID[:], id)
+
+	samples, _ := r["samples"].(string)
+	for i := 0; i+20 <= len(samples); i += 20 {
+		var sample [20]byte
+		copy(sample[:], samples[i:i+20])
+		result.Samples = append(result.Samples, sample)
+	}
+
+	num, _ := r["num"].(int64)
+	result.Num = int(num)
+
+	interval, _ := r["interval"].(int64)
+	result.Interval = time.Duration(interval) * time.Second
+
+	result.Nodes = Client.responseNodes(r)
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,178 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math"
+	"math/bits"
+	"net"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// bloomFilterBits is the size in bits of the BEP-33 scrape bloom filters.
+const bloomFilterBits = 2048
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+bloomFilter is a BEP-33 bloom filter of peer addresses: 2048 bits, two set per address.
+Filters from several nodes are merged with an OR, so a peer announced to many of them is
+only counted once.
+
+Methods:
+  - add: Adds an address.
+  - merge: Adds all addresses of another filter.
+  - size: Estimates the number of addresses added.
+*/
+type bloomFilter [bloomFilterBits / 8]byte
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+add adds an address: the first two pairs of bytes of its SHA-1, read little-endian, pick
+the bits to set.
+
+Parameters:
+  - ip: IPv4 or IPv6 address of a peer.
+*/
+func (Filter *bloomFilter) add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	sum := sha1.Sum(ip)
+
+	for _, index := range []int{int(sum[0]) | int(sum[1])<<8, int(sum[2]) | int(sum[3])<<8} {
+		index %= bloomFilterBits
+		Filter[index/8] |= 1 << (index % 8)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+merge adds all addresses of another filter.
+
+Parameters:
+  - other: Filter to merge in.
+*/
+func (Filter *bloomFilter) merge(other *bloomFilter) {
+	for i := range Filter {
+		Filter[i] |= other[i]
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+size estimates the number of distinct addresses added from the number of bits still clear.
+
+Returns:
+  - float64: Estimated address count (0 for an empty filter).
+*/
+func (Filter *bloomFilter) size() float64 {
+	zeros := 0
+	for _, b := range Filter {
+		zeros += 8 - bits.OnesCount8(b)
+	}
+
+	if zeros == bloomFilterBits {
+		return 0
+	}
+
+	zeros = max(zeros, 1)
+
+	return math.Log(float64(zeros)/bloomFilterBits) / (2 * math.Log(1-1.0/bloomFilterBits))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeBloomFilter reads a bloom filter from a get_peers response.
+
+Parameters:
+  - r: The "r" dictionary of the response.
+  - key: "BFsd" or "BFpe".
+
+Returns:
+  - *bloomFilter: The filter, or nil if missing or not 256 bytes long.
+*/
+func decodeBloomFilter(r map[string]interface{}, key string) *bloomFilter {
+	value, _ := r[key].(string)
+	if len(value) != bloomFilterBits/8 {
+		return nil
+	}
+
+	var filter bloomFilter
+	copy(filter[:], value)
+
+	return &filter
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ScrapeResult is the size of a swarm as estimated from the DHT (BEP-33).
+
+Fields:
+  - Seeders: Estimated number of seeds announced for the info hash.
+  - Leechers: Estimated number of other peers announced for it.
+  - Nodes: Number of nodes whose bloom filters were merged.
+*/
+type ScrapeResult struct {
+	Seeders  int
+	Leechers int
+	Nodes    int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Scrape estimates the size of a swarm without trackers: it looks up the nodes closest to the
+info hash like Announce, then asks the closest ones for the bloom filters of the seeds and
+peers announced to them and merges those (BEP-33). Nodes not supporting scrapes are skipped.
+
+Parameters:
+  - infoHash: Info hash of the swarm.
+  - bootstrap: Initial contacts ("host:port").
+
+Returns:
+  - *ScrapeResult: Estimated swarm size.
+  - error: Non-nil if no bootstrap contact could be resolved or no node returned filters.
+*/
+func (Client *Client) Scrape(infoHash [20]byte, bootstrap []string) (*ScrapeResult, error) {
+	_, responders, queried, err := Client.lookup(infoHash, bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds, peers bloomFilter
+	result := &ScrapeResult{}
+
+	for i := 0; i < len(responders) && i < announceCount; i++ {
+		answer, err := Client.getPeers(responders[i].Addr, infoHash, true)
+		if err != nil || answer.seeds == nil || answer.peers == nil {
+			continue
+		}
+
+		seeds.merge(answer.seeds)
+		peers.merge(answer.peers)
+		result.Nodes++
+	}
+
+	if result.Nodes == 0 {
+		return nil, fmt.Errorf("No DHT node returned scrape data for %x\n", infoHash)
+	}
+
+	result.Seeders = int(math.Round(seeds.size()))
+	result.Leechers = int(math.Round(peers.size()))
+
+	log.Printf("[INFO]\tDHT scrape for %x: %d nodes queried, %d scraped, ~%d seeders, ~%d leechers\n",
+		infoHash, queried, result.Nodes, result.Seeders, result.Leechers)
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,218 @@
+package dht
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// castagnoli is the CRC-32C table node ID prefixes are computed with (BEP-42).
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+idPrefix computes the CRC-32C a BEP-42 node ID must start with for an IP address: the masked
+address with the 3 random bits r in its top bits, hashed.
+
+Parameters:
+  - ip: IPv4 or IPv6 address of the node.
+  - r: Random value in 0-7, stored in the last byte of the node ID.
+
+Returns:
+  - uint32: The CRC-32C; its top 21 bits are the required ID prefix.
+*/
+func idPrefix(ip net.IP, r byte) uint32 {
+	mask := []byte{0x03, 0x0f, 0x3f, 0xff}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()[:8]
+		mask = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+	}
+
+	masked := make([]byte, len(ip))
+	for i := range ip {
+		masked[i] = ip[i] & mask[i]
+	}
+
+	masked[0] |= r << 5
+
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+exemptIP reports whether an address is exempt from BEP-42 checks: nodes on local networks
+do not know their external address.
+
+Parameters:
+  - ip: Address of the node.
+
+Returns:
+  - bool: True for loopback, private and link-local addresses.
+*/
+func exemptIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SecureID generates a random node ID tied to an external IP address as BEP-42 requires: its
+first 21 bits come from idPrefix and its last byte holds the random value that was hashed.
+
+Parameters:
+  - ip: Our external IP address.
+
+Returns:
+  - [20]byte: The node ID.
+  - error: Non-nil if no random bytes are available.
+*/
+func SecureID(ip net.IP) ([20]byte, error) {
+	var id [20]byte
+
+	_, err := crand.Read(id[:])
+	if err != nil {
+		return id, fmt.Errorf("Generating DHT node ID: %v\n", err)
+	}
+
+	crc := idPrefix(ip, id[19]&0x07)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+
+	return id, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SecureIDValid reports whether a node ID complies with BEP-42 for the address it was seen at.
+Addresses exempt from the check (see exemptIP) always comply.
+
+Parameters:
+  - id: Node ID.
+  - ip: Address the node was seen at.
+
+Returns:
+  - bool: True if the first 21 bits of the ID match the address.
+*/
+func SecureIDValid(id [20]byte, ip net.IP) bool {
+	if ip == nil || exemptIP(ip) {
+		return true
+	}
+
+	crc := idPrefix(ip, id[19]&0x07)
+
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SetExternalIP ties our node ID to our external IP address (BEP-42), so that nodes enforcing
+the extension keep us in their routing tables. If the current ID does not comply, a new one
+is generated and the routing table is reorganized around it.
+
+Parameters:
+  - ip: Our external IP address.
+
+Returns:
+  - error: Non-nil if no new node ID can be generated.
+*/
+func (Client *Client) SetExternalIP(ip net.IP) error {
+	if SecureIDValid(Client.nodeID(), ip) {
+		return nil
+	}
+
+	id, err := SecureID(ip)
+	if err != nil {
+		return err
+	}
+
+	Client.mutex.Lock()
+	Client.ID = id
+	Client.mutex.Unlock()
+
+	Client.table.rebase(id)
+
+	log.Printf("[INFO]\tDHT: node ID changed to %x for external IP %s\n", id, ip)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ExternalIP returns the address most responding nodes saw our queries come from, as reported
+in the "ip" key of their responses (BEP-42).
+
+Returns:
+  - net.IP: Our external IP address, or nil if no node reported it.
+*/
+func (Client *Client) ExternalIP() net.IP {
+	Client.mutex.Lock()
+	defer Client.mutex.Unlock()
+
+	var best string
+	for ip, votes := range Client.ipVotes {
+		if best == "" || votes > Client.ipVotes[best] {
+			best = ip
+		}
+	}
+
+	return net.ParseIP(best)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+recordIPVote counts the address a responding node reports seeing us at.
+
+Parameters:
+  - compact: Value of the response's "ip" key (compact IPv4 or IPv6 address and port).
+*/
+func (Client *Client) recordIPVote(compact string) {
+	if len(compact) != 6 && len(compact) != 18 {
+		return
+	}
+
+	ip := net.IP(compact[:len(compact)-2])
+	if exemptIP(ip) {
+		return
+	}
+
+	Client.mutex.Lock()
+	Client.ipVotes[ip.String()]++
+	Client.mutex.Unlock()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+compactAddr encodes an address as the "ip" key of responses: 4 or 16 address bytes followed
+by the big-endian port.
+
+Parameters:
+  - addr: Address of the querying node.
+
+Returns:
+  - string: Compact address.
+*/
+func compactAddr(addr *net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		ip = addr.IP.To16()
+	}
+
+	return string(binary.BigEndian.AppendUint16(append([]byte(nil), ip...), uint16(addr.Port)))
+}
+
+// --------------------------------------------------------------------------------------------- //
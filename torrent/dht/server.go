@@ -0,0 +1,307 @@
+package dht
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// KRPC error codes (BEP-5, BEP-44).
+const (
+	errorProtocol   = 203
+	errorMethod     = 204
+	errorTooBig     = 205
+	errorSignature  = 206
+	errorSaltTooBig = 207
+	errorCAS        = 301
+	errorSequence   = 302
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleQuery answers a KRPC query from another node and adds the node to the routing table.
+Responses tell the node the address we saw the query come from (BEP-42).
+
+Parameters:
+  - tx: Transaction ID of the query.
+  - msg: Decoded query message.
+  - from: Address the query came from.
+*/
+func (Client *Client) handleQuery(tx string, msg map[string]interface{}, from *net.UDPAddr) {
+	method, _ := msg["q"].(string)
+	args, _ := msg["a"].(map[string]interface{})
+
+	id, _ := args["id"].(string)
+	if len(id) != 20 {
+		Client.sendError(tx, from, errorProtocol, "Missing node ID")
+		return
+	}
+
+	var node Node
+	copy(node.ID[:], id)
+	node.Addr = from
+	Client.table.insert(node)
+
+	self := Client.nodeID()
+	response := map[string]interface{}{"id": string(self[:])}
+
+	switch method {
+	case "ping":
+
+	case "find_node":
+		target, ok := hashArg(args, "target")
+		if !ok {
+			Client.sendError(tx, from, errorProtocol, "Invalid target")
+			return
+		}
+
+		Client.addNodes(response, target)
+
+	case "get_peers":
+		infoHash, ok := hashArg(args, "info_hash")
+		if !ok {
+			Client.sendError(tx, from, errorProtocol, "Invalid info_hash")
+			return
+		}
+
+		response["token"] = Client.token(from.IP, false)
+
+		if scrape, _ := args["scrape"].(int64); scrape == 1 {
+			seeds, peers := Client.store.filters(infoHash)
+			response["BFsd"] = string(seeds[:])
+			response["BFpe"] = string(peers[:])
+		}
+
+		noseed, _ := args["noseed"].(int64)
+
+		values := Client.store.get(infoHash, maxValues, noseed == 1)
+		if len(values) > 0 {
+			response["values"] = values
+		} else {
+			Client.addNodes(response, infoHash)
+		}
+
+	case "announce_peer":
+		infoHash, ok := hashArg(args, "info_hash")
+		token, _ := args["token"].(string)
+		if !ok || !Client.validToken(from.IP, token) {
+			Client.sendError(tx, from, errorProtocol, "Invalid token")
+			return
+		}
+
+		port, _ := args["port"].(int64)
+		if implied, _ := args["implied_port"].(int64); implied == 1 {
+			port = int64(from.Port)
+		}
+
+		seed, _ := args["seed"].(int64)
+
+		Client.store.add(infoHash, from.IP, int(port), seed == 1)
+		log.Printf("[INFO]\tDHT: %s announced %x on port %d\n", from, infoHash, port)
+
+	case "get":
+		target, ok := hashArg(args, "target")
+		if !ok {
+			Client.sendError(tx, from, errorProtocol, "Invalid target")
+			return
+		}
+
+		response["token"] = Client.token(from.IP, false)
+		Client.addNodes(response, target)
+
+		seq, hasSeq := args["seq"].(int64)
+
+		item := Client.items.get(target)
+		if item != nil && !(hasSeq && item.Mutable() && item.Seq <= seq) {
+			response["v"] = item.Value
+
+			if item.Mutable() {
+				response["k"] = string(item.PublicKey)
+				response["sig"] = string(item.Sig)
+				response["seq"] = item.Seq
+			}
+		}
+
+	case "put":
+		token, _ := args["token"].(string)
+		if !Client.validToken(from.IP, token) {
+			Client.sendError(tx, from, errorProtocol, "Invalid token")
+			return
+		}
+
+		code, message := Client.storeItem(args)
+		if code != 0 {
+			Client.sendError(tx, from, code, message)
+			return
+		}
+
+	case "sample_infohashes":
+		target, ok := hashArg(args, "target")
+		if !ok {
+			Client.sendError(tx, from, errorProtocol, "Invalid target")
+			return
+		}
+
+		samples, num := Client.store.sample(maxSamples)
+
+		var buf []byte
+		for _, sample := range samples {
+			buf = append(buf, sample[:]...)
+		}
+
+		response["samples"] = string(buf)
+		response["num"] = num
+		response["interval"] = int(sampleInterval / time.Second)
+		Client.addNodes(response, target)
+
+	default:
+		Client.sendError(tx, from, errorMethod, "Method Unknown")
+		return
+	}
+
+	Client.send(from, map[string]interface{}{"t": tx, "y": "r", "r": response, "ip": compactAddr(from)})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+addNodes adds the routing table nodes closest to a target to a response, as "nodes" on IPv4
+and "nodes6" on IPv6 (BEP-32). Only the table of our own address family is known, so a
+"want" for the other family goes unanswered.
+
+Parameters:
+  - response: The "r" dictionary being built.
+  - target: ID or info hash the nodes should be close to.
+*/
+func (Client *Client) addNodes(response map[string]interface{}, target [20]byte) {
+	closest := Client.table.closest(target, bucketSize)
+
+	if Client.IPv6() {
+		response["nodes6"] = encodeNodes6(closest)
+	} else {
+		response["nodes"] = encodeNodes(closest)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+hashArg reads a 20-byte string argument of a query.
+
+Parameters:
+  - args: Query arguments.
+  - name: Argument name.
+
+Returns:
+  - [20]byte: The argument.
+  - bool: False if it is missing or not 20 bytes long.
+*/
+func hashArg(args map[string]interface{}, name string) ([20]byte, bool) {
+	var hash [20]byte
+
+	value, _ := args[name].(string)
+	if len(value) != 20 {
+		return hash, false
+	}
+
+	copy(hash[:], value)
+
+	return hash, true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+send encodes and sends a KRPC message; failures are only logged.
+
+Parameters:
+  - addr: Destination node.
+  - msg: Message dictionary.
+*/
+func (Client *Client) send(addr *net.UDPAddr, msg map[string]interface{}) {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		log.Printf("[ERROR]\tDHT: encoding response: %v\n", err)
+		return
+	}
+
+	_, err = Client.conn.WriteToUDP(buf.Bytes(), addr)
+	if err != nil {
+		log.Printf("[FAIL]\tDHT: sending response to %s: %v\n", addr, err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendError answers a query with a KRPC error.
+
+Parameters:
+  - tx: Transaction ID of the query.
+  - addr: Node that sent the query.
+  - code: KRPC error code.
+  - message: Error message.
+*/
+func (Client *Client) sendError(tx string, addr *net.UDPAddr, code int, message string) {
+	Client.send(addr, map[string]interface{}{"t": tx, "y": "e", "e": []interface{}{code, message}})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+token returns the announce token handed out to an IP address: a hash of the address and a
+secret that rotates every tokenRotation, so a token stays valid for one to two rotations.
+
+Parameters:
+  - ip: Address of the querying node.
+  - previous: Derive the token from the previous secret instead of the current one.
+
+Returns:
+  - string: 8-byte token.
+*/
+func (Client *Client) token(ip net.IP, previous bool) string {
+	Client.mutex.Lock()
+	if time.Since(Client.secretTime) > tokenRotation {
+		Client.previousSecret = Client.secret
+		crand.Read(Client.secret[:])
+		Client.secretTime = time.Now()
+	}
+
+	secret := Client.secret
+	if previous {
+		secret = Client.previousSecret
+	}
+	Client.mutex.Unlock()
+
+	sum := sha1.Sum(append(secret[:], ip.To16()...))
+
+	return string(sum[:8])
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+validToken reports whether a token presented with announce_peer was handed out to the IP.
+
+Parameters:
+  - ip: Address of the announcing node.
+  - token: Token from the query.
+
+Returns:
+  - bool: True if the token matches the current or previous secret.
+*/
+func (Client *Client) validToken(ip net.IP, token string) bool {
+	return token != "" && (token == Client.token(ip, false) || token == Client.token(ip, true))
+}
+
+// --------------------------------------------------------------------------------------------- //
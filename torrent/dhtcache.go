@@ -0,0 +1,117 @@
+package torrent
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"BitTorrent/torrent/dht"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// dhtNodeCacheSize is the maximum number of nodes saved to Config.DHTNodeCache.
+const dhtNodeCacheSize = 100
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+defaultDHTNodeCache returns the per-user file DHT nodes are cached in between runs.
+
+Returns:
+  - string: "<user cache dir>/BitTorrent/dht_nodes", or "" if the user cache dir is unknown.
+*/
+func defaultDHTNodeCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "BitTorrent", "dht_nodes")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+cachedDHTNodes reads the DHT nodes saved by an earlier run from Config.DHTNodeCache.
+A missing or unreadable cache yields no nodes.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Node addresses ("ip:port"), one per line of the cache file.
+*/
+func (Torrent *TorrentFile) cachedDHTNodes() []string {
+	if Torrent.Config.DHTNodeCache == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(Torrent.Config.DHTNodeCache)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[ERROR]\tReading DHT node cache: %v\n", err)
+		}
+
+		return nil
+	}
+
+	var nodes []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			nodes = append(nodes, line)
+		}
+	}
+
+	return nodes
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+saveDHTNodes writes the good nodes of DHT clients' routing tables to Config.DHTNodeCache,
+so the next run can bootstrap from nodes known to answer. IPv4 and IPv6 nodes share the file;
+each client only resolves the ones of its family. The cache is left untouched if no routing
+table has a good node. The file is written to a temporary name and renamed into place.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - clients: DHT clients that have completed a lookup.
+*/
+func (Torrent *TorrentFile) saveDHTNodes(clients ...*dht.Client) {
+	path := Torrent.Config.DHTNodeCache
+	if path == "" {
+		return
+	}
+
+	var nodes []string
+	for _, client := range clients {
+		nodes = append(nodes, client.GoodNodes(dhtNodeCacheSize)...)
+	}
+
+	if len(nodes) == 0 {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		tmp := path + ".tmp"
+
+		err = os.WriteFile(tmp, []byte(strings.Join(nodes, "\n")+"\n"), 0644)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+
+	if err != nil {
+		log.Printf("[ERROR]\tWriting DHT node cache %s: %v\n", path, err)
+		return
+	}
+
+	log.Printf("[INFO]\tSaved %d DHT nodes to %s\n", len(nodes), path)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,47 @@
+package torrent
+
+import (
+	"net"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// dialTimeout bounds how long a connection attempt to a peer may stay half-open.
+const dialTimeout = 5 * time.Second
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dialPeer opens a TCP connection to a peer, waiting first for one of the Config.MaxHalfOpen
+dial slots so that large peer lists do not leave enough connections half-open at once to
+trip the OS's SYN-flood protection. The slot is held only until the connection is
+established or fails, not for the lifetime of the connection.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the connection is for.
+  - addr: Address of the peer ("host:port").
+
+Returns:
+  - net.Conn: The established connection.
+  - error: Non-nil if the connection cannot be established.
+*/
+func (Torrent *TorrentFile) dialPeer(addr string) (net.Conn, error) {
+	Torrent.dialOnce.Do(func() {
+		if Torrent.Config.MaxHalfOpen > 0 {
+			Torrent.dialSlots = make(chan struct{}, Torrent.Config.MaxHalfOpen)
+		}
+	})
+
+	if Torrent.dialSlots != nil {
+		Torrent.dialSlots <- struct{}{}
+		defer func() { <-Torrent.dialSlots }()
+	}
+
+	Torrent.counters.halfOpen.Add(1)
+	defer Torrent.counters.halfOpen.Add(-1)
+
+	return net.DialTimeout("tcp", addr, dialTimeout)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// ltDonthaveName is the BEP-54 extension name and ltDonthaveID the ID we receive its messages with.
+const (
+	ltDonthaveName = "lt_donthave"
+	ltDonthaveID   = 4
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleDonthave processes an lt_donthave message: the peer no longer has a piece it advertised,
+so it is cleared from its bitfield. While downloading, the piece's availability is lowered and
+the peer stops counting as a seeder, as DownloadFromPeer only undoes the bits still set when
+the peer disconnects.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer retracting the piece.
+  - body: 4-byte big-endian piece index.
+
+Returns:
+  - error: Non-nil if the message is malformed.
+*/
+func (Torrent *TorrentFile) handleDonthave(peer *Peer, body []byte) error {
+	if len(body) != 4 {
+		return fmt.Errorf("Invalid lt_donthave length: %d\n", len(body))
+	}
+
+	index := int(binary.BigEndian.Uint32(body))
+	if index >= Torrent.NumPieces || !Torrent.HasPiece(peer.Bitfield, index) {
+		return nil
+	}
+
+	Torrent.setPeerPiece(peer, index, false)
+
+	if Torrent.counters.seedStart.Load() == 0 {
+		Torrent.DownloadMutex.Lock()
+		if index < len(Torrent.Availability) {
+			Torrent.Availability[index]--
+		}
+		Torrent.DownloadMutex.Unlock()
+	}
+
+	if peer.Seeder {
+		peer.Seeder = false
+		Torrent.counters.connectedSeeders.Add(-1)
+	}
+
+	logPeerf(peer, index, "[INFO]\tno longer has piece %d\n", index)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendDonthave retracts pieces we advertised but no longer have, e.g. after cache mode evicted
+them, by sending an lt_donthave message per piece to every connected peer supporting it.
+Peers without the extension keep believing we have the pieces; their requests are refused.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - pieces: Indices of the retracted pieces.
+*/
+func (Torrent *TorrentFile) sendDonthave(pieces []int) {
+	if len(pieces) == 0 {
+		return
+	}
+
+	Torrent.PeersMutex.Lock()
+	peers := make([]*Peer, len(Torrent.Peers))
+	copy(peers, Torrent.Peers)
+	Torrent.PeersMutex.Unlock()
+
+	for _, peer := range peers {
+		if !peer.supportsExtension(ltDonthaveName) {
+			continue
+		}
+
+		for _, index := range pieces {
+			err := Torrent.sendExtended(peer, ltDonthaveName, binary.BigEndian.AppendUint32(nil, uint32(index)))
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\tfailed to send lt_donthave: %v\n", err)
+				break
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
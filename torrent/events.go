@@ -0,0 +1,238 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// eventBuffer is the number of events held for a slow consumer before new ones are dropped.
+const eventBuffer = 256
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+EventType identifies what an Event reports.
+
+Values:
+  - PeerConnected: A handshake with a peer succeeded (Peer is set).
+  - PeerDisconnected: A peer's connection was closed (Peer is set).
+  - PieceCompleted: A piece was verified and written (Piece is set).
+  - PieceFailed: A downloaded piece failed its hash check (Peer and Piece are set).
+  - DownloadComplete: StartDownload finished successfully.
+  - TrackerAnnounced: An announce to a tracker succeeded (Tracker is set).
+*/
+type EventType int
+
+const (
+	PeerConnected EventType = iota
+	PeerDisconnected
+	PieceCompleted
+	PieceFailed
+	DownloadComplete
+	TrackerAnnounced
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+String returns a human-readable name for the event type.
+
+Returns:
+  - string: Event type name.
+*/
+func (Type EventType) String() string {
+	switch Type {
+	case PeerConnected:
+		return "peer connected"
+	case PeerDisconnected:
+		return "peer disconnected"
+	case PieceCompleted:
+		return "piece completed"
+	case PieceFailed:
+		return "piece failed"
+	case DownloadComplete:
+		return "download complete"
+	case TrackerAnnounced:
+		return "tracker announced"
+	default:
+		return "unknown"
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Event is a single notification delivered by Events.
+
+Fields:
+  - Type: What happened.
+  - Time: When it happened.
+  - Peer: Address of the peer ("host:port"), for peer and piece failure events.
+  - Piece: Index of the piece, for piece events (-1 otherwise).
+  - Tracker: Announce URL, for tracker events.
+*/
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Peer    string
+	Piece   int
+	Tracker string
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Events returns a channel of download events for UIs that prefer updates to polling Stats.
+The channel is buffered; events are dropped rather than blocking the download when the
+consumer falls behind, and Stats.DroppedEvents counts them. Events are only recorded from
+the first call on, so it should be made before starting the download; earlier events are
+lost without being counted. Every call returns the same channel; it is closed by Close.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to watch.
+
+Returns:
+  - <-chan Event: Channel of events.
+*/
+func (Torrent *TorrentFile) Events() <-chan Event {
+	Torrent.eventsMutex.Lock()
+	defer Torrent.eventsMutex.Unlock()
+
+	if Torrent.events == nil {
+		Torrent.events = make(chan Event, eventBuffer)
+		if Torrent.eventsClosed {
+			close(Torrent.events)
+		}
+	}
+
+	return Torrent.events
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+emit delivers an event to the Events channel without blocking.
+Nothing is done if Events was never called or the channel is closed.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - event: Event to deliver; Time is filled in.
+*/
+func (Torrent *TorrentFile) emit(event Event) {
+	Torrent.eventsMutex.Lock()
+	defer Torrent.eventsMutex.Unlock()
+
+	if Torrent.events == nil || Torrent.eventsClosed {
+		return
+	}
+
+	event.Time = time.Now()
+
+	select {
+	case Torrent.events <- event:
+	default:
+		Torrent.counters.droppedEvents.Add(1)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+closedSignal returns a channel that is closed once Close is called.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - <-chan struct{}: Channel closed by Close.
+*/
+func (Torrent *TorrentFile) closedSignal() <-chan struct{} {
+	Torrent.eventsMutex.Lock()
+	defer Torrent.eventsMutex.Unlock()
+
+	if Torrent.closed == nil {
+		Torrent.closed = make(chan struct{})
+		if Torrent.eventsClosed {
+			close(Torrent.closed)
+		}
+	}
+
+	return Torrent.closed
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+addCloser registers a listener or server for Close to shut down. It is closed at once if
+Close has already been called.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - closer: Listener or server started for the torrent.
+*/
+func (Torrent *TorrentFile) addCloser(closer io.Closer) {
+	Torrent.eventsMutex.Lock()
+	closed := Torrent.eventsClosed
+	if !closed {
+		Torrent.closers = append(Torrent.closers, closer)
+	}
+	Torrent.eventsMutex.Unlock()
+
+	if closed {
+		closer.Close()
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close stops everything running for the torrent and closes the Events channel: a running
+StartDownload is canceled (see CancelDownload) and Seed returns, which ends their PEX, LSD
+and DHT announce workers; the announcer started by RefreshPeer stops; the listener opened
+by Listen and the metrics server of ServeMetrics are closed, and every peer is disconnected.
+Close does not wait for these goroutines to return, and only Seed sends a stopped announce
+on its way out (see AnnounceStopped). Listeners passed to AcceptPeers directly and the DHT nodes shared by all
+torrents (see CloseDHT) are left to the caller. The torrent must not be downloaded or seeded
+afterwards.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to close.
+
+Returns:
+  - error: Non-nil if closing a listener or server fails.
+*/
+func (Torrent *TorrentFile) Close() error {
+	Torrent.eventsMutex.Lock()
+	if Torrent.eventsClosed {
+		Torrent.eventsMutex.Unlock()
+		return nil
+	}
+
+	Torrent.eventsClosed = true
+	if Torrent.events != nil {
+		close(Torrent.events)
+	}
+
+	if Torrent.closed != nil {
+		close(Torrent.closed)
+	}
+
+	closers := Torrent.closers
+	Torrent.closers = nil
+	Torrent.eventsMutex.Unlock()
+
+	var err error
+	for _, closer := range closers {
+		err = errors.Join(err, closer.Close())
+	}
+
+	Torrent.stopAnnouncer()
+	Torrent.CancelDownload()
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestCloseStopsWorkers(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	Torrent.OutputDir = t.TempDir()
+	Torrent.Config.ListenPort = 0
+
+	events := Torrent.Events()
+
+	listener, err := Torrent.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	Torrent.RefreshPeer()
+
+	seeded := make(chan error, 1)
+	go func() { seeded <- Torrent.Seed(context.Background()) }()
+
+	err = Torrent.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case err := <-seeded:
+		if err != nil {
+			t.Errorf("Seed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Seed still running after Close")
+	}
+
+	if _, ok := <-events; ok {
+		t.Errorf("Events channel open after Close")
+	}
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err == nil {
+		conn.Close()
+		t.Errorf("listener still accepting after Close")
+	}
+
+	Torrent.TrackersMutex.Lock()
+	announcing := Torrent.announceStop != nil
+	Torrent.TrackersMutex.Unlock()
+
+	if announcing {
+		t.Errorf("announcer still running after Close")
+	}
+
+	if err := Torrent.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// Seeding a closed torrent ends at once
+	go func() { seeded <- Torrent.Seed(context.Background()) }()
+
+	select {
+	case <-seeded:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Seed of a closed torrent did not return")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
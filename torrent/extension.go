@@ -0,0 +1,388 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// Extended is the message ID of BEP-10 extension protocol messages.
+const Extended MessageID = 20
+
+// --------------------------------------------------------------------------------------------- //
+
+// HaveAll and HaveNone are the Fast Extension (BEP-6) replacements for a full or empty Bitfield.
+const (
+	HaveAll  MessageID = 14
+	HaveNone MessageID = 15
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// extensionHandshakeID is the extended message ID reserved for the extension handshake itself.
+const extensionHandshakeID = 0
+
+// --------------------------------------------------------------------------------------------- //
+
+// utMetadataName is the BEP-9 extension name and utMetadataID the ID we receive its messages with.
+const (
+	utMetadataName = "ut_metadata"
+	utMetadataID   = 1
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+extension is a BEP-10 extension we support, as listed by extensionRegistry.
+
+Fields:
+  - Name: Extension name advertised in the handshake's "m" dictionary.
+  - ID: Extended message ID we ask peers to send the extension's messages with.
+  - Enabled: Reports whether the extension is used for a torrent (nil always enables it).
+  - Handle: Processes the body of a message received for the extension.
+*/
+type extension struct {
+	Name    string
+	ID      byte
+	Enabled func(Torrent *TorrentFile) bool
+	Handle  func(Torrent *TorrentFile, peer *Peer, body []byte) error
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+extensionRegistry lists every extension we support. A new extension plugs in by adding an
+entry here with an unused ID; the handshake and message dispatch pick it up from this list.
+
+Returns:
+  - []extension: Supported extensions.
+*/
+func extensionRegistry() []extension {
+	return []extension{
+		{Name: utMetadataName, ID: utMetadataID, Handle: (*TorrentFile).handleMetadataMessage},
+		{Name: utPexName, ID: utPexID, Enabled: (*TorrentFile).pexEnabled, Handle: (*TorrentFile).handlePex},
+		{Name: utHolepunchName, ID: utHolepunchID, Enabled: (*TorrentFile).holepunchEnabled, Handle: (*TorrentFile).handleHolepunch},
+		{Name: ltDonthaveName, ID: ltDonthaveID, Handle: (*TorrentFile).handleDonthave},
+		{Name: trHashpieceName, ID: trHashpieceID, Enabled: (*TorrentFile).IsMerkle, Handle: (*TorrentFile).handleHashpiece},
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+enabledExtensions returns the registered extensions used for the torrent.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []extension: Extensions whose Enabled function is nil or returns true.
+*/
+func (Torrent *TorrentFile) enabledExtensions() []extension {
+	var enabled []extension
+
+	for _, ext := range extensionRegistry() {
+		if ext.Enabled == nil || ext.Enabled(Torrent) {
+			enabled = append(enabled, ext)
+		}
+	}
+
+	return enabled
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+supportsExtension reports whether the peer advertised an extension in its extension handshake.
+
+Parameters:
+  - name: Extension name.
+
+Returns:
+  - bool: True if the peer gave the extension a usable message ID.
+*/
+func (peer *Peer) supportsExtension(name string) bool {
+	id := peer.Extensions[name]
+	return id > 0 && id <= 255
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendExtended sends an extension message to a peer, using the message ID the peer asked for
+in its extension handshake.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer to send the message to.
+  - name: Extension name.
+  - body: Message body following the extended message ID.
+
+Returns:
+  - error: Non-nil if the peer does not support the extension or sending fails.
+*/
+func (Torrent *TorrentFile) sendExtended(peer *Peer, name string, body []byte) error {
+	if !peer.supportsExtension(name) {
+		return fmt.Errorf("Peer %s:%d does not support %s\n", peer.IP, peer.Port, name)
+	}
+
+	payload := append([]byte{byte(peer.Extensions[name])}, body...)
+
+	return Torrent.SendMessage(peer, Message{ID: Extended, Payload: payload})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// extensionReservedByte and extensionReservedBit locate the BEP-10 support flag in the handshake's reserved bytes.
+const (
+	extensionReservedByte = 5
+	extensionReservedBit  = 0x10
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+extensionsAgreed reports whether both sides of a handshake advertised BEP-10 support.
+Other reserved bits are ignored, so peers setting bits we do not know are not rejected.
+
+Parameters:
+  - ours: Reserved bytes we sent.
+  - theirs: Reserved bytes the peer sent.
+
+Returns:
+  - bool: True if the extension handshake may be sent.
+*/
+func extensionsAgreed(ours, theirs [8]byte) bool {
+	return ours[extensionReservedByte]&theirs[extensionReservedByte]&extensionReservedBit != 0
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// fastReservedByte and fastReservedBit locate the Fast Extension (BEP-6) flag in the handshake's reserved bytes.
+const (
+	fastReservedByte = 7
+	fastReservedBit  = 0x04
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fastAgreed reports whether both sides of a handshake advertised the Fast Extension (BEP-6),
+which lets HaveAll and HaveNone stand in for the first Bitfield.
+
+Parameters:
+  - ours: Reserved bytes we sent.
+  - theirs: Reserved bytes the peer sent.
+
+Returns:
+  - bool: True if HaveAll and HaveNone may be sent.
+*/
+func fastAgreed(ours, theirs [8]byte) bool {
+	return ours[fastReservedByte]&theirs[fastReservedByte]&fastReservedBit != 0
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+extensionHandshake is the bencoded dictionary exchanged in the BEP-10 extension handshake.
+
+Fields:
+  - M: Supported extensions mapped to the message IDs the sender wants to receive them with.
+  - P: TCP port the sender listens on (may differ from the connection's source port).
+  - V: Client name and version.
+  - YourIP: Our address as seen by the sender (compact IPv4 or IPv6).
+  - MetadataSize: Size of the info dictionary, for ut_metadata (BEP-9).
+  - Reqq: Number of outstanding requests the sender supports.
+*/
+type extensionHandshake struct {
+	M            map[string]int `bencode:"m"`
+	P            int            `bencode:"p,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	MetadataSize int64          `bencode:"metadata_size,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+buildExtensionHandshake encodes our extension handshake payload (without the message ID byte).
+It advertises our listening port so peers can connect back to us, the enabled extensions of
+extensionRegistry, and the metadata size when we have the info dictionary to serve.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose configuration is advertised.
+
+Returns:
+  - []byte: Extended message payload starting with the handshake ID.
+  - error: Non-nil if encoding fails.
+*/
+func (Torrent *TorrentFile) buildExtensionHandshake() ([]byte, error) {
+	hs := extensionHandshake{
+		M: map[string]int{},
+		P: int(Torrent.Config.announcePort()),
+		V: "BitTorrent/1.0",
+	}
+
+	for _, ext := range Torrent.enabledExtensions() {
+		hs.M[ext.Name] = int(ext.ID)
+	}
+
+	if infoBytes := Torrent.metadataBytes(); infoBytes != nil {
+		hs.MetadataSize = int64(len(infoBytes))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(extensionHandshakeID)
+
+	err := bencode.Marshal(&buf, hs)
+	if err != nil {
+		return nil, fmt.Errorf("Encoding extension handshake error: %v\n", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendExtensionHandshake sends our extension handshake to a peer that advertised BEP-10 support.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer to send the handshake to.
+
+Returns:
+  - error: Non-nil if encoding or sending fails.
+*/
+func (Torrent *TorrentFile) sendExtensionHandshake(peer *Peer) error {
+	payload, err := Torrent.buildExtensionHandshake()
+	if err != nil {
+		return err
+	}
+
+	return Torrent.SendMessage(peer, Message{ID: Extended, Payload: payload})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseExtensionHandshake decodes a peer's extension handshake dictionary.
+
+Parameters:
+  - payload: Bencoded dictionary following the handshake ID byte.
+
+Returns:
+  - *extensionHandshake: Decoded handshake.
+  - error: Non-nil if the payload is not a valid dictionary.
+*/
+func parseExtensionHandshake(payload []byte) (*extensionHandshake, error) {
+	var hs extensionHandshake
+
+	err := bencode.Unmarshal(bytes.NewReader(payload), &hs)
+	if err != nil {
+		return nil, fmt.Errorf("Decoding extension handshake error: %v\n", err)
+	}
+
+	return &hs, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleExtended processes an Extended message received from a peer.
+For the extension handshake it records the peer's advertised listening port, client name,
+extensions and metadata size. Other messages are passed to the handler of the enabled
+extension owning their ID; messages for unknown IDs are ignored.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - payload: Message payload (extended message ID followed by its body).
+
+Returns:
+  - error: Non-nil if the message is malformed.
+*/
+func (Torrent *TorrentFile) handleExtended(peer *Peer, payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("Empty extended message\n")
+	}
+
+	if payload[0] != extensionHandshakeID {
+		for _, ext := range Torrent.enabledExtensions() {
+			if ext.ID == payload[0] {
+				return ext.Handle(Torrent, peer, payload[1:])
+			}
+		}
+
+		return nil
+	}
+
+	hs, err := parseExtensionHandshake(payload[1:])
+	if err != nil {
+		return err
+	}
+
+	if hs.P > 0 && hs.P <= 65535 {
+		peer.ListenPort = uint16(hs.P)
+	}
+
+	peer.Client = hs.V
+	peer.Extensions = hs.M
+	peer.MetadataSize = hs.MetadataSize
+
+	if peer.Extensions == nil {
+		peer.Extensions = map[string]int{}
+	}
+
+	logPeerf(peer, -1, "[INFO]\textension handshake, client=%q, listen port=%d\n",
+		peer.Client, peer.ListenPort)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handlePort processes a Port message, which carries the peer's DHT UDP port (BEP-5).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - payload: Message payload (2-byte big-endian port).
+*/
+func (Torrent *TorrentFile) handlePort(peer *Peer, payload []byte) {
+	if len(payload) != 2 {
+		logPeerf(peer, -1, "[ERROR]\tinvalid Port message length %d\n", len(payload))
+		return
+	}
+
+	peer.DHTPort = binary.BigEndian.Uint16(payload)
+	logPeerf(peer, -1, "[INFO]\tDHT port %d\n", peer.DHTPort)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ListenAddr returns the address to use when reconnecting to the peer or sharing it via PEX.
+It prefers the listening port advertised in the extension handshake over the connection port.
+
+Returns:
+  - string: host:port of the peer's listener.
+*/
+func (peer *Peer) ListenAddr() string {
+	port := peer.Port
+	if peer.ListenPort != 0 {
+		port = peer.ListenPort
+	}
+
+	return net.JoinHostPort(peer.IP, strconv.Itoa(int(port)))
+}
+
+// --------------------------------------------------------------------------------------------- //
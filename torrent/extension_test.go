@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// extensionBit is a reserved-bytes value with only the BEP-10 support bit set.
+var extensionBit = [8]byte{extensionReservedByte: extensionReservedBit}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAcceptHandshakeReservedBits(t *testing.T) {
+	allBits := [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	tests := []struct {
+		name      string
+		ours      [8]byte
+		theirs    [8]byte
+		extension bool
+	}{
+		{"peer without extensions", extensionBit, [8]byte{}, false},
+		{"peer with extensions", extensionBit, extensionBit, true},
+		{"peer setting unknown bits", extensionBit, allBits, true},
+		{"unknown bits only", extensionBit, [8]byte{0x80, 0, 0, 0, 0, 0x01, 0, 0x05}, false},
+		{"extensions disabled", [8]byte{}, allBits, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Torrent := newTestTorrent()
+			Torrent.Config.ReservedBits = test.ours
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listening: %v", err)
+			}
+			defer listener.Close()
+
+			accepted := make(chan error, 1)
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					accepted <- err
+					return
+				}
+
+				accepted <- Torrent.acceptHandshake(conn)
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			defer conn.Close()
+
+			request := Handshake{ProtocolNameLength: 19, Reserved: test.theirs, InfoHash: Torrent.Info.InfoHash}
+			copy(request.Protocol[:], "BitTorrent protocol")
+			copy(request.PeerID[:], "-XX0001-000000000000")
+
+			err = binary.Write(conn, binary.BigEndian, &request)
+			if err != nil {
+				t.Fatalf("sending handshake: %v", err)
+			}
+
+			var response Handshake
+			err = binary.Read(conn, binary.BigEndian, &response)
+			if err != nil {
+				t.Fatalf("reading handshake: %v", err)
+			}
+
+			// Peers are never refused for their reserved bits
+			err = <-accepted
+			if err != nil {
+				t.Fatalf("acceptHandshake: %v", err)
+			}
+
+			if response.Reserved != test.ours {
+				t.Errorf("sent reserved bytes %x, want %x", response.Reserved, test.ours)
+			}
+
+			remote := &Peer{IP: "127.0.0.1", Connection: conn}
+
+			msg, err := Torrent.readMessage(remote, 200*time.Millisecond)
+			sent := err == nil && msg != nil && msg.ID == Extended
+			if sent != test.extension {
+				t.Errorf("extension handshake sent = %v (%v), want %v", sent, err, test.extension)
+			}
+
+			if !test.extension && !errors.Is(err, errReceiveTimeout) {
+				t.Errorf("unexpected message after the handshake: %v, %v", msg, err)
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,639 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+FileEntry describes one file of a torrent independently of the metadata layout it came from.
+
+Fields:
+  - Path: Path relative to the output directory, including the torrent name for multi-file torrents.
+  - Length: Length of the file in bytes.
+  - Offset: Offset of the file's first byte in the torrent's piece space.
+  - FirstPiece: Index of the first piece containing data of this file (-1 for empty files).
+  - LastPiece: Index of the last piece containing data of this file (-1 for empty files).
+  - Pad: True for BEP-47 padding files, which hold only zeros and are not written to disk.
+  - Executable: True for files with the BEP-47 'x' attribute, made executable once complete.
+*/
+type FileEntry struct {
+	Path       string
+	Length     int64
+	Offset     int64
+	FirstPiece int
+	LastPiece  int
+	Pad        bool
+	Executable bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+v2File is a file collected from a BEP-52 "file tree".
+
+Fields:
+  - path: Path components below the torrent name.
+  - length: Length of the file in bytes.
+  - piecesRoot: Merkle root of the file's piece layer.
+  - symlink: Target path components relative to the torrent root, for BEP-47 symlink entries (nil otherwise).
+  - executable: True if the BEP-47 "attr" contains 'x'.
+*/
+type v2File struct {
+	path       []string
+	length     int64
+	piecesRoot string
+	symlink    []string
+	executable bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+walkFileTree flattens a BEP-52 file tree into a list of files in key order.
+A file is a dictionary whose "" key holds its length and pieces root, and optionally the
+BEP-47 "attr" key; symlinks (attr containing 'l') also carry a "symlink path".
+
+Parameters:
+  - tree: The (sub)tree to walk.
+  - prefix: Path components leading to tree.
+
+Returns:
+  - []v2File: Files found under tree, sorted by path.
+*/
+func walkFileTree(tree map[string]interface{}, prefix []string) []v2File {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var files []v2File
+
+	for _, key := range keys {
+		node, ok := tree[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		path := append(append([]string(nil), prefix...), key)
+
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			length, _ := leaf["length"].(int64)
+			root, _ := leaf["pieces root"].(string)
+			file := v2File{path: path, length: length, piecesRoot: root}
+
+			attr, _ := leaf["attr"].(string)
+			file.executable = strings.Contains(attr, "x")
+
+			components, _ := leaf["symlink path"].([]interface{})
+			if strings.Contains(attr, "l") || len(components) > 0 {
+				file.symlink = []string{}
+				for _, component := range components {
+					part, _ := component.(string)
+					file.symlink = append(file.symlink, part)
+				}
+			}
+
+			files = append(files, file)
+
+			continue
+		}
+
+		files = append(files, walkFileTree(node, path)...)
+	}
+
+	return files
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pieceRange returns the first and last piece overlapping a byte range.
+
+Parameters:
+  - offset: Offset of the range in the piece space.
+  - length: Length of the range.
+  - pieceLength: Length of a piece.
+
+Returns:
+  - int: First piece index (-1 if the range is empty).
+  - int: Last piece index (-1 if the range is empty).
+*/
+func pieceRange(offset, length, pieceLength int64) (int, int) {
+	if length <= 0 || pieceLength <= 0 {
+		return -1, -1
+	}
+
+	return int(offset / pieceLength), int((offset + length - 1) / pieceLength)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ListFiles returns the torrent's files as a uniform list, whatever the metadata layout.
+Single-file and multi-file v1 torrents use the "length"/"files" keys; v2-only torrents use
+the "file tree", where every file starts on a piece boundary. Hybrid torrents use the v1 layout.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to describe.
+
+Returns:
+  - []FileEntry: Files in piece-space order.
+*/
+func (Torrent *TorrentFile) ListFiles() []FileEntry {
+	pieceLength := Torrent.Info.PieceLength
+	var entries []FileEntry
+
+	switch {
+	case len(Torrent.Info.Files) > 0:
+		var offset int64
+
+		for _, file := range Torrent.Info.Files {
+			parts := append([]string{Torrent.Info.Name}, file.Path...)
+			first, last := pieceRange(offset, file.Length, pieceLength)
+
+			entries = append(entries, FileEntry{
+				Path:       filepath.Join(parts...),
+				Length:     file.Length,
+				Offset:     offset,
+				FirstPiece: first,
+				LastPiece:  last,
+				Pad:        isPadFile(file),
+				Executable: strings.Contains(file.Attr, "x"),
+			})
+
+			offset += file.Length
+		}
+
+	case len(Torrent.Info.Pieces) == 0 && len(Torrent.Info.FileTree) > 0:
+		files := walkFileTree(Torrent.Info.FileTree, nil)
+		single := len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == Torrent.Info.Name
+		var offset int64
+
+		for _, file := range files {
+			path := filepath.Join(append([]string{Torrent.Info.Name}, file.path...)...)
+			if single {
+				path = Torrent.Info.Name
+			}
+
+			first, last := pieceRange(offset, file.length, pieceLength)
+
+			entries = append(entries, FileEntry{
+				Path:       path,
+				Length:     file.length,
+				Offset:     offset,
+				FirstPiece: first,
+				LastPiece:  last,
+				Executable: file.executable,
+			})
+
+			if pieceLength > 0 {
+				offset += (file.length + pieceLength - 1) / pieceLength * pieceLength
+			}
+		}
+
+	default:
+		first, last := pieceRange(0, Torrent.Info.Length, pieceLength)
+
+		entries = append(entries, FileEntry{
+			Path:       Torrent.Info.Name,
+			Length:     Torrent.Info.Length,
+			Offset:     0,
+			FirstPiece: first,
+			LastPiece:  last,
+		})
+	}
+
+	return entries
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SelectFiles restricts the download to the given files.
+Only pieces overlapping a selected file are requested; a piece shared with a deselected
+neighbour is still downloaded in full. Paths are those reported by ListFiles.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to configure.
+  - paths: Paths of the files to download.
+
+Returns:
+  - error: Non-nil if a path does not name a file of the torrent.
+*/
+func (Torrent *TorrentFile) SelectFiles(paths []string) error {
+	err := Torrent.InitializePieces()
+	if err != nil {
+		return err
+	}
+
+	entries := Torrent.ListFiles()
+	byPath := make(map[string]FileEntry, len(entries))
+	for _, entry := range entries {
+		byPath[entry.Path] = entry
+	}
+
+	selected := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if _, ok := byPath[filepath.Clean(path)]; !ok {
+			return fmt.Errorf("File %s is not part of the torrent\n", path)
+		}
+
+		selected[filepath.Clean(path)] = true
+	}
+
+	fileWanted := make([]bool, len(entries))
+	for i, entry := range entries {
+		fileWanted[i] = selected[entry.Path]
+	}
+
+	Torrent.DownloadMutex.Lock()
+	Torrent.fileWanted = fileWanted
+	Torrent.Wanted = wantedPieces(entries, fileWanted, Torrent.NumPieces)
+	Torrent.DownloadMutex.Unlock()
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SelectFileIndices restricts the download to the files at the given indices, like SelectFiles.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to configure.
+  - indices: Indices of the files to download, in ListFiles order.
+
+Returns:
+  - error: Non-nil if an index is out of range.
+*/
+func (Torrent *TorrentFile) SelectFileIndices(indices []int) error {
+	entries := Torrent.ListFiles()
+
+	paths := make([]string, 0, len(indices))
+	for _, index := range indices {
+		if index < 0 || index >= len(entries) {
+			return fmt.Errorf("File index %d out of range (torrent has %d files)\n", index, len(entries))
+		}
+
+		paths = append(paths, entries[index].Path)
+	}
+
+	return Torrent.SelectFiles(paths)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+DeselectFile stops downloading one file while a download is running.
+Pieces lying only in deselected files are no longer requested; pieces shared with a
+still-selected neighbour keep being downloaded in full. The completion target shrinks
+accordingly. With remove set, the partially written file is deleted unless a selected
+neighbour still needs its boundary bytes to verify a shared piece. Its handle is swapped for
+one discarding writes under Torrent.DownloadMutex, which every write and seeding read holds.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - index: Index of the file in ListFiles order.
+  - remove: Delete the file from disk.
+
+Returns:
+  - error: Non-nil if the index is out of range or the file cannot be removed.
+*/
+func (Torrent *TorrentFile) DeselectFile(index int, remove bool) error {
+	entries := Torrent.ListFiles()
+	if index < 0 || index >= len(entries) {
+		return fmt.Errorf("File index %d out of range (torrent has %d files)\n", index, len(entries))
+	}
+
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	if Torrent.fileWanted == nil {
+		Torrent.fileWanted = make([]bool, len(entries))
+		for i := range Torrent.fileWanted {
+			Torrent.fileWanted[i] = true
+		}
+	}
+
+	Torrent.fileWanted[index] = false
+	Torrent.Wanted = wantedPieces(entries, Torrent.fileWanted, Torrent.NumPieces)
+	Torrent.notifyPieces()
+
+	log.Printf("[INFO]\tDeselected %s, %d pieces still wanted\n", entries[index].Path, Torrent.Wanted.Count())
+
+	if !remove || entries[index].Pad || index >= len(Torrent.Files) {
+		return nil
+	}
+
+	entry := entries[index]
+	for i := entry.FirstPiece; i >= 0 && i <= entry.LastPiece; i++ {
+		if Torrent.Wanted.Has(i) {
+			logPeerf(nil, i, "[INFO]\tKeeping %s: piece %d is shared with a selected file\n", entry.Path, i)
+			return nil
+		}
+	}
+
+	for i := entry.FirstPiece; i >= 0 && i <= entry.LastPiece; i++ {
+		Torrent.Downloaded.Clear(i)
+	}
+
+	file := &Torrent.Files[index]
+	if file.Handle != nil {
+		file.Handle.Close()
+		file.Handle = discardHandle{}
+	}
+
+	err := os.Remove(file.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove deselected file %s: %v\n", file.Path, err)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+wantedPieces returns the pieces overlapping at least one selected file.
+Padding files do not count: a piece made only of padding is never requested.
+
+Parameters:
+  - entries: Files in ListFiles order.
+  - fileWanted: Selection state per entry.
+  - numPieces: Total number of pieces.
+
+Returns:
+  - BitSet: Pieces to download.
+*/
+func wantedPieces(entries []FileEntry, fileWanted []bool, numPieces int) BitSet {
+	wanted := NewBitSet(numPieces)
+
+	for i, entry := range entries {
+		if !fileWanted[i] || entry.Pad {
+			continue
+		}
+
+		for piece := entry.FirstPiece; piece >= 0 && piece <= entry.LastPiece; piece++ {
+			wanted.Set(piece)
+		}
+	}
+
+	return wanted
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+HasPieceLocal reports whether a piece has been downloaded and verified locally.
+It is safe to call while a download is running.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to query.
+  - index: Index of the piece.
+
+Returns:
+  - bool: True if the piece is on disk.
+*/
+func (Torrent *TorrentFile) HasPieceLocal(index int) bool {
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	return Torrent.Downloaded.Has(index)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+HasByteRange reports whether every byte in [start, end) of the torrent's piece space has been
+downloaded and verified locally. An empty range is always available.
+It is safe to call while a download is running.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to query.
+  - start: Offset of the first byte.
+  - end: Offset one past the last byte.
+
+Returns:
+  - bool: True if all pieces covering the range are on disk.
+*/
+func (Torrent *TorrentFile) HasByteRange(start, end int64) bool {
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	return Torrent.hasByteRangeLocked(start, end)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+hasByteRangeLocked is HasByteRange for callers holding Torrent.DownloadMutex.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to query.
+  - start: Offset of the first byte.
+  - end: Offset one past the last byte.
+
+Returns:
+  - bool: True if all pieces covering the range are on disk.
+*/
+func (Torrent *TorrentFile) hasByteRangeLocked(start, end int64) bool {
+	if start >= end {
+		return true
+	}
+
+	first, last := pieceRange(start, end-start, Torrent.PieceLength)
+	if first < 0 || start < 0 {
+		return false
+	}
+
+	for i := first; i <= last; i++ {
+		if !Torrent.Downloaded.Has(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+symlinkEntries returns the BEP-47 symlinks of the torrent, from the "files" list when there
+is one (v1 and hybrid torrents) and from the v2 file tree otherwise.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to inspect.
+
+Returns:
+  - []v2File: Symlinks with their path and target below the torrent root.
+  - error: Non-nil if a v1 symlink entry claims to hold data.
+*/
+func (Torrent *TorrentFile) symlinkEntries() ([]v2File, error) {
+	var links []v2File
+
+	if len(Torrent.Info.Files) == 0 {
+		for _, file := range walkFileTree(Torrent.Info.FileTree, nil) {
+			if file.symlink != nil {
+				links = append(links, file)
+			}
+		}
+
+		return links, nil
+	}
+
+	for _, entry := range Torrent.Info.Files {
+		if !isSymlinkEntry(entry) {
+			continue
+		}
+
+		if entry.Length != 0 {
+			return nil, fmt.Errorf("Symlink %q has a length of %d bytes\n", entry.Path, entry.Length)
+		}
+
+		links = append(links, v2File{path: entry.Path, symlink: append([]string{}, entry.SymlinkPath...)})
+	}
+
+	return links, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+createSymlinks creates the BEP-47 symlink entries of the torrent below the torrent's
+directory. Symlinks carry no data, so they are created directly instead of downloaded.
+Links and their targets are resolved relative to the torrent root and must stay inside it,
+and no regular file of the torrent may lie at or below a link, so nothing is written
+through one. Links are written as paths relative to their own directory. An existing link
+with the same target is left alone.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - outputDir: Directory the torrent is downloaded to.
+  - created: Receives the directories and links created, for cleanup after a failure.
+
+Returns:
+  - error: Non-nil if a link or its target escapes the torrent directory, a file would be
+    written through a link, or a link cannot be created.
+*/
+func (Torrent *TorrentFile) createSymlinks(outputDir string, created *[]string) error {
+	links, err := Torrent.symlinkEntries()
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(outputDir, Torrent.Info.Name)
+	linkPaths := make(map[string]struct{}, len(links))
+
+	for _, file := range links {
+		linkPath := filepath.Join(append([]string{root}, file.path...)...)
+		if len(file.path) == 0 || !insideDir(root, linkPath) || linkPath == root {
+			return fmt.Errorf("Symlink %q is outside the torrent directory\n", file.path)
+		}
+
+		linkPaths[linkPath] = struct{}{}
+	}
+
+	// A regular file at or below a link would be opened, and truncated, through it
+	for _, file := range Torrent.Files {
+		if file.Symlink || file.Pad {
+			continue
+		}
+
+		for dir := file.Path; insideDir(root, dir) && dir != root; dir = filepath.Dir(dir) {
+			if _, isLink := linkPaths[dir]; isLink {
+				return fmt.Errorf("File %s would be written through symlink %s\n", file.Path, dir)
+			}
+		}
+	}
+
+	for _, file := range links {
+		linkPath := filepath.Join(append([]string{root}, file.path...)...)
+		target := filepath.Join(append([]string{root}, file.symlink...)...)
+
+		if len(file.symlink) == 0 || !insideDir(root, target) {
+			return fmt.Errorf("Symlink %s points outside the torrent directory: %q\n", linkPath, file.symlink)
+		}
+
+		linkTarget, err := filepath.Rel(filepath.Dir(linkPath), target)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve symlink target %s: %v\n", target, err)
+		}
+
+		existing, readErr := os.Readlink(linkPath)
+		if readErr == nil && existing == linkTarget {
+			continue
+		}
+
+		dir := filepath.Dir(linkPath)
+		newDirs := missingDirs(dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Failed to create directory %s: %v\n", dir, err)
+		}
+
+		*created = append(*created, newDirs...)
+
+		if readErr == nil {
+			os.Remove(linkPath)
+		} else if _, statErr := os.Lstat(linkPath); !errors.Is(statErr, os.ErrNotExist) {
+			return fmt.Errorf("Cannot create symlink %s: a file with that name exists\n", linkPath)
+		}
+
+		err = os.Symlink(linkTarget, linkPath)
+		if err != nil {
+			return fmt.Errorf("Failed to create symlink %s: %v\n", linkPath, err)
+		}
+
+		*created = append(*created, linkPath)
+		log.Printf("[INFO]\tCreated symlink %s -> %s\n", linkPath, linkTarget)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isSymlinkEntry reports whether a file entry of a multi-file torrent is a BEP-47 symlink.
+The "attr" key should contain 'l', but an entry that only carries a "symlink path" is
+treated as a link too, so it is never created as a regular file.
+
+Parameters:
+  - entry: File entry from the "files" list.
+
+Returns:
+  - bool: True if the entry is a symlink.
+*/
+func isSymlinkEntry(entry TorrentFileEntry) bool {
+	return strings.Contains(entry.Attr, "l") || len(entry.SymlinkPath) > 0
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+insideDir reports whether path is dir or lies below it, both being cleaned absolute or
+relative paths of the same kind.
+
+Parameters:
+  - dir: Directory that must contain path.
+  - path: Path to check.
+
+Returns:
+  - bool: True if path does not escape dir.
+*/
+func insideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,210 @@
+package torrent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newSymlinkTorrent returns a multi-file torrent with the given file entries, its files
+built below a temporary output directory.
+
+Parameters:
+  - t: Test the torrent belongs to.
+  - files: Entries of the "files" list.
+
+Returns:
+  - *TorrentFile: Torrent with Files built.
+  - string: Output directory.
+*/
+func newSymlinkTorrent(t *testing.T, files ...TorrentFileEntry) (*TorrentFile, string) {
+	t.Helper()
+
+	Torrent := newTestTorrent()
+	Torrent.Info.Name = "content"
+	Torrent.Info.Length = 0
+	Torrent.Info.Files = files
+
+	outputDir := t.TempDir()
+
+	err := Torrent.BuildFileInfo(outputDir)
+	if err != nil {
+		t.Fatalf("BuildFileInfo: %v", err)
+	}
+
+	return Torrent, outputDir
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestCreateSymlinks(t *testing.T) {
+	Torrent, outputDir := newSymlinkTorrent(t,
+		TorrentFileEntry{Length: 4 * 16384, Path: []string{"data", "a.bin"}},
+		TorrentFileEntry{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"data", "a.bin"}},
+		TorrentFileEntry{Path: []string{"data", "unmarked"}, SymlinkPath: []string{"data", "a.bin"}},
+	)
+
+	if Torrent.Files[0].Symlink || !Torrent.Files[1].Symlink || !Torrent.Files[2].Symlink {
+		t.Fatalf("Symlink flags = %v %v %v, want false true true", Torrent.Files[0].Symlink, Torrent.Files[1].Symlink, Torrent.Files[2].Symlink)
+	}
+
+	var created []string
+
+	err := Torrent.createSymlinks(outputDir, &created)
+	if err != nil {
+		t.Fatalf("createSymlinks: %v", err)
+	}
+
+	for path, want := range map[string]string{"link": filepath.Join("data", "a.bin"), filepath.Join("data", "unmarked"): "a.bin"} {
+		got, err := os.Readlink(filepath.Join(outputDir, "content", path))
+		if err != nil || got != want {
+			t.Errorf("link %s -> %q (%v), want %q", path, got, err, want)
+		}
+	}
+
+	// A second run leaves the existing links alone
+	created = nil
+
+	err = Torrent.createSymlinks(outputDir, &created)
+	if err != nil || len(created) != 0 {
+		t.Errorf("second createSymlinks created %v (%v)", created, err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestCreateSymlinksRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []TorrentFileEntry
+	}{
+		{"target outside", []TorrentFileEntry{
+			{Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"..", "..", "etc", "passwd"}},
+		}},
+		{"link outside", []TorrentFileEntry{
+			{Length: 16384, Path: []string{"a.bin"}},
+			{Path: []string{"..", "escaped"}, Attr: "l", SymlinkPath: []string{"a.bin"}},
+		}},
+		{"link is the root", []TorrentFileEntry{
+			{Length: 16384, Path: []string{"a.bin"}},
+			{Path: []string{"."}, Attr: "l", SymlinkPath: []string{"a.bin"}},
+		}},
+		{"file through link", []TorrentFileEntry{
+			{Path: []string{"dir"}, Attr: "l", SymlinkPath: []string{"data"}},
+			{Length: 16384, Path: []string{"dir", "x.bin"}},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Torrent, outputDir := newSymlinkTorrent(t, test.files...)
+
+			var created []string
+
+			err := Torrent.createSymlinks(outputDir, &created)
+			if err == nil {
+				t.Fatalf("createSymlinks accepted the torrent")
+			}
+
+			if len(created) != 0 {
+				t.Errorf("createSymlinks created %v before failing", created)
+			}
+
+			if _, err := os.Lstat(filepath.Join(outputDir, "escaped")); err == nil {
+				t.Errorf("link created outside the torrent directory")
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDeselectFileDuringWrites(t *testing.T) {
+	Torrent := newCacheTorrent(t)
+	path := Torrent.Files[0].Path
+
+	stream := Torrent.newPieceStream(0)
+	done := make(chan error)
+
+	// Blocks keep arriving for a.bin while it is deselected and removed
+	go func() {
+		for begin := int64(0); begin < 16384; begin += 1024 {
+			err := stream.write(begin, make([]byte, 1024))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	err := Torrent.DeselectFile(0, true)
+	if err != nil {
+		t.Fatalf("DeselectFile: %v", err)
+	}
+
+	err = <-done
+	if err != nil {
+		t.Errorf("write after deselecting: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("deselected file still exists (%v)", err)
+	}
+
+	if Torrent.Downloaded.Has(0) || Torrent.Wanted.Has(0) || !Torrent.Wanted.Has(2) {
+		t.Errorf("piece states after deselecting: downloaded %v, wanted %v %v", Torrent.Downloaded.Has(0), Torrent.Wanted.Has(0), Torrent.Wanted.Has(2))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestBuildFileInfoDuplicatePaths(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Info.Name = "content"
+	Torrent.Info.Length = 0
+	Torrent.Info.Files = []TorrentFileEntry{
+		{Length: 16384, Path: []string{"dir", "a.bin"}},
+		{Length: 16384, Path: []string{"dir", "a.bin"}},
+		{Length: 16384, Path: []string{"dir", "a (1).bin"}},
+		{Length: 16384, Path: []string{"dir", ".", "a.bin"}},
+	}
+
+	outputDir := t.TempDir()
+
+	err := Torrent.BuildFileInfo(outputDir)
+	if err == nil {
+		t.Fatalf("BuildFileInfo accepted duplicate paths")
+	}
+
+	if len(Torrent.Files) != 0 {
+		t.Errorf("rejected torrent kept %d files", len(Torrent.Files))
+	}
+
+	Torrent.Config.DuplicatePaths = DuplicatePathsRename
+
+	err = Torrent.BuildFileInfo(outputDir)
+	if err != nil {
+		t.Fatalf("BuildFileInfo: %v", err)
+	}
+
+	dir := filepath.Join(outputDir, "content", "dir")
+	want := []string{"a.bin", "a (1).bin", "a (1) (1).bin", "a (2).bin"}
+
+	if len(Torrent.Files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(Torrent.Files), len(want))
+	}
+
+	for i, name := range want {
+		file := Torrent.Files[i]
+		if file.Path != filepath.Join(dir, name) || file.Offset != int64(i)*16384 {
+			t.Errorf("file %d = %s at %d, want %s at %d", i, file.Path, file.Offset, name, i*16384)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,64 @@
+package torrent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// routeGateway is the RTF_GATEWAY flag of routes in /proc/net/route.
+const routeGateway = 0x2
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+defaultGateway reads the IPv4 default gateway from the kernel routing table.
+
+Returns:
+  - net.IP: Address of the default gateway.
+  - error: Non-nil if the routing table cannot be read or has no default route.
+*/
+func defaultGateway() (net.IP, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // Header line
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&routeGateway == 0 {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+
+		// The kernel prints the address in host byte order
+		gateway := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+
+		return gateway, nil
+	}
+
+	return nil, fmt.Errorf("No default route in /proc/net/route")
+}
+
+// --------------------------------------------------------------------------------------------- //
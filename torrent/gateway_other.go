@@ -0,0 +1,29 @@
+//go:build !linux
+
+package torrent
+
+import (
+	"net"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+defaultGateway guesses the IPv4 default gateway. Only Linux exposes the routing table here,
+so elsewhere the first address of the /24 holding our default-route address is assumed, which
+is what most home routers use.
+
+Returns:
+  - net.IP: Probable address of the default gateway.
+  - error: Non-nil if no default route exists.
+*/
+func defaultGateway() (net.IP, error) {
+	local, err := localAddrTo(net.IPv4(192, 0, 2, 1))
+	if err != nil {
+		return nil, err
+	}
+
+	return net.IPv4(local[0], local[1], local[2], 1).To4(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
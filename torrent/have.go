@@ -0,0 +1,235 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// maxHavesPerBatch caps the Have messages sent to one peer per flush; the rest wait for the next one.
+const maxHavesPerBatch = 64
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+broadcastHaves announces newly completed pieces to every connected peer.
+Completions are collected for Config.HaveBatchInterval and then sent to each peer as one
+write containing all its Have messages, so a burst of completed pieces does not compete
+with Request traffic message by message. At most maxHavesPerBatch Haves go to a peer per
+flush, and pieces the peer already has are skipped. A zero interval flushes after every piece.
+The function returns once completed is closed and everything queued has been sent.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - completed: Indexes of pieces as they are written to disk.
+*/
+func (Torrent *TorrentFile) broadcastHaves(completed <-chan int) {
+	var pending []int
+	sent := make(map[*Peer]int)
+
+	var tick <-chan time.Time
+	if Torrent.Config.HaveBatchInterval > 0 {
+		ticker := time.NewTicker(Torrent.Config.HaveBatchInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case index, ok := <-completed:
+			if !ok {
+				for Torrent.flushHaves(pending, sent) {
+				}
+
+				return
+			}
+
+			pending = append(pending, index)
+			if tick == nil {
+				Torrent.flushHaves(pending, sent)
+			}
+
+		case <-tick:
+			Torrent.flushHaves(pending, sent)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+flushHaves sends every connected peer the next batch of pending Haves it has not been sent yet.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - pending: Completed pieces in completion order.
+  - sent: Number of pending entries already handled per peer; updated in place.
+
+Returns:
+  - bool: True if some peer still has queued Haves after this flush.
+*/
+func (Torrent *TorrentFile) flushHaves(pending []int, sent map[*Peer]int) bool {
+	Torrent.PeersMutex.Lock()
+	peers := make([]*Peer, len(Torrent.Peers))
+	copy(peers, Torrent.Peers)
+	Torrent.PeersMutex.Unlock()
+
+	connected := make(map[*Peer]bool, len(peers))
+	backlog := false
+
+	for _, peer := range peers {
+		connected[peer] = true
+
+		next := sent[peer]
+		end := min(next+maxHavesPerBatch, len(pending))
+		if next >= end {
+			continue
+		}
+
+		var haves []Message
+
+		for _, index := range pending[next:end] {
+			if Torrent.peerHasPiece(peer, index) {
+				continue
+			}
+
+			haves = append(haves, Message{ID: Have, Payload: binary.BigEndian.AppendUint32(nil, uint32(index))})
+		}
+
+		sent[peer] = end
+		if end < len(pending) {
+			backlog = true
+		}
+
+		if len(haves) == 0 || peer.Connection == nil {
+			continue
+		}
+
+		err := Torrent.sendMessages(peer, haves)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tfailed to send %d Have messages: %v\n", len(haves), err)
+			continue
+		}
+
+		logPeerf(peer, -1, "[INFO]\tsent %d Have messages\n", len(haves))
+	}
+
+	for peer := range sent {
+		if !connected[peer] {
+			delete(sent, peer)
+		}
+	}
+
+	return backlog
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendBitfield tells a newly connected peer which pieces we have, as the first message after
+the handshake: a Bitfield, or HaveAll/HaveNone when the Fast Extension was agreed and we have
+every piece or none. Pieces completed later reach the peer as Have messages (see
+broadcastHaves). Nothing is sent while the metadata is unknown, as there is no piece count yet.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the peer connected for.
+  - peer: Peer that has just completed the handshake.
+  - fast: Whether both sides advertised the Fast Extension (see fastAgreed).
+
+Returns:
+  - error: Non-nil if the message could not be sent.
+*/
+func (Torrent *TorrentFile) sendBitfield(peer *Peer, fast bool) error {
+	Torrent.DownloadMutex.Lock()
+	count := Torrent.Downloaded.Count()
+	bitfield := append([]byte(nil), Torrent.Downloaded.Bytes()...)
+	Torrent.DownloadMutex.Unlock()
+
+	if Torrent.NumPieces == 0 || len(bitfield) == 0 {
+		return nil
+	}
+
+	msg := Message{ID: Bitfield, Payload: bitfield}
+	if fast && count == Torrent.NumPieces {
+		msg = Message{ID: HaveAll}
+	} else if fast && count == 0 {
+		msg = Message{ID: HaveNone}
+	}
+
+	return Torrent.SendMessage(peer, msg)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setBitfield replaces a peer's bitfield. Only the goroutine serving the peer changes its
+bitfield; the lock keeps the change from racing with other goroutines reading it through
+peerHasPiece, such as flushHaves.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the peer belongs to.
+  - peer: Peer whose bitfield changes.
+  - bitfield: New bitfield.
+*/
+func (Torrent *TorrentFile) setBitfield(peer *Peer, bitfield []byte) {
+	Torrent.bitfieldMutex.Lock()
+	defer Torrent.bitfieldMutex.Unlock()
+
+	peer.Bitfield = bitfield
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setPeerPiece marks one piece as held or not held in a peer's bitfield, allocating an empty
+bitfield first if the peer has none. Indexes outside the torrent are ignored.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the peer belongs to.
+  - peer: Peer whose bitfield changes.
+  - index: Index of the piece.
+  - has: Whether the peer now has the piece.
+*/
+func (Torrent *TorrentFile) setPeerPiece(peer *Peer, index int, has bool) {
+	Torrent.bitfieldMutex.Lock()
+	defer Torrent.bitfieldMutex.Unlock()
+
+	if peer.Bitfield == nil {
+		peer.Bitfield = make([]byte, (Torrent.NumPieces+7)/8)
+	}
+
+	if index < 0 || index/8 >= len(peer.Bitfield) {
+		return
+	}
+
+	if has {
+		peer.Bitfield[index/8] |= 1 << (7 - index%8)
+	} else {
+		peer.Bitfield[index/8] &^= 1 << (7 - index%8)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+peerHasPiece is HasPiece on a peer's bitfield for goroutines other than the one serving
+the peer.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the peer belongs to.
+  - peer: Peer to check.
+  - index: Index of the piece.
+
+Returns:
+  - bool: True if the peer has the piece.
+*/
+func (Torrent *TorrentFile) peerHasPiece(peer *Peer, index int) bool {
+	Torrent.bitfieldMutex.Lock()
+	defer Torrent.bitfieldMutex.Unlock()
+
+	return Torrent.HasPiece(peer.Bitfield, index)
+}
+
+// --------------------------------------------------------------------------------------------- //
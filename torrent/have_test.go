@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestFlushHavesSkipsHeldPieces(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+	Torrent.Peers = []*Peer{peer}
+	Torrent.setPeerPiece(peer, 1, true)
+	atomic.StoreInt64(&peer.lastSent, time.Now().Add(-keepAliveInterval).UnixNano())
+
+	sent := make(map[*Peer]int)
+	if Torrent.flushHaves([]int{0, 1, 2}, sent) {
+		t.Errorf("flushHaves reported a backlog for three Haves")
+	}
+
+	var got []int
+	for len(got) < 2 {
+		msg, err := Torrent.readMessage(remote, time.Second)
+		if err != nil {
+			t.Fatalf("reading Have: %v", err)
+		}
+
+		if msg != nil && msg.ID == Have {
+			got = append(got, int(binary.BigEndian.Uint32(msg.Payload)))
+		}
+	}
+
+	if got[0] != 0 || got[1] != 2 {
+		t.Errorf("Haves sent for pieces %v, want [0 2]", got)
+	}
+
+	// The batch counts as traffic, so no keep-alive is due right after it
+	if idle := time.Since(time.Unix(0, atomic.LoadInt64(&peer.lastSent))); idle > time.Second {
+		t.Errorf("connection idle for %s after sending the Haves", idle)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestFlushHavesConcurrentBitfield(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	// No connection: flushHaves only reads the bitfield while the peer's goroutine changes it
+	peer := &Peer{IP: "10.0.0.1", Port: 6881}
+	Torrent.Peers = []*Peer{peer}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 1000; i++ {
+			Torrent.setPeerPiece(peer, i%Torrent.NumPieces, i%2 == 0)
+			if i%100 == 0 {
+				Torrent.setBitfield(peer, Torrent.fullBitfield(false))
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		Torrent.flushHaves([]int{i % Torrent.NumPieces}, make(map[*Peer]int))
+	}
+
+	wg.Wait()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestHandshakeSendsBitfield(t *testing.T) {
+	fast := extensionBit
+	fast[fastReservedByte] |= fastReservedBit
+
+	tests := []struct {
+		name     string
+		reserved [8]byte
+		inbound  []int
+		inMsg    Message
+		outMsg   Message
+	}{
+		{"bitfield", extensionBit, []int{1}, Message{ID: Bitfield, Payload: []byte{0x40}}, Message{ID: Bitfield, Payload: []byte{0x00}}},
+		{"fast extension", fast, []int{0, 1, 2, 3}, Message{ID: HaveAll}, Message{ID: HaveNone}},
+		{"fast extension, some pieces", fast, []int{3}, Message{ID: Bitfield, Payload: []byte{0x10}}, Message{ID: HaveNone}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newSide := func(pieces []int) *TorrentFile {
+				Torrent := newTestTorrent()
+				Torrent.Config.ReservedBits = test.reserved
+				Torrent.Config.Encryption = EncryptionDisabled
+				Torrent.Config.FilterSelfPeers = false
+
+				err := Torrent.InitializePieces()
+				if err != nil {
+					t.Fatalf("InitializePieces: %v", err)
+				}
+
+				for _, index := range pieces {
+					Torrent.Downloaded.Set(index)
+				}
+
+				return Torrent
+			}
+
+			inbound, outbound := newSide(test.inbound), newSide(nil)
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listening: %v", err)
+			}
+			defer listener.Close()
+
+			accepted := make(chan error, 1)
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					accepted <- err
+					return
+				}
+
+				accepted <- inbound.acceptHandshake(conn)
+			}()
+
+			port := listener.Addr().(*net.TCPAddr).Port
+
+			_, err = outbound.PerformHandshake(Peer{IP: "127.0.0.1", Port: uint16(port)})
+			if err != nil {
+				t.Fatalf("PerformHandshake: %v", err)
+			}
+
+			err = <-accepted
+			if err != nil {
+				t.Fatalf("acceptHandshake: %v", err)
+			}
+
+			defer inbound.Peers[0].Connection.Close()
+			defer outbound.Peers[0].Connection.Close()
+
+			// Each side's first message after the handshake tells what it has
+			sides := []struct {
+				name string
+				from *TorrentFile
+				peer *Peer
+				want Message
+			}{
+				{"inbound", outbound, outbound.Peers[0], test.inMsg},
+				{"outbound", inbound, inbound.Peers[0], test.outMsg},
+			}
+
+			for _, side := range sides {
+				msg, err := side.from.readMessage(side.peer, time.Second)
+				if err != nil || msg == nil || msg.ID != side.want.ID || !bytes.Equal(msg.Payload, side.want.Payload) {
+					t.Errorf("%s side sent %v (%v) first, want %v", side.name, msg, err, side.want)
+				}
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,36 @@
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// fallocPunchHole is FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE.
+const fallocPunchHole = 0x02 | 0x01
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+punchHole deallocates a byte range of a file without changing its size; the range reads
+back as zeros. Handles that are not regular files (benchmark mode) are left alone.
+
+Parameters:
+  - handle: File to release space in.
+  - offset: Offset of the range in the file.
+  - length: Length of the range in bytes.
+
+Returns:
+  - error: Non-nil if the filesystem cannot punch holes.
+*/
+func punchHole(handle FileHandle, offset, length int64) error {
+	f, ok := handle.(*os.File)
+	if !ok {
+		return nil
+	}
+
+	return syscall.Fallocate(int(f.Fd()), fallocPunchHole, offset, length)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package torrent
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+punchHole would deallocate a byte range of a file. Only Linux supports it here, so on other
+systems evicted pieces keep their disk space until the file is deleted.
+
+Parameters:
+  - handle: File to release space in.
+  - offset: Offset of the range in the file.
+  - length: Length of the range in bytes.
+
+Returns:
+  - error: Always nil.
+*/
+func punchHole(handle FileHandle, offset, length int64) error {
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,363 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// utHolepunchName is the BEP-55 extension name and utHolepunchID the ID we receive its messages with.
+const (
+	utHolepunchName = "ut_holepunch"
+	utHolepunchID   = 3
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// Holepunch message types: a rendezvous asks the relay to introduce us to a peer, a connect
+// tells both sides to dial each other, and an error reports why a rendezvous failed.
+const (
+	holepunchRendezvous byte = 0x00
+	holepunchConnect    byte = 0x01
+	holepunchError      byte = 0x02
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// Holepunch error codes carried by holepunchError messages.
+const (
+	holepunchNoSuchPeer   uint32 = 1 // The target endpoint is invalid
+	holepunchNotConnected uint32 = 2 // The relay is not connected to the target
+	holepunchNoSupport    uint32 = 3 // The target does not support ut_holepunch
+	holepunchNoSelf       uint32 = 4 // The target is the peer sending the rendezvous
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+holepunchMessage is a decoded ut_holepunch message.
+
+Fields:
+  - Type: holepunchRendezvous, holepunchConnect or holepunchError.
+  - Addr: Endpoint ("host:port") the message is about.
+  - Err: Error code of holepunchError messages (0 otherwise).
+*/
+type holepunchMessage struct {
+	Type byte
+	Addr string
+	Err  uint32
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+holepunchEnabled reports whether ut_holepunch rendezvous are relayed and requested.
+Like PEX, it reveals peer addresses, so private torrents never use it (see baseTiers).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True if Config.Holepunch is set and the torrent is not private.
+*/
+func (Torrent *TorrentFile) holepunchEnabled() bool {
+	return Torrent.Config.Holepunch && Torrent.Info.Private != 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+encodeHolepunch encodes a ut_holepunch message: type, address type (0 for IPv4, 1 for IPv6),
+address, port and error code.
+
+Parameters:
+  - msg: Message to encode.
+
+Returns:
+  - []byte: Message body following the extended message ID.
+  - error: Non-nil if msg.Addr is not a valid IP address and port.
+*/
+func encodeHolepunch(msg holepunchMessage) ([]byte, error) {
+	compact, ok := compactPeer(msg.Addr)
+	if !ok {
+		return nil, fmt.Errorf("Invalid holepunch address %q\n", msg.Addr)
+	}
+
+	addrType := byte(0)
+	if len(compact) == 18 {
+		addrType = 1
+	}
+
+	body := append([]byte{msg.Type, addrType}, compact...)
+	body = binary.BigEndian.AppendUint32(body, msg.Err)
+
+	return body, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeHolepunch decodes the body of a ut_holepunch message.
+
+Parameters:
+  - body: Message body following the extended message ID.
+
+Returns:
+  - holepunchMessage: Decoded message.
+  - error: Non-nil if the message is truncated or has an unknown address type.
+*/
+func decodeHolepunch(body []byte) (holepunchMessage, error) {
+	var msg holepunchMessage
+
+	if len(body) < 2 {
+		return msg, fmt.Errorf("Holepunch message too short: %d bytes\n", len(body))
+	}
+
+	ipLength := 0
+	switch body[1] {
+	case 0:
+		ipLength = net.IPv4len
+	case 1:
+		ipLength = net.IPv6len
+	default:
+		return msg, fmt.Errorf("Unknown holepunch address type %d\n", body[1])
+	}
+
+	if len(body) < 2+ipLength+2+4 {
+		return msg, fmt.Errorf("Holepunch message too short: %d bytes\n", len(body))
+	}
+
+	ip := net.IP(body[2 : 2+ipLength])
+	port := binary.BigEndian.Uint16(body[2+ipLength:])
+
+	msg.Type = body[0]
+	msg.Addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	msg.Err = binary.BigEndian.Uint32(body[2+ipLength+2:])
+
+	return msg, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendHolepunch sends a ut_holepunch message to a peer.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer that advertised ut_holepunch in its extension handshake.
+  - msg: Message to send.
+
+Returns:
+  - error: Non-nil if encoding or sending fails.
+*/
+func (Torrent *TorrentFile) sendHolepunch(peer *Peer, msg holepunchMessage) error {
+	body, err := encodeHolepunch(msg)
+	if err != nil {
+		return err
+	}
+
+	return Torrent.sendExtended(peer, utHolepunchName, body)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleHolepunch processes a ut_holepunch message. As a relay, a rendezvous is answered by
+sending a connect message to both the sender and the target; as a target or initiator, a
+connect message makes us dial the given peer, so that both sides open the connection at the
+same time through their NATs.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - body: Message body following the extended message ID.
+
+Returns:
+  - error: Non-nil if the message is malformed or a reply cannot be sent.
+*/
+func (Torrent *TorrentFile) handleHolepunch(peer *Peer, body []byte) error {
+	if !Torrent.holepunchEnabled() {
+		return nil
+	}
+
+	msg, err := decodeHolepunch(body)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case holepunchRendezvous:
+		return Torrent.relayHolepunch(peer, msg.Addr)
+
+	case holepunchConnect:
+		host, portStr, _ := net.SplitHostPort(msg.Addr)
+		port, _ := strconv.Atoi(portStr)
+
+		logPeerf(peer, -1, "[INFO]\tholepunch connect to %s\n", msg.Addr)
+
+		Torrent.PeersMutex.Lock()
+		connected := Torrent.connectedTo(msg.Addr)
+		Torrent.PeersMutex.Unlock()
+
+		if !connected {
+			go Torrent.ConnectToPeers([]Peer{{IP: host, Port: uint16(port)}})
+		}
+
+	case holepunchError:
+		logPeerf(peer, -1, "[INFO]\tholepunch to %s failed with error %d\n", msg.Addr, msg.Err)
+
+	default:
+		logPeerf(peer, -1, "[INFO]\tignoring unknown holepunch message type %d\n", msg.Type)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+relayHolepunch answers a rendezvous from a peer wanting to connect to target: both peers get a
+connect message with the other's endpoint, or the sender gets an error if we cannot relay.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer that sent the rendezvous.
+  - target: Endpoint the peer wants to connect to.
+
+Returns:
+  - error: Non-nil if a message cannot be sent.
+*/
+func (Torrent *TorrentFile) relayHolepunch(peer *Peer, target string) error {
+	from := peer.ListenAddr()
+
+	var relayed *Peer
+	code := holepunchNotConnected
+
+	Torrent.PeersMutex.Lock()
+	for _, p := range Torrent.Peers {
+		if p.ListenAddr() == target {
+			relayed = p
+			break
+		}
+	}
+	Torrent.PeersMutex.Unlock()
+
+	switch {
+	case target == from:
+		code = holepunchNoSelf
+	case relayed != nil && !relayed.supportsExtension(utHolepunchName):
+		code = holepunchNoSupport
+	case relayed != nil:
+		code = 0
+	}
+
+	if code != 0 {
+		logPeerf(peer, -1, "[INFO]\tcannot relay holepunch to %s, error %d\n", target, code)
+		return Torrent.sendHolepunch(peer, holepunchMessage{Type: holepunchError, Addr: target, Err: code})
+	}
+
+	log.Printf("[INFO]\tRelaying holepunch between %s and %s\n", from, target)
+
+	err := Torrent.sendHolepunch(relayed, holepunchMessage{Type: holepunchConnect, Addr: from})
+	if err != nil {
+		return err
+	}
+
+	return Torrent.sendHolepunch(peer, holepunchMessage{Type: holepunchConnect, Addr: target})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+requestHolepunch asks a connected peer to relay a rendezvous with a peer we could not dial.
+The peer that told us about the address through PEX is preferred, as it is known to be
+connected to it; otherwise any peer supporting ut_holepunch is asked. Each address is only
+tried once, so a failed holepunch does not make us retry in a loop.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - target: Peer whose connection attempt failed.
+*/
+func (Torrent *TorrentFile) requestHolepunch(target Peer) {
+	if !Torrent.holepunchEnabled() {
+		return
+	}
+
+	addr := target.ListenAddr()
+	if _, ok := compactPeer(addr); !ok {
+		return
+	}
+
+	Torrent.PeersMutex.Lock()
+
+	if Torrent.holepunched == nil {
+		Torrent.holepunched = make(map[string]bool)
+	}
+
+	if Torrent.holepunched[addr] || Torrent.connectedTo(addr) {
+		Torrent.PeersMutex.Unlock()
+		return
+	}
+
+	var relay *Peer
+	for _, p := range Torrent.Peers {
+		if !p.supportsExtension(utHolepunchName) {
+			continue
+		}
+
+		if p == Torrent.pexKnown[addr].peer {
+			relay = p
+			break
+		}
+
+		if relay == nil {
+			relay = p
+		}
+	}
+
+	if relay != nil {
+		Torrent.holepunched[addr] = true
+	}
+
+	Torrent.PeersMutex.Unlock()
+
+	if relay == nil {
+		return
+	}
+
+	log.Printf("[INFO]\tAsking peer %s:%d to relay a holepunch to %s\n", relay.IP, relay.Port, addr)
+
+	err := Torrent.sendHolepunch(relay, holepunchMessage{Type: holepunchRendezvous, Addr: addr})
+	if err != nil {
+		logPeerf(relay, -1, "[ERROR]\tsending holepunch rendezvous: %v", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+connectedTo reports whether a peer with the given listen address is connected.
+The caller must hold PeersMutex.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - addr: Listen address ("host:port") of the peer.
+
+Returns:
+  - bool: True if the peer is in Torrent.Peers.
+*/
+func (Torrent *TorrentFile) connectedTo(addr string) bool {
+	for _, p := range Torrent.Peers {
+		if p.ListenAddr() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
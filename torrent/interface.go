@@ -1,5 +1,12 @@
 package torrent
 
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
 // --------------------------------------------------------------------------------------------- //
 
 /*
@@ -15,6 +22,9 @@ Returns:
 */
 func SetTorrentFile(path string) (*TorrentFile, error) {
 	var Torrent TorrentFile
+	Torrent.Config = DefaultConfig()
+	Torrent.SourcePath = path
+
 	err := Parse(&Torrent, path)
 	if err != nil {
 		return nil, err
@@ -26,25 +36,68 @@ func SetTorrentFile(path string) (*TorrentFile, error) {
 // --------------------------------------------------------------------------------------------- //
 
 /*
-FindConnections contacts the tracker and retrieves a list of peers.
+FindConnections contacts the trackers and connects to the peers they return.
 
-It sends a tracker request using the given TorrentFile metadata,
-then parses the compact peer list received in the response.
+It announces to all trackers at the same time (see announceAll) and dials the peers of each
+tracker as soon as it answers, so the first peers are connected while slower trackers are
+still being waited for. Trackers may come from "announce", "announce-list" or both. If no
+tracker yields peers, or the torrent lists none at all, peers are looked up in the DHT when
+it may be used. It returns once every peer found has been dialed.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile for which to find peers.
 
 Returns:
-  - []Peer: List of peers extracted from the tracker response.
-  - error: Non-nil if tracker communication or peer parsing fails.
+  - []Peer: List of peers found (they have already been dialed).
+  - error: Non-nil if no peers could be found, or if the torrent has no trackers and the DHT is disabled.
 */
 func FindConnections(Torrent *TorrentFile) ([]Peer, error) {
-	response, err := Torrent.SendTrackerResponse()
+	var wg sync.WaitGroup
+	dialed := make(map[string]bool)
+
+	ctx, cancel := Torrent.announceContext()
+	defer cancel()
+
+	response, err := Torrent.announceAll(ctx, EventNone, func(resp *TrackerResponse) {
+		peers, _ := Torrent.responsePeers(resp)
+
+		var fresh []Peer
+		for _, peer := range peers {
+			if !dialed[peer.ListenAddr()] {
+				dialed[peer.ListenAddr()] = true
+				fresh = append(fresh, peer)
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Torrent.ConnectToPeers(fresh)
+		}()
+	})
+	wg.Wait()
+
+	if err != nil && Torrent.dhtEnabled() {
+		log.Printf("[INFO]\tNo peers from trackers (%v), trying the DHT\n", err)
+
+		peers, dhtErr := Torrent.dhtPeers()
+		if dhtErr == nil && len(peers) > 0 {
+			Torrent.ConnectToPeers(peers)
+			return peers, nil
+		}
+
+		return nil, fmt.Errorf("No peers from trackers (%v) or the DHT (%v)\n", err, dhtErr)
+	}
+
+	if errors.Is(err, errNoTrackers) {
+		return nil, fmt.Errorf("Torrent lists no trackers and the DHT is disabled\n")
+	}
+
 	if err != nil {
 		return nil, err
 	}
 
-	allPeers, err := Torrent.ParsePeers(response.Peers)
+	allPeers, err := Torrent.responsePeers(response)
 	if err != nil {
 		return nil, err
 	}
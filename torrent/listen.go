@@ -0,0 +1,234 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Listen opens a TCP listener on Config.ListenPort and accepts inbound peer connections on it
+in the background (see AcceptPeers), so peers that cannot be dialed can still reach us.
+Closing the returned listener, or the torrent, stops accepting.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to accept peers for.
+
+Returns:
+  - net.Listener: The listener accepting peers.
+  - error: Non-nil if the port cannot be listened on.
+*/
+func (Torrent *TorrentFile) Listen() (net.Listener, error) {
+	addr := net.JoinHostPort("", strconv.Itoa(int(Torrent.Config.ListenPort)))
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Listening for peers on %s: %v\n", addr, err)
+	}
+
+	log.Printf("[INFO]\tAccepting peers on %s\n", listener.Addr())
+
+	Torrent.addCloser(listener)
+	go Torrent.AcceptPeers(listener)
+
+	return listener, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+AcceptPeers accepts inbound peer connections on listener until it is closed.
+Every connection that completes the handshake for this torrent is added to Torrent.Peers,
+where a running download or Seed picks it up, unless the peer is already connected or
+Config.MaxInboundPeers inbound peers are (see inboundRefused).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to accept peers for.
+  - listener: Listener for inbound TCP connections.
+*/
+func (Torrent *TorrentFile) AcceptPeers(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[INFO]\tStopped accepting peers on %s: %v\n", listener.Addr(), err)
+			return
+		}
+
+		go func() {
+			err := Torrent.acceptHandshake(conn)
+			if err != nil {
+				log.Printf("[FAIL]\tInbound connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+acceptHandshake answers the handshake of an inbound connection, sends our bitfield (see
+sendBitfield) and registers the peer. The connection may start with an MSE handshake (see
+mseAccept). Connections for another torrent, from banned IPs, from a PeerID already connected
+or beyond Config.MaxInboundPeers are refused (see inboundRefused).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to accept peers for.
+  - conn: Inbound TCP connection.
+
+Returns:
+  - error: Non-nil if the handshake is invalid, for another torrent, or from a refused peer.
+*/
+func (Torrent *TorrentFile) acceptHandshake(conn net.Conn) error {
+	protocol := "BitTorrent protocol"
+
+	conn, err := Torrent.mseAccept(conn)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var request Handshake
+	err = binary.Read(conn, binary.BigEndian, &request)
+	if err != nil {
+		return fmt.Errorf("Reading handshake error: %v\n", err)
+	}
+
+	if request.ProtocolNameLength != 19 || string(request.Protocol[:]) != protocol {
+		return fmt.Errorf("Invalid protocol in handshake\n")
+	}
+
+	if !bytes.Equal(request.InfoHash[:], Torrent.Info.InfoHash[:]) {
+		return fmt.Errorf("Info hash mismatch in handshake\n")
+	}
+
+	host, portStr, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	if Torrent.isBanned(host) {
+		return fmt.Errorf("Peer is banned for sending corrupt data\n")
+	}
+
+	Torrent.PeersMutex.Lock()
+	err = Torrent.inboundRefused(string(request.PeerID[:]))
+	Torrent.PeersMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	peerID, err := Torrent.PeerID()
+	if err != nil {
+		return err
+	}
+
+	var response Handshake
+	response.ProtocolNameLength = byte(len(protocol))
+	copy(response.Protocol[:], protocol)
+	response.Reserved = Torrent.Config.ReservedBits
+	response.InfoHash = Torrent.Info.InfoHash
+	copy(response.PeerID[:], peerID)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	err = binary.Write(conn, binary.BigEndian, &response)
+	if err != nil {
+		return fmt.Errorf("Sending handshake error: %v\n", err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("[INFO]\tAccepted handshake from %s, PeerID=%s\n", conn.RemoteAddr(), string(request.PeerID[:]))
+
+	accepted := &Peer{
+		IP:         host,
+		Port:       uint16(port),
+		PeerID:     string(request.PeerID[:]),
+		Connection: conn,
+		Encrypted:  isEncrypted(conn),
+		Inbound:    true,
+		State:      newPeerState(),
+	}
+
+	err = Torrent.sendBitfield(accepted, fastAgreed(response.Reserved, request.Reserved))
+	if err != nil {
+		return fmt.Errorf("Sending bitfield error: %v\n", err)
+	}
+
+	// Checked again while adding the peer, as other handshakes may have finished meanwhile
+	Torrent.PeersMutex.Lock()
+	err = Torrent.inboundRefused(accepted.PeerID)
+	if err == nil {
+		Torrent.Peers = append(Torrent.Peers, accepted)
+	}
+	Torrent.PeersMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	Torrent.counters.connectedPeers.Add(1)
+
+	if extensionsAgreed(response.Reserved, request.Reserved) {
+		err = Torrent.sendExtensionHandshake(accepted)
+		if err != nil {
+			log.Printf("[ERROR]\t%s: %v", conn.RemoteAddr(), err)
+		}
+	}
+
+	Torrent.emit(Event{Type: PeerConnected, Peer: accepted.ListenAddr(), Piece: -1})
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+inboundRefused checks whether an inbound peer that completed its handshake may be added: a
+PeerID already in Torrent.Peers is a second connection to the same peer, and no more than
+Config.MaxInboundPeers peers that connected to us are kept. It must be called with
+Torrent.PeersMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to accept peers for.
+  - peerID: PeerID from the peer's handshake.
+
+Returns:
+  - error: Non-nil if the peer must be refused.
+*/
+func (Torrent *TorrentFile) inboundRefused(peerID string) error {
+	inbound := 0
+
+	for _, peer := range Torrent.Peers {
+		if peer.PeerID == peerID {
+			return fmt.Errorf("Peer %q is already connected\n", peerID)
+		}
+
+		if peer.Inbound {
+			inbound++
+		}
+	}
+
+	limit := Torrent.Config.MaxInboundPeers
+	if limit > 0 && inbound >= limit {
+		return fmt.Errorf("Inbound peer limit of %d reached\n", limit)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAcceptHandshakeRefusesPeers(t *testing.T) {
+	const peerID = "-XX0001-000000000000"
+
+	tests := []struct {
+		name    string
+		limit   int
+		peers   []*Peer
+		wantErr string
+	}{
+		{"accepted", 2, []*Peer{{PeerID: "-XX0001-111111111111", Inbound: true}}, ""},
+		{"no limit", 0, []*Peer{{PeerID: "-XX0001-111111111111", Inbound: true}}, ""},
+		{"duplicate peer ID", 0, []*Peer{{PeerID: peerID}}, "already connected"},
+		{"inbound limit", 1, []*Peer{{PeerID: "-XX0001-111111111111", Inbound: true}}, "limit of 1 reached"},
+		{"outbound peers not counted", 1, []*Peer{{PeerID: "-XX0001-111111111111"}}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Torrent := newTestTorrent()
+			Torrent.Config.MaxInboundPeers = test.limit
+			Torrent.Config.Encryption = EncryptionDisabled
+			Torrent.Peers = test.peers
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listening: %v", err)
+			}
+			defer listener.Close()
+
+			accepted := make(chan error, 1)
+
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					accepted <- err
+					return
+				}
+				defer conn.Close()
+
+				accepted <- Torrent.acceptHandshake(conn)
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatalf("dialing: %v", err)
+			}
+			defer conn.Close()
+
+			request := Handshake{ProtocolNameLength: 19, InfoHash: Torrent.Info.InfoHash}
+			copy(request.Protocol[:], "BitTorrent protocol")
+			copy(request.PeerID[:], peerID)
+
+			err = binary.Write(conn, binary.BigEndian, &request)
+			if err != nil {
+				t.Fatalf("sending handshake: %v", err)
+			}
+
+			err = <-accepted
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Errorf("acceptHandshake = %v, want nil", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Errorf("acceptHandshake = %v, want an error containing %q", err, test.wantErr)
+			}
+
+			registered := len(Torrent.Peers) == len(test.peers)+1
+			if registered != (test.wantErr == "") {
+				t.Errorf("%d peers registered, started with %d", len(Torrent.Peers), len(test.peers))
+			}
+
+			if registered && !Torrent.Peers[len(Torrent.Peers)-1].Inbound {
+				t.Errorf("accepted peer not marked inbound")
+			}
+		})
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,230 @@
+package torrent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+LogFormat selects how SetLogOutput formats log lines.
+
+Values:
+  - LogText: The usual "[INFO]\t..." lines prefixed with date and time.
+  - LogJSON: One JSON object per event with level, time, peer, piece and message fields.
+*/
+type LogFormat int
+
+const (
+	LogText LogFormat = iota
+	LogJSON
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// jsonOutput is the writer SetLogOutput installed for LogJSON, nil while logging text
+var jsonOutput atomic.Pointer[jsonLogWriter]
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SetLogOutput directs the package's log output (the standard logger) to out in the given format.
+The format applies to the whole process, as the standard logger does.
+
+Parameters:
+  - out: Destination of log lines.
+  - format: LogText or LogJSON.
+*/
+func SetLogOutput(out io.Writer, format LogFormat) {
+	if format == LogJSON {
+		writer := &jsonLogWriter{out: out}
+
+		log.SetFlags(0)
+		log.SetOutput(writer)
+		jsonOutput.Store(writer)
+
+		return
+	}
+
+	jsonOutput.Store(nil)
+	log.SetFlags(log.LstdFlags)
+	log.SetOutput(out)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+logPeerf logs an event about a peer and, optionally, one of its pieces. As text the line reads
+"[INFO]\tPeer ip:port: message"; as JSON the address and the piece index are set in their own
+fields rather than recovered from the message.
+
+Parameters:
+  - peer: Peer the event is about (nil for none).
+  - piece: Piece index the event is about (-1 for none).
+  - format: Severity tag and message, as for log.Printf.
+  - args: Arguments of format.
+*/
+func logPeerf(peer *Peer, piece int, format string, args ...any) {
+	tag, message := splitLogTag(fmt.Sprintf(format, args...))
+
+	writer := jsonOutput.Load()
+	if writer == nil {
+		if peer != nil {
+			message = fmt.Sprintf("Peer %s:%d: %s", peer.IP, peer.Port, message)
+		}
+
+		log.Output(2, tag+"\t"+message)
+
+		return
+	}
+
+	entry := jsonLogEntry{Level: logLevel(tag), Message: strings.TrimSpace(message)}
+	if peer != nil {
+		entry.Peer = net.JoinHostPort(peer.IP, strconv.Itoa(int(peer.Port)))
+	}
+
+	if piece >= 0 {
+		entry.Piece = &piece
+	}
+
+	writer.writeEntry(entry)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+jsonLogEntry is one log event as written by jsonLogWriter.
+
+Fields:
+  - Level: Severity taken from the "[INFO]", "[FAIL]" or "[ERROR]" tag.
+  - Time: Time the event was logged.
+  - Peer: Peer address ("ip:port") the event is about, if logged with logPeerf.
+  - Piece: Piece index the event is about, if logged with logPeerf.
+  - Message: Log text without the severity tag.
+*/
+type jsonLogEntry struct {
+	Level   string `json:"level"`
+	Time    string `json:"time"`
+	Peer    string `json:"peer,omitempty"`
+	Piece   *int   `json:"piece,omitempty"`
+	Message string `json:"message"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+jsonLogWriter turns the text lines written by the standard logger into JSON objects.
+
+Fields:
+  - out: Destination of the JSON lines.
+  - mutex: Serializes writes to out.
+*/
+type jsonLogWriter struct {
+	out   io.Writer
+	mutex sync.Mutex
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Write formats one log event as a JSON line with its level and message.
+
+Parameters:
+  - line: Text of the event as produced by the log package.
+
+Returns:
+  - int: len(line) on success.
+  - error: Non-nil if writing to the destination fails.
+*/
+func (Writer *jsonLogWriter) Write(line []byte) (int, error) {
+	tag, message := splitLogTag(strings.TrimRight(string(line), "\n"))
+
+	err := Writer.writeEntry(jsonLogEntry{Level: logLevel(tag), Message: strings.TrimSpace(message)})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(line), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+writeEntry stamps an entry with the current time and writes it as one JSON line.
+
+Parameters:
+  - entry: Event to write.
+
+Returns:
+  - error: Non-nil if writing to the destination fails.
+*/
+func (Writer *jsonLogWriter) writeEntry(entry jsonLogEntry) error {
+	entry.Time = time.Now().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	Writer.mutex.Lock()
+	defer Writer.mutex.Unlock()
+
+	_, err = Writer.out.Write(append(data, '\n'))
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+splitLogTag separates the severity tag from a log line.
+
+Parameters:
+  - text: Log line, e.g. "[INFO]\tmessage".
+
+Returns:
+  - string: The tag ("[INFO]" if the line has none).
+  - string: The rest of the line.
+*/
+func splitLogTag(text string) (string, string) {
+	for _, tag := range []string{"[INFO]", "[FAIL]", "[ERROR]"} {
+		if strings.HasPrefix(text, tag) {
+			return tag, strings.TrimLeft(strings.TrimPrefix(text, tag), "\t ")
+		}
+	}
+
+	return "[INFO]", text
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+logLevel maps a severity tag to the level of a JSON log entry.
+
+Parameters:
+  - tag: "[INFO]", "[FAIL]" or "[ERROR]".
+
+Returns:
+  - string: "info", "warning" or "error".
+*/
+func logLevel(tag string) string {
+	switch tag {
+	case "[FAIL]":
+		return "warning"
+	case "[ERROR]":
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
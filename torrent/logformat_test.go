@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+captureLog directs the log output to a buffer in the given format until the test ends.
+
+Parameters:
+  - t: Test the output belongs to.
+  - format: LogText or LogJSON.
+
+Returns:
+  - *bytes.Buffer: Buffer receiving the log lines.
+*/
+func captureLog(t *testing.T, format LogFormat) *bytes.Buffer {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	SetLogOutput(buf, format)
+	t.Cleanup(func() { SetLogOutput(os.Stderr, LogText) })
+
+	return buf
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestLogJSONFields(t *testing.T) {
+	buf := captureLog(t, LogJSON)
+	peer := &Peer{IP: "10.0.0.1", Port: 6881}
+
+	logPeerf(peer, 7, "[ERROR]\tpiece %d hash mismatch\n", 7)
+	logPeerf(nil, -1, "[FAIL]\tno peers\n")
+	log.Printf("[INFO]\tPeer 10.0.0.2:1: Piece 3 seen in the text only\n")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d JSON lines, want 3:\n%s", len(lines), buf.String())
+	}
+
+	var entries [3]jsonLogEntry
+	for i, line := range lines {
+		err := json.Unmarshal([]byte(line), &entries[i])
+		if err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+
+		if entries[i].Time == "" {
+			t.Errorf("line %q has no time", line)
+		}
+	}
+
+	if entries[0].Level != "error" || entries[0].Peer != "10.0.0.1:6881" || entries[0].Piece == nil || *entries[0].Piece != 7 || entries[0].Message != "piece 7 hash mismatch" {
+		t.Errorf("peer event logged as %+v", entries[0])
+	}
+
+	if entries[1].Level != "warning" || entries[1].Peer != "" || entries[1].Piece != nil {
+		t.Errorf("event without peer logged as %+v", entries[1])
+	}
+
+	// Fields are never guessed from the message text
+	if entries[2].Level != "info" || entries[2].Peer != "" || entries[2].Piece != nil {
+		t.Errorf("plain log line logged as %+v", entries[2])
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestLogTextPeer(t *testing.T) {
+	buf := captureLog(t, LogText)
+
+	logPeerf(&Peer{IP: "10.0.0.1", Port: 6881}, 2, "[INFO]\tdownloaded piece %d\n", 2)
+
+	if !strings.HasSuffix(buf.String(), "[INFO]\tPeer 10.0.0.1:6881: downloaded piece 2\n") {
+		t.Errorf("text line = %q", buf.String())
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// lsdGroup is the IPv4 multicast group and port of Local Service Discovery (BEP-14).
+const lsdGroup = "239.192.152.143:6771"
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+lsdEnabled reports whether the torrent may be announced with Local Service Discovery.
+Never for private torrents (see baseTiers).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True if Config.LSD is set and the torrent is not private.
+*/
+func (Torrent *TorrentFile) lsdEnabled() bool {
+	return Torrent.Config.LSD && Torrent.Info.Private != 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+lsdInterface picks the network interface LSD multicasts on.
+A named interface must exist, be up and support multicast. Without a name the interface
+carrying the default route is used, so announcements do not end up on a container bridge.
+
+Parameters:
+  - name: Interface name from Config.LSDInterface (empty selects the default-route interface).
+
+Returns:
+  - *net.Interface: Interface to use (nil leaves the choice to the system).
+  - error: Non-nil if the named interface is missing, down or cannot multicast.
+*/
+func lsdInterface(name string) (*net.Interface, error) {
+	if name == "" {
+		return defaultRouteInterface(), nil
+	}
+
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("LSD interface %q: %v\n", name, err)
+	}
+
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("LSD interface %q is down\n", name)
+	}
+
+	if ifi.Flags&net.FlagMulticast == 0 {
+		return nil, fmt.Errorf("LSD interface %q does not support multicast\n", name)
+	}
+
+	return ifi, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+defaultRouteInterface finds the multicast-capable interface holding the address the system
+would send Internet traffic from. Connecting a UDP socket only consults the routing table;
+no packet is sent.
+
+Returns:
+  - *net.Interface: Default-route interface, or nil if it cannot be determined.
+*/
+func defaultRouteInterface() *net.Interface {
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	for i := range ifaces {
+		if ifaces[i].Flags&net.FlagUp == 0 || ifaces[i].Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.Equal(local) {
+				return &ifaces[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+runLSD announces the torrent on the local network every few minutes and connects to the
+peers announcing the same info hash, until ctx is cancelled.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to announce.
+  - ctx: Context ending the announces.
+*/
+func (Torrent *TorrentFile) runLSD(ctx context.Context) {
+	const lsdAnnounceInterval = 5 * time.Minute
+
+	ifi, err := lsdInterface(Torrent.Config.LSDInterface)
+	if err != nil {
+		log.Printf("[ERROR]\t%v", err)
+		return
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", lsdGroup)
+	if err != nil {
+		log.Printf("[ERROR]\tResolving LSD group: %v\n", err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		log.Printf("[ERROR]\tJoining LSD group: %v\n", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if ifi != nil {
+		log.Printf("[INFO]\tLSD on interface %s\n", ifi.Name)
+	}
+
+	go Torrent.receiveLSD(conn)
+
+	announcement := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\nInfohash: %x\r\n\r\n\r\n",
+		lsdGroup, Torrent.Config.announcePort(), Torrent.Info.InfoHash)
+
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := conn.WriteToUDP([]byte(announcement), group)
+		if err != nil {
+			log.Printf("[FAIL]\tLSD announce: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+receiveLSD reads LSD announcements until conn is closed and connects to every peer
+announcing this torrent.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to find peers for.
+  - conn: Socket joined to the LSD multicast group.
+*/
+func (Torrent *TorrentFile) receiveLSD(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	infoHash := hex.EncodeToString(Torrent.Info.InfoHash[:])
+
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		port, hashes, err := parseLSDAnnouncement(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		for _, hash := range hashes {
+			if strings.EqualFold(hash, infoHash) {
+				log.Printf("[INFO]\tLSD: peer %s:%d announces %s\n", from.IP, port, Torrent.Info.Name)
+				go Torrent.ConnectToPeers([]Peer{{IP: from.IP.String(), Port: port}})
+
+				break
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseLSDAnnouncement decodes a BT-SEARCH message.
+
+Parameters:
+  - data: Datagram received on the LSD group.
+
+Returns:
+  - uint16: Port the announcing peer listens on.
+  - []string: Hex info hashes it announces.
+  - error: Non-nil if the message is not a valid announcement.
+*/
+func parseLSDAnnouncement(data []byte) (uint16, []string, error) {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(string(data))))
+
+	line, err := reader.ReadLine()
+	if err != nil || !strings.HasPrefix(line, "BT-SEARCH * HTTP/1.1") {
+		return 0, nil, fmt.Errorf("Not an LSD announcement\n")
+	}
+
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return 0, nil, fmt.Errorf("Invalid LSD headers: %v\n", err)
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return 0, nil, fmt.Errorf("Invalid LSD port %q\n", header.Get("Port"))
+	}
+
+	return uint16(port), header.Values("Infohash"), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,314 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// magnetHashPrefix precedes the v1 info hash in a magnet link's "xt" parameter.
+const magnetHashPrefix = "urn:btih:"
+
+// --------------------------------------------------------------------------------------------- //
+
+// magnetKeyPrefix precedes the publisher key in the "xs" parameter of BEP-46 magnet links.
+const magnetKeyPrefix = "urn:btpk:"
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ParseMagnet creates a torrent from a magnet link ("magnet:?xt=urn:btih:..."). Only the info
+hash is required; "dn" sets the display name, every "tr" is added as its own tracker tier,
+"x.pe" peers are remembered in KnownPeers and "so" file indices (BEP-53) restrict the
+download once the files are known (see applySelectOnly). The info dictionary is not known yet and has
+to be fetched from peers with FetchMetadata before the download can start.
+
+Links naming a publisher key instead ("magnet:?xs=urn:btpk:...&s=...", BEP-46) are accepted
+too; their info hash stays zero until ResolveMutable looks it up in the DHT.
+
+Parameters:
+  - uri: Magnet link with a hex (40 characters) or base32 (32 characters) info hash, or a
+    hex (64 characters) ed25519 public key and optional hex salt.
+
+Returns:
+  - *TorrentFile: Torrent with the info hash (or publisher key), name and trackers filled in.
+  - error: Non-nil if the link is not a magnet link or has neither a valid v1 info hash nor
+    a valid public key.
+*/
+func ParseMagnet(uri string) (*TorrentFile, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "magnet" {
+		return nil, fmt.Errorf("Invalid magnet link: %q\n", uri)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid magnet link query: %v\n", err)
+	}
+
+	Torrent := &TorrentFile{Config: DefaultConfig()}
+	found := false
+
+	for _, xt := range query["xt"] {
+		if !strings.HasPrefix(strings.ToLower(xt), magnetHashPrefix) {
+			continue
+		}
+
+		hash, err := parseMagnetHash(xt[len(magnetHashPrefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		Torrent.Info.InfoHash = hash
+		found = true
+
+		break
+	}
+
+	for _, xs := range query["xs"] {
+		if !strings.HasPrefix(strings.ToLower(xs), magnetKeyPrefix) {
+			continue
+		}
+
+		err := Torrent.parseMutableMagnet(xs[len(magnetKeyPrefix):], query.Get("s"))
+		if err != nil {
+			return nil, err
+		}
+
+		found = true
+
+		break
+	}
+
+	if !found {
+		return nil, fmt.Errorf("Magnet link has no %s info hash or %s key\n", magnetHashPrefix, magnetKeyPrefix)
+	}
+
+	Torrent.Info.Name = query.Get("dn")
+	if Torrent.Info.Name != "" {
+		Torrent.sanitizeName()
+	}
+
+	for _, tracker := range query["tr"] {
+		if tracker == "" {
+			continue
+		}
+
+		if Torrent.Announce == "" {
+			Torrent.Announce = tracker
+		}
+
+		Torrent.AnnounceList = append(Torrent.AnnounceList, []string{tracker})
+	}
+
+	if so := query.Get("so"); so != "" {
+		Torrent.selectOnly, err = parseSelectOnly(so)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, addr := range query["x.pe"] {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+
+		Torrent.KnownPeers = append(Torrent.KnownPeers, Peer{IP: host, Port: uint16(port)})
+	}
+
+	if Torrent.mutableKey != nil {
+		log.Printf("[INFO]\tMagnet link names publisher key %x, salt %q\n", []byte(Torrent.mutableKey), Torrent.mutableSalt)
+	}
+
+	log.Printf("[INFO]\tParsed magnet link: %s, InfoHash: %x, %d trackers\n",
+		Torrent.Info.Name, Torrent.Info.InfoHash, len(Torrent.AnnounceList))
+
+	return Torrent, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseMagnetHash decodes the info hash of a magnet link.
+
+Parameters:
+  - value: 40 hex digits or 32 base32 characters.
+
+Returns:
+  - [20]byte: The info hash.
+  - error: Non-nil if the value has neither form.
+*/
+func parseMagnetHash(value string) ([20]byte, error) {
+	var hash [20]byte
+	var decoded []byte
+	var err error
+
+	switch len(value) {
+	case 40:
+		decoded, err = hex.DecodeString(value)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(value))
+	default:
+		return hash, fmt.Errorf("Invalid magnet info hash length: %d\n", len(value))
+	}
+
+	if err != nil {
+		return hash, fmt.Errorf("Invalid magnet info hash %q: %v\n", value, err)
+	}
+
+	copy(hash[:], decoded)
+
+	return hash, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseSelectOnly decodes the "so" parameter of a magnet link (BEP-53).
+
+Parameters:
+  - value: Comma-separated file indices and inclusive ranges, e.g. "0,2,4-6".
+
+Returns:
+  - []int: File indices in the order listed.
+  - error: Non-nil if an element is not an index or a range.
+*/
+func parseSelectOnly(value string) ([]int, error) {
+	var indices []int
+
+	for _, element := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(element, "-")
+
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+
+		if err != nil || start < 0 || end < start {
+			return nil, fmt.Errorf("Invalid magnet file selection %q\n", element)
+		}
+
+		for index := start; index <= end; index++ {
+			indices = append(indices, index)
+		}
+	}
+
+	return indices, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+applySelectOnly restricts the download to the files a magnet link's "so" parameter lists,
+once the metadata is known. A selection made by the caller with SelectFiles, SelectFileIndices
+or DeselectFile wins, and indices beyond the torrent's files are ignored; if none is left,
+every file is downloaded.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile about to be downloaded.
+
+Returns:
+  - error: Non-nil if the pieces cannot be initialized.
+*/
+func (Torrent *TorrentFile) applySelectOnly() error {
+	Torrent.DownloadMutex.Lock()
+	selected := Torrent.fileWanted != nil
+	Torrent.DownloadMutex.Unlock()
+
+	if Torrent.selectOnly == nil || selected {
+		return nil
+	}
+
+	count := len(Torrent.ListFiles())
+
+	var indices []int
+	for _, index := range Torrent.selectOnly {
+		if index >= count {
+			log.Printf("[INFO]\tIgnoring selected file %d: torrent has %d files\n", index, count)
+			continue
+		}
+
+		indices = append(indices, index)
+	}
+
+	if len(indices) == 0 {
+		return nil
+	}
+
+	log.Printf("[INFO]\tMagnet link selects %d of %d files\n", len(indices), count)
+
+	return Torrent.SelectFileIndices(indices)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+OpenMagnet parses a magnet link like ParseMagnet, resolves the current info hash of
+BEP-46 links with ResolveMutable and, if the metadata of the torrent is in
+Config.MetadataCacheDir from an earlier run, installs it so no exchange is needed.
+
+Parameters:
+  - uri: Magnet link.
+
+Returns:
+  - *TorrentFile: The torrent; HasMetadata tells whether FetchMetadata is still needed.
+  - error: Non-nil if the link cannot be parsed or the info hash of a BEP-46 link cannot
+    be resolved.
+*/
+func OpenMagnet(uri string) (*TorrentFile, error) {
+	Torrent, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if Torrent.mutableKey != nil {
+		err = Torrent.ResolveMutable()
+		if err != nil && Torrent.Info.InfoHash == ([20]byte{}) {
+			return nil, err
+		}
+	}
+
+	cached, err := LoadCachedMetadata(Torrent.Config.MetadataCacheDir, Torrent.Info.InfoHash)
+	if err != nil {
+		log.Printf("[ERROR]\t%v", err)
+	}
+
+	if cached != nil {
+		Torrent.Info = cached.Info
+		Torrent.SourcePath = cached.SourcePath
+	}
+
+	return Torrent, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+HasMetadata reports whether the info dictionary is known, i.e. the torrent was loaded from a
+.torrent file or its metadata has been fetched.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True if pieces can be initialized.
+*/
+func (Torrent *TorrentFile) HasMetadata() bool {
+	return len(Torrent.Info.Pieces) > 0 || len(Torrent.Info.FileTree) > 0 || Torrent.IsMerkle()
+}
+
+// --------------------------------------------------------------------------------------------- //
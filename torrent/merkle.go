@@ -0,0 +1,652 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// trHashpieceName is the BEP-30 extension name and trHashpieceID the ID we receive its messages with.
+const (
+	trHashpieceName = "Tr_hashpiece"
+	trHashpieceID   = 5
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+merkleTree is the hash tree of a BEP-30 Merkle torrent, whose info dictionary only holds the
+"root hash". Nodes are numbered breadth-first from the root (0), the children of node i being
+2i+1 and 2i+2; the leaves are the SHA-1 hashes of the pieces, followed by zero hashes up to
+the next power of two. Piece hashes become known as the hash chains sent along with piece
+data check out against the root.
+
+Fields:
+  - mutex: Guards every other field; requests are served while pieces are verified.
+  - leaves: Number of leaves, a power of two.
+  - nodes: Hash of every node; only meaningful where known is set.
+  - known: Nodes verified against the root (or computed from verified children).
+  - pending: Hash chains received with the first block of a piece, by piece, until it is verified.
+  - candidates: Hashes of on-disk pieces that could not be verified yet, for settle.
+*/
+type merkleTree struct {
+	mutex      sync.Mutex
+	leaves     int
+	nodes      [][20]byte
+	known      []bool
+	pending    map[int]map[int][20]byte
+	candidates map[int][20]byte
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newMerkleTree creates the hash tree of a Merkle torrent. Only the root and the filler leaves
+past the last piece (and the nodes above them alone) are known initially.
+
+Parameters:
+  - root: The "root hash" of the info dictionary.
+  - pieces: Number of pieces.
+
+Returns:
+  - *merkleTree: The tree.
+*/
+func newMerkleTree(root [20]byte, pieces int) *merkleTree {
+	leaves := 1
+	for leaves < pieces {
+		leaves *= 2
+	}
+
+	tree := &merkleTree{
+		leaves:     leaves,
+		nodes:      make([][20]byte, 2*leaves-1),
+		known:      make([]bool, 2*leaves-1),
+		pending:    make(map[int]map[int][20]byte),
+		candidates: make(map[int][20]byte),
+	}
+
+	for i := pieces; i < leaves; i++ {
+		tree.known[leaves-1+i] = true
+	}
+
+	for i := leaves - 2; i > 0; i-- {
+		if tree.known[2*i+1] && tree.known[2*i+2] {
+			tree.nodes[i] = hashPair(tree.nodes[2*i+1], tree.nodes[2*i+2])
+			tree.known[i] = true
+		}
+	}
+
+	tree.nodes[0] = root
+	tree.known[0] = true
+
+	return tree
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+hashPair computes the hash of an inner node from its children.
+
+Parameters:
+  - left: Hash of the left child.
+  - right: Hash of the right child.
+
+Returns:
+  - [20]byte: SHA-1 of the concatenated hashes.
+*/
+func hashPair(left, right [20]byte) [20]byte {
+	return sha1.Sum(append(left[:], right[:]...))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sibling returns the other child of a node's parent.
+
+Parameters:
+  - node: Index of a node other than the root.
+
+Returns:
+  - int: Index of its sibling.
+*/
+func sibling(node int) int {
+	if node%2 == 1 {
+		return node + 1
+	}
+
+	return node - 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+record stores the hash chain received with the first block of a piece, to verify the piece
+with once all its blocks have arrived.
+
+Parameters:
+  - piece: Index of the piece.
+  - chain: Node hashes by node index.
+*/
+func (Tree *merkleTree) record(piece int, chain map[int][20]byte) {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	Tree.pending[piece] = chain
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+verifiable reports whether a downloaded piece can be checked: its hash is known or a hash
+chain arrived with it.
+
+Parameters:
+  - piece: Index of the piece.
+
+Returns:
+  - bool: True if verify can decide about the piece.
+*/
+func (Tree *merkleTree) verifiable(piece int) bool {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	_, ok := Tree.pending[piece]
+
+	return ok || Tree.known[Tree.leaves-1+piece]
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+verify checks the hash of a piece. A known leaf is compared directly; otherwise the pending
+hash chain of the piece is used to climb towards the root until a known node is reached, and
+if the computed node matches, every hash on the way becomes known. Without a chain the hash
+is kept as a candidate for settle.
+
+Parameters:
+  - piece: Index of the piece.
+  - hash: SHA-1 of the piece data.
+
+Returns:
+  - bool: True if the hash is the piece's leaf of the tree.
+*/
+func (Tree *merkleTree) verify(piece int, hash [20]byte) bool {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	node := Tree.leaves - 1 + piece
+	if Tree.known[node] {
+		return Tree.nodes[node] == hash
+	}
+
+	chain, ok := Tree.pending[piece]
+	delete(Tree.pending, piece)
+
+	if !ok {
+		Tree.candidates[piece] = hash
+		return false
+	}
+
+	computed := map[int][20]byte{node: hash}
+	current := hash
+
+	for node > 0 {
+		other := sibling(node)
+
+		otherHash, ok := chain[other]
+		if Tree.known[other] {
+			otherHash = Tree.nodes[other]
+		} else if !ok {
+			return false
+		}
+
+		computed[other] = otherHash
+
+		if node%2 == 1 {
+			current = hashPair(current, otherHash)
+		} else {
+			current = hashPair(otherHash, current)
+		}
+
+		node = (node - 1) / 2
+
+		if Tree.known[node] {
+			if Tree.nodes[node] != current {
+				return false
+			}
+
+			for index, value := range computed {
+				Tree.nodes[index] = value
+				Tree.known[index] = true
+			}
+
+			return true
+		}
+
+		computed[node] = current
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+settle accepts the candidate hashes left by verify when, together with the leaves already
+known, they cover every piece and rebuild the root. It is what lets complete data on disk
+(e.g. content about to be seeded) be verified without any hash chain.
+
+Returns:
+  - map[int][20]byte: Accepted hashes by piece (nil if the tree could not be completed).
+*/
+func (Tree *merkleTree) settle() map[int][20]byte {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	candidates := Tree.candidates
+	Tree.candidates = make(map[int][20]byte)
+
+	nodes := append([][20]byte(nil), Tree.nodes...)
+
+	for piece := 0; piece < Tree.leaves; piece++ {
+		node := Tree.leaves - 1 + piece
+		if Tree.known[node] {
+			continue
+		}
+
+		hash, ok := candidates[piece]
+		if !ok {
+			return nil
+		}
+
+		nodes[node] = hash
+	}
+
+	for i := Tree.leaves - 2; i >= 0; i-- {
+		nodes[i] = hashPair(nodes[2*i+1], nodes[2*i+2])
+	}
+
+	if nodes[0] != Tree.nodes[0] {
+		return nil
+	}
+
+	Tree.nodes = nodes
+	for i := range Tree.known {
+		Tree.known[i] = true
+	}
+
+	return candidates
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+resolve makes a node known by computing it from its children, as far as they are known.
+It must be called with Tree.mutex held.
+
+Parameters:
+  - node: Index of the node.
+
+Returns:
+  - bool: True if the node is known.
+*/
+func (Tree *merkleTree) resolve(node int) bool {
+	if Tree.known[node] {
+		return true
+	}
+
+	left := 2*node + 1
+	if left >= len(Tree.nodes) || !Tree.resolve(left) || !Tree.resolve(left+1) {
+		return false
+	}
+
+	Tree.nodes[node] = hashPair(Tree.nodes[left], Tree.nodes[left+1])
+	Tree.known[node] = true
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+chain returns the hash chain a peer needs to verify a piece we send it: the piece's leaf and
+the sibling of every node on the way to the root.
+
+Parameters:
+  - piece: Index of the piece.
+
+Returns:
+  - map[int][20]byte: Node hashes by node index.
+  - bool: False if a hash of the chain is not known.
+*/
+func (Tree *merkleTree) chain(piece int) (map[int][20]byte, bool) {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	node := Tree.leaves - 1 + piece
+	if !Tree.resolve(node) {
+		return nil, false
+	}
+
+	chain := map[int][20]byte{node: Tree.nodes[node]}
+
+	for node > 0 {
+		other := sibling(node)
+		if !Tree.resolve(other) {
+			return nil, false
+		}
+
+		chain[other] = Tree.nodes[other]
+		node = (node - 1) / 2
+	}
+
+	return chain, true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+snapshot encodes the known nodes for the resume file, so the hashes learned from peers
+survive a restart: 4-byte big-endian node index followed by the 20-byte hash, per node.
+
+Returns:
+  - []byte: Encoded nodes.
+*/
+func (Tree *merkleTree) snapshot() []byte {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	var buf []byte
+	for i, known := range Tree.known {
+		if known {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(i))
+			buf = append(buf, Tree.nodes[i][:]...)
+		}
+	}
+
+	return buf
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+restore marks the nodes of a snapshot as known. The root is never replaced.
+
+Parameters:
+  - data: Nodes encoded by snapshot.
+*/
+func (Tree *merkleTree) restore(data []byte) {
+	Tree.mutex.Lock()
+	defer Tree.mutex.Unlock()
+
+	for ; len(data) >= 24; data = data[24:] {
+		index := int(binary.BigEndian.Uint32(data[:4]))
+		if index <= 0 || index >= len(Tree.nodes) {
+			continue
+		}
+
+		copy(Tree.nodes[index][:], data[4:24])
+		Tree.known[index] = true
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+encodeHashChain encodes a hash chain as the bencoded list of [node index, hash] pairs of
+Tr_hashpiece messages.
+
+Parameters:
+  - chain: Node hashes by node index.
+
+Returns:
+  - []byte: Bencoded hash list.
+  - error: Non-nil if encoding fails.
+*/
+func encodeHashChain(chain map[int][20]byte) ([]byte, error) {
+	list := make([]interface{}, 0, len(chain))
+	for index, hash := range chain {
+		list = append(list, []interface{}{index, string(hash[:])})
+	}
+
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, list)
+	if err != nil {
+		return nil, fmt.Errorf("Encoding hash chain: %v\n", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeHashChain decodes the hash list of a Tr_hashpiece message. Malformed pairs are skipped.
+
+Parameters:
+  - data: Bencoded list of [node index, hash] pairs.
+
+Returns:
+  - map[int][20]byte: Node hashes by node index.
+  - error: Non-nil if data is not a bencoded list.
+*/
+func decodeHashChain(data []byte) (map[int][20]byte, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Decoding hash chain: %v\n", err)
+	}
+
+	list, ok := decoded.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Hash chain is not a list\n")
+	}
+
+	chain := make(map[int][20]byte, len(list))
+
+	for _, item := range list {
+		pair, _ := item.([]interface{})
+		if len(pair) != 2 {
+			continue
+		}
+
+		index, _ := pair[0].(int64)
+		hash, _ := pair[1].(string)
+		if index < 0 || len(hash) != 20 {
+			continue
+		}
+
+		var value [20]byte
+		copy(value[:], hash)
+		chain[int(index)] = value
+	}
+
+	return chain, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+IsMerkle reports whether the torrent is a BEP-30 Merkle torrent, identified by a "root hash"
+instead of the "pieces" of its info dictionary.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True for Merkle torrents.
+*/
+func (Torrent *TorrentFile) IsMerkle() bool {
+	return len(Torrent.Info.Pieces) == 0 && len(Torrent.Info.RootHash) == 20
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pieceHashValid checks the SHA-1 of a piece: against Torrent.PieceHashes for ordinary torrents
+and against the hash tree for Merkle torrents, where a verified hash is added to PieceHashes.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - index: Index of the piece.
+  - hash: SHA-1 of the piece data.
+
+Returns:
+  - bool: True if the piece is valid.
+*/
+func (Torrent *TorrentFile) pieceHashValid(index int, hash [20]byte) bool {
+	if Torrent.merkle == nil {
+		return hash == Torrent.PieceHashes[index]
+	}
+
+	if !Torrent.merkle.verify(index, hash) {
+		return false
+	}
+
+	Torrent.PieceHashes[index] = hash
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+settleMerkle retries the pieces that failed a recheck of a Merkle torrent, accepting them all
+if their hashes rebuild the root (see merkleTree.settle).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being rechecked.
+  - failed: Pieces that failed verification.
+
+Returns:
+  - []int: Pieces still failing.
+*/
+func (Torrent *TorrentFile) settleMerkle(failed []int) []int {
+	accepted := Torrent.merkle.settle()
+	if accepted == nil {
+		return failed
+	}
+
+	Torrent.DownloadMutex.Lock()
+	for index, hash := range accepted {
+		Torrent.PieceHashes[index] = hash
+		Torrent.Downloaded.Set(index)
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	log.Printf("[INFO]\tMerkle tree of %s verified from the data on disk\n", Torrent.Info.Name)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+hashpieceMessage decodes a Tr_hashpiece message body (piece index, begin, hash list length,
+hash list, block), records the hash chain sent with the first block of a piece, and returns
+the block as an ordinary Piece message.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - body: Message body following the extended message ID.
+
+Returns:
+  - *Message: The equivalent Piece message.
+  - error: Non-nil if the message is malformed.
+*/
+func (Torrent *TorrentFile) hashpieceMessage(body []byte) (*Message, error) {
+	if len(body) < 12 {
+		return nil, fmt.Errorf("Invalid Tr_hashpiece length: %d\n", len(body))
+	}
+
+	index := int(binary.BigEndian.Uint32(body[0:4]))
+	begin := binary.BigEndian.Uint32(body[4:8])
+	listLength := int64(binary.BigEndian.Uint32(body[8:12]))
+
+	if listLength > int64(len(body)-12) {
+		return nil, fmt.Errorf("Tr_hashpiece hash list of %d bytes exceeds the message\n", listLength)
+	}
+
+	if listLength > 0 && begin == 0 && index < Torrent.NumPieces && Torrent.merkle != nil {
+		chain, err := decodeHashChain(body[12 : 12+listLength])
+		if err != nil {
+			return nil, err
+		}
+
+		Torrent.merkle.record(index, chain)
+	}
+
+	payload := append(append([]byte(nil), body[0:8]...), body[12+listLength:]...)
+
+	return &Message{ID: Piece, Payload: payload}, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleHashpiece processes a Tr_hashpiece message arriving outside a piece download: its hash
+chain is kept, the block itself is dropped like an unrequested Piece.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - body: Message body following the extended message ID.
+
+Returns:
+  - error: Non-nil if the message is malformed.
+*/
+func (Torrent *TorrentFile) handleHashpiece(peer *Peer, body []byte) error {
+	_, err := Torrent.hashpieceMessage(body)
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendHashpiece sends a block of a Merkle torrent as a Tr_hashpiece message, with the hash
+chain of the piece when it is the piece's first block.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being seeded.
+  - peer: Peer that requested the block and supports Tr_hashpiece.
+  - index: Index of the piece.
+  - begin: Offset of the block in the piece.
+  - block: Block data.
+
+Returns:
+  - error: Non-nil if sending fails.
+*/
+func (Torrent *TorrentFile) sendHashpiece(peer *Peer, index int, begin int64, block []byte) error {
+	var list []byte
+
+	if begin == 0 {
+		chain, ok := Torrent.merkle.chain(index)
+		if ok {
+			encoded, err := encodeHashChain(chain)
+			if err != nil {
+				return err
+			}
+
+			list = encoded
+		} else {
+			logPeerf(nil, index, "[ERROR]\tHash chain of piece %d is not known, sending it without\n", index)
+		}
+	}
+
+	body := binary.BigEndian.AppendUint32(nil, uint32(index))
+	body = binary.BigEndian.AppendUint32(body, uint32(begin))
+	body = binary.BigEndian.AppendUint32(body, uint32(len(list)))
+	body = append(append(body, list...), block...)
+
+	return Torrent.sendExtended(peer, trHashpieceName, body)
+}
+
+// --------------------------------------------------------------------------------------------- //
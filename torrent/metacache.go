@@ -0,0 +1,211 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+defaultMetadataCacheDir returns the per-user directory used to cache fetched metadata.
+
+Returns:
+  - string: "<user cache dir>/BitTorrent/metadata", or "" if the user cache dir is unknown.
+*/
+func defaultMetadataCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(dir, "BitTorrent", "metadata")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+metadataCachePath returns the path of the cached .torrent for an info hash.
+
+Parameters:
+  - dir: Cache directory (Config.MetadataCacheDir).
+  - infoHash: Info hash the cache entry is keyed by.
+
+Returns:
+  - string: "<dir>/<hex info hash>.torrent".
+*/
+func metadataCachePath(dir string, infoHash [20]byte) string {
+	return filepath.Join(dir, fmt.Sprintf("%x.torrent", infoHash))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SetInfoBytes installs an info dictionary obtained without a .torrent file, typically from
+peers via ut_metadata (BEP-9). Info.InfoHash must already hold the expected hash (e.g. from
+a magnet link); the bytes are rejected unless they hash to it. On success the metadata is
+written to Config.MetadataCacheDir so the next run can skip the exchange.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to populate.
+  - infoBytes: Bencoded info dictionary.
+
+Returns:
+  - error: ErrMetadataHashMismatch if the hash differs, or an error if the dictionary is malformed.
+*/
+func (Torrent *TorrentFile) SetInfoBytes(infoBytes []byte) error {
+	hash := sha1.Sum(infoBytes)
+	if hash != Torrent.Info.InfoHash {
+		return ErrMetadataHashMismatch
+	}
+
+	var info TorrentInfo
+	err := bencode.Unmarshal(bytes.NewReader(infoBytes), &info)
+	if err != nil {
+		return fmt.Errorf("Decoding info dictionary error: %v\n", err)
+	}
+
+	info.InfoHash = hash
+	Torrent.Info = info
+	Torrent.sanitizeName()
+
+	Torrent.metadataMutex.Lock()
+	Torrent.infoBytes = infoBytes
+	Torrent.metadataMutex.Unlock()
+
+	err = Torrent.decodeInfoTree(infoBytes)
+	if err != nil {
+		return err
+	}
+
+	if Torrent.Info.PieceLength <= 0 {
+		return fmt.Errorf("Invalid piece length %d in metadata\n", Torrent.Info.PieceLength)
+	}
+
+	if Torrent.Info.MetaVersion == 2 {
+		Torrent.Info.InfoHashV2 = sha256.Sum256(infoBytes)
+	}
+
+	if Torrent.Config.MetadataCacheDir != "" {
+		err = Torrent.SaveMetadata(Torrent.Config.MetadataCacheDir, infoBytes)
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SaveMetadata writes the torrent as a .torrent file into a cache directory, keyed by info hash.
+The info dictionary is stored byte for byte so the cached file has the same info hash.
+The file is written to a temporary name and renamed into place.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose trackers are stored alongside the info dictionary.
+  - dir: Cache directory.
+  - infoBytes: Bencoded info dictionary.
+
+Returns:
+  - error: Non-nil if the bytes do not match the info hash or the file cannot be written.
+*/
+func (Torrent *TorrentFile) SaveMetadata(dir string, infoBytes []byte) error {
+	if sha1.Sum(infoBytes) != Torrent.Info.InfoHash {
+		return ErrMetadataHashMismatch
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("d")
+
+	if Torrent.Announce != "" {
+		fmt.Fprintf(&buf, "8:announce%d:%s", len(Torrent.Announce), Torrent.Announce)
+	}
+
+	if len(Torrent.AnnounceList) > 0 {
+		buf.WriteString("13:announce-list")
+
+		err := bencode.Marshal(&buf, Torrent.AnnounceList)
+		if err != nil {
+			return fmt.Errorf("Encoding announce list: %v\n", err)
+		}
+	}
+
+	buf.WriteString("4:info")
+	buf.Write(infoBytes)
+	buf.WriteString("e")
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create metadata cache %s: %v\n", dir, err)
+	}
+
+	path := metadataCachePath(dir, Torrent.Info.InfoHash)
+	tmp := path + ".tmp"
+
+	err = os.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return fmt.Errorf("Writing cached metadata %s: %v\n", tmp, err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("Renaming cached metadata %s: %v\n", tmp, err)
+	}
+
+	log.Printf("[INFO]\tCached metadata of %s in %s\n", Torrent.Info.Name, path)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+LoadCachedMetadata loads a torrent from the metadata cache, to be checked before
+starting a metadata exchange. The cached file is only used if its info hash matches.
+
+Parameters:
+  - dir: Cache directory (Config.MetadataCacheDir).
+  - infoHash: Info hash to look up.
+
+Returns:
+  - *TorrentFile: The cached torrent, or nil if there is no usable cache entry.
+  - error: Non-nil if an entry exists but cannot be parsed or has a different info hash.
+*/
+func LoadCachedMetadata(dir string, infoHash [20]byte) (*TorrentFile, error) {
+	if dir == "" {
+		return nil, nil
+	}
+
+	path := metadataCachePath(dir, infoHash)
+
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	Torrent, err := SetTorrentFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Loading cached metadata %s: %v\n", path, err)
+	}
+
+	if Torrent.Info.InfoHash != infoHash {
+		return nil, fmt.Errorf("Cached metadata %s has info hash %x, expected %x\n", path, Torrent.Info.InfoHash, infoHash)
+	}
+
+	Torrent.Config.MetadataCacheDir = dir
+	log.Printf("[INFO]\tLoaded cached metadata for %x from %s\n", infoHash, path)
+
+	return Torrent, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
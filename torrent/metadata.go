@@ -0,0 +1,493 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// metadataPieceSize is the fixed size of a ut_metadata piece (BEP-9); only the last piece may be shorter.
+const metadataPieceSize = 1 << 14
+
+// --------------------------------------------------------------------------------------------- //
+
+// ErrMetadataHashMismatch is returned when reassembled metadata does not hash to the expected info hash.
+var ErrMetadataHashMismatch = errors.New("Metadata hash mismatch")
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+MetadataTooLargeError is returned when a peer advertises a metadata size above Config.MaxMetadataSize.
+The peer should be skipped and metadata requested from another one.
+
+Fields:
+  - Size: Size advertised by the peer ("metadata_size").
+  - Limit: Configured maximum.
+*/
+type MetadataTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Error implements the error interface.
+
+Returns:
+  - string: Description including the advertised size and the limit.
+*/
+func (Err *MetadataTooLargeError) Error() string {
+	return fmt.Sprintf("Metadata too large: %d bytes advertised, limit is %d", Err.Size, Err.Limit)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+metadataAssembler collects ut_metadata pieces from a peer and verifies the result.
+
+Fields:
+  - infoHash: Expected SHA-1 of the complete info dictionary.
+  - data: Buffer of the advertised size.
+  - received: Which pieces have been stored.
+*/
+type metadataAssembler struct {
+	infoHash [20]byte
+	data     []byte
+	received []bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newMetadataAssembler validates an advertised metadata size and allocates a buffer for it.
+The size is checked against limit before anything is allocated.
+
+Parameters:
+  - infoHash: Expected SHA-1 of the complete info dictionary.
+  - size: Metadata size advertised by the peer.
+  - limit: Maximum accepted size (Config.MaxMetadataSize).
+
+Returns:
+  - *metadataAssembler: Assembler ready to receive pieces.
+  - error: *MetadataTooLargeError if size exceeds limit, or an error if size is not positive.
+*/
+func newMetadataAssembler(infoHash [20]byte, size, limit int64) (*metadataAssembler, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("Invalid metadata size: %d\n", size)
+	}
+
+	if size > limit {
+		return nil, &MetadataTooLargeError{Size: size, Limit: limit}
+	}
+
+	pieces := (size + metadataPieceSize - 1) / metadataPieceSize
+
+	return &metadataAssembler{
+		infoHash: infoHash,
+		data:     make([]byte, size),
+		received: make([]bool, pieces),
+	}, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+numPieces returns the number of ut_metadata pieces expected.
+
+Returns:
+  - int: Piece count.
+*/
+func (Assembler *metadataAssembler) numPieces() int {
+	return len(Assembler.received)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+addPiece stores one metadata piece. Every piece except the last must be exactly 16 kB.
+
+Parameters:
+  - index: Piece index from the ut_metadata data message.
+  - piece: Piece payload following the bencoded header.
+
+Returns:
+  - error: Non-nil if the index or length is invalid.
+*/
+func (Assembler *metadataAssembler) addPiece(index int, piece []byte) error {
+	if index < 0 || index >= len(Assembler.received) {
+		return fmt.Errorf("Invalid metadata piece index: %d\n", index)
+	}
+
+	start := index * metadataPieceSize
+	expected := min(metadataPieceSize, len(Assembler.data)-start)
+
+	if len(piece) != expected {
+		return fmt.Errorf("Invalid metadata piece %d length: %d (expected %d)\n", index, len(piece), expected)
+	}
+
+	copy(Assembler.data[start:], piece)
+	Assembler.received[index] = true
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+complete reports whether every metadata piece has been received.
+
+Returns:
+  - bool: True once all pieces are stored.
+*/
+func (Assembler *metadataAssembler) complete() bool {
+	for _, ok := range Assembler.received {
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+verify checks the reassembled metadata against the expected info hash.
+Peer-supplied metadata must never be used without this check.
+
+Returns:
+  - []byte: The verified bencoded info dictionary.
+  - error: ErrMetadataHashMismatch if the hash differs, or an error if pieces are missing.
+*/
+func (Assembler *metadataAssembler) verify() ([]byte, error) {
+	if !Assembler.complete() {
+		return nil, fmt.Errorf("Metadata incomplete\n")
+	}
+
+	if sha1.Sum(Assembler.data) != Assembler.infoHash {
+		return nil, ErrMetadataHashMismatch
+	}
+
+	return Assembler.data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ut_metadata message types (BEP-9).
+
+Values:
+  - metadataRequest: Asks for one piece of the info dictionary.
+  - metadataData: Carries a piece, appended after the bencoded header.
+  - metadataReject: The sender does not have the piece (or will not send it).
+*/
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// metadataTimeout bounds how long FetchMetadata waits for a single peer's metadata.
+const metadataTimeout = 30 * time.Second
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+metadataMessage is the bencoded header of a ut_metadata message.
+
+Fields:
+  - MsgType: metadataRequest, metadataData or metadataReject.
+  - Piece: Index of the metadata piece.
+  - TotalSize: Size of the whole info dictionary (data messages only).
+*/
+type metadataMessage struct {
+	MsgType   int   `bencode:"msg_type"`
+	Piece     int   `bencode:"piece"`
+	TotalSize int64 `bencode:"total_size,omitempty"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseMetadataMessage splits a ut_metadata message into its header and trailing piece data.
+
+Parameters:
+  - body: Message body after the extended message ID.
+
+Returns:
+  - metadataMessage: Decoded header.
+  - []byte: Piece data following the header (empty except for data messages).
+  - error: Non-nil if the header cannot be decoded.
+*/
+func parseMetadataMessage(body []byte) (metadataMessage, []byte, error) {
+	var header metadataMessage
+
+	reader := bufio.NewReader(bytes.NewReader(body))
+
+	err := bencode.Unmarshal(reader, &header)
+	if err != nil {
+		return header, nil, fmt.Errorf("Decoding ut_metadata message error: %v\n", err)
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return header, nil, err
+	}
+
+	return header, data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendMetadataMessage sends a ut_metadata message to a peer, using the message ID the peer
+asked for in its extension handshake.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer that advertised ut_metadata.
+  - header: Message header.
+  - data: Piece data for data messages (nil otherwise).
+
+Returns:
+  - error: Non-nil if the peer does not support ut_metadata or sending fails.
+*/
+func (Torrent *TorrentFile) sendMetadataMessage(peer *Peer, header metadataMessage, data []byte) error {
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, header)
+	if err != nil {
+		return fmt.Errorf("Encoding ut_metadata message error: %v\n", err)
+	}
+
+	buf.Write(data)
+
+	return Torrent.sendExtended(peer, utMetadataName, buf.Bytes())
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+metadataBytes returns the bencoded info dictionary served to peers via ut_metadata.
+For torrents loaded from a file it is read from SourcePath on first use.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []byte: The info dictionary, or nil if it is not known.
+*/
+func (Torrent *TorrentFile) metadataBytes() []byte {
+	Torrent.metadataMutex.Lock()
+	defer Torrent.metadataMutex.Unlock()
+
+	if Torrent.infoBytes == nil && Torrent.SourcePath != "" && Torrent.HasMetadata() {
+		data, err := os.ReadFile(Torrent.SourcePath)
+		if err != nil {
+			log.Printf("[ERROR]\tReading metadata from %s: %v\n", Torrent.SourcePath, err)
+			return nil
+		}
+
+		infoBytes, err := extractInfoBytes(data)
+		if err == nil && sha1.Sum(infoBytes) == Torrent.Info.InfoHash {
+			Torrent.infoBytes = infoBytes
+		}
+	}
+
+	return Torrent.infoBytes
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleMetadataMessage answers a peer's ut_metadata requests with pieces of our info
+dictionary, or rejects them if we do not have it. Data and reject messages are only
+expected while fetching metadata and are ignored here.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - body: Message body after the extended message ID.
+
+Returns:
+  - error: Non-nil if the message is malformed or the reply cannot be sent.
+*/
+func (Torrent *TorrentFile) handleMetadataMessage(peer *Peer, body []byte) error {
+	header, _, err := parseMetadataMessage(body)
+	if err != nil {
+		return err
+	}
+
+	if header.MsgType != metadataRequest {
+		return nil
+	}
+
+	infoBytes := Torrent.metadataBytes()
+	start := header.Piece * metadataPieceSize
+
+	if infoBytes == nil || header.Piece < 0 || start >= len(infoBytes) {
+		return Torrent.sendMetadataMessage(peer, metadataMessage{MsgType: metadataReject, Piece: header.Piece}, nil)
+	}
+
+	end := min(start+metadataPieceSize, len(infoBytes))
+	reply := metadataMessage{MsgType: metadataData, Piece: header.Piece, TotalSize: int64(len(infoBytes))}
+
+	logPeerf(peer, -1, "[INFO]\tsending metadata piece %d\n", header.Piece)
+
+	return Torrent.sendMetadataMessage(peer, reply, infoBytes[start:end])
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+FetchMetadata downloads the info dictionary of a torrent opened from a magnet link from the
+connected peers, one peer at a time, and installs it with SetInfoBytes. It must run after
+ConnectToPeers and before StartDownload. Messages other than ut_metadata that arrive
+meanwhile (bitfields, haves) are kept for the download.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose Info.InfoHash is set.
+
+Returns:
+  - error: Non-nil if no connected peer delivered metadata matching the info hash.
+*/
+func (Torrent *TorrentFile) FetchMetadata() error {
+	if Torrent.HasMetadata() {
+		return nil
+	}
+
+	Torrent.PeersMutex.Lock()
+	peers := append([]*Peer(nil), Torrent.Peers...)
+	Torrent.PeersMutex.Unlock()
+
+	for _, peer := range peers {
+		infoBytes, err := Torrent.fetchMetadataFrom(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tno metadata: %v", err)
+			continue
+		}
+
+		err = Torrent.SetInfoBytes(infoBytes)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v", err)
+			continue
+		}
+
+		log.Printf("[INFO]\tFetched metadata of %s (%d bytes) from %s:%d\n", Torrent.Info.Name, len(infoBytes), peer.IP, peer.Port)
+
+		return nil
+	}
+
+	return fmt.Errorf("No peer provided the metadata for %x\n", Torrent.Info.InfoHash)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fetchMetadataFrom waits for a peer's extension handshake, requests every metadata piece it
+advertises and returns the verified info dictionary.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer.
+
+Returns:
+  - []byte: Info dictionary matching Info.InfoHash.
+  - error: Non-nil if the peer lacks ut_metadata, rejects a piece, times out or sends bad data.
+*/
+func (Torrent *TorrentFile) fetchMetadataFrom(peer *Peer) ([]byte, error) {
+	deadline := time.Now().Add(metadataTimeout)
+
+	var assembler *metadataAssembler
+
+	for {
+		if assembler == nil && peer.Extensions != nil {
+			var err error
+
+			assembler, err = newMetadataAssembler(Torrent.Info.InfoHash, peer.MetadataSize, Torrent.Config.MaxMetadataSize)
+			if err != nil {
+				return nil, err
+			}
+
+			for i := 0; i < assembler.numPieces(); i++ {
+				err = Torrent.sendMetadataMessage(peer, metadataMessage{MsgType: metadataRequest, Piece: i}, nil)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("Timed out waiting for metadata\n")
+		}
+
+		msg, err := Torrent.readMessage(peer, remaining)
+		if errors.Is(err, errReceiveTimeout) {
+			return nil, fmt.Errorf("Timed out waiting for metadata\n")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		if msg.ID != Extended {
+			peer.pending = append(peer.pending, msg)
+			continue
+		}
+
+		if len(msg.Payload) == 0 || msg.Payload[0] != utMetadataID || assembler == nil {
+			err = Torrent.handleExtended(peer, msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		header, data, err := parseMetadataMessage(msg.Payload[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.MsgType {
+		case metadataData:
+			err = assembler.addPiece(header.Piece, data)
+			if err != nil {
+				return nil, err
+			}
+
+			if assembler.complete() {
+				return assembler.verify()
+			}
+
+		case metadataReject:
+			return nil, fmt.Errorf("Metadata piece %d rejected\n", header.Piece)
+
+		default:
+			err = Torrent.handleMetadataMessage(peer, msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
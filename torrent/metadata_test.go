@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// testInfoBytes is the bencoded info dictionary of a single-piece, single-file torrent.
+var testInfoBytes = []byte("d6:lengthi16384e4:name8:test.bin12:piece lengthi16384e6:pieces20:" + strings.Repeat("\x00", 20) + "e")
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestMetadataAssembler(t *testing.T) {
+	infoHash := sha1.Sum(testInfoBytes)
+
+	_, err := newMetadataAssembler(infoHash, 1<<40, 10<<20)
+
+	var tooLarge *MetadataTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 1<<40 || tooLarge.Limit != 10<<20 {
+		t.Errorf("oversized advertisement = %v, want *MetadataTooLargeError", err)
+	}
+
+	_, err = newMetadataAssembler(infoHash, 0, 10<<20)
+	if err == nil {
+		t.Errorf("zero metadata size accepted")
+	}
+
+	assembler, err := newMetadataAssembler(infoHash, int64(len(testInfoBytes)), 10<<20)
+	if err != nil {
+		t.Fatalf("newMetadataAssembler: %v", err)
+	}
+
+	if err := assembler.addPiece(1, nil); err == nil {
+		t.Errorf("piece index past the end accepted")
+	}
+
+	if err := assembler.addPiece(0, testInfoBytes[1:]); err == nil {
+		t.Errorf("short piece accepted")
+	}
+
+	if _, err := assembler.verify(); err == nil {
+		t.Errorf("incomplete metadata verified")
+	}
+
+	// Data not matching the info hash is never accepted
+	corrupt := bytes.Clone(testInfoBytes)
+	corrupt[len(corrupt)-2] = 1
+
+	err = assembler.addPiece(0, corrupt)
+	if err != nil {
+		t.Fatalf("addPiece: %v", err)
+	}
+
+	if _, err := assembler.verify(); !errors.Is(err, ErrMetadataHashMismatch) {
+		t.Errorf("corrupt metadata verify = %v, want ErrMetadataHashMismatch", err)
+	}
+
+	err = assembler.addPiece(0, testInfoBytes)
+	if err != nil {
+		t.Fatalf("addPiece: %v", err)
+	}
+
+	data, err := assembler.verify()
+	if err != nil || !bytes.Equal(data, testInfoBytes) {
+		t.Errorf("verify = %q, %v", data, err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestFetchMetadataSkipsOversized(t *testing.T) {
+	Torrent := &TorrentFile{Config: DefaultConfig()}
+	Torrent.Info.InfoHash = sha1.Sum(testInfoBytes)
+
+	oversized, oversizedRemote := newTestPeer(t)
+	oversized.Extensions = map[string]int{utMetadataName: 3}
+	oversized.MetadataSize = Torrent.Config.MaxMetadataSize + 1
+
+	honest, honestRemote := newTestPeer(t)
+	honest.Extensions = map[string]int{utMetadataName: 3}
+	honest.MetadataSize = int64(len(testInfoBytes))
+
+	Torrent.Peers = []*Peer{oversized, honest}
+
+	// The honest peer answers the request for the only piece
+	go func() {
+		msg, err := Torrent.readMessage(honestRemote, 5*time.Second)
+		if err != nil || msg == nil || msg.ID != Extended {
+			return
+		}
+
+		var reply bytes.Buffer
+		reply.WriteByte(utMetadataID)
+		bencode.Marshal(&reply, metadataMessage{MsgType: metadataData, Piece: 0, TotalSize: int64(len(testInfoBytes))})
+		reply.Write(testInfoBytes)
+
+		Torrent.SendMessage(honestRemote, Message{ID: Extended, Payload: reply.Bytes()})
+	}()
+
+	err := Torrent.FetchMetadata()
+	if err != nil {
+		t.Fatalf("FetchMetadata: %v", err)
+	}
+
+	if Torrent.Info.Name != "test.bin" || Torrent.Info.PieceLength != 16384 {
+		t.Errorf("installed info = %+v", Torrent.Info)
+	}
+
+	// Nothing was requested from the peer advertising too much
+	_, err = Torrent.readMessage(oversizedRemote, 100*time.Millisecond)
+	if !errors.Is(err, errReceiveTimeout) {
+		t.Errorf("oversized peer received a request (%v)", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,126 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+metric describes a single Prometheus metric emitted by WriteMetrics.
+
+Fields:
+  - name: Metric name (stable, prefixed with "bittorrent_").
+  - kind: Prometheus metric type ("counter" or "gauge").
+  - help: Human-readable description.
+  - value: Current value.
+*/
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value float64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+escapeLabel escapes a string for use as a Prometheus label value.
+
+Parameters:
+  - value: Raw label value.
+
+Returns:
+  - string: Value with backslashes, quotes, and newlines escaped.
+*/
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WriteMetrics writes the torrent's statistics in the Prometheus text exposition format.
+Every metric is labeled with the torrent's info hash and name.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to report on.
+  - w: Destination writer.
+
+Returns:
+  - error: Non-nil if writing to w fails.
+*/
+func (Torrent *TorrentFile) WriteMetrics(w io.Writer) error {
+	stats := Torrent.Stats()
+
+	metrics := []metric{
+		{"bittorrent_downloaded_bytes_total", "counter", "Verified payload bytes downloaded.", float64(stats.Downloaded)},
+		{"bittorrent_uploaded_bytes_total", "counter", "Payload bytes uploaded to peers.", float64(stats.Uploaded)},
+		{"bittorrent_download_speed_bytes", "gauge", "Current download speed in bytes per second.", float64(stats.DownloadRate)},
+		{"bittorrent_connected_peers", "gauge", "Number of connected peers.", float64(stats.ConnectedPeers)},
+		{"bittorrent_half_open_connections", "gauge", "Outgoing peer connections still being dialed.", float64(stats.HalfOpen)},
+		{"bittorrent_pieces_completed", "gauge", "Number of pieces verified and written.", float64(stats.CompletedPieces)},
+		{"bittorrent_pieces_total", "gauge", "Total number of pieces in the torrent.", float64(stats.TotalPieces)},
+		{"bittorrent_hash_failures_total", "counter", "Pieces that failed hash verification.", float64(stats.HashFailures)},
+		{"bittorrent_tracker_errors_total", "counter", "Failed tracker announces.", float64(stats.TrackerErrors)},
+	}
+
+	labels := fmt.Sprintf(`info_hash="%x",name="%s"`, Torrent.Info.InfoHash, escapeLabel(Torrent.Info.Name))
+
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n",
+			m.name, m.help, m.name, m.kind, m.name, labels, m.value)
+		if err != nil {
+			return fmt.Errorf("Writing metrics error: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ServeMetrics starts an HTTP server exposing WriteMetrics at /metrics on Config.MetricsAddr.
+The server runs in a background goroutine until Close; it does nothing if MetricsAddr is empty.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to report on.
+
+Returns:
+  - None: Listen errors are logged.
+*/
+func (Torrent *TorrentFile) ServeMetrics() {
+	if Torrent.Config.MetricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		err := Torrent.WriteMetrics(w)
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	})
+
+	server := &http.Server{Addr: Torrent.Config.MetricsAddr, Handler: mux}
+	Torrent.addCloser(server)
+
+	go func() {
+		log.Printf("[INFO]\tServing metrics on http://%s/metrics\n", Torrent.Config.MetricsAddr)
+
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[ERROR]\tMetrics server failed: %v\n", err)
+		}
+	}()
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,639 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+EncryptionMode selects whether peer connections use Message Stream Encryption (MSE/PE).
+
+Values:
+  - EncryptionDisabled: Only plaintext handshakes are sent and accepted.
+  - EncryptionPrefer: Outgoing connections try an encrypted handshake and fall back to plaintext;
+    both kinds of incoming connections are accepted.
+  - EncryptionRequire: Only RC4-encrypted connections are made and accepted.
+*/
+type EncryptionMode int
+
+const (
+	EncryptionDisabled EncryptionMode = iota
+	EncryptionPrefer
+	EncryptionRequire
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// mseP is the 768-bit prime of the MSE Diffie-Hellman key exchange, with generator mseG.
+var (
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C4"+
+		"2E9A63A36210000000000090563", 16)
+	mseG = big.NewInt(2)
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// mseVC is the verification constant both sides encrypt to find the start of the encrypted stream.
+var mseVC = make([]byte, 8)
+
+// --------------------------------------------------------------------------------------------- //
+
+// mseKeyLength is the size of a public key, mseMaxPad and mseMaxInitial bound the paddings and the
+// initial payload, the mseProvide bits are the crypto methods, and mseTimeout bounds the handshake.
+const (
+	mseKeyLength        = 96
+	mseMaxPad           = 512
+	mseMaxInitial       = 4096
+	mseProvidePlaintext = 0x01
+	mseProvideRC4       = 0x02
+	mseTimeout          = 10 * time.Second
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseConn is a peer connection after the MSE handshake.
+Bytes in prefix were already received and decrypted during the handshake and are returned
+first. With RC4 selected, all later traffic is encrypted in both directions.
+
+Fields:
+  - Conn: Underlying TCP connection.
+  - prefix: Decrypted initial payload still to be read.
+  - encrypt: RC4 stream for outgoing data (nil for plaintext).
+  - decrypt: RC4 stream for incoming data (nil for plaintext).
+  - writeMutex: Serializes writes, which must reach the RC4 stream in order.
+*/
+type mseConn struct {
+	net.Conn
+	prefix     []byte
+	encrypt    *rc4.Cipher
+	decrypt    *rc4.Cipher
+	writeMutex sync.Mutex
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Read reads from the connection, decrypting the data if RC4 was selected.
+
+Parameters:
+  - data: Destination buffer.
+
+Returns:
+  - int: Number of bytes read.
+  - error: Non-nil if reading from the connection fails.
+*/
+func (Conn *mseConn) Read(data []byte) (int, error) {
+	if len(Conn.prefix) > 0 {
+		n := copy(data, Conn.prefix)
+		Conn.prefix = Conn.prefix[n:]
+
+		return n, nil
+	}
+
+	n, err := Conn.Conn.Read(data)
+	if Conn.decrypt != nil {
+		Conn.decrypt.XORKeyStream(data[:n], data[:n])
+	}
+
+	return n, err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Write writes to the connection, encrypting the data if RC4 was selected.
+
+Parameters:
+  - data: Bytes to write.
+
+Returns:
+  - int: Number of bytes written.
+  - error: Non-nil if writing to the connection fails.
+*/
+func (Conn *mseConn) Write(data []byte) (int, error) {
+	Conn.writeMutex.Lock()
+	defer Conn.writeMutex.Unlock()
+
+	if Conn.encrypt == nil {
+		return Conn.Conn.Write(data)
+	}
+
+	encrypted := make([]byte, len(data))
+	Conn.encrypt.XORKeyStream(encrypted, data)
+
+	return Conn.Conn.Write(encrypted)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isEncrypted reports whether a peer connection is RC4-encrypted.
+
+Parameters:
+  - conn: Peer connection.
+
+Returns:
+  - bool: True if the MSE handshake selected RC4.
+*/
+func isEncrypted(conn net.Conn) bool {
+	encrypted, ok := conn.(*mseConn)
+	return ok && encrypted.encrypt != nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseHash returns the SHA-1 hash of the concatenated parts, the HASH() function of MSE.
+
+Parameters:
+  - parts: Byte slices to hash in order.
+
+Returns:
+  - []byte: 20-byte digest.
+*/
+func mseHash(parts ...[]byte) []byte {
+	hash := sha1.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return hash.Sum(nil)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseKeyPair generates an ephemeral Diffie-Hellman key pair.
+
+Returns:
+  - *big.Int: Private key (160 random bits).
+  - []byte: Public key, left-padded to mseKeyLength bytes.
+  - error: Non-nil if no randomness is available.
+*/
+func mseKeyPair() (*big.Int, []byte, error) {
+	secret := make([]byte, 20)
+
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Generating MSE key error: %v\n", err)
+	}
+
+	private := new(big.Int).SetBytes(secret)
+	public := new(big.Int).Exp(mseG, private, mseP).FillBytes(make([]byte, mseKeyLength))
+
+	return private, public, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseSecret computes the shared secret S from our private key and the peer's public key.
+
+Parameters:
+  - private: Our private key.
+  - remote: The peer's public key (mseKeyLength bytes).
+
+Returns:
+  - []byte: S, left-padded to mseKeyLength bytes.
+*/
+func mseSecret(private *big.Int, remote []byte) []byte {
+	peerKey := new(big.Int).SetBytes(remote)
+	return new(big.Int).Exp(peerKey, private, mseP).FillBytes(make([]byte, mseKeyLength))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseCipher creates one direction's RC4 stream, with the first 1024 keystream bytes discarded.
+
+Parameters:
+  - name: "keyA" for the initiator's direction, "keyB" for the receiver's.
+  - secret: Shared secret S.
+  - skey: Stream key (the torrent's info hash).
+
+Returns:
+  - *rc4.Cipher: Ready-to-use RC4 stream.
+*/
+func mseCipher(name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(mseHash([]byte(name), secret, skey))
+
+	discard := make([]byte, 1024)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+msePadding returns up to mseMaxPad random bytes sent after a public key.
+
+Returns:
+  - []byte: Padding of random length.
+  - error: Non-nil if no randomness is available.
+*/
+func msePadding() ([]byte, error) {
+	var length [2]byte
+
+	_, err := rand.Read(length[:])
+	if err != nil {
+		return nil, fmt.Errorf("Generating MSE padding error: %v\n", err)
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(mseMaxPad+1))
+
+	_, err = rand.Read(pad)
+	if err != nil {
+		return nil, fmt.Errorf("Generating MSE padding error: %v\n", err)
+	}
+
+	return pad, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseSkipKey returns the obfuscated stream key the initiator sends: HASH('req2', SKEY) xor
+HASH('req3', S).
+
+Parameters:
+  - secret: Shared secret S.
+  - skey: Stream key (the torrent's info hash).
+
+Returns:
+  - []byte: 20 obfuscated bytes.
+*/
+func mseSkipKey(secret, skey []byte) []byte {
+	key := mseHash([]byte("req2"), skey)
+	mask := mseHash([]byte("req3"), secret)
+
+	for i := range key {
+		key[i] ^= mask[i]
+	}
+
+	return key
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseSync reads from r until marker has been read, skipping at most maxSkip bytes before it.
+It finds the end of the peer's random padding, whose length is not sent.
+
+Parameters:
+  - r: Connection to read from.
+  - marker: Bytes that end the padding.
+  - maxSkip: Maximum number of bytes allowed before the marker.
+
+Returns:
+  - error: Non-nil if reading fails or the marker is not found in time.
+*/
+func mseSync(r io.Reader, marker []byte, maxSkip int) error {
+	window := make([]byte, 0, len(marker)+maxSkip)
+	next := make([]byte, 1)
+
+	for len(window) < cap(window) {
+		_, err := io.ReadFull(r, next)
+		if err != nil {
+			return fmt.Errorf("Reading MSE handshake error: %v\n", err)
+		}
+
+		window = append(window, next[0])
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("MSE synchronization marker not found\n")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseReadEncrypted reads and decrypts exactly len(data) bytes.
+
+Parameters:
+  - r: Connection to read from.
+  - decrypt: RC4 stream of the sending side.
+  - data: Destination buffer.
+
+Returns:
+  - error: Non-nil if reading fails.
+*/
+func mseReadEncrypted(r io.Reader, decrypt *rc4.Cipher, data []byte) error {
+	_, err := io.ReadFull(r, data)
+	if err != nil {
+		return fmt.Errorf("Reading MSE handshake error: %v\n", err)
+	}
+
+	decrypt.XORKeyStream(data, data)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseInitiate runs the initiator side of the MSE handshake on a freshly dialed connection.
+RC4 is offered, together with plaintext unless Config.Encryption is EncryptionRequire,
+and the peer picks one. The BitTorrent handshake follows on the returned connection.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose info hash is the stream key.
+  - conn: Connection to the peer.
+
+Returns:
+  - net.Conn: Connection using the method the peer selected.
+  - error: Non-nil if the handshake fails or the peer selects a method we did not offer.
+*/
+func (Torrent *TorrentFile) mseInitiate(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	pad, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, pad...))
+	if err != nil {
+		return nil, fmt.Errorf("Sending MSE key error: %v\n", err)
+	}
+
+	remote := make([]byte, mseKeyLength)
+
+	_, err = io.ReadFull(conn, remote)
+	if err != nil {
+		return nil, fmt.Errorf("Reading MSE key error: %v\n", err)
+	}
+
+	secret := mseSecret(private, remote)
+	skey := Torrent.Info.InfoHash[:]
+	encrypt := mseCipher("keyA", secret, skey)
+	decrypt := mseCipher("keyB", secret, skey)
+
+	provide := uint32(mseProvideRC4)
+	if Torrent.Config.Encryption != EncryptionRequire {
+		provide |= mseProvidePlaintext
+	}
+
+	// VC, crypto_provide, len(PadC) = 0, len(IA) = 0
+	offer := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(offer[8:12], provide)
+	encrypt.XORKeyStream(offer, offer)
+
+	var request bytes.Buffer
+	request.Write(mseHash([]byte("req1"), secret))
+	request.Write(mseSkipKey(secret, skey))
+	request.Write(offer)
+
+	_, err = conn.Write(request.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("Sending MSE request error: %v\n", err)
+	}
+
+	vc := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(vc, mseVC)
+
+	err = mseSync(conn, vc, mseMaxPad)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 4+2)
+
+	err = mseReadEncrypted(conn, decrypt, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := binary.BigEndian.Uint32(reply[0:4])
+	padLength := int(binary.BigEndian.Uint16(reply[4:6]))
+	if padLength > mseMaxPad {
+		return nil, fmt.Errorf("Invalid MSE padding length %d\n", padLength)
+	}
+
+	err = mseReadEncrypted(conn, decrypt, make([]byte, padLength))
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == mseProvideRC4 {
+		return &mseConn{Conn: conn, encrypt: encrypt, decrypt: decrypt}, nil
+	}
+
+	if selected == mseProvidePlaintext && provide&mseProvidePlaintext != 0 {
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("Peer selected unsupported MSE crypto method %d\n", selected)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+mseAccept runs the receiver side of the MSE handshake on an inbound connection.
+A connection starting with a plaintext BitTorrent handshake is passed through unless
+Config.Encryption is EncryptionRequire; an encrypted one is refused if encryption is disabled.
+RC4 is selected whenever the peer offers it.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose info hash is the expected stream key.
+  - conn: Inbound connection.
+
+Returns:
+  - net.Conn: Connection the BitTorrent handshake is read from.
+  - error: Non-nil if the handshake fails, is for another torrent, or violates Config.Encryption.
+*/
+func (Torrent *TorrentFile) mseAccept(conn net.Conn) (net.Conn, error) {
+	const protocol = "BitTorrent protocol"
+
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	first := make([]byte, 1+len(protocol))
+
+	_, err := io.ReadFull(conn, first)
+	if err != nil {
+		return nil, fmt.Errorf("Reading handshake error: %v\n", err)
+	}
+
+	if first[0] == byte(len(protocol)) && string(first[1:]) == protocol {
+		if Torrent.Config.Encryption == EncryptionRequire {
+			return nil, fmt.Errorf("Plaintext handshake refused, encryption is required\n")
+		}
+
+		return &mseConn{Conn: conn, prefix: first}, nil
+	}
+
+	if Torrent.Config.Encryption == EncryptionDisabled {
+		return nil, fmt.Errorf("Encrypted handshake refused, encryption is disabled\n")
+	}
+
+	remote := make([]byte, mseKeyLength)
+	copy(remote, first)
+
+	_, err = io.ReadFull(conn, remote[len(first):])
+	if err != nil {
+		return nil, fmt.Errorf("Reading MSE key error: %v\n", err)
+	}
+
+	private, public, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	pad, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, pad...))
+	if err != nil {
+		return nil, fmt.Errorf("Sending MSE key error: %v\n", err)
+	}
+
+	secret := mseSecret(private, remote)
+	skey := Torrent.Info.InfoHash[:]
+
+	err = mseSync(conn, mseHash([]byte("req1"), secret), mseMaxPad)
+	if err != nil {
+		return nil, err
+	}
+
+	skipKey := make([]byte, sha1.Size)
+
+	_, err = io.ReadFull(conn, skipKey)
+	if err != nil {
+		return nil, fmt.Errorf("Reading MSE request error: %v\n", err)
+	}
+
+	if !bytes.Equal(skipKey, mseSkipKey(secret, skey)) {
+		return nil, fmt.Errorf("Info hash mismatch in MSE handshake\n")
+	}
+
+	decrypt := mseCipher("keyA", secret, skey)
+	encrypt := mseCipher("keyB", secret, skey)
+
+	offer := make([]byte, 8+4+2)
+
+	err = mseReadEncrypted(conn, decrypt, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(offer[0:8], mseVC) {
+		return nil, fmt.Errorf("Invalid MSE verification constant\n")
+	}
+
+	provide := binary.BigEndian.Uint32(offer[8:12])
+	padLength := int(binary.BigEndian.Uint16(offer[12:14]))
+	if padLength > mseMaxPad {
+		return nil, fmt.Errorf("Invalid MSE padding length %d\n", padLength)
+	}
+
+	padAndLength := make([]byte, padLength+2)
+
+	err = mseReadEncrypted(conn, decrypt, padAndLength)
+	if err != nil {
+		return nil, err
+	}
+
+	initialLength := int(binary.BigEndian.Uint16(padAndLength[padLength:]))
+	if initialLength > mseMaxInitial {
+		return nil, fmt.Errorf("Invalid MSE initial payload length %d\n", initialLength)
+	}
+
+	initial := make([]byte, initialLength)
+
+	err = mseReadEncrypted(conn, decrypt, initial)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&mseProvideRC4 != 0:
+		selected = mseProvideRC4
+	case provide&mseProvidePlaintext != 0 && Torrent.Config.Encryption != EncryptionRequire:
+		selected = mseProvidePlaintext
+	default:
+		return nil, fmt.Errorf("No common MSE crypto method (peer offered %d)\n", provide)
+	}
+
+	// VC, crypto_select, len(PadD) = 0
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, fmt.Errorf("Sending MSE reply error: %v\n", err)
+	}
+
+	accepted := &mseConn{Conn: conn, prefix: initial}
+	if selected == mseProvideRC4 {
+		accepted.encrypt = encrypt
+		accepted.decrypt = decrypt
+	}
+
+	return accepted, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dialHandshake dials a peer and, unless encryption is disabled, runs the MSE handshake on the
+connection. With EncryptionPrefer a failed encrypted handshake is retried in plaintext on a
+new connection, since peers that do not support MSE drop the connection.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile the connection is for.
+  - addr: Address of the peer ("host:port").
+
+Returns:
+  - net.Conn: Connection ready for the BitTorrent handshake.
+  - error: Non-nil if the peer cannot be reached or the required encryption fails.
+*/
+func (Torrent *TorrentFile) dialHandshake(addr string) (net.Conn, error) {
+	conn, err := Torrent.dialPeer(addr)
+	if err != nil || Torrent.Config.Encryption == EncryptionDisabled {
+		return conn, err
+	}
+
+	encrypted, err := Torrent.mseInitiate(conn)
+	if err == nil {
+		return encrypted, nil
+	}
+
+	conn.Close()
+
+	if Torrent.Config.Encryption == EncryptionRequire {
+		return nil, fmt.Errorf("Encrypted handshake failed: %v", err)
+	}
+
+	log.Printf("[INFO]\tPeer %s: encrypted handshake failed, retrying in plaintext: %v", addr, err)
+
+	return Torrent.dialPeer(addr)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,171 @@
+package torrent
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	"BitTorrent/torrent/dht"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseMutableMagnet reads the publisher key and salt of a BEP-46 magnet link.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being parsed.
+  - key: Hex-encoded ed25519 public key from the "xs" parameter.
+  - salt: Hex-encoded salt from the "s" parameter (may be empty).
+
+Returns:
+  - error: Non-nil if the key or salt is not valid hex or the key has the wrong size.
+*/
+func (Torrent *TorrentFile) parseMutableMagnet(key string, salt string) error {
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid magnet public key %q\n", key)
+	}
+
+	decodedSalt, err := hex.DecodeString(salt)
+	if err != nil {
+		return fmt.Errorf("Invalid magnet salt %q: %v\n", salt, err)
+	}
+
+	Torrent.mutableKey = ed25519.PublicKey(decoded)
+	Torrent.mutableSalt = string(decodedSalt)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ResolveMutable looks up the info hash a BEP-46 magnet link currently points to: the "ih" of
+the latest mutable item its publisher key signed, found over every DHT stack.
+
+Parameters:
+  - Torrent: Pointer to a TorrentFile parsed from a link with a publisher key.
+
+Returns:
+  - error: Non-nil if the torrent has no publisher key, the DHT cannot be used, or no valid
+    item naming an info hash is found.
+*/
+func (Torrent *TorrentFile) ResolveMutable() error {
+	if Torrent.mutableKey == nil {
+		return fmt.Errorf("Torrent has no publisher key\n")
+	}
+
+	if !Torrent.Config.DHT {
+		return fmt.Errorf("Resolving a mutable magnet link needs the DHT\n")
+	}
+
+	clients, err := Torrent.dhtClients()
+	if err != nil {
+		return err
+	}
+
+	bootstrap := Torrent.dhtBootstrap()
+
+	var latest *dht.Item
+	var latestMutex sync.Mutex
+
+	eachDHTClient(clients, func(client *dht.Client) {
+		item, err := client.GetMutable(Torrent.mutableKey, Torrent.mutableSalt, bootstrap)
+		if err != nil {
+			log.Printf("[FAIL]\tDHT get: %v", err)
+			return
+		}
+
+		latestMutex.Lock()
+		if latest == nil || item.Seq > latest.Seq {
+			latest = item
+		}
+		latestMutex.Unlock()
+	})
+
+	if latest == nil {
+		return fmt.Errorf("No DHT node has an item for key %x\n", []byte(Torrent.mutableKey))
+	}
+
+	value, _ := latest.Value.(map[string]interface{})
+	infoHash, _ := value["ih"].(string)
+	if len(infoHash) != 20 {
+		return fmt.Errorf("Mutable item of key %x names no info hash\n", []byte(Torrent.mutableKey))
+	}
+
+	copy(Torrent.Info.InfoHash[:], infoHash)
+
+	log.Printf("[INFO]\tMutable magnet link resolved to InfoHash %x (sequence %d)\n", Torrent.Info.InfoHash, latest.Seq)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PublishMutable points a stable publisher key at the torrent (BEP-46): a mutable item naming
+its info hash is signed and stored in the DHT. Publishing a new version of the content under
+the same key and salt with a higher sequence number updates what the link resolves to.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to publish.
+  - key: ed25519 private key of the publisher.
+  - salt: Salt distinguishing several torrents published with one key (may be empty).
+  - seq: Sequence number, higher than that of every earlier publication under key and salt.
+
+Returns:
+  - string: Magnet link ("magnet:?xs=urn:btpk:...") resolving to the latest publication.
+  - error: Non-nil if the torrent is private, the DHT cannot be used, or no node stored the item.
+*/
+func (Torrent *TorrentFile) PublishMutable(key ed25519.PrivateKey, salt string, seq int64) (string, error) {
+	if !Torrent.dhtEnabled() {
+		return "", fmt.Errorf("The DHT is disabled for %s\n", Torrent.Info.Name)
+	}
+
+	item, err := dht.NewMutableItem(key, salt, seq, map[string]interface{}{
+		"ih": string(Torrent.Info.InfoHash[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	clients, err := Torrent.dhtClients()
+	if err != nil {
+		return "", err
+	}
+
+	bootstrap := Torrent.dhtBootstrap()
+
+	var storedMutex sync.Mutex
+	stored := 0
+
+	eachDHTClient(clients, func(client *dht.Client) {
+		count, err := client.Put(item, bootstrap)
+		if err != nil {
+			log.Printf("[FAIL]\tDHT put: %v", err)
+			return
+		}
+
+		storedMutex.Lock()
+		stored += count
+		storedMutex.Unlock()
+	})
+
+	if stored == 0 {
+		return "", fmt.Errorf("No DHT node stored the publication of %s\n", Torrent.Info.Name)
+	}
+
+	link := "magnet:?xs=" + magnetKeyPrefix + hex.EncodeToString(item.PublicKey)
+	if salt != "" {
+		link += "&s=" + hex.EncodeToString([]byte(salt))
+	}
+
+	log.Printf("[INFO]\tPublished %s (sequence %d) to %d DHT nodes: %s\n", Torrent.Info.Name, seq, stored, link)
+
+	return link, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
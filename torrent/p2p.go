@@ -2,21 +2,48 @@ package torrent
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // --------------------------------------------------------------------------------------------- //
 
+// blockSize is the length of the blocks a piece is requested in; only the last block of the last piece may be shorter.
+const blockSize = 1 << 14 // 16 kB
+
+// --------------------------------------------------------------------------------------------- //
+
+// errReceiveTimeout is returned by receiveMessage when no message arrives within the timeout.
+var errReceiveTimeout = errors.New("Timed out waiting for a message")
+
+// errPeerSnubbed is returned by downloadPiece when an unchoked peer stops delivering blocks.
+var errPeerSnubbed = errors.New("Peer is snubbing us")
+
+// errPeerUnreachable is returned by PerformHandshake when the peer cannot be dialed.
+var errPeerUnreachable = errors.New("Connecting to peer failed")
+
+// errShortBlockRefused is returned by downloadPiece when a peer leaves the short final block unanswered.
+var errShortBlockRefused = errors.New("Peer cannot serve the short final block")
+
+// ErrDownloadCanceled is returned by StartDownload when CancelDownload stopped it.
+var ErrDownloadCanceled = errors.New("Download canceled")
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 Handshake represents the structure of a BitTorrent protocol handshake message.
 It is used to initiate a connection with a peer and verify compatibility.
@@ -40,7 +67,9 @@ type Handshake struct {
 
 /*
 PerformHandshake executes the BitTorrent handshake with a specified peer.
-It establishes a TCP connection, sends a handshake message, and verifies the response.
+It establishes a TCP connection (encrypted according to Config.Encryption), sends a handshake
+message, and verifies the response. Our bitfield follows as the first message (see
+sendBitfield), before the extension handshake.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing metadata like InfoHash.
@@ -51,19 +80,14 @@ Returns:
   - error: Non-nil if connection, handshake sending, or response validation fails.
 */
 func (Torrent *TorrentFile) PerformHandshake(peer Peer) (string, error) {
-	addr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-	myIP, err := GetExternalIP()
-	if err != nil {
-		return "", err
-	}
-
-	if peer.IP == myIP {
+	addr := net.JoinHostPort(peer.IP, strconv.Itoa(int(peer.Port)))
+	if Torrent.Config.FilterSelfPeers && Torrent.isSelf(peer) {
 		return "", fmt.Errorf("Skip handshake with self: %s", addr)
 	}
 
-	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	conn, err := Torrent.dialHandshake(addr)
 	if err != nil {
-		return "", fmt.Errorf("Connecting to peer failed: %v", err)
+		return "", fmt.Errorf("%w: %v", errPeerUnreachable, err)
 	}
 
 	protocol := "BitTorrent protocol"
@@ -71,9 +95,10 @@ func (Torrent *TorrentFile) PerformHandshake(peer Peer) (string, error) {
 	var hs Handshake
 	hs.ProtocolNameLength = byte(len(protocol))
 	copy(hs.Protocol[:], protocol)
+	hs.Reserved = Torrent.Config.ReservedBits
 	hs.InfoHash = Torrent.Info.InfoHash
 
-	peerID, err := Torrent.GeneratePeerID()
+	peerID, err := Torrent.PeerID()
 	if err != nil {
 		conn.Close()
 		return "", err
@@ -114,17 +139,37 @@ func (Torrent *TorrentFile) PerformHandshake(peer Peer) (string, error) {
 
 	remotePeerID := string(response.PeerID[:])
 
-	Torrent.PeersMutex.Lock()
-	Torrent.Peers = append(Torrent.Peers, Peer{
+	connected := &Peer{
 		IP:         peer.IP,
 		Port:       peer.Port,
 		PeerID:     remotePeerID,
 		Connection: conn,
-		Choked:     true,
+		Encrypted:  isEncrypted(conn),
+		State:      newPeerState(),
 		Bitfield:   nil,
-	})
+	}
+
+	err = Torrent.sendBitfield(connected, fastAgreed(hs.Reserved, response.Reserved))
+	if err != nil {
+		conn.Close()
+		return "", fmt.Errorf("Sending bitfield error: %v\n", err)
+	}
+
+	Torrent.counters.connectedPeers.Add(1)
+
+	if extensionsAgreed(hs.Reserved, response.Reserved) {
+		err = Torrent.sendExtensionHandshake(connected)
+		if err != nil {
+			log.Printf("[ERROR]\t%s: %v", addr, err)
+		}
+	}
+
+	Torrent.PeersMutex.Lock()
+	Torrent.Peers = append(Torrent.Peers, connected)
 	Torrent.PeersMutex.Unlock()
 
+	Torrent.emit(Event{Type: PeerConnected, Peer: connected.ListenAddr(), Piece: -1})
+
 	return remotePeerID, nil
 }
 
@@ -146,6 +191,16 @@ func (Torrent *TorrentFile) ConnectToPeers(peers []Peer) {
 	sem := make(chan struct{}, 10)
 
 	for _, peer := range peers {
+		if Torrent.Config.FilterSelfPeers && Torrent.isSelf(peer) {
+			logPeerf(&peer, -1, "[INFO]\tour own endpoint, skipping\n")
+			continue
+		}
+
+		if Torrent.isBanned(peer.IP) {
+			logPeerf(&peer, -1, "[INFO]\tbanned for sending corrupt data, skipping\n")
+			continue
+		}
+
 		wg.Add(1)
 		sem <- struct{}{}
 
@@ -153,21 +208,65 @@ func (Torrent *TorrentFile) ConnectToPeers(peers []Peer) {
 			defer func() {
 				<-sem
 				wg.Done()
-				log.Printf("[INFO]\tPeer %s:%d: CTP goroutine completed\n", peer.IP, peer.Port)
+				logPeerf(&p, -1, "[INFO]\tCTP goroutine completed\n")
 			}()
 
 			remotePeerID, err := Torrent.PerformHandshake(p)
+			if errors.Is(err, errPeerUnreachable) {
+				Torrent.requestHolepunch(p)
+			}
+
 			if err != nil {
 				return
 			}
 
-			log.Printf("[INFO]\tPeer %s:%d handshake successful, remotePeerID: %s\n",
-				p.IP, p.Port, remotePeerID)
+			logPeerf(&p, -1, "[INFO]\thandshake successful, remotePeerID: %s\n", remotePeerID)
 		}(peer)
 	}
 
 	wg.Wait()
-	log.Printf("[INFO]\tConnected to %d peers\n", len(Torrent.Peers))
+
+	Torrent.PeersMutex.Lock()
+	connected := len(Torrent.Peers)
+	Torrent.PeersMutex.Unlock()
+
+	log.Printf("[INFO]\tConnected to %d peers\n", connected)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+removePeer closes a peer's connection and drops it from Torrent.Peers, forgetting the
+addresses learned from it through PEX. It is safe to call more than once for the same peer.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the peer list.
+  - peer: Peer to disconnect.
+*/
+func (Torrent *TorrentFile) removePeer(peer *Peer) {
+	Torrent.PeersMutex.Lock()
+	defer Torrent.PeersMutex.Unlock()
+
+	for i, p := range Torrent.Peers {
+		if p == peer {
+			Torrent.Peers = append(Torrent.Peers[:i], Torrent.Peers[i+1:]...)
+			Torrent.counters.connectedPeers.Add(-1)
+			Torrent.emit(Event{Type: PeerDisconnected, Peer: peer.ListenAddr(), Piece: -1})
+
+			break
+		}
+	}
+
+	// Addresses the peer told us about may be learned and dialed again from other peers
+	for addr, source := range Torrent.pexKnown {
+		if source.peer == peer {
+			delete(Torrent.pexKnown, addr)
+		}
+	}
+
+	if peer.Connection != nil {
+		peer.Connection.Close()
+	}
 }
 
 // --------------------------------------------------------------------------------------------- //
@@ -175,6 +274,12 @@ func (Torrent *TorrentFile) ConnectToPeers(peers []Peer) {
 /*
 InitializePieces sets up the piece-related metadata for the torrent.
 It extracts piece length, number of pieces, and piece hashes from the torrent's info.
+Piece state is only allocated once, so calling it again keeps progress already recorded.
+Offsets in the piece space are int64 throughout; only offsets within a piece travel as
+uint32 on the wire, so the piece length must fit in 32 bits and the piece count must
+match the total size, or writes would land at wrapped or misaligned file offsets.
+Merkle torrents (BEP-30) have no piece hashes up front: the piece count follows from the
+total size and the hashes are learned through the hash tree (see merkleTree).
 
 Parameters:
   - Torrent: Pointer to the TorrentFile to initialize.
@@ -183,6 +288,10 @@ Returns:
   - error: Non-nil if the pieces data is invalid.
 */
 func (Torrent *TorrentFile) InitializePieces() error {
+	if Torrent.Info.PieceLength <= 0 || Torrent.Info.PieceLength > math.MaxUint32 {
+		return fmt.Errorf("Invalid piece length: %d\n", Torrent.Info.PieceLength)
+	}
+
 	Torrent.PieceLength = Torrent.Info.PieceLength
 	pieces := Torrent.Info.Pieces
 	if len(pieces)%20 != 0 {
@@ -190,19 +299,84 @@ func (Torrent *TorrentFile) InitializePieces() error {
 	}
 
 	Torrent.NumPieces = len(pieces) / 20
+
+	total, _ := Torrent.GetTotalSize()
+	if Torrent.IsMerkle() {
+		if total == 0 {
+			return fmt.Errorf("Merkle torrent has no data\n")
+		}
+
+		Torrent.NumPieces = int((int64(total) + Torrent.Info.PieceLength - 1) / Torrent.Info.PieceLength)
+	}
+	if Torrent.NumPieces > 0 && int64(Torrent.NumPieces) != (int64(total)+Torrent.Info.PieceLength-1)/Torrent.Info.PieceLength {
+		return fmt.Errorf("Piece count %d does not match total size %d with piece length %d\n",
+			Torrent.NumPieces, total, Torrent.Info.PieceLength)
+	}
+
 	Torrent.PieceHashes = make([][20]byte, Torrent.NumPieces)
 
-	for i := 0; i < Torrent.NumPieces; i++ {
+	for i := 0; i < Torrent.NumPieces && !Torrent.IsMerkle(); i++ {
 		copy(Torrent.PieceHashes[i][:], pieces[i*20:(i+1)*20])
 	}
 
-	Torrent.Downloaded = make([]bool, Torrent.NumPieces)
+	if Torrent.IsMerkle() && Torrent.merkle == nil {
+		var root [20]byte
+		copy(root[:], Torrent.Info.RootHash)
+		Torrent.merkle = newMerkleTree(root, Torrent.NumPieces)
+	}
+
+	if Torrent.Downloaded.Len() != Torrent.NumPieces {
+		Torrent.Downloaded = NewBitSet(Torrent.NumPieces)
+		Torrent.InProgress = NewBitSet(Torrent.NumPieces)
+		Torrent.Wanted = NewBitSet(Torrent.NumPieces)
+		Torrent.Availability = make([]int, Torrent.NumPieces)
+		Torrent.pieceAccess = make([]atomic.Int64, Torrent.NumPieces)
+
+		for i := 0; i < Torrent.NumPieces; i++ {
+			Torrent.Wanted.Set(i)
+		}
+	}
+
+	if Torrent.Picker == nil {
+		Torrent.Picker = &RarestFirstPicker{Torrent: Torrent}
+	}
 
 	return nil
 }
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+PieceSize returns the length in bytes of the piece at the given index.
+Every piece has PieceLength bytes except the last one, which holds the remainder.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing piece metadata.
+  - index: Index of the piece.
+
+Returns:
+  - int64: Length of the piece in bytes (0 if the piece length is not set).
+*/
+func (Torrent *TorrentFile) PieceSize(index int) int64 {
+	if Torrent.PieceLength <= 0 {
+		return 0
+	}
+
+	if index != Torrent.NumPieces-1 {
+		return Torrent.PieceLength
+	}
+
+	total, _ := Torrent.GetTotalSize()
+	size := int64(total) % Torrent.PieceLength
+	if size == 0 {
+		size = Torrent.PieceLength
+	}
+
+	return size
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 MessageID is an enumeration of BitTorrent protocol message types.
 It defines the possible message IDs used in peer communication.
@@ -217,6 +391,7 @@ Values:
   - Request: Requests a block of a piece.
   - Piece: Delivers a block of a piece.
   - Cancel: Cancels a previous request.
+  - Port: Announces the peer's DHT port.
 */
 type MessageID uint8
 
@@ -230,6 +405,7 @@ const (
 	Request
 	Piece
 	Cancel
+	Port
 )
 
 // --------------------------------------------------------------------------------------------- //
@@ -262,28 +438,53 @@ Returns:
   - error: Non-nil if the connection is invalid or all send attempts fail.
 */
 func (Torrent *TorrentFile) SendMessage(peer *Peer, msg Message) error {
+	return Torrent.sendMessages(peer, []Message{msg})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendMessages sends several messages to a peer in a single write, retried up to three times
+like SendMessage. Sending records the time for keepAlive.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Pointer to the Peer to send the messages to.
+  - msgs: Messages to send, in order.
+
+Returns:
+  - error: Non-nil if the connection is invalid or all send attempts fail.
+*/
+func (Torrent *TorrentFile) sendMessages(peer *Peer, msgs []Message) error {
 	if peer.Connection == nil {
 		return fmt.Errorf("No connection to peer %s:%d", peer.IP, peer.Port)
 	}
 
 	var buf bytes.Buffer
-	length := uint32(len(msg.Payload) + 1)
-	binary.Write(&buf, binary.BigEndian, length)
-	binary.Write(&buf, binary.BigEndian, msg.ID)
+	for _, msg := range msgs {
+		length := uint32(len(msg.Payload) + 1)
+		binary.Write(&buf, binary.BigEndian, length)
+		binary.Write(&buf, binary.BigEndian, msg.ID)
 
-	if len(msg.Payload) > 0 {
-		buf.Write(msg.Payload)
+		if len(msg.Payload) > 0 {
+			buf.Write(msg.Payload)
+		}
 	}
 
 	for attempt := 1; attempt <= 3; attempt++ {
 		peer.Connection.SetWriteDeadline(time.Now().Add(60 * time.Second))
 		_, err := peer.Connection.Write(buf.Bytes())
 		if err == nil {
-			log.Printf("[INFO]\tPeer %s:%d: sent message ID=%d, payload length=%d\n", peer.IP, peer.Port, msg.ID, len(msg.Payload))
+			atomic.StoreInt64(&peer.lastSent, time.Now().UnixNano())
+			if len(msgs) == 1 {
+				logPeerf(peer, -1, "[INFO]\tsent message ID=%d, payload length=%d\n", msgs[0].ID, len(msgs[0].Payload))
+			}
+
 			return nil
 		}
 
-		log.Printf("[FAIL]\tPeer %s:%d: attempt %d failed to send message ID = %d: %v\n", peer.IP, peer.Port, attempt, msg.ID, err)
+		logPeerf(peer, -1, "[FAIL]\tattempt %d failed to send %d messages (first ID = %d): %v\n",
+			attempt, len(msgs), msgs[0].ID, err)
 		time.Sleep(2 * time.Second)
 	}
 
@@ -301,24 +502,78 @@ Parameters:
   - peer: Pointer to the Peer to receive the message from.
 
 Returns:
-  - *Message: Pointer to the received message, or an empty message for keep-alive.
+  - *Message: Pointer to the received message, or nil for keep-alive.
   - error: Non-nil if the connection is invalid, message is too large, or read fails.
 */
 func (Torrent *TorrentFile) ReceiveMessage(peer *Peer) (*Message, error) {
+	return Torrent.receiveMessage(peer, 60*time.Second)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+receiveMessage reads the next message like ReceiveMessage, waiting at most timeout.
+If nothing at all arrives in time it returns errReceiveTimeout and the connection stays usable;
+a timeout in the middle of a message is a fatal error.
+Messages kept in peer.pending while fetching metadata are returned first.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Pointer to the Peer to receive from.
+  - timeout: Maximum time to wait for the message.
+
+Returns:
+  - *Message: The received message, or nil for a keep-alive.
+  - error: errReceiveTimeout if no message started in time, other non-nil errors on failure.
+*/
+func (Torrent *TorrentFile) receiveMessage(peer *Peer, timeout time.Duration) (*Message, error) {
+	if len(peer.pending) > 0 {
+		msg := peer.pending[0]
+		peer.pending = peer.pending[1:]
+
+		return msg, nil
+	}
+
+	return Torrent.readMessage(peer, timeout)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+readMessage reads the next message from the peer's connection, ignoring messages kept in
+peer.pending. Timeouts behave as described for receiveMessage.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Pointer to the Peer to receive from.
+  - timeout: Maximum time to wait for the message.
+
+Returns:
+  - *Message: The received message, or nil for a keep-alive.
+  - error: errReceiveTimeout if no message started in time, other non-nil errors on failure.
+*/
+func (Torrent *TorrentFile) readMessage(peer *Peer, timeout time.Duration) (*Message, error) {
 	if peer.Connection == nil {
 		return nil, fmt.Errorf("No connection to peer %s:%d", peer.IP, peer.Port)
 	}
 
-	peer.Connection.SetReadDeadline(time.Now().Add(60 * time.Second))
-	var length uint32
-	err := binary.Read(peer.Connection, binary.BigEndian, &length)
+	peer.Connection.SetReadDeadline(time.Now().Add(timeout))
+	var header [4]byte
+	n, err := io.ReadFull(peer.Connection, header[:])
 	if err != nil {
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, errReceiveTimeout
+		}
+
 		return nil, fmt.Errorf("Reading message length from %s:%d: %v", peer.IP, peer.Port, err)
 	}
 
+	length := binary.BigEndian.Uint32(header[:])
+
 	if length == 0 {
-		log.Printf("[INFO]\tPeer %s:%d: received keep-alive\n", peer.IP, peer.Port)
-		return &Message{}, nil
+		logPeerf(peer, -1, "[INFO]\treceived keep-alive\n")
+		return nil, nil
 	}
 
 	if length > 1<<20 {
@@ -336,7 +591,7 @@ func (Torrent *TorrentFile) ReceiveMessage(peer *Peer) (*Message, error) {
 		Payload: buf[1:],
 	}
 
-	log.Printf("[INFO]\tPeer %s:%d: received message ID=%d, payload length=%d\n", peer.IP, peer.Port, msg.ID, len(msg.Payload))
+	logPeerf(peer, -1, "[INFO]\treceived message ID=%d, payload length=%d\n", msg.ID, len(msg.Payload))
 
 	return msg, nil
 }
@@ -349,11 +604,13 @@ It contains the piece index and its data.
 
 Fields:
   - Index: The index of the downloaded piece.
-  - Data: The byte slice containing the piece's data.
+  - Data: The byte slice containing the piece's data (nil if Streamed).
+  - Streamed: The piece was already written to disk block by block (Config.StreamPieces).
 */
 type PieceResult struct {
-	Index int
-	Data  []byte
+	Index    int
+	Data     []byte
+	Streamed bool
 }
 
 // --------------------------------------------------------------------------------------------- //
@@ -361,6 +618,12 @@ type PieceResult struct {
 /*
 DownloadFromPeer downloads pieces from a specific peer.
 It sends an Interested message, processes incoming messages, and requests pieces.
+While downloading, the peer is also served from the pieces we already have (see handleUpload).
+When Config.MaxConcurrentPieces are already in progress, or the peer has nothing we can pick
+yet, it stays connected in waitForPieces until the pieces change or it announces a new piece
+with Have; it is only let go once every wanted piece is downloaded. Every wait on the
+peer ends once the download is over (see downloadOver), so a peer that keeps us choked cannot
+hold the download open.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing piece metadata.
@@ -373,23 +636,36 @@ Returns:
 */
 func (Torrent *TorrentFile) DownloadFromPeer(peer *Peer, pieceChan chan<- PieceResult, wg *sync.WaitGroup) {
 	defer func() {
-		if peer.Connection != nil {
-			peer.Connection.Close()
+		if !peer.State.AmChoking {
+			<-Torrent.uploadSlots()
+		}
+
+		Torrent.removePeer(peer)
+		Torrent.recordPeerTransfer(peer)
+
+		if peer.Bitfield != nil {
+			Torrent.DownloadMutex.Lock()
+			Torrent.updateAvailability(peer.Bitfield, -1)
+			Torrent.DownloadMutex.Unlock()
+		}
+
+		if peer.Seeder {
+			Torrent.counters.connectedSeeders.Add(-1)
 		}
 
 		wg.Done()
-		log.Printf("[INFO]\tPeer %s:%d: DownloadFromPeer completed\n", peer.IP, peer.Port)
+		logPeerf(peer, -1, "[INFO]\tDownloadFromPeer completed\n")
 	}()
 
-	log.Printf("[INFO]\tPeer %s:%d: Starting download\n", peer.IP, peer.Port)
+	logPeerf(peer, -1, "[INFO]\tStarting download\n")
 
 	for attempt := 1; attempt <= 3; attempt++ {
-		err := Torrent.SendMessage(peer, Message{ID: Interested})
+		err := Torrent.setInterested(peer, true)
 		if err == nil {
 			break
 		}
 
-		log.Printf("[FAIL]\tPeer %s:%d: attempt %d failed to send Interested: %v\n", peer.IP, peer.Port, attempt, err)
+		logPeerf(peer, -1, "[FAIL]\tattempt %d failed to send Interested: %v\n", attempt, err)
 
 		if attempt == 3 {
 			return
@@ -398,197 +674,232 @@ func (Torrent *TorrentFile) DownloadFromPeer(peer *Peer, pieceChan chan<- PieceR
 		time.Sleep(2 * time.Second)
 	}
 
+	lastHeard := time.Now()
+
 	for {
-		msg, err := Torrent.ReceiveMessage(peer)
+		if Torrent.downloadOver() {
+			logPeerf(peer, -1, "[INFO]\tdownload over before the peer was ready\n")
+			return
+		}
+
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+			return
+		}
+
+		timeout := min(wait, time.Until(lastHeard.Add(peerIdleTimeout)), downloadPollInterval)
+		msg, err := Torrent.receiveMessage(peer, max(timeout, time.Millisecond))
+		if errors.Is(err, errReceiveTimeout) && time.Since(lastHeard) < peerIdleTimeout {
+			continue
+		}
+
 		if err != nil {
-			log.Printf("[FAIL]\tPeer %s:%d: failed to receive message: %v\n", peer.IP, peer.Port, err)
+			logPeerf(peer, -1, "[FAIL]\tfailed to receive message: %v\n", err)
 			return
 		}
 
+		lastHeard = time.Now()
+
 		if msg == nil {
-			log.Printf("[INFO]\tPeer %s:%d: received keep-alive\n", peer.IP, peer.Port)
 			continue
 		}
 
 		switch msg.ID {
 		case Bitfield:
-			peer.Bitfield = msg.Payload
-			log.Printf("[INFO]\tPeer %s:%d: received Bitfield (length=%d)\n", peer.IP, peer.Port, len(peer.Bitfield))
-
-		case Unchoke:
-			peer.Choked = false
-			log.Printf("[INFO]\tPeer %s:%d: unchoked\n", peer.IP, peer.Port)
+			if peer.Bitfield != nil {
+				continue
+			}
 
-		case Choke:
-			peer.Choked = true
-			log.Printf("[INFO]\tPeer %s:%d: choked\n", peer.IP, peer.Port)
-		}
+			err := Torrent.checkBitfield(msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return
+			}
 
-		if !peer.Choked && peer.Bitfield != nil {
-			log.Printf("[INFO]\tPeer %s:%d: ready to download pieces\n", peer.IP, peer.Port)
-			break
-		}
-	}
+			Torrent.setBitfield(peer, msg.Payload)
 
-	const (
-		blockSize = 1 << 14 // 16 kB
-	)
+			Torrent.DownloadMutex.Lock()
+			Torrent.updateAvailability(peer.Bitfield, 1)
+			Torrent.DownloadMutex.Unlock()
 
-	for {
-		if peer.Choked {
-			log.Printf("[INFO]\tPeer %s:%d: choked, waiting for Unchoke\n", peer.IP, peer.Port)
+			Torrent.markSeeder(peer)
+			logPeerf(peer, -1, "[INFO]\treceived Bitfield (length=%d)\n", len(peer.Bitfield))
 
-			for {
-				msg, err := Torrent.ReceiveMessage(peer)
-				if err != nil {
-					log.Printf("[FAIL]\tPeer %s:%d: failed to receive message while choked: %v\n", peer.IP, peer.Port, err)
-					return
-				}
+		case HaveAll, HaveNone:
+			if peer.Bitfield != nil {
+				continue
+			}
 
-				if msg == nil {
-					continue
-				}
+			Torrent.setBitfield(peer, Torrent.fullBitfield(msg.ID == HaveAll))
 
-				switch msg.ID {
-				case Unchoke:
-					peer.Choked = false
-					log.Printf("[INFO]\tPeer %s:%d: unchoked\n", peer.IP, peer.Port)
+			Torrent.DownloadMutex.Lock()
+			Torrent.updateAvailability(peer.Bitfield, 1)
+			Torrent.DownloadMutex.Unlock()
 
-				case Choke:
-					peer.Choked = true
-					log.Printf("[INFO]\tPeer %s:%d: choked\n", peer.IP, peer.Port)
-				}
+			Torrent.markSeeder(peer)
+			logPeerf(peer, -1, "[INFO]\treceived HaveAll/HaveNone (seeder: %t)\n", peer.Seeder)
 
-				if !peer.Choked {
-					break
-				}
+		case Have:
+			_, err := Torrent.handleHave(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return
 			}
-		}
 
-		Torrent.DownloadMutex.Lock()
-		pieceIndex := -1
-
-		for i, downloaded := range Torrent.Downloaded {
-			if !downloaded && Torrent.HasPiece(peer.Bitfield, i) {
-				pieceIndex = i
-				Torrent.Downloaded[i] = true
+		case Choke, Unchoke:
+			peer.State.receive(msg.ID)
+			logPeerf(peer, -1, "[INFO]\tstate %+v\n", peer.State)
 
-				break
+		case Interested, NotInterested, Request:
+			_, err := Torrent.handleUpload(peer, msg, Torrent.uploadSlots())
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return
 			}
-		}
 
-		Torrent.DownloadMutex.Unlock()
+		case Port:
+			Torrent.handlePort(peer, msg.Payload)
 
-		if pieceIndex == -1 {
-			log.Printf("[INFO]\tPeer %s:%d: no more pieces to download\n", peer.IP, peer.Port)
-			return
+		case Extended:
+			err := Torrent.handleExtended(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[ERROR]\t%v", err)
+			}
 		}
 
-		pieceLength := Torrent.PieceLength
+		if !peer.State.PeerChoking && peer.Bitfield != nil {
+			logPeerf(peer, -1, "[INFO]\tready to download pieces\n")
+			break
+		}
+	}
 
-		if pieceIndex == Torrent.NumPieces-1 {
-			pieceLength = Torrent.Info.Length % Torrent.PieceLength
+	for {
+		if peer.State.PeerChoking {
+			logPeerf(peer, -1, "[INFO]\tchoked, waiting for Unchoke\n")
 
-			if pieceLength == 0 {
-				pieceLength = Torrent.PieceLength
+			if !Torrent.waitForUnchoke(peer) {
+				return
 			}
 		}
 
-		data := make([]byte, 0, pieceLength)
-
-		for offset := int64(0); offset < pieceLength; offset += int64(blockSize) {
-			remaining := pieceLength - offset
+		Torrent.DownloadMutex.Lock()
+		changed := Torrent.piecesSignal()
+		maxPieces := Torrent.Config.MaxConcurrentPieces
+		if maxPieces > 0 && Torrent.InProgress.Count() >= maxPieces {
+			Torrent.DownloadMutex.Unlock()
 
-			if remaining > int64(blockSize) {
-				remaining = int64(blockSize)
+			logPeerf(peer, -1, "[INFO]\t%d pieces in progress, waiting for a free slot\n", maxPieces)
+			if !Torrent.waitForPieces(peer, changed) {
+				return
 			}
 
-			payload := new(bytes.Buffer)
-			binary.Write(payload, binary.BigEndian, uint32(pieceIndex))
-			binary.Write(payload, binary.BigEndian, uint32(offset))
-			binary.Write(payload, binary.BigEndian, uint32(remaining))
+			continue
+		}
 
-			err := Torrent.SendMessage(peer, Message{ID: Request, Payload: payload.Bytes()})
-			if err != nil {
-				log.Printf("[FAIL]\tPeer %s:%d: failed to send Request for piece %d, offset %d: %v\n",
-					peer.IP, peer.Port, pieceIndex, offset, err)
-				Torrent.DownloadMutex.Lock()
-				Torrent.Downloaded[pieceIndex] = false
-				Torrent.DownloadMutex.Unlock()
+		pieceIndex, ok := Torrent.Picker.Pick(peer, Torrent.InProgress, Torrent.settledPieces(peer))
+		if ok {
+			Torrent.InProgress.Set(pieceIndex)
+		}
+
+		finished := Torrent.wantedDone() == Torrent.Wanted.Count()
+		Torrent.DownloadMutex.Unlock()
 
+		if !ok && !finished {
+			logPeerf(peer, -1, "[INFO]\tnothing to pick yet, waiting for pieces\n")
+			if !Torrent.waitForPieces(peer, changed) {
 				return
 			}
 
-			for {
-				msg, err := Torrent.ReceiveMessage(peer)
-				if err != nil {
-					log.Printf("[FAIL]\tPeer %s:%d: failed to receive Piece for piece %d, offset %d: %v\n",
-						peer.IP, peer.Port, pieceIndex, offset, err)
-					Torrent.DownloadMutex.Lock()
-					Torrent.Downloaded[pieceIndex] = false
-					Torrent.DownloadMutex.Unlock()
+			continue
+		}
 
-					return
-				}
+		if !ok {
+			logPeerf(peer, -1, "[INFO]\tno more pieces to download\n")
+			return
+		}
 
-				if msg == nil {
-					continue
-				}
+		var stream *pieceStream
+		if Torrent.Config.StreamPieces {
+			stream = Torrent.newPieceStream(pieceIndex)
+		}
+
+		networkStart := time.Now()
+		data, err := Torrent.downloadPiece(peer, pieceIndex, stream)
+		networkTime := time.Since(networkStart)
+		Torrent.counters.networkNanos.Add(int64(networkTime))
 
-				switch msg.ID {
-				case Piece:
-					if len(msg.Payload) < 8 {
-						log.Printf("[ERROR]\tPeer %s:%d: invalid Piece payload length %d for piece %d, offset %d\n",
-							peer.IP, peer.Port, len(msg.Payload), pieceIndex, offset)
-						Torrent.DownloadMutex.Lock()
-						Torrent.Downloaded[pieceIndex] = false
-						Torrent.DownloadMutex.Unlock()
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v", err)
+			Torrent.takeBlockSources(pieceIndex)
+			Torrent.DownloadMutex.Lock()
+			Torrent.releasePiece(pieceIndex)
+			Torrent.DownloadMutex.Unlock()
 
-						return
-					}
+			if errors.Is(err, errPeerSnubbed) && Torrent.waitWhileSnubbed(peer) {
+				continue
+			}
 
-					data = append(data, msg.Payload[8:]...)
-					break
+			if errors.Is(err, errShortBlockRefused) {
+				continue
+			}
 
-				case Choke:
-					peer.Choked = true
-					log.Printf("[ERROR]\tPeer %s:%d: choked during piece %d, offset %d\n",
-						peer.IP, peer.Port, pieceIndex, offset)
+			return
+		}
 
-					Torrent.DownloadMutex.Lock()
-					Torrent.Downloaded[pieceIndex] = false
-					Torrent.DownloadMutex.Unlock()
+		peer.BytesReceived += Torrent.PieceSize(pieceIndex)
+		peer.ReceiveTime += networkTime
 
-					continue
+		if Torrent.merkle != nil && !Torrent.merkle.verifiable(pieceIndex) {
+			logPeerf(peer, pieceIndex, "[FAIL]\tsent piece %d without its hash chain\n", pieceIndex)
+			Torrent.takeBlockSources(pieceIndex)
+			Torrent.DownloadMutex.Lock()
+			Torrent.releasePiece(pieceIndex)
+			Torrent.DownloadMutex.Unlock()
 
-				default:
-					log.Printf("[ERROR]\tPeer %s:%d: unexpected message ID %d for piece %d, offset %d\n",
-						peer.IP, peer.Port, msg.ID, pieceIndex, offset)
-					continue
-				}
+			return
+		}
 
-				break
-			}
+		hashStart := time.Now()
+		var hash [20]byte
+		if stream != nil {
+			hash = stream.sum()
+		} else {
+			hash = sha1.Sum(data)
 		}
+		Torrent.counters.hashNanos.Add(int64(time.Since(hashStart)))
 
-		hash := sha1.Sum(data)
+		if !Torrent.pieceHashValid(pieceIndex, hash) {
+			logPeerf(peer, pieceIndex, "[ERROR]\tpiece %d hash mismatch\n", pieceIndex)
+			Torrent.counters.hashFailures.Add(1)
+			Torrent.emit(Event{Type: PieceFailed, Peer: peer.ListenAddr(), Piece: pieceIndex})
 
-		if !bytes.Equal(hash[:], Torrent.PieceHashes[pieceIndex][:]) {
-			log.Printf("[ERROR]\tPeer %s:%d: piece %d hash mismatch\n", peer.IP, peer.Port, pieceIndex)
+			banned := Torrent.blameHashFailure(pieceIndex)
 
 			Torrent.DownloadMutex.Lock()
-			Torrent.Downloaded[pieceIndex] = false
+			Torrent.releasePiece(pieceIndex)
 			Torrent.DownloadMutex.Unlock()
 
+			for _, bannedPeer := range banned {
+				if bannedPeer == peer {
+					return
+				}
+
+				Torrent.removePeer(bannedPeer)
+			}
+
 			continue
 		}
 
-		log.Printf("[INFO]\tPeer %s:%d: downloaded piece %d (length=%d)\n",
-			peer.IP, peer.Port, pieceIndex, len(data))
+		Torrent.takeBlockSources(pieceIndex)
+
+		logPeerf(peer, pieceIndex, "[INFO]\tdownloaded piece %d (length=%d)\n",
+			pieceIndex, Torrent.PieceSize(pieceIndex))
 
 		pieceChan <- PieceResult{
-			Index: pieceIndex,
-			Data:  data,
+			Index:    pieceIndex,
+			Data:     data,
+			Streamed: stream != nil,
 		}
 	}
 }
@@ -596,24 +907,581 @@ func (Torrent *TorrentFile) DownloadFromPeer(peer *Peer, pieceChan chan<- PieceR
 // --------------------------------------------------------------------------------------------- //
 
 /*
-HasPiece checks if a peer has a specific piece based on its bitfield.
-The bitfield is a byte slice where each bit represents a piece's availability.
+downloadPiece requests all blocks of a piece from an unchoked peer and collects them.
+Up to maxPipelinedRequests block requests are kept outstanding. If the peer chokes us
+mid-piece, its outstanding requests are dropped (the peer discards them per the protocol);
+after the next Unchoke only the blocks still missing are requested again. If the peer stays
+unchoked but delivers no block for Config.SnubTimeout, it is marked snubbed and the piece is
+given up so other peers can take it. A peer that leaves the short final block of the last
+piece as the only unanswered request is marked NoShortBlocks instead and the piece is left to
+other peers. We do not advertise the Fast Extension (BEP-6), so peers never send
+RejectRequest and a refused block is only noticed through the timeout. With a stream,
+blocks are written to disk as they arrive instead of being collected, and no piece buffer is
+returned. Keep-alives are sent while waiting, including while choked, and a peer that sends
+nothing at all for peerIdleTimeout is dropped.
 
 Parameters:
-  - Torrent: Pointer to the TorrentFile.
-  - bitfield: Byte slice representing the peer's available pieces.
-  - index: Index of the piece to check.
+  - Torrent: Pointer to the TorrentFile containing piece metadata.
+  - peer: Peer to download from.
+  - pieceIndex: Index of the piece to download.
+  - stream: Destination for blocks written straight to disk (nil to buffer the piece).
 
 Returns:
-  - bool: True if the peer has the piece, false otherwise.
+  - []byte: Piece data (not yet hash-checked; nil when streaming).
+  - error: errPeerSnubbed if the peer stopped delivering, errShortBlockRefused if it cannot serve
+    the short final block, other non-nil errors if sending or receiving fails or the peer sends
+    a malformed Piece.
 */
-func (Torrent *TorrentFile) HasPiece(bitfield []byte, index int) bool {
-	if bitfield == nil {
-		return false
+func (Torrent *TorrentFile) downloadPiece(peer *Peer, pieceIndex int, stream *pieceStream) ([]byte, error) {
+	const maxPipelinedRequests = 5
+
+	pieceLength := Torrent.PieceSize(pieceIndex)
+	numBlocks := int((pieceLength + blockSize - 1) / blockSize)
+	shortBlock := -1
+	if pieceLength%blockSize != 0 {
+		shortBlock = numBlocks - 1
 	}
 
-	byteIndex := index / 8
-	bitIndex := index % 8
+	var data []byte
+	if stream == nil {
+		data = make([]byte, pieceLength)
+	}
+
+	received := make([]bool, numBlocks)
+	outstanding := make(map[int]bool)
+	receivedCount := 0
+	waitingSince := time.Now()
+	lastHeard := waitingSince
+
+	for receivedCount < numBlocks {
+		for block := 0; !peer.State.PeerChoking && len(outstanding) < maxPipelinedRequests && block < numBlocks; block++ {
+			if received[block] || outstanding[block] {
+				continue
+			}
+
+			offset := int64(block) * blockSize
+			length := min(int64(blockSize), pieceLength-offset)
+
+			payload := new(bytes.Buffer)
+			binary.Write(payload, binary.BigEndian, uint32(pieceIndex))
+			binary.Write(payload, binary.BigEndian, uint32(offset))
+			binary.Write(payload, binary.BigEndian, uint32(length))
+
+			err := Torrent.SendMessage(peer, Message{ID: Request, Payload: payload.Bytes()})
+			if err != nil {
+				return nil, fmt.Errorf("Sending Request for piece %d, offset %d: %v\n", pieceIndex, offset, err)
+			}
+
+			outstanding[block] = true
+		}
+
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout := min(wait, time.Until(lastHeard.Add(peerIdleTimeout)))
+		snubTimeout := Torrent.Config.SnubTimeout
+		watchSnub := snubTimeout > 0 && !peer.State.PeerChoking && len(outstanding) > 0
+		if watchSnub {
+			timeout = min(timeout, time.Until(waitingSince.Add(snubTimeout)))
+		}
+
+		msg, err := Torrent.receiveMessage(peer, max(timeout, time.Millisecond))
+		if errors.Is(err, errReceiveTimeout) && watchSnub && time.Since(waitingSince) >= snubTimeout {
+			if len(outstanding) == 1 && outstanding[shortBlock] {
+				peer.NoShortBlocks = true
+				logPeerf(peer, pieceIndex, "[INFO]\tdid not answer short final block of piece %d\n",
+					pieceIndex)
+
+				return nil, errShortBlockRefused
+			}
+
+			peer.Snubbed = true
+			logPeerf(peer, pieceIndex, "[INFO]\tno block for %s during piece %d, marking snubbed\n",
+				snubTimeout, pieceIndex)
+
+			return nil, errPeerSnubbed
+		}
+
+		if errors.Is(err, errReceiveTimeout) && time.Since(lastHeard) < peerIdleTimeout {
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Receiving blocks of piece %d: %v\n", pieceIndex, err)
+		}
+
+		lastHeard = time.Now()
+
+		if msg == nil {
+			continue
+		}
+
+		if msg.ID == Extended && Torrent.merkle != nil && len(msg.Payload) > 0 && msg.Payload[0] == trHashpieceID {
+			msg, err = Torrent.hashpieceMessage(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		switch msg.ID {
+		case Piece:
+			if len(msg.Payload) < 8 {
+				return nil, fmt.Errorf("Invalid Piece payload length %d for piece %d\n", len(msg.Payload), pieceIndex)
+			}
+
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			begin := int64(binary.BigEndian.Uint32(msg.Payload[4:8]))
+			block := int(begin / blockSize)
+
+			if index != pieceIndex || begin%blockSize != 0 || block >= numBlocks || received[block] {
+				logPeerf(peer, index, "[INFO]\tignoring unrequested block (piece %d, begin %d)\n",
+					index, begin)
+				continue
+			}
+
+			blockData := msg.Payload[8:]
+			if int64(len(blockData)) != min(int64(blockSize), pieceLength-begin) {
+				return nil, fmt.Errorf("Invalid block length %d for piece %d, offset %d\n", len(blockData), pieceIndex, begin)
+			}
+
+			if stream != nil {
+				err := stream.write(begin, blockData)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				copy(data[begin:], blockData)
+			}
+
+			Torrent.recordBlockSource(pieceIndex, block, numBlocks, peer)
+			received[block] = true
+			receivedCount++
+			delete(outstanding, block)
+
+			peer.LastBlock = time.Now()
+			waitingSince = peer.LastBlock
+
+		case Choke:
+			peer.State.receive(msg.ID)
+			logPeerf(peer, pieceIndex, "[INFO]\tchoked during piece %d, dropping %d outstanding requests\n",
+				pieceIndex, len(outstanding))
+
+			clear(outstanding)
+
+		case Unchoke:
+			peer.State.receive(msg.ID)
+			waitingSince = time.Now()
+			logPeerf(peer, pieceIndex, "[INFO]\tunchoked, resuming piece %d (%d/%d blocks)\n",
+				pieceIndex, receivedCount, numBlocks)
+
+		case Interested, NotInterested, Request:
+			_, err := Torrent.handleUpload(peer, msg, Torrent.uploadSlots())
+			if err != nil {
+				return nil, fmt.Errorf("Serving peer during piece %d: %v\n", pieceIndex, err)
+			}
+
+		case Have:
+			_, err := Torrent.handleHave(peer, msg.Payload)
+			if err != nil {
+				return nil, err
+			}
+
+		case Extended:
+			err := Torrent.handleExtended(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[ERROR]\t%v", err)
+			}
+
+		default:
+			logPeerf(peer, pieceIndex, "[INFO]\tignoring message ID %d during piece %d\n",
+				msg.ID, pieceIndex)
+		}
+	}
+
+	return data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+waitForUnchoke waits until a peer that is choking us unchokes us again, sending keep-alives
+while the connection is idle so the peer does not drop it. Waiting ends once the download is
+over (see downloadOver), even if the peer keeps us choked and only sends keep-alives.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer choking us.
+
+Returns:
+  - bool: True if the peer unchoked us, false to drop it.
+*/
+func (Torrent *TorrentFile) waitForUnchoke(peer *Peer) bool {
+	for peer.State.PeerChoking {
+		if Torrent.downloadOver() {
+			return false
+		}
+
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+			return false
+		}
+
+		msg, err := Torrent.receiveMessage(peer, min(wait, downloadPollInterval))
+		if errors.Is(err, errReceiveTimeout) {
+			continue
+		}
+
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tfailed to receive message while choked: %v\n", err)
+			return false
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		if msg.ID == Have {
+			_, err := Torrent.handleHave(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return false
+			}
+
+			continue
+		}
+
+		handled, err := Torrent.handleUpload(peer, msg, Torrent.uploadSlots())
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+			return false
+		}
+
+		if !handled && peer.State.receive(msg.ID) {
+			logPeerf(peer, -1, "[INFO]\tstate %+v\n", peer.State)
+		}
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+waitForPieces waits until changed is closed (see piecesSignal) or the peer announces a new
+piece with Have, while keeping the peer's connection serviced: its messages are handled as
+they arrive, and keep-alives are sent
+whenever nothing has been sent for keepAliveInterval (see keepAlive). A read already under way is cut short
+by moving the connection's read deadline, so the wait ends promptly on the signal.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - peer: Peer to keep connected.
+  - changed: Channel from piecesSignal.
+
+Returns:
+  - bool: True once changed is closed or the peer has a new piece, false to drop the peer.
+*/
+func (Torrent *TorrentFile) waitForPieces(peer *Peer, changed <-chan struct{}) bool {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// The waker is gone before returning, so it cannot cut short the caller's next read
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	go func() {
+		defer close(stopped)
+
+		select {
+		case <-changed:
+		case <-stop:
+			return
+		}
+
+		// Repeated until the wait returns, in case receiveMessage set a new deadline meanwhile
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			peer.Connection.SetReadDeadline(time.Now())
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-changed:
+			return true
+		default:
+		}
+
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+			return false
+		}
+
+		msg, err := Torrent.receiveMessage(peer, wait)
+		if errors.Is(err, errReceiveTimeout) {
+			continue
+		}
+
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tconnection lost while waiting for pieces: %v\n", err)
+			return false
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case Interested, NotInterested, Request:
+			_, err := Torrent.handleUpload(peer, msg, Torrent.uploadSlots())
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+				return false
+			}
+
+		case Have:
+			added, err := Torrent.handleHave(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return false
+			}
+
+			if added {
+				return true
+			}
+
+		case Port:
+			Torrent.handlePort(peer, msg.Payload)
+
+		case Extended:
+			err := Torrent.handleExtended(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[ERROR]\t%v", err)
+			}
+
+		default:
+			peer.State.receive(msg.ID)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+waitWhileSnubbed keeps the connection to a snubbed peer open without sending it new requests.
+The peer is un-snubbed as soon as it delivers a block again (answering one of the requests it
+was sitting on). Waiting ends once the download is over (see downloadOver).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Snubbed peer to wait on.
+
+Returns:
+  - bool: True if the peer was un-snubbed and may be used again, false to drop it.
+*/
+func (Torrent *TorrentFile) waitWhileSnubbed(peer *Peer) bool {
+	for peer.Snubbed {
+		if Torrent.downloadOver() {
+			return false
+		}
+
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+			return false
+		}
+
+		msg, err := Torrent.receiveMessage(peer, min(wait, Torrent.Config.SnubTimeout, downloadPollInterval))
+		if errors.Is(err, errReceiveTimeout) {
+			continue
+		}
+
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tconnection lost while snubbed: %v\n", err)
+			return false
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case Piece:
+			peer.Snubbed = false
+			peer.LastBlock = time.Now()
+			logPeerf(peer, -1, "[INFO]\tdelivering again, no longer snubbed\n")
+
+		case Have:
+			_, err := Torrent.handleHave(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return false
+			}
+
+		case Interested, NotInterested, Request:
+			_, err := Torrent.handleUpload(peer, msg, Torrent.uploadSlots())
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v\n", err)
+				return false
+			}
+
+		default:
+			peer.State.receive(msg.ID)
+		}
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+checkBitfield validates a Bitfield payload against the torrent's piece count.
+The payload must be exactly ceil(NumPieces/8) bytes long and the spare bits after the
+last piece must be zero, so a malformed peer cannot advertise pieces that do not exist.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile for the piece count.
+  - bitfield: Bitfield payload received from a peer.
+
+Returns:
+  - error: Non-nil if the bitfield has the wrong length or spare bits set.
+*/
+func (Torrent *TorrentFile) checkBitfield(bitfield []byte) error {
+	expected := (Torrent.NumPieces + 7) / 8
+	if len(bitfield) != expected {
+		return fmt.Errorf("Invalid bitfield length %d, expected %d\n", len(bitfield), expected)
+	}
+
+	if spare := Torrent.NumPieces % 8; spare != 0 && bitfield[expected-1]&(0xFF>>spare) != 0 {
+		return fmt.Errorf("Bitfield has spare bits set after piece %d\n", Torrent.NumPieces-1)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleHave records a piece a download peer announces with Have: the piece is set in its
+bitfield and its availability raised, so the picker can choose it and DownloadFromPeer undoes
+it when the peer disconnects. A peer completing its bitfield this way becomes a seeder.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - peer: Peer announcing the piece.
+  - payload: 4-byte big-endian piece index.
+
+Returns:
+  - bool: True if the peer did not have the piece before.
+  - error: Non-nil if the message is malformed or names a piece that does not exist.
+*/
+func (Torrent *TorrentFile) handleHave(peer *Peer, payload []byte) (bool, error) {
+	if len(payload) != 4 {
+		return false, fmt.Errorf("Invalid Have length: %d\n", len(payload))
+	}
+
+	index := int(binary.BigEndian.Uint32(payload))
+	if index >= Torrent.NumPieces {
+		return false, fmt.Errorf("Have for piece %d, torrent has %d pieces\n", index, Torrent.NumPieces)
+	}
+
+	if Torrent.HasPiece(peer.Bitfield, index) {
+		return false, nil
+	}
+
+	Torrent.setPeerPiece(peer, index, true)
+
+	Torrent.DownloadMutex.Lock()
+	if index < len(Torrent.Availability) {
+		Torrent.Availability[index]++
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	Torrent.markSeeder(peer)
+
+	return true, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+markSeeder flags a download peer whose bitfield covers every piece and counts it in
+Stats.ConnectedSeeders. It is called whenever the bitfield grows: on Bitfield and HaveAll, and
+on every Have, so a peer finishing its own download while connected becomes a seeder too.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - peer: Peer whose bitfield has just been set or extended.
+*/
+func (Torrent *TorrentFile) markSeeder(peer *Peer) {
+	if peer.Seeder || !Torrent.isSeeder(peer) {
+		return
+	}
+
+	peer.Seeder = true
+	Torrent.counters.connectedSeeders.Add(1)
+	logPeerf(peer, -1, "[INFO]\tis a seeder\n")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fullBitfield builds the bitfield a HaveAll or HaveNone message stands for.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile for the piece count.
+  - all: True for HaveAll, false for HaveNone.
+
+Returns:
+  - []byte: Bitfield in wire format with every piece set or none.
+*/
+func (Torrent *TorrentFile) fullBitfield(all bool) []byte {
+	bits := NewBitSet(Torrent.NumPieces)
+	if all {
+		for i := 0; i < Torrent.NumPieces; i++ {
+			bits.Set(i)
+		}
+	}
+
+	return append([]byte(nil), bits.Bytes()...)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+HasPiece checks if a peer has a specific piece based on its bitfield.
+The bitfield is a byte slice where each bit represents a piece's availability.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - bitfield: Byte slice representing the peer's available pieces.
+  - index: Index of the piece to check.
+
+Returns:
+  - bool: True if the peer has the piece, false otherwise.
+*/
+func (Torrent *TorrentFile) HasPiece(bitfield []byte, index int) bool {
+	if bitfield == nil {
+		return false
+	}
+
+	byteIndex := index / 8
+	bitIndex := index % 8
 
 	if byteIndex >= len(bitfield) {
 		return false
@@ -627,37 +1495,136 @@ func (Torrent *TorrentFile) HasPiece(bitfield []byte, index int) bool {
 /*
 StartDownload initiates the download process for the torrent.
 It initializes pieces, creates output files, and spawns goroutines to download from peers.
+With Config.DeletePartialOnFailure, the files and directories it created are removed if the
+download fails; a download stopped by CancelDownload keeps them so it can be resumed.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing metadata and peer connections.
   - outputDir: Directory where downloaded files will be saved.
 
 Returns:
-  - error: Non-nil if piece initialization, file creation, or download fails.
+  - error: ErrDownloadCanceled if CancelDownload stopped the download, other non-nil errors
+    if piece initialization, file creation, or download fails.
 */
 func (Torrent *TorrentFile) StartDownload(outputDir string) error {
+	var created []string
+
+	Torrent.canceled.Store(false)
+
+	err := Torrent.download(outputDir, &created)
+	if err != nil && !errors.Is(err, ErrDownloadCanceled) && Torrent.Config.DeletePartialOnFailure {
+		Torrent.removeCreated(created)
+	}
+
+	if err == nil {
+		Torrent.emit(Event{Type: DownloadComplete, Piece: -1})
+	}
+
+	Torrent.DownloadMutex.Lock()
+	completedRun := Torrent.completedRun
+	Torrent.DownloadMutex.Unlock()
+
+	// Resumed downloads that were already complete, or whose completion was announced by an
+	// earlier run, must not send completed again
+	if err == nil && !Torrent.Config.Benchmark && completedRun && !Torrent.completedSent.Load() {
+		Torrent.AnnounceCompleted()
+		Torrent.completedSent.Store(true)
+
+		err := Torrent.SaveResume(outputDir)
+		if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	}
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+download runs the download for StartDownload.
+Every file and directory it creates (as opposed to reusing for a resume) is appended to created.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata and peer connections.
+  - outputDir: Directory where downloaded files will be saved.
+  - created: Receives the paths created by this run, in creation order.
+
+Returns:
+  - error: Non-nil if piece initialization, file creation, or download fails.
+*/
+func (Torrent *TorrentFile) download(outputDir string, created *[]string) error {
 	err := Torrent.InitializePieces()
 	if err != nil {
 		return fmt.Errorf("Failed to initialize pieces: %v", err)
 	}
 
+	err = Torrent.checkSignatures()
+	if err != nil {
+		return err
+	}
+
+	if Torrent.merkle != nil && Torrent.Config.BlobStore != "" {
+		return fmt.Errorf("The blob store needs piece hashes up front, which Merkle torrents do not have\n")
+	}
+
+	err = Torrent.applySelectOnly()
+	if err != nil {
+		return err
+	}
+
 	err = Torrent.BuildFileInfo(outputDir)
 	if err != nil {
 		return err
 	}
 
+	Torrent.OutputDir = outputDir
+
+	if !Torrent.Config.Benchmark {
+		err = Torrent.createSymlinks(outputDir, created)
+		if err != nil {
+			return err
+		}
+	}
+
 	for i := range Torrent.Files {
 		file := &Torrent.Files[i]
+		if Torrent.Config.Benchmark {
+			file.Handle = discardHandle{}
+			continue
+		}
+
+		if Torrent.Config.BlobStore != "" {
+			continue
+		}
+
+		if file.Pad {
+			file.Handle = padHandle{}
+			continue
+		}
+
+		if file.Symlink {
+			continue
+		}
+
 		dir := filepath.Dir(file.Path)
+		newDirs := missingDirs(dir)
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("Failed to create directory %s: %v\n", dir, err)
 		}
 
+		*created = append(*created, newDirs...)
+
+		_, statErr := os.Stat(file.Path)
 		f, err := os.OpenFile(file.Path, os.O_RDWR|os.O_CREATE, 0644)
 		if err != nil {
 			return fmt.Errorf("Failed to create file %s: %v\n", file.Path, err)
 		}
 
+		if errors.Is(statErr, os.ErrNotExist) {
+			*created = append(*created, file.Path)
+		}
+
 		if err := f.Truncate(file.Length); err != nil {
 			f.Close()
 			return fmt.Errorf("Failed to truncate file %s: %v\n", file.Path, err)
@@ -666,10 +1633,43 @@ func (Torrent *TorrentFile) StartDownload(outputDir string) error {
 		file.Handle = f
 	}
 
+	_, statErr := os.Stat(Torrent.resumePath(outputDir))
+	if errors.Is(statErr, os.ErrNotExist) && !Torrent.Config.Benchmark {
+		*created = append(*created, Torrent.resumePath(outputDir))
+	}
+
+	if !Torrent.Config.Benchmark && Torrent.Config.BlobStore != "" {
+		// Only the resume file lives in outputDir; the data goes to the blob store
+		err = os.MkdirAll(outputDir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create directory %s: %v\n", outputDir, err)
+		}
+
+		Torrent.openBlobStore()
+	}
+
+	if !Torrent.Config.Benchmark {
+		err = Torrent.LoadResume(outputDir)
+		if errors.Is(err, errResumeMismatch) {
+			log.Printf("[INFO]\tRechecking existing data of %s\n", Torrent.Info.Name)
+			Torrent.VerifyDownload()
+		} else if err != nil {
+			log.Printf("[ERROR]\t%v", err)
+		}
+	}
+
 	defer func() {
-		for _, file := range Torrent.Files {
-			if file.Handle != nil {
-				file.Handle.Close()
+		if !Torrent.Config.Benchmark {
+			err := Torrent.SaveResume(outputDir)
+			if err != nil {
+				log.Printf("[ERROR]\t%v", err)
+			}
+		}
+
+		for i := range Torrent.Files {
+			if Torrent.Files[i].Handle != nil {
+				Torrent.Files[i].Handle.Close()
+				Torrent.Files[i].Handle = nil
 			}
 		}
 	}()
@@ -678,40 +1678,133 @@ func (Torrent *TorrentFile) StartDownload(outputDir string) error {
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, 10)
 
-	Torrent.PeersMutex.Lock()
-	peers := make([]Peer, len(Torrent.Peers))
-	copy(peers, Torrent.Peers)
-	Torrent.PeersMutex.Unlock()
+	started := make(map[*Peer]bool)
+	var active atomic.Int32
+	peerDone := make(chan struct{}, 1)
 
-	for i := range peers {
-		peer := &peers[i]
+	sourceDone := func() {
+		active.Add(-1)
 
-		if peer.Connection == nil {
-			log.Printf("[FAIL]\tPeer %s:%d: invalid connection, skipping\n", peer.IP, peer.Port)
-			continue
+		select {
+		case peerDone <- struct{}{}:
+		default:
+		}
+	}
+
+	startPeers := func() {
+		Torrent.PeersMutex.Lock()
+		peers := make([]*Peer, len(Torrent.Peers))
+		copy(peers, Torrent.Peers)
+		Torrent.PeersMutex.Unlock()
+
+		for _, peer := range peers {
+			if started[peer] {
+				continue
+			}
+
+			started[peer] = true
+
+			if peer.Connection == nil {
+				logPeerf(peer, -1, "[FAIL]\tinvalid connection, skipping\n")
+				continue
+			}
+
+			wg.Add(1)
+			active.Add(1)
+			sem <- struct{}{}
+			go func(pp *Peer) {
+				defer func() {
+					<-sem
+					sourceDone()
+					logPeerf(pp, -1, "[INFO]\tStartDownload goroutine completed\n")
+				}()
+
+				Torrent.DownloadFromPeer(pp, pieceChan, &wg)
+			}(peer)
 		}
+	}
+
+	startPeers()
 
+	for _, seedURL := range Torrent.WebSeeds() {
 		wg.Add(1)
-		sem <- struct{}{}
-		go func(pp *Peer) {
-			defer func() {
-				<-sem
-				log.Printf("[INFO]\tPeer %s:%d: StartDownload goroutine completed\n", pp.IP, pp.Port)
-			}()
+		active.Add(1)
+		go func(base string) {
+			defer sourceDone()
 
-			Torrent.DownloadFromPeer(pp, pieceChan, &wg)
-		}(peer)
+			Torrent.downloadFromWebSeed(base, pieceChan, &wg)
+		}(seedURL)
 	}
 
+	// Peers connecting later (inbound, re-announces, PEX) join while any peer or web seed is downloading
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-peerDone:
+			}
+
+			Torrent.DownloadMutex.Lock()
+			finished := Torrent.wantedDone() == Torrent.Wanted.Count()
+			Torrent.DownloadMutex.Unlock()
+
+			if finished || active.Load() == 0 || Torrent.canceled.Load() {
+				return
+			}
+
+			startPeers()
+		}
+	}()
+
 	go func() {
 		wg.Wait()
 		close(pieceChan)
 		log.Printf("[INFO]\tAll download goroutines completed, pieceChan closed")
 	}()
 
+	if Torrent.pexEnabled() {
+		pexCtx, stopPex := context.WithCancel(context.Background())
+		defer stopPex()
+
+		go Torrent.runPex(pexCtx)
+	}
+
+	haveChan := make(chan int, Torrent.NumPieces)
+	havesDone := make(chan struct{})
+
+	go func() {
+		Torrent.broadcastHaves(haveChan)
+		close(havesDone)
+	}()
+
+	defer func() {
+		close(haveChan)
+		<-havesDone
+	}()
+
+	const resumeSaveEvery = 16
+
 	completed := make(map[int]bool)
 	barWidth := 50
-	completedCount := 0
+	progress := Torrent.progressRenderer()
+
+	Torrent.DownloadMutex.Lock()
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.Downloaded.Has(i) {
+			completed[i] = true
+		}
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	completedCount := len(completed)
+	wantedCount := Torrent.Wanted.Count()
+	entries := Torrent.ListFiles()
 
 	var totalBytesLoaded int64
 	type speedSample struct {
@@ -726,45 +1819,63 @@ func (Torrent *TorrentFile) StartDownload(outputDir string) error {
 		Torrent.DownloadMutex.Lock()
 
 		if completed[piece.Index] {
-			log.Printf("[INFO]\tPiece %d already written, skipping\n", piece.Index)
+			logPeerf(nil, piece.Index, "[INFO]\tPiece %d already written, skipping\n", piece.Index)
 			Torrent.DownloadMutex.Unlock()
 
 			continue
 		}
 
-		pieceStart := int64(piece.Index) * Torrent.PieceLength
-		pieceEnd := pieceStart + int64(len(piece.Data))
+		pieceSize := Torrent.PieceSize(piece.Index)
+		written := piece.Streamed || Torrent.writeRange(int64(piece.Index)*Torrent.PieceLength, piece.Data)
 
-		for _, file := range Torrent.Files {
-			fileStart := file.Offset
-			fileEnd := file.Offset + file.Length
+		Torrent.releasePiece(piece.Index)
 
-			start := max(pieceStart, fileStart)
-			end := min(pieceEnd, fileEnd)
+		if !written {
+			Torrent.DownloadMutex.Unlock()
+			continue
+		}
 
-			if start >= end {
-				continue
-			}
+		Torrent.Downloaded.Set(piece.Index)
+		Torrent.touchPiece(piece.Index)
+		Torrent.emit(Event{Type: PieceCompleted, Piece: piece.Index})
+		Torrent.counters.downloaded.Add(pieceSize)
+		completed[piece.Index] = true
+		completedCount++
+		totalBytesLoaded += pieceSize
 
-			startInPiece := start - pieceStart
-			endInPiece := end - pieceStart
+		if Torrent.Downloaded.Count() == Torrent.NumPieces {
+			Torrent.completedRun = true
+		}
 
-			chunk := piece.Data[startInPiece:endInPiece]
+		evicted := Torrent.evictPieces()
+		for _, index := range evicted {
+			delete(completed, index)
+			completedCount--
+		}
 
-			_, err := file.Handle.WriteAt(chunk, start-file.Offset)
-			if err != nil {
-				log.Printf("[ERROR]\tFailed writing to %s: %v", file.Path, err)
-				Torrent.Downloaded[piece.Index] = false
+		wantedCount = Torrent.Wanted.Count()
+		wantedDone := Torrent.wantedDone()
+		finished := Torrent.completedFiles(entries, piece.Index)
+		Torrent.DownloadMutex.Unlock()
+
+		Torrent.sendDonthave(evicted)
+		haveChan <- piece.Index
+
+		for _, file := range finished {
+			if !Torrent.Config.Benchmark {
+				Torrent.finishFile(outputDir, entries[file])
 			}
 		}
 
-		completed[piece.Index] = true
-		completedCount++
-		totalBytesLoaded += int64(len(piece.Data))
-		Torrent.DownloadMutex.Unlock()
+		if completedCount%resumeSaveEvery == 0 && !Torrent.Config.Benchmark {
+			err := Torrent.SaveResume(outputDir)
+			if err != nil {
+				log.Printf("[ERROR]\t%v", err)
+			}
+		}
 
 		now := time.Now()
-		speedSamples = append(speedSamples, speedSample{bytes: int64(len(piece.Data)), time: now})
+		speedSamples = append(speedSamples, speedSample{bytes: pieceSize, time: now})
 
 		cutoff := now.Add(-windowDuration)
 		for len(speedSamples) > 0 && speedSamples[0].time.Before(cutoff) {
@@ -784,19 +1895,67 @@ func (Torrent *TorrentFile) StartDownload(outputDir string) error {
 		speedMBps := 0.0
 		if windowSeconds > 0 {
 			speedMBps = float64(bytesInWindow) / windowSeconds / (1024 * 1024)
+			Torrent.counters.downloadRate.Store(int64(float64(bytesInWindow) / windowSeconds))
+		}
+
+		fraction := 1.0
+		if wantedCount > 0 {
+			fraction = float64(wantedDone) / float64(wantedCount)
 		}
 
-		progress := float64(completedCount) / float64(Torrent.NumPieces)
-		filled := int(progress * float64(barWidth))
+		percentage := fraction * 100.0
+		seeders, leechers := Torrent.swarmCounts()
+
+		filled := int(fraction * float64(barWidth))
 		bar := strings.Repeat("»", filled) + strings.Repeat("-", barWidth-filled)
-		percentage := progress * 100.0
-		fmt.Printf("\r[%s]\t[%s] (%.2f/100%%) [%.2f MB/s]", Torrent.Info.Name, bar, percentage, speedMBps)
+
+		progress.update(
+			fmt.Sprintf("[%s]\t[%s] (%.2f/100%%) [%.2f MB/s] [S: %d / L: %d]", Torrent.Info.Name, bar, percentage, speedMBps, seeders, leechers),
+			fmt.Sprintf("%s: %.1f%% %.2f MB/s (seeders: %d, leechers: %d)", Torrent.Info.Name, percentage, speedMBps, seeders, leechers),
+			fraction >= 1,
+		)
+	}
+
+	Torrent.counters.downloadRate.Store(0)
+
+	if Torrent.canceled.Load() {
+		progress.message("Download canceled")
+
+		if !Torrent.Config.Benchmark {
+			err := Torrent.SaveResume(outputDir)
+			if err != nil {
+				log.Printf("[ERROR]\t%v", err)
+			}
+		}
+
+		return ErrDownloadCanceled
+	}
+
+	progress.message("Download completed!")
+
+	Torrent.DownloadMutex.Lock()
+	wantedDone := Torrent.wantedDone()
+	wantedCount = Torrent.Wanted.Count()
+	finished := Torrent.completedFiles(entries, -1)
+	Torrent.DownloadMutex.Unlock()
+
+	for _, file := range finished {
+		if !Torrent.Config.Benchmark {
+			Torrent.finishFile(outputDir, entries[file])
+		}
+	}
+
+	if wantedDone != wantedCount {
+		return fmt.Errorf("Download incomplete: %d/%d wanted pieces written", wantedDone, wantedCount)
 	}
 
-	fmt.Println("\nDownload completed!")
+	if !Torrent.Config.SkipVerify && !Torrent.Config.Benchmark {
+		progress.message("Verifying downloaded data...")
 
-	if len(completed) != Torrent.NumPieces {
-		return fmt.Errorf("Download incomplete: %d/%d pieces written", len(completed), Torrent.NumPieces)
+		failed := Torrent.VerifyDownload()
+		if len(failed) > 0 {
+			return fmt.Errorf("Verification failed: %d/%d pieces corrupt on disk", len(failed), wantedCount)
+		}
 	}
 
 	return nil
@@ -804,39 +1963,248 @@ func (Torrent *TorrentFile) StartDownload(outputDir string) error {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+writeRange writes bytes of the piece space to the files they belong to.
+A failure to write one file is logged and the remaining files are still written.
+It must be called with Torrent.DownloadMutex held, as DeselectFile replaces handles.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - offset: Offset of data in the piece space.
+  - data: Bytes to write.
+
+Returns:
+  - bool: True if every file write succeeded.
+*/
+func (Torrent *TorrentFile) writeRange(offset int64, data []byte) bool {
+	end := offset + int64(len(data))
+	written := true
+
+	for _, file := range Torrent.Files {
+		start := max(offset, file.Offset)
+		stop := min(end, file.Offset+file.Length)
+
+		if start >= stop {
+			continue
+		}
+
+		_, err := file.Handle.WriteAt(data[start-offset:stop-offset], start-file.Offset)
+		if err != nil {
+			log.Printf("[ERROR]\tFailed writing to %s: %v", file.Path, err)
+			written = false
+		}
+	}
+
+	return written
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+missingDirs returns dir and those of its ancestors that do not exist yet, outermost first.
+
+Parameters:
+  - dir: Directory about to be created with os.MkdirAll.
+
+Returns:
+  - []string: Directories MkdirAll will create.
+*/
+func missingDirs(dir string) []string {
+	var missing []string
+
+	for {
+		_, err := os.Stat(dir)
+		if !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		missing = append([]string{dir}, missing...)
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+
+		dir = parent
+	}
+
+	return missing
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+CancelDownload stops a running StartDownload: every peer is disconnected, web seeds stop
+after their current piece, and StartDownload saves the resume data and returns
+ErrDownloadCanceled. Pieces already written are kept.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+*/
+func (Torrent *TorrentFile) CancelDownload() {
+	Torrent.canceled.Store(true)
+
+	Torrent.DownloadMutex.Lock()
+	Torrent.notifyPieces()
+	Torrent.DownloadMutex.Unlock()
+
+	Torrent.PeersMutex.Lock()
+	peers := append([]*Peer(nil), Torrent.Peers...)
+	Torrent.PeersMutex.Unlock()
+
+	for _, peer := range peers {
+		Torrent.removePeer(peer)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+removeCreated deletes the files and directories a failed download created, newest first.
+Pre-existing files (such as partial data being resumed, with its resume file) are never in
+the list and survive. Directories are only removed if they are empty.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose download failed.
+  - created: Paths recorded by download.
+*/
+func (Torrent *TorrentFile) removeCreated(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		err := os.Remove(created[i])
+		if err != nil {
+			log.Printf("[ERROR]\tFailed to remove %s: %v\n", created[i], err)
+			continue
+		}
+
+		log.Printf("[INFO]\tRemoved partial download %s\n", created[i])
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 RefreshPeer periodically refreshes the peer list by contacting trackers.
-It runs in a goroutine, updating peers at intervals specified by the tracker.
+It starts the announcer (see runAnnouncer), which gives every tracker its own goroutine, so
+that dead or slow trackers delay nobody but themselves. The announcer runs until
+AnnounceStopped; calling RefreshPeer while it runs does nothing.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile to refresh peers for.
+*/
+func (Torrent *TorrentFile) RefreshPeer() {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	if Torrent.announceStop != nil {
+		return
+	}
+
+	Torrent.announceStop = make(chan struct{})
+	Torrent.announcing = make(map[string]bool)
+
+	go Torrent.runAnnouncer(Torrent.announceStop)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// defaultAnnounceInterval is the announce interval used when a tracker does not send one.
+const defaultAnnounceInterval = 30 * time.Minute
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceInterval returns the regular announce interval a tracker response asks for: its
+interval (defaultAnnounceInterval if it has none), but never less than its min interval.
+
+Parameters:
+  - resp: Tracker response.
 
 Returns:
-  - None: The function runs indefinitely, updating Torrent.Peers and logging status.
+  - time.Duration: Time until the next regular announce.
 */
-func (Torrent *TorrentFile) RefreshPeer() {
-	go func() {
-		for {
-			resp, err := Torrent.SendTrackerResponse()
-			if err != nil {
-				log.Printf("[FAIL]\tFailed to refresh peers: %v\n", err)
-				time.Sleep(60 * time.Second)
+func announceInterval(resp *TrackerResponse) time.Duration {
+	interval := time.Duration(resp.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
 
-				continue
-			}
+	return max(interval, time.Duration(resp.MinInterval)*time.Second)
+}
 
-			newPeers, err := Torrent.ParsePeers(resp.Peers)
-			if err != nil {
-				log.Printf("[FAIL]\tFailed to parse new peers: %v\n", err)
-				time.Sleep(60 * time.Second)
+// --------------------------------------------------------------------------------------------- //
 
-				continue
-			}
+/*
+nextAnnounceDelay decides how long a tracker's announcer goroutine waits before the next
+announce, normally the announceInterval of its response.
+While fewer than Config.MinHealthyPeers peers are connected, it re-announces sooner and asks
+for more peers each time, never earlier than the tracker's min interval or scarcePeersDelay
+and never for fewer than Config.NumWant or more than scarcePeersMaxNumWant peers.
 
-			Torrent.ConnectToPeers(newPeers)
-			time.Sleep(time.Duration(resp.Interval) * time.Second)
-		}
-	}()
+Parameters:
+  - Torrent: Pointer to the TorrentFile being refreshed.
+  - resp: Response of the last announce.
+
+Returns:
+  - time.Duration: Delay before the next announce.
+*/
+func (Torrent *TorrentFile) nextAnnounceDelay(resp *TrackerResponse) time.Duration {
+	const (
+		scarcePeersDelay      = 2 * time.Minute
+		scarcePeersNumWant    = 50
+		scarcePeersMaxNumWant = 200
+	)
+
+	interval := announceInterval(resp)
+	connected := int(Torrent.counters.connectedPeers.Load())
+
+	if Torrent.Config.MinHealthyPeers <= 0 || connected >= Torrent.Config.MinHealthyPeers {
+		Torrent.numWant.Store(0)
+		return interval
+	}
+
+	configured := int32(max(Torrent.Config.NumWant, 0))
+
+	numWant := Torrent.numWant.Load() * 2
+	if numWant < max(scarcePeersNumWant, configured) {
+		numWant = max(scarcePeersNumWant, configured)
+	}
+
+	if numWant > max(scarcePeersMaxNumWant, configured) {
+		numWant = max(scarcePeersMaxNumWant, configured)
+	}
+
+	Torrent.numWant.Store(numWant)
+
+	delay := max(scarcePeersDelay, time.Duration(resp.MinInterval)*time.Second)
+	if interval > 0 && interval < delay {
+		delay = interval
+	}
+
+	log.Printf("[INFO]\tOnly %d/%d peers connected, re-announcing in %s with num_want=%d\n",
+		connected, Torrent.Config.MinHealthyPeers, delay, numWant)
+
+	return delay
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+currentAddress describes the address trackers see us at: the local address of the default
+route and the external IP last reported by a tracker.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - string: "local/external", either part empty if unknown.
+*/
+func (Torrent *TorrentFile) currentAddress() string {
+	local := ""
+	if ip, err := localAddrTo(net.IPv4(192, 0, 2, 1)); err == nil {
+		local = ip.String()
+	}
+
+	return local + "/" + Torrent.ExternalIP()
 }
 
 // --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,848 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newTestPeer connects an unchoked peer to a remote end over loopback TCP, whose buffering
+lets requests be pipelined as on a real connection. The remote end is driven with the
+torrent's own readMessage and SendMessage through the returned Peer.
+
+Parameters:
+  - t: Test the connection belongs to; both ends are closed when it ends.
+
+Returns:
+  - *Peer: Our side of the connection.
+  - *Peer: The remote side of the connection.
+*/
+func newTestPeer(t *testing.T) (*Peer, *Peer) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer listener.Close()
+
+	local, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+
+	remote, err := listener.Accept()
+	if err != nil {
+		local.Close()
+		t.Fatalf("accepting: %v", err)
+	}
+
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	peer := &Peer{IP: "10.0.0.1", Port: 6881, Connection: local, State: newPeerState()}
+	peer.State.PeerChoking = false
+
+	return peer, &Peer{IP: "10.0.0.2", Port: 6881, Connection: remote, State: newPeerState()}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+serveBlocks answers the Request messages read from remote with Piece messages of zeros
+until the connection is closed. Requests shorter than blockSize are left unanswered when
+skipShort is set.
+
+Parameters:
+  - Torrent: Torrent the messages are exchanged for.
+  - remote: Remote side of the connection.
+  - skipShort: Whether to ignore requests for short blocks.
+*/
+func serveBlocks(Torrent *TorrentFile, remote *Peer, skipShort bool) {
+	for {
+		msg, err := Torrent.readMessage(remote, time.Minute)
+		if err != nil {
+			return
+		}
+
+		if msg == nil || msg.ID != Request || len(msg.Payload) != 12 {
+			continue
+		}
+
+		length := binary.BigEndian.Uint32(msg.Payload[8:12])
+		if skipShort && length < blockSize {
+			continue
+		}
+
+		payload := append(append([]byte{}, msg.Payload[:8]...), make([]byte, length)...)
+		if Torrent.SendMessage(remote, Message{ID: Piece, Payload: payload}) != nil {
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestConnectToPeersWhilePeersChange(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Config.Encryption = EncryptionDisabled
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	// Inbound peers may be registered while the dialed ones are counted
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; ; i++ {
+			Torrent.PeersMutex.Lock()
+			Torrent.Peers = append(Torrent.Peers[:0], &Peer{IP: "10.0.0.9"})
+			Torrent.PeersMutex.Unlock()
+
+			if i == 0 {
+				close(started)
+			}
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+
+	<-started
+	Torrent.ConnectToPeers([]Peer{{IP: "127.0.0.1", Port: uint16(port)}})
+
+	close(stop)
+	<-done
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDownloadPieceShortBlockIgnored(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Info.PieceLength = 2 * blockSize
+	Torrent.Info.Length = 3*blockSize + 100
+	Torrent.Info.Pieces = string(make([]byte, 2*20))
+	Torrent.Config.SnubTimeout = 200 * time.Millisecond
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+	go serveBlocks(Torrent, remote, true)
+
+	// The full first block of the last piece arrives, the 100-byte second block never does
+	_, err = Torrent.downloadPiece(peer, 1, nil)
+	if !errors.Is(err, errShortBlockRefused) {
+		t.Fatalf("downloadPiece of the last piece = %v, want errShortBlockRefused", err)
+	}
+
+	if !peer.NoShortBlocks || peer.Snubbed {
+		t.Errorf("peer NoShortBlocks = %v, Snubbed = %v, want true false", peer.NoShortBlocks, peer.Snubbed)
+	}
+
+	data, err := Torrent.downloadPiece(peer, 0, nil)
+	if err != nil || len(data) != 2*blockSize {
+		t.Fatalf("downloadPiece of a full piece = %d bytes, %v", len(data), err)
+	}
+
+	Torrent.DownloadMutex.Lock()
+	settled := Torrent.settledPieces(peer)
+	Torrent.DownloadMutex.Unlock()
+
+	if settled.Has(0) || !settled.Has(1) {
+		t.Errorf("settled pieces for the peer = %v %v, want false true", settled.Has(0), settled.Has(1))
+	}
+
+	// Other peers are still asked for the last piece
+	Torrent.DownloadMutex.Lock()
+	settled = Torrent.settledPieces(&Peer{})
+	Torrent.DownloadMutex.Unlock()
+
+	if settled.Has(1) {
+		t.Errorf("last piece settled for a peer serving short blocks")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDownloadPieceShortBlockServed(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Info.Length = 3*blockSize + 100
+	Torrent.Info.Pieces = string(make([]byte, 4*20))
+	Torrent.Config.SnubTimeout = 200 * time.Millisecond
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+	go serveBlocks(Torrent, remote, false)
+
+	data, err := Torrent.downloadPiece(peer, 3, nil)
+	if err != nil || len(data) != 100 {
+		t.Fatalf("downloadPiece of the short last piece = %d bytes, %v", len(data), err)
+	}
+
+	if peer.NoShortBlocks {
+		t.Errorf("peer serving the short block marked NoShortBlocks")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newDownloadTorrent opens a torrent written by writeTestTorrent for a download that uses no
+trackers, DHT or peers.
+
+Parameters:
+  - t: Test the torrent belongs to.
+
+Returns:
+  - *TorrentFile: Torrent ready for StartDownload.
+*/
+func newDownloadTorrent(t *testing.T) *TorrentFile {
+	t.Helper()
+
+	torrentPath, _ := writeTestTorrent(t, 3*16384+100, 16384)
+
+	Torrent, err := SetTorrentFile(torrentPath)
+	if err != nil {
+		t.Fatalf("SetTorrentFile: %v", err)
+	}
+
+	Torrent.Config.DHT = false
+	Torrent.Config.ProgressMode = ProgressNone
+	Torrent.Config.DeletePartialOnFailure = true
+
+	return Torrent
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestStartDownloadFailureRemovesCreated(t *testing.T) {
+	Torrent := newDownloadTorrent(t)
+	outputDir := t.TempDir()
+
+	// Without peers or web seeds the download fails at once
+	err := Torrent.StartDownload(outputDir)
+	if err == nil || errors.Is(err, ErrDownloadCanceled) {
+		t.Fatalf("StartDownload without sources = %v, want a failure", err)
+	}
+
+	_, err = os.Stat(filepath.Join(outputDir, Torrent.Info.Name))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("file created by the failed download still exists (%v)", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestStartDownloadCanceledKeepsFiles(t *testing.T) {
+	Torrent := newDownloadTorrent(t)
+	outputDir := t.TempDir()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Torrent.CancelDownload()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	Torrent.Config.WebSeeds = true
+	Torrent.URLList = []string{server.URL + "/"}
+
+	err := Torrent.StartDownload(outputDir)
+	if !errors.Is(err, ErrDownloadCanceled) {
+		t.Fatalf("canceled StartDownload = %v, want ErrDownloadCanceled", err)
+	}
+
+	_, err = os.Stat(filepath.Join(outputDir, Torrent.Info.Name))
+	if err != nil {
+		t.Errorf("canceled download removed its file: %v", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestWaitForPiecesSlotFreed(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Config.MaxConcurrentPieces = 1
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+
+	Torrent.DownloadMutex.Lock()
+	Torrent.InProgress.Set(2)
+	changed := Torrent.piecesSignal()
+	Torrent.DownloadMutex.Unlock()
+
+	// Messages arriving during the wait are handled, and the freed slot ends it
+	go func() {
+		Torrent.SendMessage(remote, Message{ID: Unchoke})
+		time.Sleep(100 * time.Millisecond)
+
+		Torrent.DownloadMutex.Lock()
+		Torrent.releasePiece(2)
+		Torrent.DownloadMutex.Unlock()
+	}()
+
+	peer.State.PeerChoking = true
+	started := time.Now()
+
+	if !Torrent.waitForPieces(peer, changed) {
+		t.Fatalf("waitForPieces dropped the peer")
+	}
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("waitForPieces returned %s after the slot was freed", elapsed)
+	}
+
+	if peer.State.PeerChoking {
+		t.Errorf("Unchoke received during the wait was not applied")
+	}
+
+	// The connection is still usable after the interrupted read
+	err = Torrent.SendMessage(remote, Message{ID: Interested})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	msg, err := Torrent.receiveMessage(peer, time.Second)
+	if err != nil || msg == nil || msg.ID != Interested {
+		t.Errorf("message after the wait = %v, %v", msg, err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestWaitForPiecesConnectionLost(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+
+	Torrent.DownloadMutex.Lock()
+	changed := Torrent.piecesSignal()
+	Torrent.DownloadMutex.Unlock()
+
+	remote.Connection.Close()
+
+	if Torrent.waitForPieces(peer, changed) {
+		t.Errorf("waitForPieces kept a closed connection")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestMaxConcurrentPiecesBounded(t *testing.T) {
+	const (
+		numPieces   = 8
+		pieceLength = 4 * blockSize
+		maxPieces   = 2
+	)
+
+	Torrent := newTestTorrent()
+	Torrent.Config.MaxConcurrentPieces = maxPieces
+	Torrent.Info.PieceLength = pieceLength
+	Torrent.Info.Length = numPieces * pieceLength
+
+	zeroHash := sha1.Sum(make([]byte, pieceLength))
+	Torrent.Info.Pieces = string(bytes.Repeat(zeroHash[:], numPieces))
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	pieceChan := make(chan PieceResult)
+
+	for i := 0; i < 4; i++ {
+		peer, remote := newTestPeer(t)
+		Torrent.Peers = append(Torrent.Peers, peer)
+
+		go func() {
+			Torrent.SendMessage(remote, Message{ID: Bitfield, Payload: []byte{0xff}})
+			Torrent.SendMessage(remote, Message{ID: Unchoke})
+			serveBlocks(Torrent, remote, false)
+		}()
+
+		wg.Add(1)
+		go Torrent.DownloadFromPeer(peer, pieceChan, &wg)
+	}
+
+	// Sample the pieces in flight for as long as the peers download
+	stop := make(chan struct{})
+	sampled := make(chan int, 1)
+
+	go func() {
+		highest := 0
+		for {
+			Torrent.DownloadMutex.Lock()
+			highest = max(highest, Torrent.InProgress.Count())
+			Torrent.DownloadMutex.Unlock()
+
+			select {
+			case <-stop:
+				sampled <- highest
+				return
+			case <-time.After(100 * time.Microsecond):
+			}
+		}
+	}()
+
+	timeout := time.After(10 * time.Second)
+
+	for received := 0; received < numPieces; received++ {
+		select {
+		case result := <-pieceChan:
+			Torrent.DownloadMutex.Lock()
+			if inFlight := Torrent.InProgress.Count(); inFlight > maxPieces {
+				t.Errorf("%d pieces in flight, limit %d", inFlight, maxPieces)
+			}
+
+			Torrent.Downloaded.Set(result.Index)
+			Torrent.releasePiece(result.Index)
+			Torrent.DownloadMutex.Unlock()
+
+		case <-timeout:
+			t.Fatalf("%d of %d pieces downloaded in time", received, numPieces)
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("peers still downloading after every piece arrived")
+	}
+
+	close(stop)
+	if highest := <-sampled; highest > maxPieces || highest == 0 {
+		t.Errorf("at most %d pieces were in flight, want 1 to %d", highest, maxPieces)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDownloadFromPeerEndsWhenDone(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+	peer.State.PeerChoking = true
+	Torrent.Peers = []*Peer{peer}
+
+	// The remote has every piece but keeps us choked, sending only keep-alives
+	go func() {
+		Torrent.SendMessage(remote, Message{ID: Bitfield, Payload: []byte{0xf0}})
+
+		for Torrent.sendKeepAlive(remote) == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+
+		Torrent.DownloadMutex.Lock()
+		for i := 0; i < Torrent.NumPieces; i++ {
+			Torrent.Downloaded.Set(i)
+		}
+		Torrent.notifyPieces()
+		Torrent.DownloadMutex.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		Torrent.DownloadFromPeer(peer, make(chan PieceResult), &wg)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("DownloadFromPeer still waiting on a choking peer with every piece downloaded")
+	}
+
+	// A canceled download ends the choked wait as well
+	choked, chokingRemote := newTestPeer(t)
+	choked.State.PeerChoking = true
+	Torrent.Downloaded = NewBitSet(Torrent.NumPieces)
+	Torrent.canceled.Store(true)
+
+	go func() {
+		for Torrent.sendKeepAlive(chokingRemote) == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	unchoked := make(chan bool, 1)
+	go func() { unchoked <- Torrent.waitForUnchoke(choked) }()
+
+	select {
+	case ok := <-unchoked:
+		if ok {
+			t.Errorf("waitForUnchoke kept the peer of a canceled download")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waitForUnchoke still waiting after the download was canceled")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDownloadFromPeerWaitsForHave(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	Torrent.Downloaded.Set(0)
+
+	peer, remote := newTestPeer(t)
+	Torrent.Peers = []*Peer{peer}
+
+	requested := make(chan int, 1)
+
+	// The remote starts with only a piece we already have, and announces piece 2 later
+	go func() {
+		Torrent.SendMessage(remote, Message{ID: Bitfield, Payload: []byte{0x80}})
+		Torrent.SendMessage(remote, Message{ID: Unchoke})
+		time.Sleep(200 * time.Millisecond)
+		Torrent.SendMessage(remote, Message{ID: Have, Payload: binary.BigEndian.AppendUint32(nil, 2)})
+
+		for {
+			msg, err := Torrent.readMessage(remote, 5*time.Second)
+			if err != nil {
+				requested <- -1
+				return
+			}
+
+			if msg != nil && msg.ID == Request {
+				requested <- int(binary.BigEndian.Uint32(msg.Payload))
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		Torrent.DownloadFromPeer(peer, make(chan PieceResult, 1), &wg)
+		close(done)
+	}()
+
+	if index := <-requested; index != 2 {
+		t.Fatalf("requested piece %d, want 2", index)
+	}
+
+	select {
+	case <-done:
+		t.Fatalf("DownloadFromPeer returned while downloading the announced piece")
+	default:
+	}
+
+	Torrent.DownloadMutex.Lock()
+	availability := append([]int(nil), Torrent.Availability...)
+	Torrent.DownloadMutex.Unlock()
+
+	if availability[0] != 1 || availability[2] != 1 || availability[1] != 0 {
+		t.Errorf("availability after Have = %v, want [1 0 1 0]", availability)
+	}
+
+	remote.Connection.Close()
+	<-done
+
+	if availability := Torrent.Availability; availability[0] != 0 || availability[2] != 0 {
+		t.Errorf("availability after disconnect = %v, want all zero", availability)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+offsetHandle is a FileHandle recording where it is written to; reads return bytes derived
+from their offset in the file, so misplaced reads are detected without storing any data.
+
+Fields:
+  - writes: Offset and length of every write, in order.
+*/
+type offsetHandle struct {
+	writes [][2]int64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// WriteAt records the offset and length of a write.
+func (Handle *offsetHandle) WriteAt(data []byte, offset int64) (int, error) {
+	Handle.writes = append(Handle.writes, [2]int64{offset, int64(len(data))})
+	return len(data), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// ReadAt fills data with the bytes derived from their file offsets.
+func (Handle *offsetHandle) ReadAt(data []byte, offset int64) (int, error) {
+	for i := range data {
+		data[i] = byte((offset + int64(i)) % 251)
+	}
+
+	return len(data), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// Close does nothing.
+func (Handle *offsetHandle) Close() error {
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestPieceOffsetsBeyond4GB(t *testing.T) {
+	const (
+		pieceLength = 4 << 20
+		firstLength = 5<<30 + 12345
+	)
+
+	Torrent := newTestTorrent()
+	Torrent.Info.Name = "large"
+	Torrent.Info.Length = 0
+	Torrent.Info.PieceLength = pieceLength
+	Torrent.Info.Files = []TorrentFileEntry{
+		{Length: firstLength, Path: []string{"a.bin"}},
+		{Length: 2 << 30, Path: []string{"b.bin"}},
+	}
+	Torrent.Info.Pieces = string(make([]byte, 1793*20))
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	if Torrent.NumPieces != 1793 || Torrent.PieceSize(1792) != 12345 {
+		t.Fatalf("%d pieces, last of %d bytes, want 1793 and 12345", Torrent.NumPieces, Torrent.PieceSize(1792))
+	}
+
+	entries := Torrent.ListFiles()
+	if entries[1].Offset != firstLength || entries[1].FirstPiece != 1280 || entries[1].LastPiece != 1792 {
+		t.Errorf("b.bin at offset %d, pieces %d-%d, want %d, 1280-1792", entries[1].Offset, entries[1].FirstPiece, entries[1].LastPiece, int64(firstLength))
+	}
+
+	err = Torrent.BuildFileInfo(t.TempDir())
+	if err != nil {
+		t.Fatalf("BuildFileInfo: %v", err)
+	}
+
+	handles := []*offsetHandle{{}, {}}
+	Torrent.Files[0].Handle = handles[0]
+	Torrent.Files[1].Handle = handles[1]
+
+	// Piece 1280 starts at 5 GiB, past 2^32, and straddles the two files
+	if !Torrent.writeRange(1280*pieceLength, make([]byte, pieceLength)) {
+		t.Fatalf("writeRange failed")
+	}
+
+	if len(handles[0].writes) != 1 || handles[0].writes[0] != [2]int64{5 << 30, 12345} {
+		t.Errorf("writes to a.bin %v, want [[%d 12345]]", handles[0].writes, int64(5<<30))
+	}
+
+	if len(handles[1].writes) != 1 || handles[1].writes[0] != [2]int64{0, pieceLength - 12345} {
+		t.Errorf("writes to b.bin %v, want [[0 %d]]", handles[1].writes, pieceLength-12345)
+	}
+
+	block, err := Torrent.ReadBlock(1280, 12000, 1000)
+	if err != nil {
+		t.Fatalf("ReadBlock: %v", err)
+	}
+
+	for i, b := range block {
+		want := byte((5<<30 + 12000 + int64(i)) % 251)
+		if i >= 345 {
+			want = byte(int64(i-345) % 251)
+		}
+
+		if b != want {
+			t.Fatalf("byte %d of the block = %d, want %d", i, b, want)
+		}
+	}
+
+	// Piece counts that do not match the size, and piece lengths past 32 bits, are refused
+	Torrent.Downloaded = BitSet{}
+	Torrent.Info.Pieces = string(make([]byte, 1792*20))
+
+	if Torrent.InitializePieces() == nil {
+		t.Errorf("InitializePieces accepted a piece count not matching the size")
+	}
+
+	Torrent.Info.PieceLength = 1 << 32
+	if Torrent.InitializePieces() == nil {
+		t.Errorf("InitializePieces accepted a piece length past 32 bits")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestStartDownloadSelectedFileCompletes(t *testing.T) {
+	content := make([]byte, 4*16384+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	var pieces []byte
+	for start := 0; start < len(content); start += 16384 {
+		hash := sha1.Sum(content[start:min(start+16384, len(content))])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	Torrent := newTestTorrent()
+	Torrent.Config.ProgressMode = ProgressNone
+	Torrent.Config.WebSeeds = true
+	Torrent.Info.Name = "content"
+	Torrent.Info.Length = 0
+	Torrent.Info.Pieces = string(pieces)
+	Torrent.Info.Files = []TorrentFileEntry{
+		{Length: 2 * 16384, Path: []string{"a.bin"}},
+		{Length: 2*16384 + 100, Path: []string{"b.bin"}},
+	}
+
+	var requested sync.Map
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested.Store(r.URL.Path, true)
+
+		data := content[2*16384:]
+		if r.URL.Path == "/content/a.bin" {
+			data = content[:2*16384]
+		}
+
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	Torrent.URLList = []string{server.URL + "/"}
+
+	err := Torrent.SelectFiles([]string{filepath.Join("content", "b.bin")})
+	if err != nil {
+		t.Fatalf("SelectFiles: %v", err)
+	}
+
+	// Completion counts the wanted pieces only, so the download ends without a.bin
+	outputDir := t.TempDir()
+
+	err = Torrent.StartDownload(outputDir)
+	if err != nil {
+		t.Fatalf("StartDownload: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "content", "b.bin"))
+	if err != nil || !bytes.Equal(data, content[2*16384:]) {
+		t.Errorf("selected file not downloaded (%v)", err)
+	}
+
+	if _, ok := requested.Load("/content/a.bin"); ok {
+		t.Errorf("deselected file was fetched from the web seed")
+	}
+
+	if Torrent.Downloaded.Has(0) || Torrent.Downloaded.Has(1) || !Torrent.Downloaded.Has(4) {
+		t.Errorf("downloaded pieces: %v %v %v", Torrent.Downloaded.Has(0), Torrent.Downloaded.Has(1), Torrent.Downloaded.Has(4))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestHandleHaveMarksSeeder(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer := &Peer{}
+
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if peer.Seeder {
+			t.Fatalf("peer marked a seeder with %d of %d pieces", i, Torrent.NumPieces)
+		}
+
+		added, err := Torrent.handleHave(peer, binary.BigEndian.AppendUint32(nil, uint32(i)))
+		if err != nil || !added {
+			t.Fatalf("handleHave(%d) = %v, %v", i, added, err)
+		}
+	}
+
+	if !peer.Seeder || Torrent.counters.connectedSeeders.Load() != 1 {
+		t.Errorf("peer completing through Have: seeder %v, %d seeders counted", peer.Seeder,
+			Torrent.counters.connectedSeeders.Load())
+	}
+
+	// A repeated Have changes nothing, and malformed ones are refused
+	added, err := Torrent.handleHave(peer, binary.BigEndian.AppendUint32(nil, 0))
+	if added || err != nil || Torrent.Availability[0] != 1 || Torrent.counters.connectedSeeders.Load() != 1 {
+		t.Errorf("repeated Have = %v, %v (availability %d)", added, err, Torrent.Availability[0])
+	}
+
+	if _, err := Torrent.handleHave(peer, binary.BigEndian.AppendUint32(nil, uint32(Torrent.NumPieces))); err == nil {
+		t.Errorf("Have for a piece past the end accepted")
+	}
+
+	if _, err := Torrent.handleHave(peer, []byte{0, 0}); err == nil {
+		t.Errorf("short Have accepted")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// padPrefix is the file name prefix BitComet and older clients give padding files.
+const padPrefix = "_____padding_file_"
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isPadFile reports whether a file entry of a multi-file torrent is a padding file (BEP-47).
+Padding files only align the next file on a piece boundary: their content is all zeros and
+they are never written to disk. Besides the "attr" key containing 'p', the ".pad" directory
+and the BitComet name prefix used before BEP-47 are recognized.
+
+Parameters:
+  - entry: File entry from the "files" list.
+
+Returns:
+  - bool: True if the entry is a padding file.
+*/
+func isPadFile(entry TorrentFileEntry) bool {
+	if strings.Contains(entry.Attr, "p") {
+		return true
+	}
+
+	if len(entry.Path) == 0 {
+		return false
+	}
+
+	return entry.Path[0] == ".pad" || strings.HasPrefix(entry.Path[len(entry.Path)-1], padPrefix)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+padHandle is the FileHandle of padding files.
+Writes succeed without storing anything and reads return zeros, so pieces overlapping a
+padding file verify without it existing on disk.
+*/
+type padHandle struct{}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WriteAt discards the data.
+
+Parameters:
+  - data: Bytes to write.
+  - offset: Ignored.
+
+Returns:
+  - int: len(data).
+  - error: Always nil.
+*/
+func (Handle padHandle) WriteAt(data []byte, offset int64) (int, error) {
+	return len(data), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadAt fills the buffer with zeros, the content of every padding file.
+
+Parameters:
+  - data: Destination buffer.
+  - offset: Ignored.
+
+Returns:
+  - int: len(data).
+  - error: Always nil.
+*/
+func (Handle padHandle) ReadAt(data []byte, offset int64) (int, error) {
+	clear(data)
+
+	return len(data), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close does nothing.
+
+Returns:
+  - error: Always nil.
+*/
+func (Handle padHandle) Close() error {
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -3,6 +3,7 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"log"
 	"os"
@@ -109,6 +110,33 @@ func computeInfoHash(path string) ([20]byte, error) {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+computeInfoHashV2 computes the SHA-256 hash of the info dictionary from a torrent file.
+This is the BEP-52 info hash used by v2 and hybrid torrents.
+
+Parameters:
+  - path: Path to the .torrent file on disk.
+
+Returns:
+  - [32]byte: SHA-256 hash of the info dictionary.
+  - error: Non-nil if file reading or info dictionary extraction fails.
+*/
+func computeInfoHashV2(path string) ([32]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("Cannot read %q: %w", path, err)
+	}
+
+	infoBytes, err := extractInfoBytes(data)
+	if err != nil {
+		return [32]byte{}, fmt.Errorf("ExtractInfoBytes: %w", err)
+	}
+
+	return sha256.Sum256(infoBytes), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 Parse loads and parses a .torrent file, populating a TorrentFile struct.
 It decodes the bencoded file and computes the info hash for the torrent.
@@ -133,8 +161,37 @@ func Parse(Torrent *TorrentFile, file string) error {
 	}
 
 	hash, err := computeInfoHash(file)
+	if err != nil {
+		return err
+	}
+
 	log.Printf("[INFO]\tInfo hash: %x\n", hash)
 	Torrent.Info.InfoHash = hash
+	Torrent.sanitizeName()
+
+	err = Torrent.decodeFileTree(file)
+	if err != nil {
+		return err
+	}
+
+	err = Torrent.decodeSignatures(file)
+	if err != nil {
+		return err
+	}
+
+	if Torrent.Info.PieceLength <= 0 {
+		return fmt.Errorf("Invalid piece length %d in %s\n", Torrent.Info.PieceLength, file)
+	}
+
+	if Torrent.Info.MetaVersion == 2 {
+		hashV2, err := computeInfoHashV2(file)
+		if err != nil {
+			return err
+		}
+
+		Torrent.Info.InfoHashV2 = hashV2
+		log.Printf("[INFO]\tInfo hash v2: %x\n", hashV2)
+	}
 
 	log.Printf("[INFO]\tParsed torrent: %s, InfoHash: %x, Computed Hash: %x\n",
 		Torrent.Info.Name, Torrent.Info.InfoHash, hash)
@@ -143,3 +200,131 @@ func Parse(Torrent *TorrentFile, file string) error {
 }
 
 // --------------------------------------------------------------------------------------------- //
+
+/*
+decodeFileTree fills Info.FileTree from a generic decode of the info dictionary.
+The struct-tag decoder cannot build nested dictionaries inside map[string]interface{},
+so the v2 "file tree" has to be decoded separately. The same pass recovers a piece length
+the struct-tag decoder left at zero (see lenientPieceLength).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to populate.
+  - path: Path to the .torrent file on disk.
+
+Returns:
+  - error: Non-nil if the file cannot be read or the info dictionary is malformed.
+*/
+func (Torrent *TorrentFile) decodeFileTree(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read %q: %w", path, err)
+	}
+
+	infoBytes, err := extractInfoBytes(data)
+	if err != nil {
+		return fmt.Errorf("ExtractInfoBytes: %w", err)
+	}
+
+	return Torrent.decodeInfoTree(infoBytes)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeSignatures fills Signatures from a generic decode of the .torrent file, as the
+struct-tag decoder cannot build the nested dictionaries of the "signatures" key (BEP-35).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to populate.
+  - path: Path to the .torrent file on disk.
+
+Returns:
+  - error: Non-nil if the file cannot be read or decoded.
+*/
+func (Torrent *TorrentFile) decodeSignatures(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read %q: %w", path, err)
+	}
+
+	raw, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("Decoding error: %v\n", err)
+	}
+
+	root, _ := raw.(map[string]interface{})
+	Torrent.Signatures, _ = root["signatures"].(map[string]interface{})
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+decodeInfoTree does the work of decodeFileTree on a raw bencoded info dictionary.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to populate.
+  - infoBytes: Bencoded info dictionary.
+
+Returns:
+  - error: Non-nil if the info dictionary is malformed.
+*/
+func (Torrent *TorrentFile) decodeInfoTree(infoBytes []byte) error {
+	raw, err := bencode.Decode(bytes.NewReader(infoBytes))
+	if err != nil {
+		return fmt.Errorf("Decoding info dictionary error: %v\n", err)
+	}
+
+	info, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Info is not a dictionary\n")
+	}
+
+	tree, ok := info["file tree"].(map[string]interface{})
+	if ok {
+		Torrent.Info.FileTree = tree
+	}
+
+	if Torrent.Info.PieceLength <= 0 {
+		Torrent.Info.PieceLength = lenientPieceLength(info)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+lenientPieceLength reads the piece length from an info dictionary written by an out-of-spec
+encoder. Known quirks are a decimal string instead of an integer and the key spelled
+"piece_length" or "piecelength".
+
+Parameters:
+  - info: Generically decoded info dictionary.
+
+Returns:
+  - int64: Piece length, or 0 if none can be recovered.
+*/
+func lenientPieceLength(info map[string]interface{}) int64 {
+	for _, key := range []string{"piece length", "piece_length", "piecelength"} {
+		switch value := info[key].(type) {
+		case int64:
+			if value > 0 {
+				log.Printf("[INFO]\tRecovered piece length %d from key %q\n", value, key)
+				return value
+			}
+
+		case string:
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && length > 0 {
+				log.Printf("[INFO]\tRecovered piece length %d from string value of key %q\n", length, key)
+				return length
+			}
+		}
+	}
+
+	return 0
+}
+
+// --------------------------------------------------------------------------------------------- //
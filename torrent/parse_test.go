@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// hybridInfo is the info dictionary of a one-file hybrid v1/v2 torrent. Its hashes below were
+// computed independently (sha1sum and sha256sum of these bytes).
+var hybridInfo = "d9:file treed8:data.bind0:d6:lengthi16384e11:pieces root32:" + strings.Repeat("a", 32) +
+	"eee6:lengthi16384e12:meta versioni2e4:name8:data.bin12:piece lengthi16384e6:pieces20:" + strings.Repeat("b", 20) + "e"
+
+const (
+	hybridInfoHashV1 = "fb643b1815fd7baca9323de6f003e2ac93445bdd"
+	hybridInfoHashV2 = "28eaab6f722d49fc9caf3b011b00480778b9397666176bcec94a355f3e4d2489"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestParseHybridInfoHashes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hybrid.torrent")
+
+	err := os.WriteFile(path, []byte("d8:announce31:http://tracker.example/announce4:info"+hybridInfo+"e"), 0644)
+	if err != nil {
+		t.Fatalf("writing torrent: %v", err)
+	}
+
+	Torrent := &TorrentFile{Config: DefaultConfig()}
+
+	err = Parse(Torrent, path)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if !Torrent.IsHybrid() {
+		t.Fatalf("torrent with pieces and a file tree not hybrid")
+	}
+
+	v1, err := Torrent.GetInfoHash()
+	if err != nil || hex.EncodeToString(v1[:]) != hybridInfoHashV1 {
+		t.Errorf("v1 info hash = %x (%v), want %s", v1, err, hybridInfoHashV1)
+	}
+
+	v2, err := Torrent.GetInfoHashV2()
+	if err != nil || hex.EncodeToString(v2[:]) != hybridInfoHashV2 {
+		t.Errorf("v2 info hash = %x (%v), want %s", v2, err, hybridInfoHashV2)
+	}
+
+	short, err := Torrent.GetShortInfoHashV2()
+	if err != nil || hex.EncodeToString(short[:]) != hybridInfoHashV2[:40] {
+		t.Errorf("short v2 info hash = %x (%v), want %s", short, err, hybridInfoHashV2[:40])
+	}
+
+	if !Torrent.MatchesInfoHash(v1) || !Torrent.MatchesInfoHash(short) || Torrent.MatchesInfoHash([20]byte{1}) {
+		t.Errorf("MatchesInfoHash does not accept exactly the v1 and short v2 hashes")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"ubuntu.iso", "ubuntu.iso"},
+		{"  padded  ", "padded"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"a\\b\x00c", "a_bc"},
+		{"", hex.EncodeToString(testInfoHash[:])},
+		{"..", hex.EncodeToString(testInfoHash[:])},
+		{" . ", hex.EncodeToString(testInfoHash[:])},
+	}
+
+	for _, test := range tests {
+		Torrent := newTestTorrent()
+		Torrent.Info.Name = test.name
+		Torrent.sanitizeName()
+
+		if Torrent.Info.Name != test.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", test.name, Torrent.Info.Name, test.want)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestParseEmptyName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "unnamed.torrent")
+	info := "d6:lengthi16384e4:name0:12:piece lengthi16384e6:pieces20:" + strings.Repeat("c", 20) + "e"
+
+	err := os.WriteFile(path, []byte("d8:announce31:http://tracker.example/announce4:info"+info+"e"), 0644)
+	if err != nil {
+		t.Fatalf("writing torrent: %v", err)
+	}
+
+	Torrent := &TorrentFile{Config: DefaultConfig()}
+
+	err = Parse(Torrent, path)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	// The download goes to a file named after the info hash inside the output directory
+	want := hex.EncodeToString(Torrent.Info.InfoHash[:])
+	if Torrent.Info.Name != want {
+		t.Fatalf("name of an unnamed torrent = %q, want %q", Torrent.Info.Name, want)
+	}
+
+	outputDir := t.TempDir()
+
+	err = Torrent.BuildFileInfo(outputDir)
+	if err != nil {
+		t.Fatalf("BuildFileInfo: %v", err)
+	}
+
+	if len(Torrent.Files) != 1 || Torrent.Files[0].Path != filepath.Join(outputDir, want) {
+		t.Errorf("files of an unnamed torrent = %+v", Torrent.Files)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,217 @@
+package torrent
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// keepAliveInterval is how long a connection may sit idle before we send a keep-alive.
+// Peers commonly drop connections that stay silent for two minutes.
+const keepAliveInterval = 60 * time.Second
+
+// peerIdleTimeout is how long a peer we are waiting on may stay silent before it is dropped:
+// a live peer sends at least a keep-alive in that time.
+const peerIdleTimeout = 2 * keepAliveInterval
+
+// downloadPollInterval bounds every read of a download loop, so the loop notices a finished or
+// canceled download (see downloadOver) even while the peer sends nothing.
+const downloadPollInterval = time.Second
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PeerState is the BEP-3 choke and interest state of one connection, in both directions.
+Connections start choked and not interested on both sides. Our side only changes through
+setChoking and setInterested, which send the matching message when the state changes;
+the peer's side is updated by receive.
+
+Fields:
+  - AmChoking: We are choking the peer (it may not request blocks from us).
+  - AmInterested: We told the peer we want pieces it has.
+  - PeerChoking: The peer is choking us (our requests are not served).
+  - PeerInterested: The peer told us it wants pieces we have.
+*/
+type PeerState struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newPeerState returns the state of a freshly handshaked connection.
+
+Returns:
+  - PeerState: Both sides choking, neither interested.
+*/
+func newPeerState() PeerState {
+	return PeerState{AmChoking: true, PeerChoking: true}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+receive applies a Choke, Unchoke, Interested or NotInterested message from the peer.
+
+Parameters:
+  - State: State of the connection the message arrived on.
+  - id: ID of the received message.
+
+Returns:
+  - bool: True if the message was a state message and has been applied.
+*/
+func (State *PeerState) receive(id MessageID) bool {
+	switch id {
+	case Choke:
+		State.PeerChoking = true
+	case Unchoke:
+		State.PeerChoking = false
+	case Interested:
+		State.PeerInterested = true
+	case NotInterested:
+		State.PeerInterested = false
+	default:
+		return false
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setInterested tells the peer whether we want pieces from it. Nothing is sent if the state
+does not change; if sending fails the state is left as it was, so the call can be retried.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer.
+  - interested: Desired interest state.
+
+Returns:
+  - error: Non-nil if the Interested or NotInterested message cannot be sent.
+*/
+func (Torrent *TorrentFile) setInterested(peer *Peer, interested bool) error {
+	if peer.State.AmInterested == interested {
+		return nil
+	}
+
+	id := NotInterested
+	if interested {
+		id = Interested
+	}
+
+	err := Torrent.SendMessage(peer, Message{ID: id})
+	if err != nil {
+		return err
+	}
+
+	peer.State.AmInterested = interested
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setChoking chokes or unchokes the peer. Nothing is sent if the state does not change;
+if sending fails the state is left as it was.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer.
+  - choking: Desired choke state.
+
+Returns:
+  - error: Non-nil if the Choke or Unchoke message cannot be sent.
+*/
+func (Torrent *TorrentFile) setChoking(peer *Peer, choking bool) error {
+	if peer.State.AmChoking == choking {
+		return nil
+	}
+
+	id := Unchoke
+	if choking {
+		id = Choke
+	}
+
+	err := Torrent.SendMessage(peer, Message{ID: id})
+	if err != nil {
+		return err
+	}
+
+	peer.State.AmChoking = choking
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendKeepAlive sends a keep-alive (a zero-length message) so the peer does not drop an idle connection.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer.
+
+Returns:
+  - error: Non-nil if the keep-alive cannot be written.
+*/
+func (Torrent *TorrentFile) sendKeepAlive(peer *Peer) error {
+	if peer.Connection == nil {
+		return fmt.Errorf("No connection to peer %s:%d", peer.IP, peer.Port)
+	}
+
+	peer.Connection.SetWriteDeadline(time.Now().Add(60 * time.Second))
+
+	_, err := peer.Connection.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return fmt.Errorf("Sending keep-alive to %s:%d: %v", peer.IP, peer.Port, err)
+	}
+
+	atomic.StoreInt64(&peer.lastSent, time.Now().UnixNano())
+	logPeerf(peer, -1, "[INFO]\tsent keep-alive\n")
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+keepAlive sends a keep-alive if nothing has been sent to the peer for keepAliveInterval.
+Every loop reading from a peer calls it before each read and waits no longer than the
+returned time, so the connection never idles on our side however long the loop waits.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Connected peer.
+
+Returns:
+  - time.Duration: Time until the next keep-alive is due.
+  - error: Non-nil if the keep-alive cannot be sent.
+*/
+func (Torrent *TorrentFile) keepAlive(peer *Peer) (time.Duration, error) {
+	now := time.Now().UnixNano()
+
+	// The handshake counts as the first write
+	atomic.CompareAndSwapInt64(&peer.lastSent, 0, now)
+
+	due := time.Until(time.Unix(0, atomic.LoadInt64(&peer.lastSent)).Add(keepAliveInterval))
+	if due > 0 {
+		return due, nil
+	}
+
+	err := Torrent.sendKeepAlive(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	return keepAliveInterval, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
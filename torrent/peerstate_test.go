@@ -0,0 +1,175 @@
+package torrent
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestPeerStateReceive(t *testing.T) {
+	State := newPeerState()
+	if !State.AmChoking || !State.PeerChoking || State.AmInterested || State.PeerInterested {
+		t.Fatalf("new state = %+v, want both sides choking and not interested", State)
+	}
+
+	steps := []struct {
+		id      MessageID
+		handled bool
+		want    PeerState
+	}{
+		{Unchoke, true, PeerState{AmChoking: true}},
+		{Interested, true, PeerState{AmChoking: true, PeerInterested: true}},
+		{Have, false, PeerState{AmChoking: true, PeerInterested: true}},
+		{Choke, true, PeerState{AmChoking: true, PeerChoking: true, PeerInterested: true}},
+		{NotInterested, true, PeerState{AmChoking: true, PeerChoking: true}},
+	}
+
+	for _, step := range steps {
+		handled := State.receive(step.id)
+		if handled != step.handled || State != step.want {
+			t.Errorf("after message %d: handled %v, state %+v; want %v, %+v", step.id, handled, State, step.handled, step.want)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestSetStateSendsOnChange(t *testing.T) {
+	Torrent := newTestTorrent()
+	peer, remote := newTestPeer(t)
+
+	// Already in the requested state: nothing is sent
+	err := Torrent.setInterested(peer, false)
+	if err != nil {
+		t.Fatalf("setInterested: %v", err)
+	}
+
+	err = Torrent.setChoking(peer, true)
+	if err != nil {
+		t.Fatalf("setChoking: %v", err)
+	}
+
+	err = Torrent.setInterested(peer, true)
+	if err != nil {
+		t.Fatalf("setInterested: %v", err)
+	}
+
+	err = Torrent.setInterested(peer, true)
+	if err != nil {
+		t.Fatalf("setInterested: %v", err)
+	}
+
+	err = Torrent.setChoking(peer, false)
+	if err != nil {
+		t.Fatalf("setChoking: %v", err)
+	}
+
+	for _, want := range []MessageID{Interested, Unchoke} {
+		msg, err := Torrent.readMessage(remote, time.Second)
+		if err != nil || msg == nil || msg.ID != want {
+			t.Fatalf("remote received %v, %v; want message %d", msg, err, want)
+		}
+	}
+
+	_, err = Torrent.readMessage(remote, 100*time.Millisecond)
+	if !errors.Is(err, errReceiveTimeout) {
+		t.Errorf("unchanged state sent a message (%v)", err)
+	}
+
+	if !peer.State.AmInterested || peer.State.AmChoking {
+		t.Errorf("state after the calls = %+v", peer.State)
+	}
+
+	// A failed send leaves the state as it was
+	peer.Connection = nil
+
+	err = Torrent.setInterested(peer, false)
+	if err == nil || !peer.State.AmInterested {
+		t.Errorf("setInterested without a connection: %v, state %+v", err, peer.State)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestKeepAlive(t *testing.T) {
+	Torrent := newTestTorrent()
+	peer, remote := newTestPeer(t)
+
+	// A fresh connection counts as just written to
+	wait, err := Torrent.keepAlive(peer)
+	if err != nil || wait <= keepAliveInterval-time.Second || wait > keepAliveInterval {
+		t.Fatalf("keepAlive on a fresh connection = %s, %v", wait, err)
+	}
+
+	_, err = Torrent.readMessage(remote, 100*time.Millisecond)
+	if !errors.Is(err, errReceiveTimeout) {
+		t.Fatalf("keep-alive sent before it was due (%v)", err)
+	}
+
+	atomic.StoreInt64(&peer.lastSent, time.Now().Add(-keepAliveInterval).UnixNano())
+
+	wait, err = Torrent.keepAlive(peer)
+	if err != nil || wait != keepAliveInterval {
+		t.Fatalf("keepAlive when due = %s, %v", wait, err)
+	}
+
+	msg, err := Torrent.readMessage(remote, time.Second)
+	if err != nil || msg != nil {
+		t.Fatalf("remote received %v, %v; want a keep-alive", msg, err)
+	}
+
+	// Any other message postpones the next keep-alive
+	atomic.StoreInt64(&peer.lastSent, time.Now().Add(-keepAliveInterval).UnixNano())
+
+	err = Torrent.SendMessage(peer, Message{ID: Interested})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	wait, err = Torrent.keepAlive(peer)
+	if err != nil || wait <= keepAliveInterval-time.Second {
+		t.Errorf("keepAlive after a message = %s, %v", wait, err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestWaitForUnchokeSendsKeepAlive(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	peer, remote := newTestPeer(t)
+	peer.State.PeerChoking = true
+	atomic.StoreInt64(&peer.lastSent, time.Now().Add(-keepAliveInterval).UnixNano())
+
+	received := make(chan error, 1)
+
+	// The choked wait is idle, so a keep-alive arrives before the peer unchokes us
+	go func() {
+		msg, err := Torrent.readMessage(remote, 5*time.Second)
+		if err == nil && msg != nil {
+			err = errors.New("not a keep-alive")
+		}
+
+		received <- err
+		Torrent.SendMessage(remote, Message{ID: Unchoke})
+	}()
+
+	if !Torrent.waitForUnchoke(peer) {
+		t.Fatalf("waitForUnchoke dropped the peer")
+	}
+
+	err = <-received
+	if err != nil {
+		t.Errorf("remote side: %v", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,350 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// utPexName is the BEP-11 extension name and utPexID the ID we receive its messages with.
+const (
+	utPexName = "ut_pex"
+	utPexID   = 2
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// pexInterval is the minimum time between two PEX messages to or from the same peer,
+// pexMaxPeers the maximum number of added or dropped peers carried by one message, and
+// pexForget how long an address learned through PEX is kept from being dialed again.
+const (
+	pexInterval = time.Minute
+	pexMaxPeers = 50
+	pexForget   = 30 * time.Minute
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pexSource records where an address learned through PEX came from.
+
+Fields:
+  - peer: Peer whose PEX message added the address.
+  - learned: When the address was learned.
+*/
+type pexSource struct {
+	peer    *Peer
+	learned time.Time
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pexMessage is the bencoded dictionary of a ut_pex message.
+
+Fields:
+  - Added: Compact IPv4 peers (6 bytes each) connected since the previous message.
+  - AddedF: One flags byte per added IPv4 peer.
+  - Dropped: Compact IPv4 peers disconnected since the previous message.
+  - Added6: Compact IPv6 peers (18 bytes each) connected since the previous message.
+  - Added6F: One flags byte per added IPv6 peer.
+  - Dropped6: Compact IPv6 peers disconnected since the previous message.
+*/
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6"`
+	Added6F  string `bencode:"added6.f"`
+	Dropped6 string `bencode:"dropped6"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pexEnabled reports whether peers may be exchanged with Peer Exchange, which private
+torrents never do (see baseTiers).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True if Config.PEX is set and the torrent is not private.
+*/
+func (Torrent *TorrentFile) pexEnabled() bool {
+	return Torrent.Config.PEX && Torrent.Info.Private != 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+compactPeer encodes a peer address in the compact form used by trackers and PEX: 6 bytes
+for IPv4 addresses, 18 bytes for IPv6 addresses.
+
+Parameters:
+  - addr: Peer address ("host:port").
+
+Returns:
+  - []byte: 4- or 16-byte IP address followed by the big-endian port.
+  - bool: False if the address is not a valid IP address and port.
+*/
+func compactPeer(addr string) ([]byte, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil || port == 0 {
+		return nil, false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	compact := make([]byte, len(ip)+2)
+	copy(compact, ip)
+	binary.BigEndian.PutUint16(compact[len(ip):], uint16(port))
+
+	return compact, true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handlePex processes a ut_pex message and connects to the peers it adds.
+Peers already connected, banned, or learned through PEX in the last pexForget are not dialed
+again, so a peer repeating its list does not make us reconnect in a loop. A message arriving
+within pexInterval of the previous one from the same peer is dropped, as BEP-11 allows one
+message per minute.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - body: Bencoded dictionary following the extended message ID.
+
+Returns:
+  - error: Non-nil if the message is malformed.
+*/
+func (Torrent *TorrentFile) handlePex(peer *Peer, body []byte) error {
+	if !Torrent.pexEnabled() {
+		return nil
+	}
+
+	now := time.Now()
+	if !peer.pexReceived.IsZero() && now.Sub(peer.pexReceived) < pexInterval {
+		logPeerf(peer, -1, "[INFO]\tdropping PEX message sent %s after the previous one\n",
+			now.Sub(peer.pexReceived).Round(time.Second))
+
+		return nil
+	}
+
+	peer.pexReceived = now
+
+	var msg pexMessage
+
+	err := bencode.Unmarshal(bytes.NewReader(body), &msg)
+	if err != nil {
+		return fmt.Errorf("Decoding PEX message error: %v\n", err)
+	}
+
+	added, err := Torrent.ParsePeers(msg.Added)
+	if err != nil {
+		return fmt.Errorf("Invalid PEX peer list: %v", err)
+	}
+
+	added6, err := Torrent.ParsePeers6(msg.Added6)
+	if err != nil {
+		return fmt.Errorf("Invalid PEX peer list: %v", err)
+	}
+
+	added = append(added, added6...)
+
+	Torrent.PeersMutex.Lock()
+
+	connected := make(map[string]bool, len(Torrent.Peers))
+	for _, p := range Torrent.Peers {
+		connected[p.ListenAddr()] = true
+	}
+
+	if Torrent.pexKnown == nil {
+		Torrent.pexKnown = make(map[string]pexSource)
+	}
+
+	for addr, source := range Torrent.pexKnown {
+		if now.Sub(source.learned) >= pexForget {
+			delete(Torrent.pexKnown, addr)
+		}
+	}
+
+	var fresh []Peer
+	for i := range added {
+		addr := added[i].ListenAddr()
+		if _, known := Torrent.pexKnown[addr]; connected[addr] || known || len(fresh) >= pexMaxPeers {
+			continue
+		}
+
+		Torrent.pexKnown[addr] = pexSource{peer: peer, learned: now}
+		fresh = append(fresh, added[i])
+	}
+
+	Torrent.PeersMutex.Unlock()
+
+	logPeerf(peer, -1, "[INFO]\tPEX added %d peers, %d new\n", len(added), len(fresh))
+
+	if len(fresh) > 0 {
+		go Torrent.ConnectToPeers(fresh)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendPex sends a peer the changes to our connected peer list since the previous PEX message
+sent to it. Nothing is sent if the list did not change.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer that advertised ut_pex in its extension handshake.
+  - current: Listen addresses of our connected peers.
+
+Returns:
+  - error: Non-nil if encoding or sending fails.
+*/
+func (Torrent *TorrentFile) sendPex(peer *Peer, current map[string]bool) error {
+	self := peer.ListenAddr()
+
+	var msg pexMessage
+	var added, dropped int
+	sent := make(map[string]bool, len(current))
+
+	for addr := range current {
+		if addr == self {
+			continue
+		}
+
+		if peer.pexSent[addr] {
+			sent[addr] = true
+			continue
+		}
+
+		compact, ok := compactPeer(addr)
+		if !ok || added >= pexMaxPeers {
+			continue
+		}
+
+		sent[addr] = true
+		added++
+
+		if len(compact) == 6 {
+			msg.Added += string(compact)
+			msg.AddedF += "\x00"
+		} else {
+			msg.Added6 += string(compact)
+			msg.Added6F += "\x00"
+		}
+	}
+
+	for addr := range peer.pexSent {
+		if sent[addr] {
+			continue
+		}
+
+		compact, ok := compactPeer(addr)
+		if !ok {
+			continue
+		}
+
+		if dropped >= pexMaxPeers {
+			// Still reported as sent so it is dropped in a later message
+			sent[addr] = true
+			continue
+		}
+
+		dropped++
+
+		if len(compact) == 6 {
+			msg.Dropped += string(compact)
+		} else {
+			msg.Dropped6 += string(compact)
+		}
+	}
+
+	if added == 0 && dropped == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	err := bencode.Marshal(&buf, msg)
+	if err != nil {
+		return fmt.Errorf("Encoding PEX message error: %v\n", err)
+	}
+
+	err = Torrent.sendExtended(peer, utPexName, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	peer.pexSent = sent
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+runPex sends every connected peer supporting ut_pex the changes to our peer list once per
+pexInterval, until ctx is cancelled. Peers we receive through PEX are handled by handlePex.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - ctx: Context ending the exchange.
+*/
+func (Torrent *TorrentFile) runPex(ctx context.Context) {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		Torrent.PeersMutex.Lock()
+		peers := make([]*Peer, len(Torrent.Peers))
+		copy(peers, Torrent.Peers)
+		Torrent.PeersMutex.Unlock()
+
+		current := make(map[string]bool, len(peers))
+		for _, peer := range peers {
+			current[peer.ListenAddr()] = true
+		}
+
+		for _, peer := range peers {
+			if !peer.supportsExtension(utPexName) {
+				continue
+			}
+
+			err := Torrent.sendPex(peer, current)
+			if err != nil {
+				logPeerf(peer, -1, "[ERROR]\tsending PEX: %v", err)
+			}
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,91 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pexBody encodes a ut_pex message adding IPv4 peers on 127.0.0.1, where nothing listens on
+the low ports used, so dialing them fails at once.
+
+Parameters:
+  - t: Test the message belongs to.
+  - ports: Ports of the added peers.
+
+Returns:
+  - []byte: Bencoded message body.
+*/
+func pexBody(t *testing.T, ports ...int) []byte {
+	t.Helper()
+
+	var msg pexMessage
+	for _, port := range ports {
+		msg.Added += string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)})
+		msg.AddedF += "\x00"
+	}
+
+	var body bytes.Buffer
+
+	err := bencode.Marshal(&body, msg)
+	if err != nil {
+		t.Fatalf("encoding PEX message: %v", err)
+	}
+
+	return body.Bytes()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestHandlePexRateLimit(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Config.PEX = true
+
+	peer := &Peer{IP: "10.0.0.1", Port: 6881}
+	Torrent.Peers = []*Peer{peer}
+
+	known := func(port string) bool {
+		Torrent.PeersMutex.Lock()
+		defer Torrent.PeersMutex.Unlock()
+
+		_, ok := Torrent.pexKnown["127.0.0.1:"+port]
+		return ok
+	}
+
+	err := Torrent.handlePex(peer, pexBody(t, 1))
+	if err != nil || !known("1") {
+		t.Fatalf("first PEX message not accepted (%v)", err)
+	}
+
+	// A second message within pexInterval is dropped
+	err = Torrent.handlePex(peer, pexBody(t, 2))
+	if err != nil || known("2") {
+		t.Errorf("PEX message within pexInterval accepted (%v)", err)
+	}
+
+	// Once pexInterval has passed, messages are accepted again and old entries forgotten
+	peer.pexReceived = time.Now().Add(-pexInterval)
+
+	Torrent.PeersMutex.Lock()
+	Torrent.pexKnown["127.0.0.1:1"] = pexSource{peer: peer, learned: time.Now().Add(-pexForget)}
+	Torrent.PeersMutex.Unlock()
+
+	err = Torrent.handlePex(peer, pexBody(t, 3))
+	if err != nil || !known("3") || known("1") {
+		t.Errorf("after pexInterval: 3 known %v, expired 1 known %v (%v)", known("3"), known("1"), err)
+	}
+
+	// Disconnecting the peer forgets what it told us
+	Torrent.removePeer(peer)
+
+	if known("3") {
+		t.Errorf("address learned from a removed peer still known")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
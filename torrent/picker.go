@@ -0,0 +1,359 @@
+package torrent
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PiecePicker decides which piece a peer should download next.
+Pick is always called with Torrent.DownloadMutex held, so implementations may read
+torrent state (such as availability counters) without additional locking.
+
+Methods:
+  - Pick: Returns the index of the next piece to request from peer, or ok=false if
+    the peer has nothing we still need.
+*/
+type PiecePicker interface {
+	Pick(peer *Peer, inProgress, done BitSet) (index int, ok bool)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+candidate reports whether a piece can be handed out to the given peer.
+A piece is a candidate if the peer has it and it is neither finished nor claimed.
+
+Parameters:
+  - peer: Peer whose bitfield is checked.
+  - index: Piece index to check.
+  - inProgress: Pieces currently being downloaded.
+  - done: Pieces already verified and written.
+
+Returns:
+  - bool: True if the piece may be picked.
+*/
+func candidate(peer *Peer, index int, inProgress, done BitSet) bool {
+	if done.Has(index) || inProgress.Has(index) {
+		return false
+	}
+
+	byteIndex := index / 8
+	if byteIndex >= len(peer.Bitfield) {
+		return false
+	}
+
+	return (peer.Bitfield[byteIndex]>>(7-index%8))&1 == 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SequentialPicker hands out pieces in ascending index order.
+It is useful for streaming, where the beginning of the data is needed first.
+*/
+type SequentialPicker struct{}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Pick returns the lowest-indexed piece the peer has that is still needed.
+
+Parameters:
+  - peer: Peer to pick a piece for.
+  - inProgress: Pieces currently being downloaded.
+  - done: Pieces already verified and written.
+
+Returns:
+  - int: Index of the picked piece.
+  - bool: False if no piece is available from this peer.
+*/
+func (Picker *SequentialPicker) Pick(peer *Peer, inProgress, done BitSet) (int, bool) {
+	for i := 0; i < done.Len(); i++ {
+		if candidate(peer, i, inProgress, done) {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+RarestFirstPicker hands out the piece held by the fewest connected peers.
+Rarity is taken from Torrent.Availability, which is raised as bitfields and Have messages
+arrive and lowered by lt_donthave and disconnects.
+
+Fields:
+  - Torrent: Torrent whose availability counters are consulted.
+*/
+type RarestFirstPicker struct {
+	Torrent *TorrentFile
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Pick returns the rarest piece the peer has that is still needed.
+Ties are broken by the lowest index. While seeders are connected, a peer that is not a seeder
+leaves pieces only the seeders and itself hold to the seeders, the most reliable source for
+rare pieces, and only takes one of them when it has nothing else to offer.
+
+Parameters:
+  - peer: Peer to pick a piece for.
+  - inProgress: Pieces currently being downloaded.
+  - done: Pieces already verified and written.
+
+Returns:
+  - int: Index of the picked piece.
+  - bool: False if no piece is available from this peer.
+*/
+func (Picker *RarestFirstPicker) Pick(peer *Peer, inProgress, done BitSet) (int, bool) {
+	seeders := 0
+	if !peer.Seeder {
+		seeders = int(Picker.Torrent.counters.connectedSeeders.Load())
+	}
+
+	best, bestRare := -1, -1
+	bestCount, bestRareCount := 0, 0
+
+	for i := 0; i < done.Len(); i++ {
+		if !candidate(peer, i, inProgress, done) {
+			continue
+		}
+
+		count := 0
+		if i < len(Picker.Torrent.Availability) {
+			count = Picker.Torrent.Availability[i]
+		}
+
+		if seeders > 0 && count <= seeders+1 {
+			if bestRare == -1 || count < bestRareCount {
+				bestRare = i
+				bestRareCount = count
+			}
+
+			continue
+		}
+
+		if best == -1 || count < bestCount {
+			best = i
+			bestCount = count
+		}
+	}
+
+	if best == -1 {
+		return bestRare, bestRare != -1
+	}
+
+	return best, true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PriorityPicker hands out pieces by descending priority.
+Pieces with a negative priority are never picked; pieces without an entry have priority 0.
+
+Fields:
+  - Priorities: Per-piece priority values, indexed by piece.
+*/
+type PriorityPicker struct {
+	Priorities []int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Pick returns the highest-priority piece the peer has that is still needed.
+Ties are broken by the lowest index.
+
+Parameters:
+  - peer: Peer to pick a piece for.
+  - inProgress: Pieces currently being downloaded.
+  - done: Pieces already verified and written.
+
+Returns:
+  - int: Index of the picked piece.
+  - bool: False if no piece is available from this peer.
+*/
+func (Picker *PriorityPicker) Pick(peer *Peer, inProgress, done BitSet) (int, bool) {
+	best := -1
+	bestPriority := 0
+
+	for i := 0; i < done.Len(); i++ {
+		priority := 0
+		if i < len(Picker.Priorities) {
+			priority = Picker.Priorities[i]
+		}
+
+		if priority < 0 || !candidate(peer, i, inProgress, done) {
+			continue
+		}
+
+		if best == -1 || priority > bestPriority {
+			best = i
+			bestPriority = priority
+		}
+	}
+
+	return best, best != -1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+updateAvailability adds delta to the availability counter of every piece in a bitfield.
+It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose counters are updated.
+  - bitfield: Peer bitfield in wire format.
+  - delta: +1 when a peer announces its bitfield, -1 when it disconnects (see handleHave for single pieces).
+*/
+func (Torrent *TorrentFile) updateAvailability(bitfield []byte, delta int) {
+	for i := range Torrent.Availability {
+		if Torrent.HasPiece(bitfield, i) {
+			Torrent.Availability[i] += delta
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+settledPieces returns the pieces a peer should not be asked for: those already downloaded,
+those lying entirely within deselected files and, for peers that cannot serve short blocks,
+a last piece ending in a short block. It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the pieces would be requested from.
+
+Returns:
+  - BitSet: Pieces to skip (Torrent.Downloaded itself if nothing else is excluded).
+*/
+func (Torrent *TorrentFile) settledPieces(peer *Peer) BitSet {
+	last := Torrent.NumPieces - 1
+	skipLast := peer.NoShortBlocks && last >= 0 && Torrent.PieceSize(last)%blockSize != 0
+
+	if Torrent.Wanted.Count() == Torrent.NumPieces && !skipLast {
+		return Torrent.Downloaded
+	}
+
+	settled := NewBitSet(Torrent.NumPieces)
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.Downloaded.Has(i) || !Torrent.Wanted.Has(i) {
+			settled.Set(i)
+		}
+	}
+
+	if skipLast {
+		settled.Set(last)
+	}
+
+	return settled
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+wantedDone counts downloaded pieces that are wanted.
+It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - int: Number of wanted pieces already downloaded.
+*/
+func (Torrent *TorrentFile) wantedDone() int {
+	done := 0
+
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.Downloaded.Has(i) && Torrent.Wanted.Has(i) {
+			done++
+		}
+	}
+
+	return done
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+downloadOver reports whether downloaders have nothing left to wait for: every wanted piece is
+downloaded or the download was canceled. Read loops waiting on a peer check it on every pass
+and at least every downloadPollInterval, so a peer that keeps us choked or idle cannot keep
+them running after the download ends.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+
+Returns:
+  - bool: True once the download is finished or canceled.
+*/
+func (Torrent *TorrentFile) downloadOver() bool {
+	if Torrent.canceled.Load() {
+		return true
+	}
+
+	Torrent.DownloadMutex.Lock()
+	defer Torrent.DownloadMutex.Unlock()
+
+	return Torrent.wantedDone() == Torrent.Wanted.Count()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+piecesSignal returns a channel that is closed the next time the pieces a peer could pick
+change: a piece in progress is finished or given up, pieces are wanted again or deselected,
+or the download is canceled. Downloaders that find nothing to pick wait on it instead of
+polling. It must be called with Torrent.DownloadMutex held, before checking what to pick, so
+no change between the check and the wait is missed.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+
+Returns:
+  - <-chan struct{}: Channel closed by the next notifyPieces.
+*/
+func (Torrent *TorrentFile) piecesSignal() <-chan struct{} {
+	if Torrent.piecesChanged == nil {
+		Torrent.piecesChanged = make(chan struct{})
+	}
+
+	return Torrent.piecesChanged
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+notifyPieces wakes everyone waiting on piecesSignal. It must be called with
+Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+*/
+func (Torrent *TorrentFile) notifyPieces() {
+	if Torrent.piecesChanged != nil {
+		close(Torrent.piecesChanged)
+		Torrent.piecesChanged = nil
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+releasePiece takes a piece out of InProgress, because it was written or given up, and wakes
+the downloaders waiting for one. It must be called with Torrent.DownloadMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - index: Index of the piece.
+*/
+func (Torrent *TorrentFile) releasePiece(index int) {
+	Torrent.InProgress.Clear(index)
+	Torrent.notifyPieces()
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,153 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestSequentialPicker(t *testing.T) {
+	inProgress, done := NewBitSet(4), NewBitSet(4)
+	peer := &Peer{Bitfield: []byte{0x60}}
+	picker := &SequentialPicker{}
+
+	if index, ok := picker.Pick(peer, inProgress, done); !ok || index != 1 {
+		t.Errorf("Pick = %d, %v, want 1", index, ok)
+	}
+
+	inProgress.Set(1)
+	if index, ok := picker.Pick(peer, inProgress, done); !ok || index != 2 {
+		t.Errorf("Pick with piece 1 in progress = %d, %v, want 2", index, ok)
+	}
+
+	done.Set(2)
+	if index, ok := picker.Pick(peer, inProgress, done); ok {
+		t.Errorf("Pick with nothing left = %d, want none", index)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestRarestFirstPicker(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	Torrent.Availability = []int{3, 2, 2, 1}
+
+	peer := &Peer{Bitfield: []byte{0xf0}}
+	picker := &RarestFirstPicker{Torrent: Torrent}
+
+	if index, ok := picker.Pick(peer, Torrent.InProgress, Torrent.Downloaded); !ok || index != 3 {
+		t.Errorf("Pick = %d, %v, want the rarest piece 3", index, ok)
+	}
+
+	// Pieces announced with Have count towards their availability
+	for i := 0; i < 2; i++ {
+		_, err := Torrent.handleHave(&Peer{}, binary.BigEndian.AppendUint32(nil, 3))
+		if err != nil {
+			t.Fatalf("handleHave: %v", err)
+		}
+	}
+
+	if Torrent.Availability[3] != 3 {
+		t.Errorf("availability of piece 3 after two Haves = %d, want 3", Torrent.Availability[3])
+	}
+
+	if index, ok := picker.Pick(peer, Torrent.InProgress, Torrent.Downloaded); !ok || index != 1 {
+		t.Errorf("Pick after Have = %d, %v, want the lower of the tied pieces 1", index, ok)
+	}
+
+	Torrent.InProgress.Set(1)
+	if index, ok := picker.Pick(peer, Torrent.InProgress, Torrent.Downloaded); !ok || index != 2 {
+		t.Errorf("Pick with piece 1 in progress = %d, %v, want 2", index, ok)
+	}
+
+	if index, ok := picker.Pick(&Peer{}, Torrent.InProgress, Torrent.Downloaded); ok {
+		t.Errorf("Pick for a peer without pieces = %d, want none", index)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestPriorityPicker(t *testing.T) {
+	inProgress, done := NewBitSet(4), NewBitSet(4)
+	peer := &Peer{Bitfield: []byte{0xf0}}
+	picker := &PriorityPicker{Priorities: []int{0, 5, -1, 5}}
+
+	if index, ok := picker.Pick(peer, inProgress, done); !ok || index != 1 {
+		t.Errorf("Pick = %d, %v, want the first top-priority piece 1", index, ok)
+	}
+
+	inProgress.Set(1)
+	if index, ok := picker.Pick(peer, inProgress, done); !ok || index != 3 {
+		t.Errorf("Pick with piece 1 in progress = %d, %v, want 3", index, ok)
+	}
+
+	done.Set(3)
+	if index, ok := picker.Pick(peer, inProgress, done); !ok || index != 0 {
+		t.Errorf("Pick with the top pieces taken = %d, %v, want 0", index, ok)
+	}
+
+	// Pieces with a negative priority are never picked
+	done.Set(0)
+	if index, ok := picker.Pick(peer, inProgress, done); ok {
+		t.Errorf("Pick with only a skipped piece left = %d, want none", index)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestRarestFirstPrefersSeeders(t *testing.T) {
+	Torrent := newTestTorrent()
+
+	err := Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	seeder := &Peer{Bitfield: []byte{0xf0}}
+	partial := &Peer{Bitfield: []byte{0xc0}}
+	other := &Peer{Bitfield: []byte{0x40}}
+
+	Torrent.DownloadMutex.Lock()
+	for _, peer := range []*Peer{seeder, partial, other} {
+		Torrent.updateAvailability(peer.Bitfield, 1)
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	Torrent.markSeeder(seeder)
+	Torrent.markSeeder(partial)
+
+	if !seeder.Seeder || partial.Seeder || Torrent.counters.connectedSeeders.Load() != 1 {
+		t.Fatalf("seeders = %v %v (%d counted), want only the full peer", seeder.Seeder, partial.Seeder,
+			Torrent.counters.connectedSeeders.Load())
+	}
+
+	picker := &RarestFirstPicker{Torrent: Torrent}
+
+	// Piece 0 is held only by the seeder and the partial peer: it is left to the seeder
+	if index, ok := picker.Pick(partial, Torrent.InProgress, Torrent.Downloaded); !ok || index != 1 {
+		t.Errorf("partial peer Pick = %d, %v, want 1", index, ok)
+	}
+
+	Torrent.Downloaded.Set(2)
+	Torrent.Downloaded.Set(3)
+
+	if index, ok := picker.Pick(seeder, Torrent.InProgress, Torrent.Downloaded); !ok || index != 0 {
+		t.Errorf("seeder Pick = %d, %v, want the shared piece 0", index, ok)
+	}
+
+	// With nothing else to offer, the partial peer takes the shared piece after all
+	Torrent.Downloaded.Set(1)
+
+	if index, ok := picker.Pick(partial, Torrent.InProgress, Torrent.Downloaded); !ok || index != 0 {
+		t.Errorf("partial peer Pick with only piece 0 left = %d, %v, want 0", index, ok)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
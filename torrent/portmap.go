@@ -0,0 +1,471 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// portMapLifetime is the lease requested for a port mapping; mappings are renewed after half
+// of the lease the gateway granted.
+const portMapLifetime = 2 * time.Hour
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+portMapper creates and removes TCP port mappings on a gateway with one protocol.
+
+Methods:
+  - Name: Returns the protocol name, for logging.
+  - Add: Maps the external port to the internal port of this host for the given lease and
+    returns the external port and lease the gateway granted (a lease of 0 is permanent).
+  - Remove: Deletes the mapping of the internal port.
+*/
+type portMapper interface {
+	Name() string
+	Add(internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error)
+	Remove(internal, external uint16) error
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PortMapping is a port forwarding of the listen port on the local gateway, kept alive in the
+background until Close is called.
+
+Fields:
+  - Protocol: Protocol the mapping was made with ("PCP", "NAT-PMP" or "UPnP").
+  - InternalPort: Local port being forwarded.
+  - ExternalPort: Port the gateway forwards to InternalPort.
+*/
+type PortMapping struct {
+	Protocol     string
+	InternalPort uint16
+	ExternalPort uint16
+
+	mapper    portMapper
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ForwardPort maps Config.ListenPort on the local gateway so that peers outside our NAT can
+connect to the listener. PCP and NAT-PMP are tried on the default gateway first, then UPnP
+IGD is discovered on the local network. The mapping is renewed before its lease expires until
+Close removes it. If the gateway assigns another external port and Config.AnnouncePort is
+unset, the external port is advertised to trackers instead.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose listen port is forwarded.
+
+Returns:
+  - *PortMapping: The mapping; the caller must Close it.
+  - error: Non-nil if no gateway could map the port.
+*/
+func (Torrent *TorrentFile) ForwardPort() (*PortMapping, error) {
+	port := Torrent.Config.ListenPort
+
+	var mappers []portMapper
+
+	gateway, err := defaultGateway()
+	if err != nil {
+		log.Printf("[INFO]\tNo default gateway for PCP and NAT-PMP: %v", err)
+	} else {
+		mappers = append(mappers, newPCP(gateway), &natPMP{gateway: gateway})
+	}
+
+	mappers = append(mappers, &upnpIGD{})
+
+	for _, mapper := range mappers {
+		external, lifetime, err := mapper.Add(port, port, portMapLifetime)
+		if err != nil {
+			log.Printf("[INFO]\tPort mapping with %s failed: %v", mapper.Name(), err)
+			continue
+		}
+
+		log.Printf("[INFO]\tMapped external TCP port %d to %d with %s (lease %v)\n",
+			external, port, mapper.Name(), lifetime)
+
+		if external != port && Torrent.Config.AnnouncePort == 0 {
+			Torrent.Config.AnnouncePort = external
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		mapping := &PortMapping{
+			Protocol:     mapper.Name(),
+			InternalPort: port,
+			ExternalPort: external,
+			mapper:       mapper,
+			cancel:       cancel,
+			done:         make(chan struct{}),
+		}
+
+		go mapping.renew(ctx, lifetime)
+
+		return mapping, nil
+	}
+
+	return nil, fmt.Errorf("No gateway could forward port %d\n", port)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+renew refreshes the mapping after half of each lease until ctx is cancelled. Permanent
+mappings (a lease of 0) are not renewed.
+
+Parameters:
+  - Mapping: Pointer to the PortMapping to keep alive.
+  - ctx: Context ending the renewals.
+  - lifetime: Lease granted by the gateway for the current mapping.
+*/
+func (Mapping *PortMapping) renew(ctx context.Context, lifetime time.Duration) {
+	defer close(Mapping.done)
+
+	for lifetime > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(lifetime / 2):
+		}
+
+		external, granted, err := Mapping.mapper.Add(Mapping.InternalPort, Mapping.ExternalPort, portMapLifetime)
+		if err != nil {
+			log.Printf("[ERROR]\tRenewing %s port mapping: %v", Mapping.Protocol, err)
+			lifetime = 2 * time.Minute
+			continue
+		}
+
+		if external != Mapping.ExternalPort {
+			log.Printf("[INFO]\t%s port mapping moved from external port %d to %d\n",
+				Mapping.Protocol, Mapping.ExternalPort, external)
+		}
+
+		Mapping.ExternalPort = external
+		lifetime = granted
+	}
+
+	<-ctx.Done()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close stops renewing the mapping and removes it from the gateway. It is safe to call more
+than once.
+
+Parameters:
+  - Mapping: Pointer to the PortMapping to remove.
+
+Returns:
+  - error: Non-nil if the gateway refused to remove the mapping.
+*/
+func (Mapping *PortMapping) Close() error {
+	var err error
+
+	Mapping.closeOnce.Do(func() {
+		Mapping.cancel()
+		<-Mapping.done
+
+		err = Mapping.mapper.Remove(Mapping.InternalPort, Mapping.ExternalPort)
+		if err == nil {
+			log.Printf("[INFO]\tRemoved %s port mapping of port %d\n", Mapping.Protocol, Mapping.InternalPort)
+		}
+	})
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+localAddrTo returns the local address used to reach a host, as the internal address of
+port mappings. Connecting a UDP socket only consults the routing table; no packet is sent.
+
+Parameters:
+  - host: IP address of the gateway.
+
+Returns:
+  - net.IP: Local IPv4 address.
+  - error: Non-nil if no route to the host exists.
+*/
+func localAddrTo(host net.IP) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: host, Port: 9})
+	if err != nil {
+		return nil, fmt.Errorf("No route to %s: %v", host, err)
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4(), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// natPMPPort is the UDP port PCP and NAT-PMP servers listen on, and natPMPTries the number of
+// times a request is sent, waiting twice as long as before each time.
+const (
+	natPMPPort  = 5351
+	natPMPTries = 4
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+natPMPRequest sends a PCP or NAT-PMP request to the gateway and waits for the answer,
+retransmitting it with an exponential backoff starting at 250ms.
+
+Parameters:
+  - gateway: IP address of the gateway.
+  - req: Request packet.
+  - valid: Reports whether a received packet answers the request.
+
+Returns:
+  - []byte: Response packet.
+  - error: Non-nil if the gateway did not answer.
+*/
+func natPMPRequest(gateway net.IP, req []byte, valid func([]byte) bool) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: gateway, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := 250 * time.Millisecond
+	resp := make([]byte, 1100)
+
+	for try := 0; try < natPMPTries; try, timeout = try+1, timeout*2 {
+		_, err = conn.Write(req)
+		if err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		for {
+			n, err := conn.Read(resp)
+			if err != nil {
+				break
+			}
+
+			if valid(resp[:n]) {
+				return resp[:n], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("No answer from %s after %d tries", gateway, natPMPTries)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+natPMP maps ports with NAT-PMP (RFC 6886).
+
+Fields:
+  - gateway: IP address of the default gateway.
+*/
+type natPMP struct {
+	gateway net.IP
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// Name returns "NAT-PMP".
+func (Mapper *natPMP) Name() string {
+	return "NAT-PMP"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Add sends a TCP mapping request (opcode 2) and returns the port and lease granted.
+
+Parameters:
+  - Mapper: Pointer to the natPMP mapper.
+  - internal: Local port to forward.
+  - external: Suggested external port.
+  - lifetime: Requested lease (0 removes the mapping).
+
+Returns:
+  - uint16: External port granted.
+  - time.Duration: Lease granted.
+  - error: Non-nil if the gateway did not answer or refused the mapping.
+*/
+func (Mapper *natPMP) Add(internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	req := make([]byte, 12)
+	req[1] = 2
+	binary.BigEndian.PutUint16(req[4:6], internal)
+	binary.BigEndian.PutUint16(req[6:8], external)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lifetime/time.Second))
+
+	resp, err := natPMPRequest(Mapper.gateway, req, func(resp []byte) bool {
+		return len(resp) >= 16 && resp[0] == 0 && resp[1] == 128+2 &&
+			binary.BigEndian.Uint16(resp[8:10]) == internal
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	result := binary.BigEndian.Uint16(resp[2:4])
+	if result != 0 {
+		return 0, 0, fmt.Errorf("NAT-PMP result code %d", result)
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second
+	if lifetime > 0 && granted == 0 {
+		return 0, 0, fmt.Errorf("NAT-PMP granted no lease")
+	}
+
+	return binary.BigEndian.Uint16(resp[10:12]), granted, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Remove deletes the mapping by requesting a lease of 0 with an external port of 0.
+
+Parameters:
+  - Mapper: Pointer to the natPMP mapper.
+  - internal: Local port of the mapping.
+  - external: External port of the mapping (unused).
+
+Returns:
+  - error: Non-nil if the gateway did not answer or refused.
+*/
+func (Mapper *natPMP) Remove(internal, external uint16) error {
+	_, _, err := Mapper.Add(internal, 0, 0)
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pcp maps ports with the Port Control Protocol (RFC 6887), the successor of NAT-PMP.
+
+Fields:
+  - gateway: IP address of the default gateway.
+  - nonce: Mapping nonce, identifying our mapping in renewals and its removal.
+*/
+type pcp struct {
+	gateway net.IP
+	nonce   [12]byte
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newPCP creates a PCP mapper with a random mapping nonce.
+
+Parameters:
+  - gateway: IP address of the default gateway.
+
+Returns:
+  - *pcp: The mapper.
+*/
+func newPCP(gateway net.IP) *pcp {
+	mapper := &pcp{gateway: gateway}
+	rand.Read(mapper.nonce[:])
+
+	return mapper
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// Name returns "PCP".
+func (Mapper *pcp) Name() string {
+	return "PCP"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Add sends a MAP request for TCP and returns the port and lease granted. Gateways that only
+speak NAT-PMP answer with an unsupported version, which fails the request.
+
+Parameters:
+  - Mapper: Pointer to the pcp mapper.
+  - internal: Local port to forward.
+  - external: Suggested external port.
+  - lifetime: Requested lease (0 removes the mapping).
+
+Returns:
+  - uint16: External port granted.
+  - time.Duration: Lease granted.
+  - error: Non-nil if the gateway did not answer, does not speak PCP or refused the mapping.
+*/
+func (Mapper *pcp) Add(internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	local, err := localAddrTo(Mapper.gateway)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	req := make([]byte, 60)
+	req[0] = 2
+	req[1] = 1
+	binary.BigEndian.PutUint32(req[4:8], uint32(lifetime/time.Second))
+	copy(req[8:24], local.To16())
+	copy(req[24:36], Mapper.nonce[:])
+	req[36] = 6
+	binary.BigEndian.PutUint16(req[40:42], internal)
+	binary.BigEndian.PutUint16(req[42:44], external)
+	copy(req[44:60], net.IPv4zero.To16())
+
+	resp, err := natPMPRequest(Mapper.gateway, req, func(resp []byte) bool {
+		if len(resp) >= 4 && resp[0] == 0 {
+			return true
+		}
+
+		return len(resp) >= 60 && resp[0] == 2 && resp[1] == 128+1 &&
+			bytes.Equal(resp[24:36], Mapper.nonce[:])
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if resp[0] != 2 {
+		return 0, 0, fmt.Errorf("Gateway does not support PCP")
+	}
+
+	if resp[3] != 0 {
+		return 0, 0, fmt.Errorf("PCP result code %d", resp[3])
+	}
+
+	granted := time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second
+	if lifetime > 0 && granted == 0 {
+		return 0, 0, fmt.Errorf("PCP granted no lease")
+	}
+
+	return binary.BigEndian.Uint16(resp[42:44]), granted, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Remove deletes the mapping by sending a MAP request with a lease of 0.
+
+Parameters:
+  - Mapper: Pointer to the pcp mapper.
+  - internal: Local port of the mapping.
+  - external: External port of the mapping (unused).
+
+Returns:
+  - error: Non-nil if the gateway did not answer or refused.
+*/
+func (Mapper *pcp) Remove(internal, external uint16) error {
+	_, _, err := Mapper.Add(internal, 0, 0)
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
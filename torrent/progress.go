@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"fmt"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// progressLineInterval is how often ProgressLines prints a progress line.
+const progressLineInterval = 5 * time.Second
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+progressRenderer prints the progress of a download, verification or repair on stdout in
+the way Config.ProgressMode asks for. Nothing is printed with ProgressNone.
+
+Fields:
+  - mode: Resolved progress mode (never ProgressAuto).
+  - lastLine: When ProgressLines last printed a line.
+  - drawn: Whether ProgressBar has a progress line on screen that is not ended yet.
+*/
+type progressRenderer struct {
+	mode     ProgressMode
+	lastLine time.Time
+	drawn    bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+progressRenderer returns a renderer for the torrent's Config.ProgressMode.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose config is used.
+
+Returns:
+  - *progressRenderer: New renderer.
+*/
+func (Torrent *TorrentFile) progressRenderer() *progressRenderer {
+	return &progressRenderer{mode: Torrent.Config.ProgressMode.resolve()}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+update reports progress: ProgressBar redraws bar in place, ProgressLines prints line at most
+every progressLineInterval and always once done.
+
+Parameters:
+  - Renderer: Renderer to print with.
+  - bar: Text of the in-place progress line.
+  - line: Text of a plain progress line.
+  - done: Whether this is the last update.
+*/
+func (Renderer *progressRenderer) update(bar, line string, done bool) {
+	switch Renderer.mode {
+	case ProgressBar:
+		fmt.Print("\r" + bar)
+		Renderer.drawn = true
+
+	case ProgressLines:
+		now := time.Now()
+		if done || now.Sub(Renderer.lastLine) >= progressLineInterval {
+			Renderer.lastLine = now
+			fmt.Println(line)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+message prints a one-off status line, ending the bar on screen first.
+
+Parameters:
+  - Renderer: Renderer to print with.
+  - format: fmt format of the message, without a trailing newline.
+  - args: Format arguments.
+*/
+func (Renderer *progressRenderer) message(format string, args ...any) {
+	if Renderer.mode != ProgressBar && Renderer.mode != ProgressLines {
+		return
+	}
+
+	Renderer.finish()
+	fmt.Printf(format+"\n", args...)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+finish ends the progress bar line on screen, if any.
+
+Parameters:
+  - Renderer: Renderer to print with.
+*/
+func (Renderer *progressRenderer) finish() {
+	if Renderer.drawn {
+		fmt.Println()
+		Renderer.drawn = false
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,148 @@
+package torrent
+
+import (
+	"net/url"
+	"strings"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// hexDigits are the digits percent-encoded bytes are written with.
+const hexDigits = "0123456789ABCDEF"
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+escapeQueryValue percent-encodes a tracker query value, byte by byte. Only the RFC 3986
+unreserved characters are left as they are, so binary values such as the raw 20-byte info hash
+and peer ID are encoded exactly once and decode to the same bytes on every tracker. Unlike
+url.QueryEscape, spaces become "%20" rather than "+", which some trackers do not decode.
+
+Parameters:
+  - value: Raw value, may contain any byte.
+
+Returns:
+  - string: The encoded value.
+*/
+func escapeQueryValue(value string) string {
+	var builder strings.Builder
+	builder.Grow(len(value) * 3)
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			builder.WriteByte(c)
+		default:
+			builder.WriteByte('%')
+			builder.WriteByte(hexDigits[c>>4])
+			builder.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+
+	return builder.String()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+queryParam is a single name/value pair of a tracker query.
+
+Fields:
+  - name: Parameter name.
+  - value: Raw (unencoded) parameter value.
+*/
+type queryParam struct {
+	name  string
+	value string
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerQuery builds the query string of HTTP tracker requests.
+Values are kept raw and only encoded by Encode, using escapeQueryValue, and parameters keep
+the order they were added in.
+*/
+type trackerQuery []queryParam
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Add appends a parameter, even if one with the same name exists ("info_hash" may repeat in
+scrape requests).
+
+Parameters:
+  - name: Parameter name.
+  - value: Raw parameter value.
+*/
+func (Query *trackerQuery) Add(name, value string) {
+	*Query = append(*Query, queryParam{name: name, value: value})
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Set replaces the value of the first parameter with the given name, or appends the parameter
+if there is none.
+
+Parameters:
+  - name: Parameter name.
+  - value: Raw parameter value.
+*/
+func (Query *trackerQuery) Set(name, value string) {
+	for i := range *Query {
+		if (*Query)[i].name == name {
+			(*Query)[i].value = value
+			return
+		}
+	}
+
+	Query.Add(name, value)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Encode returns the query string, with every name and value percent-encoded once.
+
+Returns:
+  - string: "name=value" pairs joined by '&', without a leading '?'.
+*/
+func (Query trackerQuery) Encode() string {
+	parts := make([]string, 0, len(Query))
+	for _, param := range Query {
+		parts = append(parts, escapeQueryValue(param.name)+"="+escapeQueryValue(param.value))
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+withQuery appends an encoded query to a tracker URL. A query already present in the URL
+(e.g. a private tracker's passkey) is kept verbatim, without being decoded and re-encoded.
+
+Parameters:
+  - u: Parsed tracker URL; it is not modified.
+  - query: Parameters to append.
+
+Returns:
+  - string: The request URL.
+*/
+func withQuery(u *url.URL, query trackerQuery) string {
+	request := *u
+
+	if request.RawQuery == "" {
+		request.RawQuery = query.Encode()
+	} else {
+		request.RawQuery += "&" + query.Encode()
+	}
+
+	return request.String()
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,103 @@
+package torrent
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestEscapeQueryValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"abcXYZ019-._~", "abcXYZ019-._~"},
+		{"a b+c", "a%20b%2Bc"},
+		{"%41", "%2541"},
+		{"\x00\x12\xab\xff", "%00%12%AB%FF"},
+		{"-BT0001-\x80\x81/?&=", "-BT0001-%80%81%2F%3F%26%3D"},
+	}
+
+	for _, test := range tests {
+		got := escapeQueryValue(test.value)
+		if got != test.want {
+			t.Errorf("escapeQueryValue(%q) = %q, want %q", test.value, got, test.want)
+		}
+
+		decoded, err := url.PathUnescape(got)
+		if err != nil || decoded != test.value {
+			t.Errorf("%q decodes to %q (%v), want %q", got, decoded, err, test.value)
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestTrackerQueryBinaryValues(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = byte(i * 13)
+	}
+
+	peerID := "-BT0001-" + "\x00\xff\x20\x2b\x25\x7e abcd"
+
+	var query trackerQuery
+	query.Add("info_hash", string(infoHash[:]))
+	query.Add("peer_id", peerID)
+	query.Add("port", "6881")
+	query.Set("port", "51413")
+
+	encoded := query.Encode()
+	if strings.Count(encoded, "port=") != 1 || !strings.HasSuffix(encoded, "&port=51413") {
+		t.Errorf("Set did not replace the port in %q", encoded)
+	}
+
+	// Decoding with the standard library, as trackers do, gives back the raw bytes
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", encoded, err)
+	}
+
+	if values.Get("info_hash") != string(infoHash[:]) {
+		t.Errorf("info_hash decodes to %x, want %x", values.Get("info_hash"), infoHash)
+	}
+
+	if values.Get("peer_id") != peerID {
+		t.Errorf("peer_id decodes to %q, want %q", values.Get("peer_id"), peerID)
+	}
+
+	if strings.Contains(encoded, "+") || strings.Contains(encoded, "%2500") {
+		t.Errorf("query %q is encoded more than once or uses '+'", encoded)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestWithQueryKeepsPasskey(t *testing.T) {
+	u, err := url.Parse("https://tracker.example/announce?passkey=a%2Fb%3D%3D&uid=7")
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+
+	var query trackerQuery
+	query.Add("info_hash", "\x01\x02 ")
+
+	got := withQuery(u, query)
+	want := "https://tracker.example/announce?passkey=a%2Fb%3D%3D&uid=7&info_hash=%01%02%20"
+	if got != want {
+		t.Errorf("withQuery = %q, want %q", got, want)
+	}
+
+	if u.RawQuery != "passkey=a%2Fb%3D%3D&uid=7" {
+		t.Errorf("withQuery modified the URL to %q", u.RawQuery)
+	}
+
+	bare, _ := url.Parse("http://tracker.example/announce")
+	if got := withQuery(bare, query); got != "http://tracker.example/announce?info_hash=%01%02%20" {
+		t.Errorf("withQuery without a query = %q", got)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,279 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// resumeVersion is the current version of the resume file format.
+const resumeVersion = 1
+
+// errResumeMismatch is returned by LoadResume when the resume file was recorded for another
+// torrent or piece length; its bitfield cannot be trusted and the data has to be rechecked.
+var errResumeMismatch = errors.New("Resume data does not match the torrent")
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ResumeData is the on-disk state that lets a download continue after a restart.
+
+Fields:
+  - Version: Format version (resumeVersion).
+  - InfoHash: Hex-encoded info hash of the torrent the state belongs to.
+  - PieceLength: Piece length the bitfield was recorded with.
+  - Bitfield: Verified pieces in wire format.
+  - Downloaded: Cumulative verified bytes downloaded across sessions.
+  - Uploaded: Cumulative bytes uploaded across sessions.
+  - Key: Announce key (see AnnounceKey), 0 if none was recorded.
+  - Completed: Trackers were sent the completed event for this download.
+  - MerkleNodes: Known hash tree nodes of Merkle torrents (see merkleTree.snapshot).
+*/
+type ResumeData struct {
+	Version     int    `json:"version"`
+	InfoHash    string `json:"info_hash"`
+	PieceLength int64  `json:"piece_length"`
+	Bitfield    []byte `json:"bitfield"`
+	Downloaded  int64  `json:"downloaded"`
+	Uploaded    int64  `json:"uploaded"`
+	Key         uint32 `json:"key,omitempty"`
+	Completed   bool   `json:"completed,omitempty"`
+	MerkleNodes []byte `json:"merkle_nodes,omitempty"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+resumePath returns where the resume file for a download lives.
+Config.ResumeFile takes precedence; otherwise it is a hidden file next to the content.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - outputDir: Directory the torrent is downloaded to.
+
+Returns:
+  - string: Path of the resume file.
+*/
+func (Torrent *TorrentFile) resumePath(outputDir string) string {
+	if Torrent.Config.ResumeFile != "" {
+		return Torrent.Config.ResumeFile
+	}
+
+	return filepath.Join(outputDir, "."+Torrent.Info.Name+".resume")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+LoadResume restores the verified-piece bitfield, the cumulative transfer counters and the
+announce key from the resume file, so the first announce already reports accurate progress.
+A missing resume file is not an error. A resume file recorded for another info hash or
+piece length is discarded and errResumeMismatch is returned, so the caller can recheck the data.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to restore.
+  - outputDir: Directory the torrent is downloaded to.
+
+Returns:
+  - error: Non-nil if pieces cannot be initialized, the resume file is unreadable or it does not match.
+*/
+func (Torrent *TorrentFile) LoadResume(outputDir string) error {
+	err := Torrent.InitializePieces()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize pieces: %v", err)
+	}
+
+	path := Torrent.resumePath(outputDir)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Reading resume file %s: %v\n", path, err)
+	}
+
+	var resume ResumeData
+	err = json.Unmarshal(data, &resume)
+	if err != nil {
+		return fmt.Errorf("Decoding resume file %s: %v\n", path, err)
+	}
+
+	if !Torrent.applyResume(resume, path) {
+		return fmt.Errorf("%w: %s\n", errResumeMismatch, path)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+applyResume restores the bitfield and counters from decoded resume data.
+Data recorded for another torrent or with another piece length (e.g. after the .torrent file
+was swapped) is ignored, since its bitfield would map to the wrong data. Pieces must already
+be initialized.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to restore.
+  - resume: Decoded resume data.
+  - source: Where the data came from, for log messages.
+
+Returns:
+  - bool: True if the data was applied.
+*/
+func (Torrent *TorrentFile) applyResume(resume ResumeData, source string) bool {
+	if resume.InfoHash != hex.EncodeToString(Torrent.Info.InfoHash[:]) {
+		log.Printf("[ERROR]\tResume data in %s belongs to another torrent, ignoring it\n", source)
+		return false
+	}
+
+	if resume.PieceLength != Torrent.PieceLength {
+		log.Printf("[ERROR]\tResume data in %s has piece length %d instead of %d, ignoring it\n",
+			source, resume.PieceLength, Torrent.PieceLength)
+		return false
+	}
+
+	Torrent.DownloadMutex.Lock()
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.HasPiece(resume.Bitfield, i) {
+			Torrent.Downloaded.Set(i)
+		}
+	}
+	count := Torrent.Downloaded.Count()
+	Torrent.DownloadMutex.Unlock()
+
+	Torrent.counters.downloaded.Store(resume.Downloaded)
+	Torrent.counters.uploaded.Store(resume.Uploaded)
+
+	if resume.Key != 0 {
+		Torrent.announceKey.Store(resume.Key)
+	}
+
+	Torrent.completedSent.Store(resume.Completed)
+
+	if Torrent.merkle != nil {
+		Torrent.merkle.restore(resume.MerkleNodes)
+	}
+
+	log.Printf("[INFO]\tResumed %s: %d/%d pieces, downloaded=%d, uploaded=%d\n",
+		Torrent.Info.Name, count, Torrent.NumPieces, resume.Downloaded, resume.Uploaded)
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SaveResume writes the verified-piece bitfield and the cumulative transfer counters
+to the resume file. The file is written to a temporary name and renamed into place.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to save.
+  - outputDir: Directory the torrent is downloaded to.
+
+Returns:
+  - error: Non-nil if the resume file cannot be written.
+*/
+func (Torrent *TorrentFile) SaveResume(outputDir string) error {
+	resume := Torrent.resumeData()
+
+	data, err := json.Marshal(&resume)
+	if err != nil {
+		return fmt.Errorf("Encoding resume data: %v\n", err)
+	}
+
+	path := Torrent.resumePath(outputDir)
+	tmp := path + ".tmp"
+
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("Writing resume file %s: %v\n", tmp, err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("Renaming resume file %s: %v\n", tmp, err)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+resumeData captures the current bitfield and cumulative counters.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to capture.
+
+Returns:
+  - ResumeData: Snapshot suitable for writing to a resume or session file.
+*/
+func (Torrent *TorrentFile) resumeData() ResumeData {
+	Torrent.DownloadMutex.Lock()
+	bitfield := append([]byte(nil), Torrent.Downloaded.Bytes()...)
+	Torrent.DownloadMutex.Unlock()
+
+	var merkleNodes []byte
+	if Torrent.merkle != nil {
+		merkleNodes = Torrent.merkle.snapshot()
+	}
+
+	return ResumeData{
+		Version:     resumeVersion,
+		InfoHash:    hex.EncodeToString(Torrent.Info.InfoHash[:]),
+		PieceLength: Torrent.PieceLength,
+		Bitfield:    bitfield,
+		Downloaded:  Torrent.counters.downloaded.Load(),
+		Uploaded:    Torrent.counters.uploaded.Load(),
+		Key:         Torrent.AnnounceKey(),
+		Completed:   Torrent.completedSent.Load(),
+		MerkleNodes: merkleNodes,
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceCounters returns the transfer figures reported to trackers.
+downloaded and uploaded are the cumulative counters (restored from the resume file);
+left is the size of everything not yet verified.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to report on.
+
+Returns:
+  - uint64: Bytes downloaded.
+  - uint64: Bytes uploaded.
+  - uint64: Bytes left to download.
+*/
+func (Torrent *TorrentFile) announceCounters() (uint64, uint64, uint64) {
+	total, _ := Torrent.GetTotalSize()
+	left := total
+
+	// Before a magnet link's metadata arrives the size is unknown; a non-zero "left" keeps
+	// trackers from taking us for a seeder and leaving seeders out of the peer list
+	if !Torrent.HasMetadata() {
+		left = metadataPieceSize
+	}
+
+	Torrent.DownloadMutex.Lock()
+	for i := 0; i < Torrent.Downloaded.Len(); i++ {
+		if Torrent.Downloaded.Has(i) {
+			left -= min(left, uint64(Torrent.PieceSize(i)))
+		}
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	return uint64(Torrent.counters.downloaded.Load()), uint64(Torrent.counters.uploaded.Load()), left
+}
+
+// --------------------------------------------------------------------------------------------- //
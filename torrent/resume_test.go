@@ -0,0 +1,81 @@
+package torrent
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestLoadResumeMismatch(t *testing.T) {
+	torrentPath, _ := writeTestTorrent(t, 5*16384+100, 16384)
+	outputDir := t.TempDir()
+
+	load := func() *TorrentFile {
+		Torrent, err := SetTorrentFile(torrentPath)
+		if err != nil {
+			t.Fatalf("SetTorrentFile: %v", err)
+		}
+
+		err = Torrent.InitializePieces()
+		if err != nil {
+			t.Fatalf("InitializePieces: %v", err)
+		}
+
+		return Torrent
+	}
+
+	Torrent := load()
+	Torrent.Downloaded.Set(1)
+	Torrent.Downloaded.Set(4)
+
+	err := Torrent.SaveResume(outputDir)
+	if err != nil {
+		t.Fatalf("SaveResume: %v", err)
+	}
+
+	resume := Torrent.resumeData()
+
+	restored := load()
+
+	err = restored.LoadResume(outputDir)
+	if err != nil || !restored.Downloaded.Has(1) || !restored.Downloaded.Has(4) || restored.Downloaded.Count() != 2 {
+		t.Fatalf("matching resume file: %v, %d pieces restored", err, restored.Downloaded.Count())
+	}
+
+	// The same bitfield recorded with another piece length or for another torrent is never trusted
+	mismatched := map[string]func(*ResumeData){
+		"piece length": func(resume *ResumeData) { resume.PieceLength = 32768 },
+		"info hash":    func(resume *ResumeData) { resume.InfoHash = "00" + resume.InfoHash[2:] },
+	}
+
+	for name, change := range mismatched {
+		data := resume
+		change(&data)
+
+		encoded, err := json.Marshal(&data)
+		if err != nil {
+			t.Fatalf("encoding resume data: %v", err)
+		}
+
+		err = os.WriteFile(Torrent.resumePath(outputDir), encoded, 0644)
+		if err != nil {
+			t.Fatalf("writing resume file: %v", err)
+		}
+
+		restored := load()
+
+		err = restored.LoadResume(outputDir)
+		if !errors.Is(err, errResumeMismatch) {
+			t.Errorf("%s: LoadResume = %v, want errResumeMismatch", name, err)
+		}
+
+		if restored.Downloaded.Count() != 0 {
+			t.Errorf("%s: %d pieces restored from mismatched resume data", name, restored.Downloaded.Count())
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,304 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ScrapeResult holds the swarm statistics a tracker reported for the torrent.
+
+Fields:
+  - Tracker: URL of the tracker.
+  - Seeders: Number of peers with the complete torrent.
+  - Completed: Number of times the torrent has been downloaded.
+  - Leechers: Number of peers still downloading.
+*/
+type ScrapeResult struct {
+	Tracker   string
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SwarmHealth summarizes the scrape results of all trackers of the torrent. Trackers usually
+share most of the swarm, so the largest count reported by any of them is kept rather than
+their sum.
+
+Fields:
+  - Seeders: Largest number of seeders reported by a tracker.
+  - Leechers: Largest number of leechers reported by a tracker.
+  - Completed: Largest number of completed downloads reported by a tracker.
+  - Trackers: Number of trackers that answered the scrape.
+*/
+type SwarmHealth struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+	Trackers  int
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Scrape asks the trackers of the torrent for the size of the swarm without announcing,
+so callers can decide whether it is worth joining. UDP trackers are scraped with BEP-15
+action 2, HTTP trackers through the scrape convention (BEP-48); HTTP trackers whose URL
+does not allow it are skipped. Trackers that fail are logged and skipped.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs.
+
+Returns:
+  - []ScrapeResult: One result per tracker that answered.
+  - error: Non-nil if the torrent has no tracker to scrape or none of them answered.
+*/
+func (Torrent *TorrentFile) Scrape() ([]ScrapeResult, error) {
+	var results []ScrapeResult
+	trackers := 0
+
+	for _, trackerURL := range Torrent.trackerURLs() {
+		u, err := url.Parse(trackerURL)
+		if err != nil {
+			continue
+		}
+
+		var result ScrapeResult
+
+		switch u.Scheme {
+		case "udp":
+			trackers++
+			result, err = Torrent.udpScrape(trackerURL)
+
+		case "http", "https":
+			scrapeURL, ok := ScrapeURL(trackerURL)
+			if !ok {
+				continue
+			}
+
+			trackers++
+			result, err = Torrent.httpScrape(trackerURL, scrapeURL)
+
+		default:
+			continue
+		}
+
+		if err != nil {
+			log.Printf("[ERROR]\tScrape %s: %v", trackerURL, err)
+			continue
+		}
+
+		log.Printf("[INFO]\tScrape %s: %d seeders, %d leechers, %d completed\n",
+			trackerURL, result.Seeders, result.Leechers, result.Completed)
+
+		results = append(results, result)
+	}
+
+	if trackers == 0 {
+		return nil, fmt.Errorf("No tracker to scrape\n")
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("No tracker answered the scrape\n")
+	}
+
+	return results, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SwarmHealth scrapes the trackers of the torrent and summarizes their answers.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs.
+
+Returns:
+  - SwarmHealth: Swarm statistics over every tracker that answered.
+  - error: Non-nil if no tracker answered the scrape.
+*/
+func (Torrent *TorrentFile) SwarmHealth() (SwarmHealth, error) {
+	results, err := Torrent.Scrape()
+	if err != nil {
+		return SwarmHealth{}, err
+	}
+
+	health := SwarmHealth{Trackers: len(results)}
+
+	for _, result := range results {
+		health.Seeders = max(health.Seeders, result.Seeders)
+		health.Leechers = max(health.Leechers, result.Leechers)
+		health.Completed = max(health.Completed, result.Completed)
+	}
+
+	return health, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ScrapeURL converts an HTTP announce URL to its scrape URL (BEP-48): the last path component
+must start with "announce", which is replaced with "scrape".
+
+Parameters:
+  - announceURL: Announce URL of an HTTP tracker.
+
+Returns:
+  - string: The scrape URL.
+  - bool: False if the tracker does not support the scrape convention.
+*/
+func ScrapeURL(announceURL string) (string, bool) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", false
+	}
+
+	slash := strings.LastIndex(u.Path, "/")
+	if slash < 0 || !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", false
+	}
+
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+
+	return u.String(), true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+httpScrape issues a scrape request to an HTTP tracker and reads the entry of the torrent
+from the "files" dictionary of the response, which is keyed by info hash.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the InfoHash.
+  - announceURL: Announce URL of the tracker, reported in the result.
+  - scrapeURL: Scrape URL of the tracker.
+
+Returns:
+  - ScrapeResult: Statistics reported by the tracker.
+  - error: Non-nil if the request fails, the response is malformed or the torrent is missing.
+*/
+func (Torrent *TorrentFile) httpScrape(announceURL, scrapeURL string) (ScrapeResult, error) {
+	result := ScrapeResult{Tracker: announceURL}
+
+	u, err := url.Parse(scrapeURL)
+	if err != nil {
+		return result, fmt.Errorf("URL parsing error: %v\n", err)
+	}
+
+	params := trackerQuery{}
+	params.Add("info_hash", string(Torrent.Info.InfoHash[:]))
+
+	client := Torrent.trackerClient()
+
+	req, err := http.NewRequest("GET", withQuery(u, params), nil)
+	if err != nil {
+		return result, fmt.Errorf("Creating HTTP request error: %v\n", err)
+	}
+
+	req.Header.Set("User-Agent", "BitTorrent/1.0")
+
+	response, err := client.Do(req)
+	if err != nil {
+		return result, fmt.Errorf("Sending scrape error: %v\n", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Tracker returned %s\n", response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return result, fmt.Errorf("Reading scrape response error: %v\n", err)
+	}
+
+	data, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return result, fmt.Errorf("Decoding scrape response error: %v\n", err)
+	}
+
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return result, fmt.Errorf("Scrape response is not a dictionary\n")
+	}
+
+	if failure, ok := dict["failure reason"].(string); ok {
+		return result, fmt.Errorf("Tracker failure: %s\n", failure)
+	}
+
+	files, _ := dict["files"].(map[string]interface{})
+
+	file, ok := files[string(Torrent.Info.InfoHash[:])].(map[string]interface{})
+	if !ok {
+		return result, fmt.Errorf("Torrent missing from scrape response\n")
+	}
+
+	count := func(key string) int {
+		value, _ := file[key].(int64)
+		return int(value)
+	}
+
+	result.Seeders = count("complete")
+	result.Completed = count("downloaded")
+	result.Leechers = count("incomplete")
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+udpScrape performs a scrape exchange (BEP-15 action 2) with a UDP tracker (see udpRequest).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the InfoHash.
+  - announceURL: URL of the UDP tracker to contact.
+
+Returns:
+  - ScrapeResult: Statistics reported by the tracker.
+  - error: Non-nil if the exchange fails or the tracker returns an error.
+*/
+func (Torrent *TorrentFile) udpScrape(announceURL string) (ScrapeResult, error) {
+	result := ScrapeResult{Tracker: announceURL}
+
+	resp, _, err := Torrent.udpRequest(context.Background(), announceURL, udpActionScrape, func(connectionID uint64, transactionID uint32) []byte {
+		scrapeReq := make([]byte, 36)
+		binary.BigEndian.PutUint64(scrapeReq[0:8], connectionID)
+		binary.BigEndian.PutUint32(scrapeReq[8:12], udpActionScrape)
+		binary.BigEndian.PutUint32(scrapeReq[12:16], transactionID)
+		copy(scrapeReq[16:36], Torrent.Info.InfoHash[:])
+
+		return scrapeReq
+	})
+	if err != nil {
+		return result, err
+	}
+
+	if len(resp) < 20 {
+		return result, fmt.Errorf("Invalid scrape response length: %d\n", len(resp))
+	}
+
+	result.Seeders = int(binary.BigEndian.Uint32(resp[8:12]))
+	result.Completed = int(binary.BigEndian.Uint32(resp[12:16]))
+	result.Leechers = int(binary.BigEndian.Uint32(resp[16:20]))
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
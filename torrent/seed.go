@@ -0,0 +1,841 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"BitTorrent/torrent/dht"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// maxRequestLength is the largest block length we serve for a single Request (128 kB).
+const maxRequestLength = 1 << 17
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+openForSeeding opens every file of the torrent read-only if it is not open already.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose Files have been built.
+
+Returns:
+  - error: Non-nil if a file cannot be opened.
+*/
+func (Torrent *TorrentFile) openForSeeding() error {
+	if Torrent.Config.BlobStore != "" {
+		for i := range Torrent.Files {
+			Torrent.Files[i].Handle = blobHandle{torrent: Torrent, offset: Torrent.Files[i].Offset}
+		}
+
+		return nil
+	}
+
+	for i := range Torrent.Files {
+		file := &Torrent.Files[i]
+		if file.Handle != nil {
+			continue
+		}
+
+		if file.Pad {
+			file.Handle = padHandle{}
+			continue
+		}
+
+		if file.Symlink {
+			continue
+		}
+
+		f, err := os.Open(file.Path)
+		if err != nil {
+			return fmt.Errorf("Failed to open %s for seeding: %v\n", file.Path, err)
+		}
+
+		file.Handle = f
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+PrepareSeed sets up a torrent whose content already exists in dir for seeding without
+downloading it first: files are opened read-only and every piece is verified from disk.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to seed.
+  - dir: Directory holding the content (as passed to StartDownload).
+
+Returns:
+  - error: Non-nil if the pieces or files cannot be set up, or a piece fails verification.
+*/
+func (Torrent *TorrentFile) PrepareSeed(dir string) error {
+	err := Torrent.InitializePieces()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize pieces: %v", err)
+	}
+
+	err = Torrent.BuildFileInfo(dir)
+	if err != nil {
+		return err
+	}
+
+	Torrent.OutputDir = dir
+
+	err = Torrent.openForSeeding()
+	if err != nil {
+		return err
+	}
+
+	failed := Torrent.VerifyDownload()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d pieces failed verification in %s\n", len(failed), Torrent.NumPieces, dir)
+	}
+
+	return nil
+}
+
+/*
+Seed serves pieces to connected peers until ctx is cancelled, the torrent is closed or a seed
+limit (Config.SeedRatioLimit, Config.SeedTimeLimit) is reached, then sends a stopped announce.
+Peers connected by RefreshPeer are picked up as they appear. At most Config.UploadSlots
+interested peers are unchoked at a time.
+
+Parameters:
+  - Torrent: Pointer to a TorrentFile whose download has completed.
+  - ctx: Context controlling how long to seed.
+
+Returns:
+  - error: Non-nil if the files cannot be opened.
+*/
+func (Torrent *TorrentFile) Seed(ctx context.Context) error {
+	err := Torrent.openForSeeding()
+	if err != nil {
+		return err
+	}
+
+	// Close ends the seeding like a cancelled ctx, and with it the workers below
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	closed := Torrent.closedSignal()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	defer func() {
+		for i := range Torrent.Files {
+			if Torrent.Files[i].Handle != nil {
+				Torrent.Files[i].Handle.Close()
+				Torrent.Files[i].Handle = nil
+			}
+		}
+	}()
+
+	slots := Torrent.uploadSlots()
+	served := make(map[*Peer]bool)
+
+	Torrent.counters.seedStart.Store(time.Now().UnixNano())
+	log.Printf("[INFO]\tSeeding %s\n", Torrent.Info.Name)
+
+	if Torrent.dhtEnabled() {
+		go Torrent.announceToDHT(ctx)
+	}
+
+	if Torrent.lsdEnabled() {
+		go Torrent.runLSD(ctx)
+	}
+
+	if Torrent.pexEnabled() {
+		go Torrent.runPex(ctx)
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		Torrent.PeersMutex.Lock()
+		for _, peer := range Torrent.Peers {
+			if !served[peer] {
+				served[peer] = true
+				go Torrent.servePeer(peer, slots)
+			}
+		}
+		Torrent.PeersMutex.Unlock()
+
+		limitReached := Torrent.seedLimitReached()
+		if limitReached && Torrent.Config.OnSeedingComplete != nil {
+			Torrent.Config.OnSeedingComplete(Torrent.Stats())
+		}
+
+		stopped := limitReached
+		if !stopped {
+			select {
+			case <-ctx.Done():
+				stopped = true
+			case <-ticker.C:
+			}
+		}
+
+		if stopped {
+			log.Printf("[INFO]\tSeeding stopped after %s (limit reached: %t)\n", Torrent.Stats().SeedTime, limitReached)
+
+			Torrent.PeersMutex.Lock()
+			peers := make([]*Peer, len(Torrent.Peers))
+			copy(peers, Torrent.Peers)
+			Torrent.PeersMutex.Unlock()
+
+			for _, peer := range peers {
+				Torrent.removePeer(peer)
+			}
+
+			Torrent.AnnounceStopped()
+
+			err := Torrent.SaveResume(Torrent.OutputDir)
+			if err != nil {
+				log.Printf("[ERROR]\t%v", err)
+			}
+
+			return nil
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+seedLimitReached reports whether seeding should stop because of the configured limits.
+When nothing was downloaded in this session (seed-only mode) the ratio is unbounded,
+so only the time limit applies.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being seeded.
+
+Returns:
+  - bool: True if the ratio or time limit has been reached.
+*/
+func (Torrent *TorrentFile) seedLimitReached() bool {
+	stats := Torrent.Stats()
+
+	if Torrent.Config.SeedTimeLimit > 0 && stats.SeedTime >= Torrent.Config.SeedTimeLimit {
+		return true
+	}
+
+	if Torrent.Config.SeedRatioLimit > 0 && stats.Downloaded > 0 && stats.Ratio >= Torrent.Config.SeedRatioLimit {
+		return true
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+servePeer answers a single peer's requests while seeding.
+The peer was sent our bitfield right after the handshake (see sendBitfield) and hears of
+later pieces through Have, so it is unchoked and served through handleUpload straight away.
+Idle connections are kept open with keep-alives.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being seeded.
+  - peer: Connected peer to serve.
+  - slots: Semaphore bounding the number of unchoked peers.
+*/
+func (Torrent *TorrentFile) servePeer(peer *Peer, slots chan struct{}) {
+	defer func() {
+		if !peer.State.AmChoking {
+			<-slots
+		}
+
+		Torrent.removePeer(peer)
+		logPeerf(peer, -1, "[INFO]\tservePeer completed\n")
+	}()
+
+	for {
+		wait, err := Torrent.keepAlive(peer)
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tseeding connection closed: %v\n", err)
+			return
+		}
+
+		msg, err := Torrent.receiveMessage(peer, wait)
+		if errors.Is(err, errReceiveTimeout) {
+			continue
+		}
+
+		if err != nil {
+			logPeerf(peer, -1, "[FAIL]\tseeding connection closed: %v\n", err)
+			return
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		handled, err := Torrent.handleUpload(peer, msg, slots)
+		if err != nil {
+			return
+		}
+
+		if handled {
+			continue
+		}
+
+		switch msg.ID {
+		case Bitfield:
+			err := Torrent.checkBitfield(msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[FAIL]\t%v", err)
+				return
+			}
+
+			Torrent.setBitfield(peer, msg.Payload)
+
+		case HaveAll, HaveNone:
+			Torrent.setBitfield(peer, Torrent.fullBitfield(msg.ID == HaveAll))
+
+		case Have:
+			if len(msg.Payload) != 4 {
+				continue
+			}
+
+			Torrent.setPeerPiece(peer, int(binary.BigEndian.Uint32(msg.Payload)), true)
+
+		case Port:
+			Torrent.handlePort(peer, msg.Payload)
+
+		case Extended:
+			err := Torrent.handleExtended(peer, msg.Payload)
+			if err != nil {
+				logPeerf(peer, -1, "[ERROR]\t%v", err)
+			}
+		}
+
+		if Torrent.isSeeder(peer) {
+			logPeerf(peer, -1, "[INFO]\thas all pieces, disconnecting while seeding\n")
+			return
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+uploadSlots returns the semaphore bounding the number of unchoked peers to Config.UploadSlots.
+It is shared by downloading and seeding, so peers served while downloading count against the
+same limit.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - chan struct{}: Semaphore holding one element per unchoked peer.
+*/
+func (Torrent *TorrentFile) uploadSlots() chan struct{} {
+	Torrent.uploadOnce.Do(func() {
+		slotCount := Torrent.Config.UploadSlots
+		if slotCount <= 0 {
+			slotCount = 1
+		}
+
+		Torrent.upSlots = make(chan struct{}, slotCount)
+	})
+
+	return Torrent.upSlots
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+handleUpload processes the messages of the upload side of a connection: Interested and
+NotInterested choke or unchoke the peer depending on the free upload slots, and Request
+messages are answered by serveRequest.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer the message came from.
+  - msg: Received message.
+  - slots: Semaphore bounding the number of unchoked peers (see uploadSlots).
+
+Returns:
+  - bool: True if the message belonged to the upload side and was handled.
+  - error: Non-nil if sending to the peer fails and the connection should be dropped.
+*/
+func (Torrent *TorrentFile) handleUpload(peer *Peer, msg *Message, slots chan struct{}) (bool, error) {
+	switch msg.ID {
+	case Interested:
+		peer.State.receive(msg.ID)
+		if !peer.State.AmChoking {
+			return true, nil
+		}
+
+		select {
+		case slots <- struct{}{}:
+			err := Torrent.setChoking(peer, false)
+			if err != nil {
+				<-slots
+				return true, err
+			}
+
+		default:
+			logPeerf(peer, -1, "[INFO]\tno free upload slot, keeping choked\n")
+		}
+
+	case NotInterested:
+		peer.State.receive(msg.ID)
+		if peer.State.AmChoking {
+			return true, nil
+		}
+
+		err := Torrent.setChoking(peer, true)
+		if err != nil {
+			return true, err
+		}
+
+		<-slots
+
+	case Request:
+		return true, Torrent.serveRequest(peer, msg.Payload)
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+serveRequest answers a Request message with a Piece message read from disk and counts the
+uploaded bytes. Requests from choked peers, for pieces we do not have, or longer than
+maxRequestLength are ignored.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer that sent the request.
+  - payload: Request payload (piece index, begin and length).
+
+Returns:
+  - error: Non-nil if sending the block fails.
+*/
+func (Torrent *TorrentFile) serveRequest(peer *Peer, payload []byte) error {
+	if peer.State.AmChoking || len(payload) != 12 {
+		return nil
+	}
+
+	index := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := int64(binary.BigEndian.Uint32(payload[4:8]))
+	length := int64(binary.BigEndian.Uint32(payload[8:12]))
+
+	// The block is read under the lock, so DeselectFile and evictPieces cannot change the file meanwhile
+	Torrent.DownloadMutex.Lock()
+	have := Torrent.Downloaded.Has(index)
+
+	var block []byte
+	var err error
+
+	if have && length <= maxRequestLength {
+		block, err = Torrent.ReadBlock(index, begin, length)
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	if !have || length > maxRequestLength {
+		logPeerf(peer, index, "[ERROR]\tinvalid request for piece %d, begin %d, length %d\n",
+			index, begin, length)
+		return nil
+	}
+
+	if err != nil {
+		logPeerf(peer, -1, "[ERROR]\t%v", err)
+		return nil
+	}
+
+	if Torrent.merkle != nil && peer.supportsExtension(trHashpieceName) {
+		err = Torrent.sendHashpiece(peer, index, begin, block)
+		if err != nil {
+			return err
+		}
+
+		Torrent.counters.uploaded.Add(length)
+
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(index))
+	binary.Write(buf, binary.BigEndian, uint32(begin))
+	buf.Write(block)
+
+	err = Torrent.SendMessage(peer, Message{ID: Piece, Payload: buf.Bytes()})
+	if err != nil {
+		return err
+	}
+
+	Torrent.counters.uploaded.Add(length)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isSeeder reports whether a peer's bitfield covers every piece of the torrent.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile for the piece count.
+  - peer: Peer to check.
+
+Returns:
+  - bool: True if the peer has all pieces.
+*/
+func (Torrent *TorrentFile) isSeeder(peer *Peer) bool {
+	if peer.Bitfield == nil || Torrent.NumPieces == 0 {
+		return false
+	}
+
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if !Torrent.HasPiece(peer.Bitfield, i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dhtEnabled reports whether the torrent may be announced to the DHT.
+Private torrents are not (see baseTiers).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - bool: True if Config.DHT is set and the torrent is not private.
+*/
+func (Torrent *TorrentFile) dhtEnabled() bool {
+	return Torrent.Config.DHT && Torrent.Info.Private != 1
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceToDHT periodically announces the torrent to the DHT while seeding, so downloaders
+without a working tracker can still find us. Each round looks up the nodes closest to the
+info hash with get_peers and announces our port to them with the tokens they returned, on
+every stack opened by dhtClients.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being seeded.
+  - ctx: Context ending the announces when seeding stops.
+*/
+func (Torrent *TorrentFile) announceToDHT(ctx context.Context) {
+	const dhtAnnounceInterval = 15 * time.Minute
+
+	clients, err := Torrent.dhtClients()
+	if err != nil {
+		log.Printf("[ERROR]\t%v", err)
+		return
+	}
+
+	bootstrap := Torrent.dhtBootstrap()
+
+	eachDHTClient(clients, func(client *dht.Client) {
+		Torrent.secureDHTID(client)
+
+		_, err := client.Bootstrap(bootstrap)
+		if err != nil {
+			log.Printf("[FAIL]\tDHT bootstrap: %v", err)
+		}
+
+		Torrent.secureDHTID(client)
+	})
+
+	Torrent.saveDHTNodes(clients...)
+
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		eachDHTClient(clients, func(client *dht.Client) {
+			_, announced, err := client.Announce(Torrent.Info.InfoHash, Torrent.Config.announcePort(), true, bootstrap)
+			if err != nil {
+				log.Printf("[FAIL]\tDHT announce: %v", err)
+			} else {
+				log.Printf("[INFO]\tAnnounced %s to %d DHT nodes\n", Torrent.Info.Name, announced)
+			}
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dhtPeers looks up peers of the torrent in the DHT, for torrents without a working tracker.
+The lookup runs on every stack opened by dhtClients and the peers found are merged.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to look up.
+
+Returns:
+  - []Peer: Peers found.
+  - error: Non-nil if no DHT client can be started or no lookup could start.
+*/
+func (Torrent *TorrentFile) dhtPeers() ([]Peer, error) {
+	clients, err := Torrent.dhtClients()
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrap := Torrent.dhtBootstrap()
+
+	var resultMutex sync.Mutex
+	var addrs []string
+	var lookupErr error
+	succeeded := 0
+
+	eachDHTClient(clients, func(client *dht.Client) {
+		Torrent.secureDHTID(client)
+
+		found, err := client.FindPeers(Torrent.Info.InfoHash, bootstrap)
+
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+
+		if err != nil {
+			lookupErr = err
+			return
+		}
+
+		succeeded++
+		addrs = append(addrs, found...)
+	})
+
+	if succeeded == 0 {
+		return nil, lookupErr
+	}
+
+	Torrent.saveDHTNodes(clients...)
+
+	var peers []Peer
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+
+		peers = append(peers, Peer{IP: host, Port: uint16(port)})
+	}
+
+	return peers, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// dhtNodes are the DHT nodes of the process, opened by dhtClients on first use and shared by
+// every lookup and announce so their routing tables and stored peers outlive each of them.
+var dhtNodes struct {
+	mutex sync.Mutex
+	ipv4  *dht.Client
+	ipv6  *dht.Client
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dhtClients returns the DHT nodes lookups and announces run on: one over IPv4 and, if
+Config.DHTIPv6 is set, one over IPv6 (BEP-32), so IPv6-only swarms are reachable. The nodes
+are opened once per process and stay open until CloseDHT. An IPv6 node that cannot be
+opened, e.g. because the host has IPv6 disabled, is logged and left out.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []*dht.Client: Open nodes, shared with every other torrent; do not close them.
+  - error: Non-nil if the IPv4 node cannot be opened.
+*/
+func (Torrent *TorrentFile) dhtClients() ([]*dht.Client, error) {
+	dhtNodes.mutex.Lock()
+	defer dhtNodes.mutex.Unlock()
+
+	if dhtNodes.ipv4 == nil {
+		client, err := dht.NewClient()
+		if err != nil {
+			return nil, err
+		}
+
+		dhtNodes.ipv4 = client
+	}
+
+	clients := []*dht.Client{dhtNodes.ipv4}
+
+	if Torrent.Config.DHTIPv6 && dhtNodes.ipv6 == nil {
+		client6, err := dht.NewClient6()
+		if err != nil {
+			log.Printf("[FAIL]\tIPv6 DHT: %v", err)
+		} else {
+			dhtNodes.ipv6 = client6
+		}
+	}
+
+	if Torrent.Config.DHTIPv6 && dhtNodes.ipv6 != nil {
+		clients = append(clients, dhtNodes.ipv6)
+	}
+
+	return clients, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+eachDHTClient runs a function on every DHT client concurrently and waits for all of them.
+
+Parameters:
+  - clients: Clients from dhtClients.
+  - fn: Function to run per client.
+*/
+func eachDHTClient(clients []*dht.Client, fn func(client *dht.Client)) {
+	var wg sync.WaitGroup
+
+	for _, client := range clients {
+		wg.Add(1)
+
+		go func(client *dht.Client) {
+			defer wg.Done()
+			fn(client)
+		}(client)
+	}
+
+	wg.Wait()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+CloseDHT closes the DHT nodes shared by the torrents of the process. The next lookup or
+announce opens new ones.
+
+Returns:
+  - error: Non-nil if closing a node fails.
+*/
+func CloseDHT() error {
+	dhtNodes.mutex.Lock()
+	defer dhtNodes.mutex.Unlock()
+
+	var err error
+	for _, client := range []*dht.Client{dhtNodes.ipv4, dhtNodes.ipv6} {
+		if client != nil {
+			err = errors.Join(err, client.Close())
+		}
+	}
+
+	dhtNodes.ipv4, dhtNodes.ipv6 = nil, nil
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+secureDHTID ties the DHT client's node ID to our external IP (BEP-42), taken from the
+trackers or else from what the DHT nodes that answered us reported. The tracker address is
+only used if it belongs to the client's address family. Nothing changes while neither knows
+the address.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - client: DHT client to update.
+*/
+func (Torrent *TorrentFile) secureDHTID(client *dht.Client) {
+	ip := net.ParseIP(Torrent.ExternalIP())
+	if ip == nil || (ip.To4() == nil) != client.IPv6() {
+		ip = client.ExternalIP()
+	}
+
+	if ip == nil {
+		return
+	}
+
+	err := client.SetExternalIP(ip)
+	if err != nil {
+		log.Printf("[ERROR]\t%v", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dhtBootstrap returns the contacts DHT lookups start from: the "nodes" listed in the torrent
+first, then the nodes cached by an earlier run (see saveDHTNodes), then Config.DHTBootstrap,
+or dht.DefaultBootstrap if the config lists none.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Contacts ("host:port").
+*/
+func (Torrent *TorrentFile) dhtBootstrap() []string {
+	var contacts []string
+
+	for _, node := range Torrent.Nodes {
+		if len(node) != 2 {
+			continue
+		}
+
+		host, ok := node[0].(string)
+
+		var port int64
+		switch value := node[1].(type) {
+		case int64:
+			port = value
+		case int:
+			port = int64(value)
+		}
+
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+
+		contacts = append(contacts, net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+
+	contacts = append(contacts, Torrent.cachedDHTNodes()...)
+
+	if len(Torrent.Config.DHTBootstrap) > 0 {
+		return append(contacts, Torrent.Config.DHTBootstrap...)
+	}
+
+	return append(contacts, dht.DefaultBootstrap...)
+}
+
+// --------------------------------------------------------------------------------------------- //
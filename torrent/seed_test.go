@@ -0,0 +1,39 @@
+package torrent
+
+import "testing"
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestDHTClientsShared(t *testing.T) {
+	t.Cleanup(func() { CloseDHT() })
+
+	first, err := newTestTorrent().dhtClients()
+	if err != nil {
+		t.Fatalf("dhtClients: %v", err)
+	}
+
+	second, err := newTestTorrent().dhtClients()
+	if err != nil {
+		t.Fatalf("dhtClients: %v", err)
+	}
+
+	if len(first) != len(second) || first[0] != second[0] {
+		t.Fatalf("two torrents got different DHT nodes")
+	}
+
+	err = CloseDHT()
+	if err != nil {
+		t.Fatalf("CloseDHT: %v", err)
+	}
+
+	reopened, err := newTestTorrent().dhtClients()
+	if err != nil {
+		t.Fatalf("dhtClients after CloseDHT: %v", err)
+	}
+
+	if reopened[0] == first[0] {
+		t.Errorf("CloseDHT kept the closed node")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
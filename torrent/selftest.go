@@ -0,0 +1,186 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SelfTest runs a full round trip on loopback without any external service: it writes a random
+file, creates a torrent for it, seeds it from one TorrentFile, downloads it with another and
+checks that the downloaded bytes match. The result and the time of every step are written to w.
+
+Parameters:
+  - w: Destination of the report.
+
+Returns:
+  - error: Non-nil if any step fails or the downloaded data differs from the original.
+*/
+func SelfTest(w io.Writer) error {
+	const (
+		fileSize    = 1<<20 + 12345 // not a multiple of the piece length, to exercise the last piece
+		pieceLength = 32 * 1024
+	)
+
+	started := time.Now()
+
+	err := selfTest(w, fileSize, pieceLength)
+	if err != nil {
+		fmt.Fprintf(w, "Self-test FAILED after %s: %v\n", time.Since(started).Round(time.Millisecond), err)
+		return err
+	}
+
+	fmt.Fprintf(w, "Self-test PASSED in %s\n", time.Since(started).Round(time.Millisecond))
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+selfTest performs the steps of SelfTest.
+
+Parameters:
+  - w: Destination of the per-step timings.
+  - fileSize: Size of the random file in bytes.
+  - pieceLength: Piece length of the created torrent.
+
+Returns:
+  - error: Non-nil if a step fails.
+*/
+func selfTest(w io.Writer, fileSize int, pieceLength int64) error {
+	dir, err := os.MkdirTemp("", "bittorrent-selftest-")
+	if err != nil {
+		return fmt.Errorf("Creating temporary directory: %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := time.Now()
+	report := func(name string) {
+		fmt.Fprintf(w, "  %-10s %s\n", name, time.Since(step).Round(time.Millisecond))
+		step = time.Now()
+	}
+
+	seedDir := filepath.Join(dir, "seed")
+	downloadDir := filepath.Join(dir, "download")
+
+	for _, d := range []string{seedDir, downloadDir} {
+		err = os.Mkdir(d, 0755)
+		if err != nil {
+			return fmt.Errorf("Creating %s: %v\n", d, err)
+		}
+	}
+
+	original := make([]byte, fileSize)
+	_, err = crand.Read(original)
+	if err != nil {
+		return fmt.Errorf("Generating random data: %v\n", err)
+	}
+
+	sourcePath := filepath.Join(seedDir, "selftest.bin")
+	err = os.WriteFile(sourcePath, original, 0644)
+	if err != nil {
+		return fmt.Errorf("Writing %s: %v\n", sourcePath, err)
+	}
+
+	report("generate")
+
+	meta, err := CreateTorrent(sourcePath, "", pieceLength)
+	if err != nil {
+		return err
+	}
+
+	torrentPath := filepath.Join(dir, "selftest.torrent")
+	err = os.WriteFile(torrentPath, meta, 0644)
+	if err != nil {
+		return fmt.Errorf("Writing %s: %v\n", torrentPath, err)
+	}
+
+	report("create")
+
+	seeder, err := SetTorrentFile(torrentPath)
+	if err != nil {
+		return err
+	}
+
+	seeder.Config.DefaultTrackers = nil
+	seeder.Config.DHT = false
+
+	err = seeder.PrepareSeed(seedDir)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("Listening on loopback: %v\n", err)
+	}
+	defer listener.Close()
+
+	go seeder.AcceptPeers(listener)
+
+	leecher, err := SetTorrentFile(torrentPath)
+	if err != nil {
+		return err
+	}
+
+	leecher.Config.DefaultTrackers = nil
+	leecher.Config.DHT = false
+	leecher.Config.FilterSelfPeers = false
+	leecher.Config.ProgressMode = ProgressNone
+
+	port := uint16(listener.Addr().(*net.TCPAddr).Port)
+	leecher.ConnectToPeers([]Peer{{IP: "127.0.0.1", Port: port}})
+
+	if len(leecher.Peers) == 0 {
+		return fmt.Errorf("Could not connect to the local seeder on port %d\n", port)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	seedDone := make(chan error, 1)
+
+	go func() {
+		seedDone <- seeder.Seed(ctx)
+	}()
+
+	report("seed")
+
+	err = leecher.StartDownload(downloadDir)
+	cancel()
+	listener.Close()
+
+	seedErr := <-seedDone
+	if err != nil {
+		return fmt.Errorf("Download failed: %v", err)
+	}
+
+	if seedErr != nil {
+		return fmt.Errorf("Seeding failed: %v", seedErr)
+	}
+
+	report("download")
+
+	downloaded, err := os.ReadFile(filepath.Join(downloadDir, "selftest.bin"))
+	if err != nil {
+		return fmt.Errorf("Reading downloaded file: %v\n", err)
+	}
+
+	if !bytes.Equal(downloaded, original) {
+		return fmt.Errorf("Downloaded data differs from the original (%d vs %d bytes)\n", len(downloaded), len(original))
+	}
+
+	report("verify")
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
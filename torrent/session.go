@@ -0,0 +1,350 @@
+package torrent
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// sessionVersion is the current version of the session state file format.
+const sessionVersion = 1
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SessionTorrent is the saved state of one torrent of a session.
+
+Fields:
+  - TorrentPath: Path of the .torrent file to reload the metadata from.
+  - OutputDir: Directory the torrent is downloaded to.
+  - Resume: Verified pieces and cumulative counters.
+  - Peers: Addresses ("host:port") of peers we had working connections with.
+  - Trackers: Per-tracker state, including dead trackers and pending backoffs.
+*/
+type SessionTorrent struct {
+	TorrentPath string        `json:"torrent_path"`
+	OutputDir   string        `json:"output_dir"`
+	Resume      ResumeData    `json:"resume"`
+	Peers       []string      `json:"peers"`
+	Trackers    []TrackerStat `json:"trackers"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SessionState is the on-disk state of a whole session.
+
+Fields:
+  - Version: Format version (sessionVersion).
+  - Torrents: Saved state of every torrent in the session.
+*/
+type SessionState struct {
+	Version  int              `json:"version"`
+	Torrents []SessionTorrent `json:"torrents"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Session groups several torrents whose state is saved to and restored from a single file.
+It is meant for programs embedding the package that manage several torrents at once; the
+command line client handles one torrent per run and keeps its state in the resume file.
+
+Fields:
+  - StatePath: Path of the session state file.
+  - Torrents: Torrents belonging to the session.
+  - trackerTLS: TLS settings given to every torrent's Config.TrackerTLS (see SetTrackerTLS).
+  - mutex: Guards Torrents and trackerTLS.
+*/
+type Session struct {
+	StatePath  string
+	Torrents   []*TorrentFile
+	trackerTLS *tls.Config
+	mutex      sync.Mutex
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+OpenSession creates a session backed by the given state file and restores every torrent
+saved in it. A missing state file yields an empty session. Torrents whose metadata can no
+longer be loaded are skipped with a log message.
+
+Parameters:
+  - statePath: Path of the session state file.
+
+Returns:
+  - *Session: The restored session.
+  - error: Non-nil if the state file exists but cannot be read or has an unknown version.
+*/
+func OpenSession(statePath string) (*Session, error) {
+	session := &Session{StatePath: statePath}
+
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return session, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Reading session file %s: %v\n", statePath, err)
+	}
+
+	var state SessionState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, fmt.Errorf("Decoding session file %s: %v\n", statePath, err)
+	}
+
+	if state.Version < 1 || state.Version > sessionVersion {
+		return nil, fmt.Errorf("Unsupported session file version %d in %s\n", state.Version, statePath)
+	}
+
+	for _, saved := range state.Torrents {
+		Torrent, err := SetTorrentFile(saved.TorrentPath)
+		if err != nil {
+			log.Printf("[ERROR]\tSkipping %s from session: %v", saved.TorrentPath, err)
+			continue
+		}
+
+		err = Torrent.InitializePieces()
+		if err != nil {
+			log.Printf("[ERROR]\tSkipping %s from session: %v", saved.TorrentPath, err)
+			continue
+		}
+
+		Torrent.OutputDir = saved.OutputDir
+		Torrent.applyResume(saved.Resume, statePath)
+		Torrent.restoreTrackerStats(saved.Trackers)
+
+		for _, addr := range saved.Peers {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				continue
+			}
+
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				continue
+			}
+
+			Torrent.KnownPeers = append(Torrent.KnownPeers, Peer{IP: host, Port: uint16(port)})
+		}
+
+		session.Torrents = append(session.Torrents, Torrent)
+	}
+
+	log.Printf("[INFO]\tRestored session from %s: %d torrents\n", statePath, len(session.Torrents))
+
+	return session, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Add registers a torrent with the session so it is included in the saved state.
+If the session has TLS settings for HTTPS trackers, the torrent is given them.
+
+Parameters:
+  - Session: Session to add to.
+  - Torrent: Torrent to add; its SourcePath must be set (as done by SetTorrentFile).
+*/
+func (Session *Session) Add(Torrent *TorrentFile) {
+	Session.mutex.Lock()
+	defer Session.mutex.Unlock()
+
+	if Session.trackerTLS != nil {
+		Torrent.Config.TrackerTLS = Session.trackerTLS
+	}
+
+	Session.Torrents = append(Session.Torrents, Torrent)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SetTrackerTLS sets the TLS settings of HTTPS trackers for the whole session: every torrent in
+it and every torrent added later uses them as Config.TrackerTLS.
+
+Parameters:
+  - Session: Session to configure.
+  - config: TLS settings, e.g. from LoadTrackerTLS (nil restores the system defaults).
+*/
+func (Session *Session) SetTrackerTLS(config *tls.Config) {
+	Session.mutex.Lock()
+	defer Session.mutex.Unlock()
+
+	Session.trackerTLS = config
+	for _, Torrent := range Session.Torrents {
+		Torrent.Config.TrackerTLS = config
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Save writes the state of every torrent to the session file.
+The file is written to a temporary name and renamed into place.
+
+Parameters:
+  - Session: Session to save.
+
+Returns:
+  - error: Non-nil if the state cannot be encoded or written.
+*/
+func (Session *Session) Save() error {
+	Session.mutex.Lock()
+	torrents := append([]*TorrentFile(nil), Session.Torrents...)
+	Session.mutex.Unlock()
+
+	state := SessionState{Version: sessionVersion}
+
+	for _, Torrent := range torrents {
+		state.Torrents = append(state.Torrents, SessionTorrent{
+			TorrentPath: Torrent.SourcePath,
+			OutputDir:   Torrent.OutputDir,
+			Resume:      Torrent.resumeData(),
+			Peers:       Torrent.knownPeerAddrs(),
+			Trackers:    Torrent.TrackerStats(),
+		})
+	}
+
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Encoding session state: %v\n", err)
+	}
+
+	tmp := Session.StatePath + ".tmp"
+
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("Writing session file %s: %v\n", tmp, err)
+	}
+
+	err = os.Rename(tmp, Session.StatePath)
+	if err != nil {
+		return fmt.Errorf("Renaming session file %s: %v\n", tmp, err)
+	}
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Remove takes a torrent out of the session, so it is no longer saved, and tells its trackers
+that we left the swarm.
+
+Parameters:
+  - Session: Session to remove from.
+  - Torrent: Torrent to remove.
+*/
+func (Session *Session) Remove(Torrent *TorrentFile) {
+	Session.mutex.Lock()
+	for i, other := range Session.Torrents {
+		if other == Torrent {
+			Session.Torrents = append(Session.Torrents[:i], Session.Torrents[i+1:]...)
+			break
+		}
+	}
+	Session.mutex.Unlock()
+
+	Torrent.AnnounceStopped()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Close saves the session state and then sends a stopped announce for every torrent.
+The session must not be used afterwards.
+
+Parameters:
+  - Session: Session to close.
+
+Returns:
+  - error: Non-nil if the state cannot be saved.
+*/
+func (Session *Session) Close() error {
+	err := Session.Save()
+
+	Session.mutex.Lock()
+	torrents := append([]*TorrentFile(nil), Session.Torrents...)
+	Session.mutex.Unlock()
+
+	for _, Torrent := range torrents {
+		Torrent.AnnounceStopped()
+	}
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ExternalIP returns our public IP address as reported by the trackers of the session's torrents.
+
+Parameters:
+  - Session: Session to query.
+
+Returns:
+  - string: Our external IP address, or "" if no tracker reported it yet.
+*/
+func (Session *Session) ExternalIP() string {
+	Session.mutex.Lock()
+	defer Session.mutex.Unlock()
+
+	for _, Torrent := range Session.Torrents {
+		ip := Torrent.ExternalIP()
+		if ip != "" {
+			return ip
+		}
+	}
+
+	return ""
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+knownPeerAddrs returns the addresses of currently connected peers followed by peers
+remembered from a previous session, without duplicates.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Peer addresses ("host:port").
+*/
+func (Torrent *TorrentFile) knownPeerAddrs() []string {
+	seen := make(map[string]bool)
+	var addrs []string
+
+	Torrent.PeersMutex.Lock()
+	for _, peer := range Torrent.Peers {
+		addr := peer.ListenAddr()
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	Torrent.PeersMutex.Unlock()
+
+	for i := range Torrent.KnownPeers {
+		addr := Torrent.KnownPeers[i].ListenAddr()
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,162 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+writeTestTorrent writes a file of deterministic content and a .torrent file describing it
+to a temporary directory.
+
+Parameters:
+  - t: Test the directory belongs to.
+  - size: Size of the file in bytes.
+  - pieceLength: Piece length of the torrent.
+
+Returns:
+  - string: Path of the .torrent file.
+  - []byte: Content of the shared file.
+*/
+func writeTestTorrent(t *testing.T, size int, pieceLength int64) (string, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	content := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+
+	dataPath := filepath.Join(dir, "data.bin")
+	err := os.WriteFile(dataPath, content, 0644)
+	if err != nil {
+		t.Fatalf("writing data: %v", err)
+	}
+
+	metainfo, err := CreateTorrent(dataPath, "http://tracker.example/announce", pieceLength)
+	if err != nil {
+		t.Fatalf("creating torrent: %v", err)
+	}
+
+	torrentPath := filepath.Join(dir, "data.torrent")
+	err = os.WriteFile(torrentPath, metainfo, 0644)
+	if err != nil {
+		t.Fatalf("writing torrent: %v", err)
+	}
+
+	return torrentPath, content
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestSessionRoundTrip(t *testing.T) {
+	torrentPath, _ := writeTestTorrent(t, 5*16384+100, 16384)
+
+	Torrent, err := SetTorrentFile(torrentPath)
+	if err != nil {
+		t.Fatalf("SetTorrentFile: %v", err)
+	}
+
+	err = Torrent.InitializePieces()
+	if err != nil {
+		t.Fatalf("InitializePieces: %v", err)
+	}
+
+	Torrent.OutputDir = t.TempDir()
+	Torrent.Downloaded.Set(0)
+	Torrent.Downloaded.Set(3)
+	Torrent.counters.downloaded.Store(2 * 16384)
+	Torrent.counters.uploaded.Store(777)
+	Torrent.completedSent.Store(true)
+	Torrent.KnownPeers = []Peer{{IP: "10.0.0.1", Port: 6881}, {IP: "2001:db8::1", Port: 51413}}
+	key := Torrent.AnnounceKey()
+
+	retryAt := time.Now().Add(time.Hour).Round(time.Second)
+	Torrent.restoreTrackerStats([]TrackerStat{
+		{URL: "http://dead.example/announce", Status: TrackerDead, StatusCode: 410},
+		{URL: "udp://slow.example:6969/announce", Status: TrackerBackoff, RetryAt: retryAt, Failures: 4},
+	})
+
+	statePath := filepath.Join(t.TempDir(), "session.json")
+	session, err := OpenSession(statePath)
+	if err != nil || len(session.Torrents) != 0 {
+		t.Fatalf("OpenSession of a missing file = %v, %v", session, err)
+	}
+
+	session.Add(Torrent)
+	err = session.Save()
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	restored, err := OpenSession(statePath)
+	if err != nil {
+		t.Fatalf("OpenSession: %v", err)
+	}
+
+	if len(restored.Torrents) != 1 {
+		t.Fatalf("restored %d torrents, want 1", len(restored.Torrents))
+	}
+
+	got := restored.Torrents[0]
+
+	if got.Info.InfoHash != Torrent.Info.InfoHash || got.OutputDir != Torrent.OutputDir {
+		t.Errorf("restored torrent %x in %s, want %x in %s", got.Info.InfoHash, got.OutputDir, Torrent.Info.InfoHash, Torrent.OutputDir)
+	}
+
+	for i := 0; i < got.NumPieces; i++ {
+		if got.Downloaded.Has(i) != (i == 0 || i == 3) {
+			t.Errorf("piece %d downloaded = %v", i, got.Downloaded.Has(i))
+		}
+	}
+
+	if got.counters.downloaded.Load() != 2*16384 || got.counters.uploaded.Load() != 777 {
+		t.Errorf("restored counters downloaded=%d uploaded=%d", got.counters.downloaded.Load(), got.counters.uploaded.Load())
+	}
+
+	if got.AnnounceKey() != key || !got.completedSent.Load() {
+		t.Errorf("restored key %08X completed %v, want %08X true", got.AnnounceKey(), got.completedSent.Load(), key)
+	}
+
+	if len(got.KnownPeers) != 2 || got.KnownPeers[0].ListenAddr() != "10.0.0.1:6881" || got.KnownPeers[1].ListenAddr() != "[2001:db8::1]:51413" {
+		t.Errorf("restored peers %v", got.KnownPeers)
+	}
+
+	stats := got.TrackerStats()
+	if len(stats) != 2 {
+		t.Fatalf("restored %d tracker states, want 2", len(stats))
+	}
+
+	if stats[0].Status != TrackerDead || stats[0].StatusCode != 410 {
+		t.Errorf("restored dead tracker as %+v", stats[0])
+	}
+
+	if stats[1].Status != TrackerBackoff || !stats[1].RetryAt.Equal(retryAt) || stats[1].Failures != 4 {
+		t.Errorf("restored backed-off tracker as %+v", stats[1])
+	}
+
+	// Dead trackers stay dead and backoffs are kept across the restart
+	if got.trackerUsable("http://dead.example/announce", EventStarted) || got.trackerUsable("udp://slow.example:6969/announce", EventStarted) {
+		t.Errorf("restored trackers usable again")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestSessionVersion(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "session.json")
+
+	err := os.WriteFile(statePath, []byte(`{"version": 99, "torrents": []}`), 0644)
+	if err != nil {
+		t.Fatalf("writing state: %v", err)
+	}
+
+	_, err = OpenSession(statePath)
+	if err == nil {
+		t.Errorf("OpenSession accepted an unknown version")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SignaturePolicy selects what StartDownload does with the publisher signatures of a torrent
+(BEP-35). A signature is valid if it verifies against one of Config.TrustedPublishers.
+
+Values:
+  - SignaturesIgnore: Signatures are not checked.
+  - SignaturesCheck: Signed torrents must carry a valid signature; unsigned torrents are accepted.
+  - SignaturesRequire: Only torrents carrying a valid signature are accepted.
+*/
+type SignaturePolicy int
+
+const (
+	SignaturesIgnore SignaturePolicy = iota
+	SignaturesCheck
+	SignaturesRequire
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// ErrUntrustedTorrent is returned when a torrent is refused by Config.Signatures.
+var ErrUntrustedTorrent = errors.New("Torrent has no valid signature of a trusted publisher")
+
+// --------------------------------------------------------------------------------------------- //
+
+// legacySignature names the top-level "signature" key in the identities VerifySignatures returns.
+const legacySignature = "signature"
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+LoadPublisherKey reads a trusted publisher key for Config.TrustedPublishers from a PEM file
+holding a certificate, a PKIX public key or a PKCS#1 RSA public key.
+
+Parameters:
+  - path: Path of the PEM file.
+
+Returns:
+  - crypto.PublicKey: RSA, ECDSA or ed25519 public key.
+  - error: Non-nil if the file cannot be read or holds no supported key.
+*/
+func LoadPublisherKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Reading publisher key: %v\n", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("Publisher key %s is not PEM encoded\n", path)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing publisher certificate %s: %v\n", path, err)
+		}
+
+		return cert.PublicKey, nil
+
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing publisher key %s: %v\n", path, err)
+		}
+
+		return key, nil
+
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing publisher key %s: %v\n", path, err)
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported PEM block %q in %s\n", block.Type, path)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+SignatureCount returns the number of publisher signatures the torrent carries: the entries of
+the "signatures" dictionary (BEP-35) plus the top-level "signature" key if set.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - int: Number of signatures.
+*/
+func (Torrent *TorrentFile) SignatureCount() int {
+	count := len(Torrent.Signatures)
+	if Torrent.Signature != "" {
+		count++
+	}
+
+	return count
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+VerifySignatures checks the torrent's publisher signatures against Config.TrustedPublishers.
+Each entry of the "signatures" dictionary signs the SHA-1 of the bencoded info dictionary
+followed by the entry's own bencoded "info" dictionary, if any (BEP-35); certificates embedded
+in entries are not trusted by themselves. The top-level "signature" key is checked the same
+way without the extra dictionary. RSA (PKCS#1 v1.5), ECDSA (ASN.1) and ed25519 keys are supported.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Sorted identities whose signature verified ("signature" for the top-level key).
+  - error: Non-nil if the info dictionary is not known.
+*/
+func (Torrent *TorrentFile) VerifySignatures() ([]string, error) {
+	infoBytes := Torrent.metadataBytes()
+	if infoBytes == nil {
+		return nil, fmt.Errorf("Cannot verify signatures of %s: info dictionary unknown\n", Torrent.Info.Name)
+	}
+
+	var valid []string
+
+	for identity, raw := range Torrent.Signatures {
+		entry, _ := raw.(map[string]interface{})
+		signature, _ := entry["signature"].(string)
+
+		signed := append([]byte(nil), infoBytes...)
+
+		if info, ok := entry["info"]; ok {
+			var buf bytes.Buffer
+
+			err := bencode.Marshal(&buf, info)
+			if err != nil {
+				continue
+			}
+
+			signed = append(signed, buf.Bytes()...)
+		}
+
+		if Torrent.Config.trustedSignature(sha1.Sum(signed), []byte(signature)) {
+			valid = append(valid, identity)
+		}
+	}
+
+	if Torrent.Signature != "" && Torrent.Config.trustedSignature(sha1.Sum(infoBytes), []byte(Torrent.Signature)) {
+		valid = append(valid, legacySignature)
+	}
+
+	sort.Strings(valid)
+
+	return valid, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+checkSignatures applies Config.Signatures before a download starts.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile about to be downloaded.
+
+Returns:
+  - error: ErrUntrustedTorrent if the policy refuses the torrent.
+*/
+func (Torrent *TorrentFile) checkSignatures() error {
+	policy := Torrent.Config.Signatures
+	count := Torrent.SignatureCount()
+
+	if policy == SignaturesIgnore || (policy == SignaturesCheck && count == 0) {
+		return nil
+	}
+
+	valid, err := Torrent.VerifySignatures()
+	if err != nil {
+		return err
+	}
+
+	if len(valid) == 0 {
+		log.Printf("[FAIL]\t%s: none of %d signatures is from a trusted publisher\n", Torrent.Info.Name, count)
+		return ErrUntrustedTorrent
+	}
+
+	log.Printf("[INFO]\t%s: signed by trusted publishers %v\n", Torrent.Info.Name, valid)
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trustedSignature reports whether a signature of a digest verifies against a trusted key.
+
+Parameters:
+  - Settings: Configuration holding TrustedPublishers.
+  - digest: SHA-1 of the signed data.
+  - signature: Signature to check.
+
+Returns:
+  - bool: True if some trusted key accepts the signature.
+*/
+func (Settings Config) trustedSignature(digest [20]byte, signature []byte) bool {
+	for _, key := range Settings.TrustedPublishers {
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA1, digest[:], signature) == nil {
+				return true
+			}
+
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest[:], signature) {
+				return true
+			}
+
+		case ed25519.PublicKey:
+			if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, digest[:], signature) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
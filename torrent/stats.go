@@ -0,0 +1,166 @@
+package torrent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+statCounters holds the live counters updated by the download engine.
+All fields are atomics so they can be read by Stats without taking the download mutex.
+
+Fields:
+  - downloaded: Verified payload bytes written to disk.
+  - uploaded: Payload bytes sent to peers.
+  - downloadRate: Current download speed in bytes per second.
+  - connectedPeers: Number of peers with an open connection.
+  - connectedSeeders: Number of connected download peers that have every piece.
+  - halfOpen: Number of outgoing connection attempts still in progress.
+  - hashFailures: Number of pieces that failed SHA-1 verification.
+  - trackerErrors: Number of failed tracker announces.
+  - seedStart: Unix time in nanoseconds when seeding started (0 if not seeding).
+  - hashNanos: Total time spent hashing downloaded pieces, in nanoseconds.
+  - networkNanos: Total time peer goroutines spent receiving pieces, in nanoseconds.
+  - droppedEvents: Number of events not delivered because the Events channel was full.
+*/
+type statCounters struct {
+	downloaded       atomic.Int64
+	uploaded         atomic.Int64
+	downloadRate     atomic.Int64
+	connectedPeers   atomic.Int64
+	connectedSeeders atomic.Int64
+	halfOpen         atomic.Int64
+	hashFailures     atomic.Int64
+	trackerErrors    atomic.Int64
+	seedStart        atomic.Int64
+	hashNanos        atomic.Int64
+	networkNanos     atomic.Int64
+	droppedEvents    atomic.Int64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Stats is a point-in-time snapshot of a torrent's transfer statistics.
+
+Fields:
+  - Downloaded: Verified payload bytes written to disk.
+  - Uploaded: Payload bytes sent to peers.
+  - DownloadRate: Current download speed in bytes per second.
+  - ConnectedPeers: Number of peers with an open connection.
+  - ConnectedSeeders: Number of connected peers we download from that have every piece.
+  - HalfOpen: Number of outgoing connection attempts not yet established or failed.
+  - CompletedPieces: Number of pieces verified and written.
+  - TotalPieces: Total number of pieces in the torrent.
+  - HashFailures: Number of pieces that failed SHA-1 verification.
+  - TrackerErrors: Number of failed tracker announces.
+  - Ratio: Uploaded divided by downloaded bytes (0 if nothing was downloaded).
+  - SeedTime: Time spent seeding so far.
+  - HashTime: Total time spent hashing downloaded pieces.
+  - NetworkTime: Total time spent receiving pieces, summed over all peers.
+  - Seeders: Largest seeder count reported by a working tracker.
+  - Leechers: Largest leecher count reported by a working tracker.
+  - DroppedEvents: Events not delivered because the Events consumer fell behind.
+*/
+type Stats struct {
+	Downloaded       int64
+	Uploaded         int64
+	DownloadRate     int64
+	ConnectedPeers   int
+	ConnectedSeeders int
+	HalfOpen         int
+	CompletedPieces  int
+	TotalPieces      int
+	HashFailures     int64
+	TrackerErrors    int64
+	Ratio            float64
+	SeedTime         time.Duration
+	HashTime         time.Duration
+	NetworkTime      time.Duration
+	Seeders          int
+	Leechers         int
+	DroppedEvents    int64
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Stats returns a snapshot of the torrent's current transfer statistics.
+It is safe to call concurrently with an active download.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to report on.
+
+Returns:
+  - Stats: Snapshot of counters and piece progress.
+*/
+func (Torrent *TorrentFile) Stats() Stats {
+	Torrent.DownloadMutex.Lock()
+	completed := Torrent.Downloaded.Count()
+	Torrent.DownloadMutex.Unlock()
+
+	downloaded := Torrent.counters.downloaded.Load()
+	uploaded := Torrent.counters.uploaded.Load()
+
+	ratio := 0.0
+	if downloaded > 0 {
+		ratio = float64(uploaded) / float64(downloaded)
+	}
+
+	var seedTime time.Duration
+	if start := Torrent.counters.seedStart.Load(); start != 0 {
+		seedTime = time.Since(time.Unix(0, start))
+	}
+
+	seeders, leechers := Torrent.swarmCounts()
+
+	return Stats{
+		Downloaded:       downloaded,
+		Uploaded:         uploaded,
+		DownloadRate:     Torrent.counters.downloadRate.Load(),
+		ConnectedPeers:   int(Torrent.counters.connectedPeers.Load()),
+		ConnectedSeeders: int(Torrent.counters.connectedSeeders.Load()),
+		HalfOpen:         int(Torrent.counters.halfOpen.Load()),
+		CompletedPieces:  completed,
+		TotalPieces:      Torrent.NumPieces,
+		HashFailures:     Torrent.counters.hashFailures.Load(),
+		TrackerErrors:    Torrent.counters.trackerErrors.Load(),
+		Ratio:            ratio,
+		SeedTime:         seedTime,
+		HashTime:         time.Duration(Torrent.counters.hashNanos.Load()),
+		NetworkTime:      time.Duration(Torrent.counters.networkNanos.Load()),
+		Seeders:          seeders,
+		Leechers:         leechers,
+		DroppedEvents:    Torrent.counters.droppedEvents.Load(),
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+swarmCounts returns the largest seeder and leecher counts reported by a working tracker.
+Trackers see different parts of the swarm, so the maximum is the best available estimate.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+
+Returns:
+  - int: Number of seeders.
+  - int: Number of leechers.
+*/
+func (Torrent *TorrentFile) swarmCounts() (int, int) {
+	var seeders, leechers int
+
+	for _, tracker := range Torrent.TrackerStats() {
+		if tracker.Status == TrackerWorking {
+			seeders = max(seeders, tracker.Seeders)
+			leechers = max(leechers, tracker.Leechers)
+		}
+	}
+
+	return seeders, leechers
+}
+
+// --------------------------------------------------------------------------------------------- //
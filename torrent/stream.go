@@ -0,0 +1,113 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+pieceStream writes the blocks of one piece to disk as they arrive and hashes them in order.
+Blocks arriving ahead of the hash position are kept until the gap before them is filled,
+which with pipelining is at most a few blocks.
+
+Fields:
+  - torrent: TorrentFile the piece belongs to.
+  - index: Index of the piece.
+  - offset: Offset of the piece in the piece space.
+  - hasher: SHA-1 of the bytes up to hashed.
+  - hashed: Number of leading piece bytes fed to hasher.
+  - pending: Blocks written but not hashed yet, keyed by offset within the piece.
+*/
+type pieceStream struct {
+	torrent *TorrentFile
+	index   int
+	offset  int64
+	hasher  hash.Hash
+	hashed  int64
+	pending map[int64][]byte
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newPieceStream prepares streaming a piece to disk.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - index: Index of the piece.
+
+Returns:
+  - *pieceStream: Stream positioned at the start of the piece.
+*/
+func (Torrent *TorrentFile) newPieceStream(index int) *pieceStream {
+	return &pieceStream{
+		torrent: Torrent,
+		index:   index,
+		offset:  int64(index) * Torrent.PieceLength,
+		hasher:  sha1.New(),
+		pending: make(map[int64][]byte),
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+write stores a block on disk and feeds every block now contiguous with the hash position
+to the hasher.
+
+Parameters:
+  - begin: Offset of the block within the piece.
+  - block: Block data; it is copied if it has to wait for an earlier block.
+
+Returns:
+  - error: Non-nil if the block cannot be written.
+*/
+func (Stream *pieceStream) write(begin int64, block []byte) error {
+	Stream.torrent.DownloadMutex.Lock()
+	written := Stream.torrent.writeRange(Stream.offset+begin, block)
+	Stream.torrent.DownloadMutex.Unlock()
+
+	if !written {
+		return fmt.Errorf("Writing block at offset %d of piece %d failed\n", begin, Stream.index)
+	}
+
+	if begin != Stream.hashed {
+		Stream.pending[begin] = append([]byte(nil), block...)
+		return nil
+	}
+
+	Stream.hasher.Write(block)
+	Stream.hashed += int64(len(block))
+
+	for {
+		next, ok := Stream.pending[Stream.hashed]
+		if !ok {
+			return nil
+		}
+
+		delete(Stream.pending, Stream.hashed)
+		Stream.hasher.Write(next)
+		Stream.hashed += int64(len(next))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sum returns the SHA-1 of the streamed piece. It must only be called once every block
+has been written.
+
+Returns:
+  - [20]byte: Hash of the piece.
+*/
+func (Stream *pieceStream) sum() [20]byte {
+	var hash [20]byte
+	copy(hash[:], Stream.hasher.Sum(nil))
+
+	return hash
+}
+
+// --------------------------------------------------------------------------------------------- //
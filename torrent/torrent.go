@@ -1,10 +1,12 @@
 package torrent
 
 import (
+	"crypto/ed25519"
+	"io"
 	mrand "math/rand"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,29 +16,79 @@ import (
 // including both standard metadata and additional fields used
 // by the torrent client during download.
 type TorrentFile struct {
-	Announce      string                 `bencode:"announce"`      // URL of the main tracker
-	AnnounceList  [][]string             `bencode:"announce-list"` // List of alternative trackers (each sublist is a tier)
-	Comment       string                 `bencode:"comment"`       // Optional comment about the torrent
-	CreatedBy     string                 `bencode:"created by"`    // Name of the program that created the torrent
-	CreationDate  int64                  `bencode:"creation date"` // Creation time (Unix timestamp)
-	Encoding      string                 `bencode:"encoding"`      // Character encoding used in text fields
-	Info          TorrentInfo            `bencode:"info"`          // Core metadata about the files being shared
-	Nodes         [][]interface{}        `bencode:"nodes"`         // DHT bootstrap nodes (IP and port)
-	URLList       []string               `bencode:"url-list"`      // List of Web Seed URLs (HTTP/FTP sources)
-	HTTPSeeds     []string               `bencode:"httpseeds"`     // Legacy HTTP seed URLs
-	Publisher     string                 `bencode:"publisher"`     // Name of the publisher (optional)
-	PublisherURL  string                 `bencode:"publisher-url"` // URL of the publisher (optional)
-	Source        string                 `bencode:"source"`        // Source identifier for private torrents
-	Signature     string                 `bencode:"signature"`     // Digital signature (if present)
-	Custom        map[string]interface{} `bencode:"-"`             // Non-standard/custom fields (not encoded)
-	Peers         []Peer                 `bencode:"-"`             // List of peers participating in the download
-	PeersMutex    sync.Mutex             `bencode:"-"`             // Mutex for synchronizing access to Peers
-	PieceLength   int64                  `bencode:"-"`             // Length of each piece in bytes
-	NumPieces     int                    `bencode:"-"`             // Total number of pieces
-	PieceHashes   [][20]byte             `bencode:"-"`             // SHA-1 hashes of each piece
-	Downloaded    []bool                 `bencode:"-"`             // Bitfield indicating downloaded pieces
-	DownloadMutex sync.Mutex             `bencode:"-"`             // Mutex for synchronizing download state
-	Files         []FileInfo             `bencode:"-"`             // Local file info (paths, offsets, handles)
+	Announce      string                  `bencode:"announce"`      // URL of the main tracker
+	AnnounceList  [][]string              `bencode:"announce-list"` // List of alternative trackers (each sublist is a tier)
+	Comment       string                  `bencode:"comment"`       // Optional comment about the torrent
+	CreatedBy     string                  `bencode:"created by"`    // Name of the program that created the torrent
+	CreationDate  int64                   `bencode:"creation date"` // Creation time (Unix timestamp)
+	Encoding      string                  `bencode:"encoding"`      // Character encoding used in text fields
+	Info          TorrentInfo             `bencode:"info"`          // Core metadata about the files being shared
+	Nodes         [][]interface{}         `bencode:"nodes"`         // DHT bootstrap nodes (IP and port)
+	URLList       []string                `bencode:"url-list"`      // List of Web Seed URLs (HTTP/FTP sources)
+	HTTPSeeds     []string                `bencode:"httpseeds"`     // Legacy HTTP seed URLs
+	Publisher     string                  `bencode:"publisher"`     // Name of the publisher (optional)
+	PublisherURL  string                  `bencode:"publisher-url"` // URL of the publisher (optional)
+	Source        string                  `bencode:"source"`        // Source identifier for private torrents
+	Signature     string                  `bencode:"signature"`     // Digital signature (if present, see VerifySignatures)
+	Signatures    map[string]interface{}  `bencode:"-"`             // Publisher signatures by identity (BEP-35, see decodeSignatures)
+	Custom        map[string]interface{}  `bencode:"-"`             // Non-standard/custom fields (not encoded)
+	Peers         []*Peer                 `bencode:"-"`             // Peers with an established connection
+	PeersMutex    sync.Mutex              `bencode:"-"`             // Mutex for synchronizing access to Peers
+	PieceLength   int64                   `bencode:"-"`             // Length of each piece in bytes
+	NumPieces     int                     `bencode:"-"`             // Total number of pieces
+	PieceHashes   [][20]byte              `bencode:"-"`             // SHA-1 hashes of each piece
+	merkle        *merkleTree             `bencode:"-"`             // Piece hash tree of Merkle torrents (BEP-30, nil otherwise)
+	Downloaded    BitSet                  `bencode:"-"`             // Pieces verified and written to disk
+	InProgress    BitSet                  `bencode:"-"`             // Pieces currently claimed by a peer goroutine
+	Wanted        BitSet                  `bencode:"-"`             // Pieces overlapping selected files (all by default)
+	pieceAccess   []atomic.Int64          `bencode:"-"`             // Last read or write of each piece in Unix nanoseconds (see evictPieces)
+	fileWanted    []bool                  `bencode:"-"`             // Selection state per ListFiles entry (nil selects all)
+	fileDone      []bool                  `bencode:"-"`             // Files whose completion steps have run (see finishFile)
+	completedRun  bool                    `bencode:"-"`             // Whether this run downloaded the last missing piece (see StartDownload)
+	Availability  []int                   `bencode:"-"`             // Number of connected peers having each piece
+	Picker        PiecePicker             `bencode:"-"`             // Strategy selecting the next piece to download
+	DownloadMutex sync.Mutex              `bencode:"-"`             // Mutex for synchronizing download state
+	Files         []FileInfo              `bencode:"-"`             // Local file info (paths, offsets, handles)
+	SourcePath    string                  `bencode:"-"`             // Path of the .torrent file the metadata was loaded from
+	infoBytes     []byte                  `bencode:"-"`             // Bencoded info dictionary served via ut_metadata (see metadataBytes)
+	metadataMutex sync.Mutex              `bencode:"-"`             // Mutex for synchronizing infoBytes
+	OutputDir     string                  `bencode:"-"`             // Directory the content is downloaded to
+	KnownPeers    []Peer                  `bencode:"-"`             // Peers we connected to in a previous session
+	Config        Config                  `bencode:"-"`             // User-tunable download settings
+	counters      statCounters            `bencode:"-"`             // Live transfer statistics (see Stats)
+	trackers      map[string]*TrackerStat `bencode:"-"`             // Per-tracker announce state (see TrackerStats)
+	tiers         [][]string              `bencode:"-"`             // Shuffled announce tiers in the order they are tried (BEP-12, see trackerTiers)
+	tiersKey      string                  `bencode:"-"`             // baseTiers the tiers were built from
+	announceStop  chan struct{}           `bencode:"-"`             // Closed to end the announcer goroutines (nil while none run, see RefreshPeer)
+	announcing    map[string]bool         `bencode:"-"`             // Trackers that have an announcer goroutine
+	TrackersMutex sync.Mutex              `bencode:"-"`             // Mutex for synchronizing tracker state
+	numWant       atomic.Int32            `bencode:"-"`             // Peers requested per announce while peers are scarce (0 uses Config.NumWant)
+	announceKey   atomic.Uint32           `bencode:"-"`             // Key sent with every announce (see AnnounceKey)
+	completedSent atomic.Bool             `bencode:"-"`             // Whether trackers were sent the completed event, saved in the resume file
+	canceled      atomic.Bool             `bencode:"-"`             // Whether CancelDownload stopped the running download
+	peerID        string                  `bencode:"-"`             // Peer ID sent to trackers and peers (see PeerID)
+	peerIDMutex   sync.Mutex              `bencode:"-"`             // Mutex for synchronizing peerID
+	dialSlots     chan struct{}           `bencode:"-"`             // Semaphore of Config.MaxHalfOpen concurrent dials (see dialPeer)
+	dialOnce      sync.Once               `bencode:"-"`             // Guards the creation of dialSlots
+	upSlots       chan struct{}           `bencode:"-"`             // Semaphore of Config.UploadSlots unchoked peers (see uploadSlots)
+	uploadOnce    sync.Once               `bencode:"-"`             // Guards the creation of upSlots
+	extIP         string                  `bencode:"-"`             // Our public IP address as reported by trackers (see ExternalIP)
+	extIPMutex    sync.Mutex              `bencode:"-"`             // Mutex for synchronizing extIP
+	transfers     []PeerTransfer          `bencode:"-"`             // Per-peer download totals of finished peers (see PeerTransfers)
+	blockSources  map[int][]*Peer         `bencode:"-"`             // Peer that delivered each block of in-progress pieces
+	peerFailures  map[string]int          `bencode:"-"`             // Hash failures blamed on each peer IP
+	events        chan Event              `bencode:"-"`             // Channel returned by Events (nil until requested)
+	eventsClosed  bool                    `bencode:"-"`             // Whether Close has been called
+	closed        chan struct{}           `bencode:"-"`             // Closed by Close to end Seed and its workers (see closedSignal)
+	closers       []io.Closer             `bencode:"-"`             // Listeners and servers started by Listen and ServeMetrics, closed by Close
+	eventsMutex   sync.Mutex              `bencode:"-"`             // Mutex for synchronizing events, eventsClosed, closed and closers
+	pexKnown      map[string]pexSource    `bencode:"-"`             // Peer and time each address was learned through PEX, guarded by PeersMutex
+	holepunched   map[string]bool         `bencode:"-"`             // Peer addresses a holepunch rendezvous was requested for, guarded by PeersMutex
+	bitfieldMutex sync.Mutex              `bencode:"-"`             // Guards changes to Peer.Bitfield against reads from other goroutines (see setBitfield)
+	mutableKey    ed25519.PublicKey       `bencode:"-"`             // Publisher key of a BEP-46 magnet link (see ResolveMutable)
+	mutableSalt   string                  `bencode:"-"`             // Salt of the mutable item the magnet link names
+	selectOnly    []int                   `bencode:"-"`             // File indices of a magnet link's "so" parameter (see applySelectOnly)
+	piecesChanged chan struct{}           `bencode:"-"`             // Closed when pieces are given back, finished or wanted again (see piecesSignal), guarded by DownloadMutex
 }
 
 // TorrentInfo represents the "info" dictionary inside a .torrent file,
@@ -54,51 +106,102 @@ type TorrentInfo struct {
 	FileTree    map[string]interface{} `bencode:"file tree"`    // BEP-47: file tree representation
 	PieceLayers map[string]string      `bencode:"piece layers"` // BEP-47: used for Merkle root trees
 	PiecesRoot  string                 `bencode:"pieces root"`  // BEP-47: root hash of the Merkle tree
+	RootHash    string                 `bencode:"root hash"`    // BEP-30: root of the piece hash tree of Merkle torrents
 	Custom      map[string]interface{} `bencode:"-"`            // Non-standard/custom fields (not encoded)
 	InfoHash    [20]byte               `bencode:"-"`            // SHA-1 hash of the bencoded Info dictionary
+	InfoHashV2  [32]byte               `bencode:"-"`            // SHA-256 hash of the bencoded Info dictionary (v2/hybrid only)
 }
 
 // TorrentFileEntry represents an individual file in a multi-file torrent.
 type TorrentFileEntry struct {
-	Length     int64                  // Length of the file in bytes
-	Path       []string               // File path split into directories and file name
-	MD5Sum     string                 // Optional MD5 checksum
-	PiecesRoot string                 // Merkle root for this file (BEP-47)
-	Custom     map[string]interface{} // Custom/non-standard fields
+	Length      int64                  // Length of the file in bytes
+	Path        []string               // File path split into directories and file name
+	MD5Sum      string                 // Optional MD5 checksum
+	PiecesRoot  string                 // Merkle root for this file (BEP-47)
+	Attr        string                 `bencode:"attr"`         // BEP-47 attributes: 'p' padding, 'l' symlink, 'x' executable
+	SymlinkPath []string               `bencode:"symlink path"` // BEP-47 symlink target relative to the torrent root
+	Custom      map[string]interface{} // Custom/non-standard fields
 }
 
 // TrackerResponse represents the response from a tracker server.
 type TrackerResponse struct {
-	Peers    string // Compact peer list (each peer is 6 bytes: 4 for IP, 2 for port)
-	Failure  string // Error message if the tracker request failed
-	Interval int    // Interval (in seconds) before the next announce request
+	Peers       string // Compact peer list (each peer is 6 bytes: 4 for IP, 2 for port)
+	Peers6      string `bencode:"peers6"`          // Compact IPv6 peer list (each peer is 18 bytes: 16 for IP, 2 for port)
+	Failure     string `bencode:"failure reason"`  // Error message if the tracker request failed
+	Warning     string `bencode:"warning message"` // Non-fatal message the tracker wants shown to the user
+	TrackerID   string `bencode:"tracker id"`      // Value to send back as "trackerid" in later announces
+	Interval    int    // Interval (in seconds) before the next announce request
+	MinInterval int    `bencode:"min interval"` // Minimum interval (in seconds) the tracker allows between announces
+	Seeders     int    `bencode:"complete"`     // Number of peers with the complete torrent
+	Leechers    int    `bencode:"incomplete"`   // Number of peers still downloading
+	ExternalIP  string `bencode:"external ip"`  // Our address as seen by the tracker (4 or 16 bytes, BEP-24)
 }
 
 // Peer represents a remote peer in the BitTorrent swarm.
 type Peer struct {
-	IP         string   // IP address of the peer
-	Port       uint16   // Port number of the peer
-	PeerID     string   // Peer ID (optional)
-	Connection net.Conn // TCP connection to the peer
-	Choked     bool     // Whether this peer is currently choking us
-	Bitfield   []byte   // Bitfield indicating which pieces the peer has
+	IP            string          // IP address of the peer
+	Port          uint16          // Port number of the peer
+	PeerID        string          // Peer ID (optional)
+	Connection    net.Conn        // TCP connection to the peer
+	Encrypted     bool            // Whether the connection is RC4-encrypted with MSE
+	Inbound       bool            // Whether the peer connected to us (see acceptHandshake)
+	State         PeerState       // Choke and interest state in both directions
+	Bitfield      []byte          // Bitfield indicating which pieces the peer has, changed with setBitfield and setPeerPiece
+	Seeder        bool            // Whether the peer announced every piece (see markSeeder)
+	ListenPort    uint16          // Listening port advertised in the extension handshake (0 if unknown)
+	DHTPort       uint16          // DHT UDP port advertised with a Port message (0 if unknown)
+	Client        string          // Client name advertised in the extension handshake
+	Extensions    map[string]int  // Extended message IDs from the extension handshake (nil until received)
+	MetadataSize  int64           // Info dictionary size advertised for ut_metadata (0 if unknown)
+	Snubbed       bool            // Whether the peer stopped delivering blocks while unchoking us
+	LastBlock     time.Time       // When the peer last delivered a block
+	NoShortBlocks bool            // Whether the peer ignored a short final block request
+	BytesReceived int64           // Piece bytes received from the peer (including failed pieces)
+	ReceiveTime   time.Duration   // Time spent waiting for the peer's blocks
+	pending       []*Message      // Messages read while fetching metadata, returned first by receiveMessage
+	pexSent       map[string]bool // Peer addresses included in the PEX messages sent to the peer
+	pexReceived   time.Time       // When the last PEX message from the peer was accepted
+	lastSent      int64           // Unix nanoseconds of our last write to the peer, accessed atomically (see keepAlive)
+}
+
+// FileHandle is the storage a torrent file is read from and written to.
+// *os.File implements it; benchmark mode uses a handle that discards writes.
+type FileHandle interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
 }
 
 // FileInfo contains information about a file on disk,
 // used for reading and writing data during the download process.
 type FileInfo struct {
-	Path   string   // Full file path on the local filesystem
-	Length int64    // Length of the file in bytes
-	Offset int64    // Offset from the beginning of the torrent data
-	Handle *os.File `bencode:"-"` // File handle (not part of the .torrent format)
+	Path       string     // Full file path on the local filesystem
+	Length     int64      // Length of the file in bytes
+	Offset     int64      // Offset from the beginning of the torrent data
+	Handle     FileHandle `bencode:"-"` // File handle (not part of the .torrent format)
+	Pad        bool       `bencode:"-"` // BEP-47 padding file, never written to disk
+	Symlink    bool       `bencode:"-"` // BEP-47 symlink, created by createSymlinks instead of downloaded
+	Executable bool       `bencode:"-"` // BEP-47 executable file, made executable once written
 }
 
 // --------------------------------------------------------------------------------------------- //
 
-// init seeds the math/rand random number generator with the current time,
-// ensuring different random sequences on each run.
-func init() {
-	mrand.New(mrand.NewSource(time.Now().UnixNano()))
+// rng is the package's math/rand generator, seeded with the current time so that
+// non-cryptographic random values (announce keys, fallbacks) differ between runs.
+// *rand.Rand is not safe for concurrent use, so every access goes through rngMutex.
+var (
+	rng      = mrand.New(mrand.NewSource(time.Now().UnixNano()))
+	rngMutex sync.Mutex
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// randUint32 returns a pseudo-random uint32 from the package's seeded generator.
+func randUint32() uint32 {
+	rngMutex.Lock()
+	defer rngMutex.Unlock()
+
+	return rng.Uint32()
 }
 
 // --------------------------------------------------------------------------------------------- //
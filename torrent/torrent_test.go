@@ -0,0 +1,50 @@
+package torrent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestRandUint32VariesAcrossRuns(t *testing.T) {
+	// In the child processes: report the first value of this run's generator
+	if os.Getenv("BT_RAND_CHILD") == "1" {
+		fmt.Printf("rand=%d\n", randUint32())
+		return
+	}
+
+	values := make(map[string]bool)
+
+	for run := 0; run < 3; run++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRandUint32VariesAcrossRuns$")
+		cmd.Env = append(os.Environ(), "BT_RAND_CHILD=1")
+
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("child run: %v", err)
+		}
+
+		value, _, _ := strings.Cut(strings.TrimPrefix(string(output), "rand="), "\n")
+		values[value] = true
+	}
+
+	if len(values) < 2 {
+		t.Errorf("every run started with the same value: %v", values)
+	}
+
+	// Within a run the values vary too
+	first := randUint32()
+	for i := 0; i < 8; i++ {
+		if randUint32() != first {
+			return
+		}
+	}
+
+	t.Errorf("randUint32 returned %d nine times", first)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -1,25 +1,97 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	mrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
 // --------------------------------------------------------------------------------------------- //
 
+// errNoTrackers is returned by announce when neither the torrent nor the config lists a tracker.
+var errNoTrackers = errors.New("No trackers found")
+
+// errWebTorrentTracker is the LastError of ws:// and wss:// trackers, whose peers are only
+// reachable over WebRTC.
+var errWebTorrentTracker = errors.New("WebTorrent trackers are not supported (no WebRTC transport)\n")
+
+// --------------------------------------------------------------------------------------------- //
+
+// announceParams are the query parameters set by the client itself in HTTP announces;
+// Config.ExtraAnnounceParams may not override them.
+var announceParams = map[string]bool{
+	"info_hash":  true,
+	"peer_id":    true,
+	"port":       true,
+	"uploaded":   true,
+	"downloaded": true,
+	"left":       true,
+	"key":        true,
+	"compact":    true,
+	"event":      true,
+	"numwant":    true,
+	"trackerid":  true,
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+AnnounceEvent is the "event" reported to trackers with an announce.
+The numeric values match the UDP tracker protocol (BEP-15).
+
+Values:
+  - EventNone: Regular periodic announce.
+  - EventCompleted: The download has just finished.
+  - EventStarted: First announce of the session.
+  - EventStopped: The client is shutting down or removing the torrent.
+*/
+type AnnounceEvent uint32
+
+const (
+	EventNone AnnounceEvent = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+String returns the HTTP tracker representation of the event.
+
+Returns:
+  - string: "completed", "started", "stopped", or "" for EventNone.
+*/
+func (Event AnnounceEvent) String() string {
+	switch Event {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 SendHTTPTrackerRequest sends an HTTP request to a tracker to retrieve peer information.
-It constructs a request with torrent metadata and parses the bencoded response.
+It first asks for a compact peer list; if the tracker returns no peers that way, it retries
+exactly once with compact=0 and parses the dictionary-form peer list instead.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing metadata such as InfoHash and total size.
@@ -30,6 +102,87 @@ Returns:
   - error: Non-nil if URL parsing, metadata retrieval, HTTP request, or response decoding fails.
 */
 func (Torrent *TorrentFile) SendHTTPTrackerRequest(announceURL string) (*TrackerResponse, error) {
+	return Torrent.httpAnnounce(context.Background(), announceURL, EventStarted)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+httpAnnounce announces to an HTTP tracker with the given event, falling back to
+compact=0 once if the compact response carries no peers. Stopped announces are never retried,
+as their peers are not used. A tracker whose compact=0 answer was empty too is remembered in
+its TrackerStat and not retried again.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata such as InfoHash and total size.
+  - ctx: Context bounding the requests.
+  - announceURL: URL of the HTTP tracker to contact.
+  - event: Announce event to report.
+
+Returns:
+  - *TrackerResponse: Pointer to the TrackerResponse containing peers and interval.
+  - error: Non-nil if the announce fails.
+*/
+func (Torrent *TorrentFile) httpAnnounce(ctx context.Context, announceURL string, event AnnounceEvent) (*TrackerResponse, error) {
+	trackerResp, err := Torrent.sendHTTPAnnounce(ctx, announceURL, event, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if event == EventStopped || trackerResp.peerCount() > 0 {
+		return trackerResp, nil
+	}
+
+	Torrent.TrackersMutex.Lock()
+	noFallback := Torrent.trackerState(announceURL).noFallback
+	Torrent.TrackersMutex.Unlock()
+
+	if noFallback {
+		return trackerResp, nil
+	}
+
+	log.Printf("[INFO]\tTracker %s returned no compact peers, retrying with compact=0\n", announceURL)
+
+	fallbackResp, err := Torrent.sendHTTPAnnounce(ctx, announceURL, event, false)
+	if err != nil {
+		log.Printf("[FAIL]\tcompact=0 fallback to %s failed: %v\n", announceURL, err)
+		return trackerResp, nil
+	}
+
+	if fallbackResp.peerCount() == 0 {
+		log.Printf("[INFO]\tcompact=0 fallback to %s did not return any peers, not retrying it\n", announceURL)
+
+		Torrent.TrackersMutex.Lock()
+		Torrent.trackerState(announceURL).noFallback = true
+		Torrent.TrackersMutex.Unlock()
+
+		return trackerResp, nil
+	}
+
+	log.Printf("[INFO]\tcompact=0 fallback to %s returned %d peers\n", announceURL, fallbackResp.peerCount())
+
+	return fallbackResp, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+sendHTTPAnnounce performs a single HTTP announce and decodes the bencoded response.
+Both compact and dictionary-form peer lists are accepted; dictionary peers are converted
+to the compact representation so callers can treat them uniformly.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata such as InfoHash and total size.
+  - ctx: Context bounding the request.
+  - announceURL: URL of the HTTP tracker to contact.
+  - event: Announce event to report (omitted from the query for EventNone).
+  - compact: Whether to request a compact peer list.
+
+Returns:
+  - *TrackerResponse: Pointer to the TrackerResponse containing peers and interval.
+  - error: Non-nil if URL parsing, metadata retrieval, HTTP request, or response decoding fails.
+*/
+func (Torrent *TorrentFile) sendHTTPAnnounce(ctx context.Context, announceURL string, event AnnounceEvent, compact bool) (*TrackerResponse, error) {
 	u, err := url.Parse(announceURL)
 	if err != nil {
 		return nil, fmt.Errorf("URL parsing error: %v\n", err)
@@ -40,40 +193,58 @@ func (Torrent *TorrentFile) SendHTTPTrackerRequest(announceURL string) (*Tracker
 		return nil, err
 	}
 
-	peerID, err := Torrent.GeneratePeerID()
+	peerID, err := Torrent.PeerID()
 	if err != nil {
 		return nil, err
 	}
 
-	left, err := Torrent.GetTotalSize()
-	if err != nil {
-		return nil, err
-	}
+	downloaded, uploaded, left := Torrent.announceCounters()
 
-	params := url.Values{}
-	params.Add("info_hash", url.QueryEscape(string(infoHash[:])))
+	params := trackerQuery{}
+	params.Add("info_hash", string(infoHash[:]))
 	params.Add("peer_id", peerID)
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
+	params.Add("port", strconv.Itoa(int(Torrent.Config.announcePort())))
+	params.Add("uploaded", fmt.Sprintf("%d", uploaded))
+	params.Add("downloaded", fmt.Sprintf("%d", downloaded))
 	params.Add("left", fmt.Sprintf("%d", left))
-	params.Add("compact", "1")
-	params.Add("event", "started")
+	params.Add("key", fmt.Sprintf("%08X", Torrent.AnnounceKey()))
+	if compact {
+		params.Add("compact", "1")
+	} else {
+		params.Add("compact", "0")
+	}
+
+	if event != EventNone {
+		params.Add("event", event.String())
+	}
 
-	u.RawQuery = params.Encode()
+	numWant := Torrent.announceNumWant()
+	if numWant > 0 {
+		params.Add("numwant", strconv.Itoa(int(numWant)))
+	}
 
-	client := &http.Client{
-		Timeout: 15 * time.Second,
+	if trackerID := Torrent.trackerID(announceURL); trackerID != "" {
+		params.Add("trackerid", trackerID)
 	}
 
-	req, err := http.NewRequest("GET", u.String(), nil)
+	for name, value := range Torrent.Config.ExtraAnnounceParams {
+		if !announceParams[strings.ToLower(name)] {
+			params.Set(name, value)
+		}
+	}
+
+	requestURL := withQuery(u, params)
+
+	client := Torrent.trackerClient()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("Creating HTTP request error: %v\n", err)
 	}
 
 	req.Header.Set("User-Agent", "BitTorrent/1.0")
 
-	log.Printf("[INFO]\tSending HTTP request to %s\n", u.String())
+	log.Printf("[INFO]\tSending HTTP request to %s\n", requestURL)
 
 	response, err := client.Do(req)
 	if err != nil {
@@ -82,24 +253,98 @@ func (Torrent *TorrentFile) SendHTTPTrackerRequest(announceURL string) (*Tracker
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Tracker status code error: %v\n", err)
+		return nil, &TrackerHTTPError{
+			StatusCode: response.StatusCode,
+			RetryAfter: parseRetryAfter(response.Header.Get("Retry-After")),
+		}
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Reading tracker response error: %v\n", err)
 	}
 
 	var trackerResp TrackerResponse
-	err = bencode.Unmarshal(response.Body, &trackerResp)
+	err = bencode.Unmarshal(bytes.NewReader(body), &trackerResp)
 	if err != nil {
 		return nil, fmt.Errorf("Decoding tracker response error: %v\n", err)
 	}
 
+	if trackerResp.Peers == "" && trackerResp.Peers6 == "" {
+		trackerResp.Peers, trackerResp.Peers6 = decodeDictionaryPeers(body)
+	}
+
 	if trackerResp.Failure != "" {
 		return nil, fmt.Errorf("Tracker failure: %s\n", trackerResp.Failure)
 	}
 
+	Torrent.setExternalIP(trackerResp.ExternalIP)
+
 	return &trackerResp, nil
 }
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+decodeDictionaryPeers extracts a dictionary-form peer list from a bencoded tracker response.
+Each entry is a dictionary with "ip" and "port" keys (and an optional "peer id"); entries are
+re-encoded into the 6-byte IPv4 or 18-byte IPv6 compact form, invalid entries are skipped.
+
+Parameters:
+  - body: Raw bencoded tracker response.
+
+Returns:
+  - string: Compact IPv4 peer list built from the dictionary entries (empty if none).
+  - string: Compact IPv6 peer list built from the dictionary entries (empty if none).
+*/
+func decodeDictionaryPeers(body []byte) (string, string) {
+	data, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return "", ""
+	}
+
+	dict, ok := data.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+
+	list, ok := dict["peers"].([]interface{})
+	if !ok {
+		return "", ""
+	}
+
+	var compact, compact6 []byte
+
+	for _, entry := range list {
+		peer, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		ipString, _ := peer["ip"].(string)
+		port, ok := peer["port"].(int64)
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+
+		encoded, ok := compactPeer(net.JoinHostPort(ipString, strconv.FormatInt(port, 10)))
+		if !ok {
+			log.Printf("[INFO]\tSkipping invalid dictionary peer %q\n", ipString)
+			continue
+		}
+
+		if len(encoded) == 6 {
+			compact = append(compact, encoded...)
+		} else {
+			compact6 = append(compact6, encoded...)
+		}
+	}
+
+	return string(compact), string(compact6)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 CreateAnnounceRequest constructs a binary announce request for a UDP tracker.
 It formats the request according to the BitTorrent UDP tracker protocol.
@@ -174,349 +419,715 @@ Returns:
   - error: Non-nil if URL parsing, connection, request sending, or response validation fails.
 */
 func (Torrent *TorrentFile) SendUDPTrackerRequest(announceURL string) (*TrackerResponse, error) {
+	return Torrent.udpAnnounce(context.Background(), announceURL, EventStarted)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+dialUDPTracker opens a UDP socket to a tracker, bound to Config.ListenPort when
+Config.BindTrackerPort is set. udpRequest ensures no other exchange holds the port, so
+binding only fails if another program uses it; the socket then falls back to an ephemeral
+port, with a warning.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - announceURL: URL of the UDP tracker to contact.
+
+Returns:
+  - *net.UDPConn: Connected socket; the caller must close it.
+  - *net.UDPAddr: Resolved tracker address.
+  - error: Non-nil if the URL cannot be parsed or resolved, or the socket cannot be opened.
+*/
+func (Torrent *TorrentFile) dialUDPTracker(announceURL string) (*net.UDPConn, *net.UDPAddr, error) {
 	u, err := url.Parse(announceURL)
 	if err != nil {
-		return nil, fmt.Errorf("parsing UDP URL error: %v", err)
+		return nil, nil, fmt.Errorf("parsing UDP URL error: %v", err)
 	}
 
 	addr, err := net.ResolveUDPAddr("udp", u.Host)
 	if err != nil {
-		return nil, fmt.Errorf("resolving UDP address error: %v", err)
+		return nil, nil, fmt.Errorf("resolving UDP address error: %v", err)
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		return nil, fmt.Errorf("dial UDP error: %v", err)
+	var local *net.UDPAddr
+	if Torrent.Config.BindTrackerPort {
+		local = &net.UDPAddr{Port: int(Torrent.Config.ListenPort)}
 	}
-	defer conn.Close()
 
-	transactionID, err := Torrent.GenerateTransactionID()
-	if err != nil {
-		return nil, err
+	conn, err := net.DialUDP("udp", local, addr)
+	if err != nil && local != nil {
+		log.Printf("[FAIL]\tCannot bind UDP port %d for tracker %s, using an ephemeral port: %v\n",
+			local.Port, announceURL, err)
+		conn, err = net.DialUDP("udp", nil, addr)
 	}
 
-	const (
-		protocolID  = 0x41727101980
-		connPackage = 0x00
-	)
-
-	connectReq := make([]byte, 16)
-	binary.BigEndian.PutUint64(connectReq[0:8], protocolID)
-	binary.BigEndian.PutUint32(connectReq[8:12], connPackage)
-	binary.BigEndian.PutUint32(connectReq[12:16], transactionID)
-
-	log.Printf("[INFO]\tSending Connect to %s, transaction_id: %d\n", addr, transactionID)
-
-	for attempt := 0; attempt < 3; attempt++ {
-		conn.SetDeadline(time.Now().Add(time.Duration(5+attempt*2) * time.Second))
-		_, err = conn.Write(connectReq)
-
-		if err != nil {
-			log.Printf("[FAIL]\tAttempt %d failed to send connect: %v\n", attempt+1, err)
-			continue
-		}
-
-		resp := make([]byte, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial UDP error: %v", err)
+	}
 
-		n, err := conn.Read(resp)
-		if err != nil {
-			log.Printf("[FAIL]\tAttempt %d failed to read connect response: %v\n", attempt+1, err)
-			continue
-		}
+	return conn, addr, nil
+}
 
-		if n < 16 {
-			log.Printf("[ERROR]\tAttempt %d invalid connect response length: %d\n", attempt+1, n)
-			continue
-		}
+// --------------------------------------------------------------------------------------------- //
 
-		action := binary.BigEndian.Uint32(resp[0:4])
+/*
+udpAnnounce performs an announce exchange with a UDP tracker for the given event (see udpRequest).
 
-		if action != 0 {
-			return nil, fmt.Errorf("Invalid connect action: %d\n", action)
-		}
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata such as InfoHash and total size.
+  - ctx: Context bounding the exchange.
+  - announceURL: URL of the UDP tracker to contact.
+  - event: Announce event to report.
 
-		if binary.BigEndian.Uint32(resp[4:8]) != transactionID {
-			return nil, fmt.Errorf("Transaction ID mismatch\n")
-		}
+Returns:
+  - *TrackerResponse: Pointer to the TrackerResponse containing peers and interval.
+  - error: Non-nil if the exchange fails.
+*/
+func (Torrent *TorrentFile) udpAnnounce(ctx context.Context, announceURL string, event AnnounceEvent) (*TrackerResponse, error) {
+	infoHash, err := Torrent.GetInfoHash()
+	if err != nil {
+		return nil, err
+	}
 
-		connectionID := binary.BigEndian.Uint64(resp[8:16])
+	log.Printf("[INFO]\tUDP InfoHash: %x\n", infoHash)
 
-		infoHash, err := Torrent.GetInfoHash()
-		if err != nil {
-			return nil, err
-		}
+	peerID, err := Torrent.PeerID()
+	if err != nil {
+		return nil, err
+	}
 
-		log.Printf("[INFO]\tUDP InfoHash: %x\n", infoHash)
+	downloaded, uploaded, left := Torrent.announceCounters()
 
-		peerID, err := Torrent.GeneratePeerID()
-		if err != nil {
-			return nil, err
-		}
+	const ip = 0
 
-		left, err := Torrent.GetTotalSize()
-		if err != nil {
-			return nil, err
-		}
+	num_want := Torrent.announceNumWant()
+	if num_want <= 0 {
+		num_want = -1
+	}
 
-		const (
-			announce   = 1
-			downloaded = 0
-			uploaded   = 0
-			started    = 2
-			ip         = 0
-			num_want   = -1
-			port       = 6881
-		)
+	resp, addr, err := Torrent.udpRequest(ctx, announceURL, udpActionAnnounce, func(connectionID uint64, transactionID uint32) []byte {
+		log.Printf("[INFO]\tSending Announce to %s: info_hash = %x, peer_id = %s, left = %d\n", announceURL, infoHash, peerID, left)
 
-		announceReq := Torrent.CreateAnnounceRequest(
+		return Torrent.CreateAnnounceRequest(
 			connectionID,
-			announce,
+			udpActionAnnounce,
 			transactionID,
 			infoHash[:],
 			peerID,
 			downloaded,
 			left,
 			uploaded,
-			started,
+			uint32(event),
 			ip,
-			mrand.Uint32(),
+			Torrent.AnnounceKey(),
 			num_want,
-			port,
+			Torrent.Config.announcePort(),
 		)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		log.Printf("[INFO]\tSending Announce to %s: info_hash = %x, peer_id = %s, left = %d\n", addr, infoHash, peerID, left)
-		conn.SetDeadline(time.Now().Add(5 * time.Second))
+	log.Printf("[INFO]\tRaw announce response: %x\n", resp)
 
-		_, err = conn.Write(announceReq)
-		if err != nil {
-			return nil, fmt.Errorf("Sending announce request error: %v\n", err)
-		}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("Invalid announce response length: %d\n", len(resp))
+	}
 
-		resp = make([]byte, 1024)
+	interval := int(binary.BigEndian.Uint32(resp[8:12]))
+	leechers := binary.BigEndian.Uint32(resp[12:16])
+	seeders := binary.BigEndian.Uint32(resp[16:20])
 
-		n, err = conn.Read(resp)
-		if err != nil {
-			return nil, fmt.Errorf("Reading announce response error: %v\n", err)
-		}
+	peers := resp[20:]
+	log.Printf("[INFO]\tRaw peers bytes: %x\n", peers)
 
-		if n < 20 {
-			return nil, fmt.Errorf("Invalid announce response length: %d\n", n)
-		}
+	// Trackers reached over IPv6 answer with 18-byte IPv6 peers (BEP-15)
+	peerSize := 6
+	if addr.IP.To4() == nil {
+		peerSize = 18
+	}
 
-		log.Printf("[INFO]\tRaw announce response: %x\n", resp[:n])
-		action = binary.BigEndian.Uint32(resp[0:4])
+	if len(peers)%peerSize != 0 {
+		return nil, fmt.Errorf("Invalid peers length: %d (must be multiple of %d)\n", len(peers), peerSize)
+	}
 
-		if action == 3 {
-			errorMsg := string(resp[8:n])
-			return nil, fmt.Errorf("Tracker error: %s\n", errorMsg)
-		}
+	log.Printf("[INFO]\tReceived %d peers, leechers: %d, seeders: %d\n", len(peers)/peerSize, leechers, seeders)
 
-		if action != 1 {
-			return nil, fmt.Errorf("Invalid announce action: %d\n", action)
-		}
+	trackerResp := &TrackerResponse{
+		Interval: interval,
+		Seeders:  int(seeders),
+		Leechers: int(leechers),
+	}
 
-		if binary.BigEndian.Uint32(resp[4:8]) != transactionID {
-			return nil, fmt.Errorf("Transaction ID mismatch\n")
-		}
+	if peerSize == 18 {
+		trackerResp.Peers6 = string(peers)
+	} else {
+		trackerResp.Peers = string(peers)
+	}
 
-		interval := int(binary.BigEndian.Uint32(resp[8:12]))
-		leechers := binary.BigEndian.Uint32(resp[12:16])
-		seeders := binary.BigEndian.Uint32(resp[16:20])
+	return trackerResp, nil
+}
 
-		peers := resp[20:n]
-		log.Printf("[INFO]\tRaw peers bytes: %x\n", peers)
+// --------------------------------------------------------------------------------------------- //
 
-		if len(peers)%6 != 0 {
-			return nil, fmt.Errorf("Invalid peers length: %d (must be multiple of 6)\n", len(peers))
-		}
+/*
+SendTrackerResponse aggregates peer information from multiple trackers.
+It contacts both HTTP and UDP trackers, combining their peer lists and selecting the shortest interval.
+Trackers that have not acknowledged a started event yet are sent one; the others get a
+regular announce without an event. It is used for one-off announces such as the first one of
+a download; the periodic re-announces are made per tracker by RefreshPeer's announcer.
 
-		log.Printf("[INFO]\tReceived %d peers, leechers: %d, seeders: %d\n", len(peers)/6, leechers, seeders)
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs and metadata.
 
-		trackerResp := &TrackerResponse{
-			Peers:    string(peers),
-			Interval: interval,
-		}
+Returns:
+  - *TrackerResponse: Pointer to the TrackerResponse with a combined peer list and minimum interval.
+  - error: Non-nil if no trackers are found or no peers are received.
+*/
+func (Torrent *TorrentFile) SendTrackerResponse() (*TrackerResponse, error) {
+	return Torrent.announce(EventNone)
+}
 
-		if trackerResp.Failure != "" {
-			return nil, fmt.Errorf("Tracker failure: %s\n", trackerResp.Failure)
-		}
+// --------------------------------------------------------------------------------------------- //
 
-		return trackerResp, nil
+/*
+AnnounceCompleted tells every usable tracker that the download has finished.
+Each tracker is told at most once; responses are ignored and errors only logged.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to announce for.
+*/
+func (Torrent *TorrentFile) AnnounceCompleted() {
+	_, err := Torrent.announce(EventCompleted)
+	if err != nil {
+		log.Printf("[INFO]\tCompleted announce finished: %v\n", err)
 	}
+}
 
-	return nil, fmt.Errorf("No connect response after 3 attempts\n")
+// --------------------------------------------------------------------------------------------- //
+
+/*
+AnnounceKey returns the key sent with every HTTP and UDP announce. It is chosen once and
+saved in the resume file, so trackers can recognize us as the same client after our IP
+address changes or the client restarts. Zero is never used, since it marks an unset key.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - uint32: Announce key.
+*/
+func (Torrent *TorrentFile) AnnounceKey() uint32 {
+	key := Torrent.announceKey.Load()
+	for key == 0 {
+		Torrent.announceKey.CompareAndSwap(0, randUint32())
+		key = Torrent.announceKey.Load()
+	}
+
+	return key
 }
 
 // --------------------------------------------------------------------------------------------- //
 
 /*
-SendTrackerResponse aggregates peer information from multiple trackers.
-It contacts both HTTP and UDP trackers, combining their peer lists and selecting the shortest interval.
+announceNumWant returns the number of peers to request per announce: the raised number while
+peers are scarce (see nextAnnounceDelay), otherwise Config.NumWant.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - int32: Peers to request (0 leaves it to the tracker).
+*/
+func (Torrent *TorrentFile) announceNumWant() int32 {
+	if numWant := Torrent.numWant.Load(); numWant > 0 {
+		return numWant
+	}
+
+	return int32(max(Torrent.Config.NumWant, 0))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerID returns the "tracker id" a tracker asked us to send back in later announces.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+
+Returns:
+  - string: The tracker id, or "" if the tracker never sent one.
+*/
+func (Torrent *TorrentFile) trackerID(announceURL string) string {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	return Torrent.trackerState(announceURL).TrackerID
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+AnnounceStopped tells every usable tracker that the client is leaving the swarm.
+The announcer started by RefreshPeer is stopped first, so no regular announce follows.
+Only trackers we sent a started event to are told. Responses are ignored; errors are only logged.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to announce for.
+*/
+func (Torrent *TorrentFile) AnnounceStopped() {
+	Torrent.stopAnnouncer()
+
+	_, err := Torrent.announce(EventStopped)
+	if err != nil {
+		log.Printf("[INFO]\tStopped announce finished: %v\n", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announce contacts the torrent's trackers with the given event and merges their peer lists,
+giving up on trackers that have not answered within Config.AnnounceTimeout (see announceAll).
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing tracker URLs and metadata.
+  - event: Announce event to report.
 
 Returns:
   - *TrackerResponse: Pointer to the TrackerResponse with a combined peer list and minimum interval.
   - error: Non-nil if no trackers are found or no peers are received.
 */
-func (Torrent *TorrentFile) SendTrackerResponse() (*TrackerResponse, error) {
-	publicTrackers := []string{
-		"udp://tracker.opentrackr.org:1337/announce",
-		"udp://tracker.torrent.eu.org:451/announce",
-		"udp://open.tracker.cl:1337/announce",
-		"udp://open.stealth.si:80/announce",
-		"udp://tracker.tiny-vps.com:6969/announce",
+func (Torrent *TorrentFile) announce(event AnnounceEvent) (*TrackerResponse, error) {
+	ctx, cancel := Torrent.announceContext()
+	defer cancel()
+
+	return Torrent.announceAll(ctx, event, nil)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceContext returns the context of a one-off announce, ending after Config.AnnounceTimeout.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the config.
+
+Returns:
+  - context.Context: Context to announce under (without deadline if AnnounceTimeout is 0).
+  - context.CancelFunc: Releases the context; must be called.
+*/
+func (Torrent *TorrentFile) announceContext() (context.Context, context.CancelFunc) {
+	if Torrent.Config.AnnounceTimeout <= 0 {
+		return context.WithCancel(context.Background())
 	}
 
-	trackersMap := make(map[string]struct{})
-	if Torrent.Announce != "" {
-		trackersMap[Torrent.Announce] = struct{}{}
+	return context.WithTimeout(context.Background(), Torrent.Config.AnnounceTimeout)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+announceAll contacts the torrent's trackers concurrently and merges their peer lists.
+Regular, started and completed announces follow the tiers of the announce list (BEP-12, see
+announceTiers); stopped announces go to every tracker, as trackerEvent only sends them to
+trackers that were told we started. The event actually sent to each tracker is chosen by
+trackerEvent. Responses are handed to arrived as they come in, so their peers can be dialed
+while slower trackers are still being waited for; once ctx is done the trackers still
+pending are given up on and the responses received so far are merged.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs and metadata.
+  - ctx: Context bounding the announce.
+  - event: Announce event to report.
+  - arrived: Called with every usable response, one at a time (may be nil).
+
+Returns:
+  - *TrackerResponse: Pointer to the TrackerResponse with a combined peer list and minimum interval.
+  - error: Non-nil if no trackers are found or no peers are received.
+*/
+func (Torrent *TorrentFile) announceAll(ctx context.Context, event AnnounceEvent, arrived func(*TrackerResponse)) (*TrackerResponse, error) {
+	trackers := Torrent.trackerURLs()
+	if len(trackers) == 0 {
+		return nil, errNoTrackers
 	}
 
-	for _, tier := range Torrent.AnnounceList {
+	log.Printf("[INFO]\tFound %d unique trackers: %v\n", len(trackers), trackers)
+
+	tiers := Torrent.trackerTiers()
+	if event == EventStopped {
+		tiers = make([][]string, len(trackers))
+		for i, announce := range trackers {
+			tiers[i] = []string{announce}
+		}
+	}
+
+	return Torrent.announceTiers(ctx, tiers, event, arrived)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerURLs returns every tracker of the torrent, Config.DefaultTrackers and Config.ExtraTrackers,
+without duplicates (only the torrent's own trackers for private torrents, see baseTiers).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs.
+
+Returns:
+  - []string: Announce URLs.
+*/
+func (Torrent *TorrentFile) trackerURLs() []string {
+	var trackers []string
+	for _, tier := range Torrent.baseTiers() {
+		trackers = append(trackers, tier...)
+	}
+
+	return trackers
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+baseTiers returns the tracker tiers in metadata order: the tiers of the announce list, or the
+single "announce" URL when there is none, followed by one tier holding Config.DefaultTrackers
+and Config.ExtraTrackers. A URL is kept in its first tier only.
+
+Private torrents (BEP-27) only use their own trackers: announcing them anywhere else, be it
+other trackers, the DHT, PEX or Local Service Discovery, leaks the info hash, which private
+trackers ban users for. The added tier is left out for them here, and every other peer source
+checks Info.Private the same way before use.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs.
+
+Returns:
+  - [][]string: Non-empty tiers of announce URLs.
+*/
+func (Torrent *TorrentFile) baseTiers() [][]string {
+	tiers := Torrent.AnnounceList
+	if len(tiers) == 0 && Torrent.Announce != "" {
+		tiers = [][]string{{Torrent.Announce}}
+	}
+
+	if Torrent.Info.Private != 1 {
+		added := append(append([]string(nil), Torrent.Config.DefaultTrackers...), Torrent.Config.ExtraTrackers...)
+		tiers = append(append([][]string(nil), tiers...), added)
+	}
+
+	seen := make(map[string]bool)
+	var result [][]string
+
+	for _, tier := range tiers {
+		var urls []string
 		for _, announce := range tier {
-			if announce != "" {
-				trackersMap[announce] = struct{}{}
+			if announce != "" && !seen[announce] {
+				seen[announce] = true
+				urls = append(urls, announce)
 			}
 		}
-	}
 
-	for _, tracker := range publicTrackers {
-		trackersMap[tracker] = struct{}{}
+		if len(urls) > 0 {
+			result = append(result, urls)
+		}
 	}
 
-	trackers := make([]string, 0, len(trackersMap))
-	for tracker := range trackersMap {
-		trackers = append(trackers, tracker)
+	return result
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerTiers returns the tiers announceTiers walks through. They are built from baseTiers with
+every tier shuffled once (BEP-12) and then kept, so that promoteTracker's reordering lasts;
+they are rebuilt when the trackers of the torrent change, e.g. after metadata arrives.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing tracker URLs.
+
+Returns:
+  - [][]string: Copy of the current tiers.
+*/
+func (Torrent *TorrentFile) trackerTiers() [][]string {
+	base := Torrent.baseTiers()
+	key := fmt.Sprint(base)
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	if Torrent.tiersKey != key {
+		rngMutex.Lock()
+		for _, tier := range base {
+			rng.Shuffle(len(tier), func(i, j int) { tier[i], tier[j] = tier[j], tier[i] })
+		}
+		rngMutex.Unlock()
+
+		Torrent.tiers = base
+		Torrent.tiersKey = key
 	}
 
-	if len(trackers) == 0 {
-		return nil, fmt.Errorf("No trackers found")
+	tiers := make([][]string, len(Torrent.tiers))
+	for i, tier := range Torrent.tiers {
+		tiers[i] = append([]string(nil), tier...)
 	}
 
-	udpTrackers := []string{}
-	httpTrackers := []string{}
-	for _, tracker := range trackers {
-		if isUDP(tracker) {
-			udpTrackers = append(udpTrackers, tracker)
-		} else if isHTTP(tracker) {
-			httpTrackers = append(httpTrackers, tracker)
+	return tiers
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+promoteTracker moves a tracker that answered to the front of its tier (BEP-12), so the next
+announce tries it first.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tiers.
+  - announceURL: Announce URL of the tracker.
+*/
+func (Torrent *TorrentFile) promoteTracker(announceURL string) {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	for _, tier := range Torrent.tiers {
+		for i, announce := range tier {
+			if announce == announceURL {
+				copy(tier[1:i+1], tier[:i])
+				tier[0] = announceURL
+
+				return
+			}
 		}
 	}
+}
 
-	log.Printf("[INFO]\tFound %d unique trackers: %v\n", len(trackers), trackers)
-	log.Printf("[INFO]\tUDP trackers: %v\n", udpTrackers)
-	log.Printf("[INFO]\tHTTP trackers: %v\n", httpTrackers)
+// --------------------------------------------------------------------------------------------- //
 
-	allPeers := make(map[string]struct{})
-	var finalInterval int
+/*
+announceTiers announces with BEP-12 tier semantics, all tiers at the same time: the trackers
+of a tier are tried one after the other, stopping at the first that answers, which is
+promoted to the front of its tier. Trackers further down a tier are only contacted while
+those before them fail.
 
-	for _, announce := range udpTrackers {
-		log.Printf("[INFO]\tTrying tracker: %s\n", announce)
-		resp, err := Torrent.SendUDPTrackerRequest(announce)
-		if err == nil {
-			log.Printf("[INFO]\tSuccess from UDP tracker %s: %d peers, interval: %d\n", announce, len(resp.Peers)/6, resp.Interval)
-			peers, err := Torrent.ParsePeers(resp.Peers)
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata.
+  - ctx: Context bounding the announce; pending trackers are given up on when it is done.
+  - tiers: Tiers of announce URLs.
+  - event: Announce event to report.
+  - arrived: Called with every usable response as it comes in (may be nil).
 
-			if err != nil {
-				log.Printf("[FAIL]\tFailed to parse peers from %s: %v\n", announce, err)
-				continue
+Returns:
+  - *TrackerResponse: Combined response of the trackers that answered.
+  - error: Non-nil if no tracker answered or they returned no peers.
+*/
+func (Torrent *TorrentFile) announceTiers(
+	ctx context.Context,
+	tiers [][]string,
+	event AnnounceEvent,
+	arrived func(*TrackerResponse),
+) (*TrackerResponse, error) {
+	results := make(chan *TrackerResponse, len(tiers))
+
+	for _, tier := range tiers {
+		go func(tier []string) {
+			for _, announce := range tier {
+				resp, ok := Torrent.announceTracker(ctx, announce, event)
+				if ok {
+					Torrent.promoteTracker(announce)
+					results <- resp
+
+					return
+				}
 			}
 
-			for _, peer := range peers {
-				addr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-				allPeers[addr] = struct{}{}
+			results <- nil
+		}(tier)
+	}
+
+	var responses []*TrackerResponse
+
+	for pending := len(tiers); pending > 0; pending-- {
+		select {
+		case resp := <-results:
+			if resp == nil {
+				continue
 			}
 
-			if finalInterval == 0 || resp.Interval < finalInterval {
-				finalInterval = resp.Interval
+			responses = append(responses, resp)
+			if arrived != nil {
+				arrived(resp)
 			}
 
-		} else {
-			log.Printf("[FAIL]\tUDP tracker %s failed: %v\n", announce, err)
+		case <-ctx.Done():
+			log.Printf("[INFO]\tAnnounce deadline reached, giving up on %d of %d tiers\n", pending, len(tiers))
+			return Torrent.mergeResponses(responses)
 		}
 	}
 
-	for _, announce := range httpTrackers {
-		log.Printf("[INFO]\tTrying tracker: %s\n", announce)
-		resp, err := Torrent.SendHTTPTrackerRequest(announce)
+	return Torrent.mergeResponses(responses)
+}
 
-		if err == nil {
-			log.Printf("[INFO]\tSuccess from HTTP tracker %s: %d peers, interval: %d\n", announce, len(resp.Peers)/6, resp.Interval)
-			peers, err := Torrent.ParsePeers(resp.Peers)
+// --------------------------------------------------------------------------------------------- //
 
-			if err != nil {
-				log.Printf("[FAIL]\tFailed to parse peers from %s: %v\n", announce, err)
-				continue
-			}
+/*
+announceTracker sends one announce over UDP or HTTP and records the result in the tracker's
+state. Trackers that are dead or in backoff are skipped. WebTorrent support is not
+implemented: ws:// and wss:// trackers only hand out WebRTC offers, and the client has no
+WebRTC transport to answer them, so they are never announced to and are marked dead with
+errWebTorrentTracker on first use.
 
-			for _, peer := range peers {
-				addr := fmt.Sprintf("%s:%d", peer.IP, peer.Port)
-				allPeers[addr] = struct{}{}
-			}
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing metadata.
+  - ctx: Context bounding the announce; a cancelled announce is not recorded as a failure.
+  - announce: Announce URL of the tracker.
+  - event: Announce event to report (see trackerEvent).
 
-			if finalInterval == 0 || resp.Interval < finalInterval {
-				finalInterval = resp.Interval
-			}
-		} else {
-			log.Printf("[FAIL]\tHTTP tracker %s failed: %v\n", announce, err)
+Returns:
+  - *TrackerResponse: Response of the tracker.
+  - bool: True if the tracker answered with a usable response.
+*/
+func (Torrent *TorrentFile) announceTracker(ctx context.Context, announce string, event AnnounceEvent) (*TrackerResponse, bool) {
+	if isWebSocket(announce) {
+		Torrent.TrackersMutex.Lock()
+		state := Torrent.trackerState(announce)
+		if state.Status != TrackerDead {
+			state.Status = TrackerDead
+			state.LastError = errWebTorrentTracker.Error()
+			log.Printf("[INFO]\tNot using tracker %s: %v", announce, errWebTorrentTracker)
 		}
+		Torrent.TrackersMutex.Unlock()
+
+		return nil, false
 	}
 
-	if len(allPeers) == 0 {
-		return nil, fmt.Errorf("No peers received from any tracker")
+	if !isUDP(announce) && !isHTTP(announce) {
+		return nil, false
+	}
+
+	trackerEvent, send := Torrent.trackerEvent(announce, event)
+	if !send {
+		return nil, false
 	}
 
-	peerBytes := make([]byte, 0, len(allPeers)*6)
+	if !Torrent.trackerUsable(announce, trackerEvent) {
+		log.Printf("[INFO]\tSkipping tracker %s (backoff, min interval or dead)\n", announce)
+		return nil, false
+	}
 
-	for addr := range allPeers {
-		parts := strings.Split(addr, ":")
-		if len(parts) != 2 {
-			continue
-		}
+	if ctx.Err() != nil {
+		return nil, false
+	}
 
-		ipParts := strings.Split(parts[0], ".")
-		if len(ipParts) != 4 {
-			continue
-		}
+	log.Printf("[INFO]\tTrying tracker: %s\n", announce)
 
-		port, err := strconv.ParseUint(parts[1], 10, 16)
-		if err != nil {
-			continue
-		}
+	kind := "HTTP"
+	var resp *TrackerResponse
+	var err error
 
-		peerBytes = append(peerBytes,
-			byte(atoi(ipParts[0])),
-			byte(atoi(ipParts[1])),
-			byte(atoi(ipParts[2])),
-			byte(atoi(ipParts[3])),
-			byte(port>>8),
-			byte(port&0xFF),
-		)
+	if isUDP(announce) {
+		kind = "UDP"
+		resp, err = Torrent.udpAnnounce(ctx, announce, trackerEvent)
+	} else {
+		resp, err = Torrent.httpAnnounce(ctx, announce, trackerEvent)
 	}
 
-	return &TrackerResponse{
-		Peers:    string(peerBytes),
-		Interval: finalInterval,
-	}, nil
+	if err != nil && ctx.Err() != nil {
+		// Given up on by the caller rather than failed, so the tracker's state is left alone
+		log.Printf("[INFO]\t%s tracker %s abandoned: %v\n", kind, announce, ctx.Err())
+		return nil, false
+	}
+
+	Torrent.recordTrackerResult(announce, trackerEvent, resp, err)
+
+	if err != nil {
+		log.Printf("[FAIL]\t%s tracker %s failed: %v\n", kind, announce, err)
+		Torrent.counters.trackerErrors.Add(1)
+
+		return nil, false
+	}
+
+	log.Printf("[INFO]\tSuccess from %s tracker %s: %d peers, interval: %d\n", kind, announce, resp.peerCount(), resp.Interval)
+
+	if resp.Warning != "" {
+		log.Printf("[INFO]\tWarning from %s tracker %s: %s\n", kind, announce, resp.Warning)
+	}
+
+	_, err = Torrent.responsePeers(resp)
+	if err != nil {
+		log.Printf("[FAIL]\tFailed to parse peers from %s: %v\n", announce, err)
+		return nil, false
+	}
+
+	return resp, true
 }
 
 // --------------------------------------------------------------------------------------------- //
 
 /*
-atoi converts a string to an integer, ignoring errors.
-It is a helper function for parsing IP addresses.
+mergeResponses combines tracker responses into one: the union of their peers, the shortest
+interval, the longest min interval and the largest swarm counts.
 
 Parameters:
-  - s: String to convert to an integer.
+  - Torrent: Pointer to the TorrentFile the responses belong to.
+  - responses: Responses checked by announceTracker.
 
 Returns:
-  - int: The parsed integer, or 0 if parsing fails.
+  - *TrackerResponse: Combined response with compact peer lists.
+  - error: Non-nil if the responses hold no peers.
 */
-func atoi(s string) int {
-	n, _ := strconv.Atoi(s)
-	return n
+func (Torrent *TorrentFile) mergeResponses(responses []*TrackerResponse) (*TrackerResponse, error) {
+	allPeers := make(map[string]struct{})
+	var finalInterval int
+	var finalMinInterval int
+	var finalSeeders, finalLeechers int
+
+	for _, resp := range responses {
+		peers, _ := Torrent.responsePeers(resp)
+
+		for _, peer := range peers {
+			allPeers[peer.ListenAddr()] = struct{}{}
+		}
+
+		if finalInterval == 0 || resp.Interval < finalInterval {
+			finalInterval = resp.Interval
+		}
+
+		if resp.MinInterval > finalMinInterval {
+			finalMinInterval = resp.MinInterval
+		}
+
+		finalSeeders = max(finalSeeders, resp.Seeders)
+		finalLeechers = max(finalLeechers, resp.Leechers)
+	}
+
+	if len(allPeers) == 0 {
+		return nil, fmt.Errorf("No peers received from any tracker")
+	}
+
+	var peerBytes, peerBytes6 []byte
+
+	for addr := range allPeers {
+		encoded, ok := compactPeer(addr)
+		if !ok {
+			continue
+		}
+
+		if len(encoded) == 6 {
+			peerBytes = append(peerBytes, encoded...)
+		} else {
+			peerBytes6 = append(peerBytes6, encoded...)
+		}
+	}
+
+	return &TrackerResponse{
+		Peers:       string(peerBytes),
+		Peers6:      string(peerBytes6),
+		Interval:    finalInterval,
+		MinInterval: finalMinInterval,
+		Seeders:     finalSeeders,
+		Leechers:    finalLeechers,
+	}, nil
 }
 
 // --------------------------------------------------------------------------------------------- //
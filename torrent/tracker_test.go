@@ -0,0 +1,853 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// testInfoHash contains bytes that must be percent-encoded in announces, including a NUL.
+var testInfoHash = [20]byte{0x00, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, ' ', '%', '&', '=', '+', '/', '?', 0xff, 0x80, 0x7f, 0x01}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newTestTorrent returns a single-file torrent of 4 pieces that announces only to the given
+trackers, without public trackers or peer discovery outside them.
+
+Parameters:
+  - trackers: Announce URLs, each in its own tier.
+
+Returns:
+  - *TorrentFile: Torrent ready to announce.
+*/
+func newTestTorrent(trackers ...string) *TorrentFile {
+	Torrent := &TorrentFile{Config: DefaultConfig()}
+	Torrent.Config.DefaultTrackers = nil
+	Torrent.Config.DHT = false
+	Torrent.Config.MinHealthyPeers = 0
+	Torrent.Config.ListenPort = 51413
+
+	Torrent.Info.Name = "test.bin"
+	Torrent.Info.PieceLength = 16384
+	Torrent.Info.Length = 4 * 16384
+	Torrent.Info.Pieces = string(make([]byte, 4*20))
+	Torrent.Info.InfoHash = testInfoHash
+
+	for _, announce := range trackers {
+		Torrent.AnnounceList = append(Torrent.AnnounceList, []string{announce})
+	}
+
+	return Torrent
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fakeHTTPTracker is an in-memory HTTP tracker recording every announce it receives.
+
+Fields:
+  - server: Underlying test server; server.URL + "/announce" is the announce URL.
+  - mutex: Guards the fields below.
+  - queries: Decoded query of every announce, in order.
+  - status: HTTP status to answer with (200 by default).
+  - header: Headers added to every answer.
+  - response: Bencoded dictionary returned with a 200 status.
+*/
+type fakeHTTPTracker struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	queries  []url.Values
+	status   int
+	header   http.Header
+	response map[string]interface{}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newFakeHTTPTracker starts a fakeHTTPTracker returning one compact peer and the given intervals.
+
+Parameters:
+  - t: Test the tracker is closed with.
+  - interval: "interval" of the response, in seconds.
+  - minInterval: "min interval" of the response, in seconds (0 leaves it out).
+
+Returns:
+  - *fakeHTTPTracker: Running tracker.
+*/
+func newFakeHTTPTracker(t *testing.T, interval, minInterval int) *fakeHTTPTracker {
+	tracker := &fakeHTTPTracker{
+		status: http.StatusOK,
+		header: http.Header{},
+		response: map[string]interface{}{
+			"interval": interval,
+			"peers":    string([]byte{10, 0, 0, 1, 0x1a, 0xe1}),
+		},
+	}
+
+	if minInterval > 0 {
+		tracker.response["min interval"] = minInterval
+	}
+
+	tracker.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+
+		tracker.queries = append(tracker.queries, r.URL.Query())
+
+		for name, values := range tracker.header {
+			w.Header()[name] = values
+		}
+
+		if tracker.status != http.StatusOK {
+			w.WriteHeader(tracker.status)
+			return
+		}
+
+		var buf bytes.Buffer
+		bencode.Marshal(&buf, tracker.response)
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(tracker.server.Close)
+
+	return tracker
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// announceURL returns the tracker's announce URL.
+func (Tracker *fakeHTTPTracker) announceURL() string {
+	return Tracker.server.URL + "/announce"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// lastQuery returns the decoded query of the last announce.
+func (Tracker *fakeHTTPTracker) lastQuery(t *testing.T) url.Values {
+	Tracker.mutex.Lock()
+	defer Tracker.mutex.Unlock()
+
+	if len(Tracker.queries) == 0 {
+		t.Fatalf("tracker received no announce")
+	}
+
+	return Tracker.queries[len(Tracker.queries)-1]
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fakeUDPTracker is an in-memory BEP-15 tracker recording the announces it receives.
+
+Fields:
+  - conn: Socket the tracker serves on.
+  - mutex: Guards the fields below.
+  - connects: Number of connect requests received.
+  - announces: Raw announce requests received, in order.
+  - sources: Address each announce was sent from, in order.
+*/
+type fakeUDPTracker struct {
+	conn      *net.UDPConn
+	mutex     sync.Mutex
+	connects  int
+	announces [][]byte
+	sources   []*net.UDPAddr
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// fakeUDPConnectionID is the connection ID handed out by fakeUDPTracker.
+const fakeUDPConnectionID = 0x0123456789abcdef
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+newFakeUDPTracker starts a fakeUDPTracker on a loopback port, answering announces with one
+IPv4 peer, 3 leechers, 2 seeders and an interval of 900 seconds.
+
+Parameters:
+  - t: Test the tracker is closed with.
+
+Returns:
+  - *fakeUDPTracker: Running tracker.
+*/
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	tracker := &fakeUDPTracker{conn: conn}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			req := append([]byte(nil), buf[:n]...)
+			if n < 16 {
+				continue
+			}
+
+			action := binary.BigEndian.Uint32(req[8:12])
+			transactionID := req[12:16]
+
+			var resp []byte
+			switch {
+			case action == udpActionConnect && binary.BigEndian.Uint64(req[0:8]) == udpProtocolID:
+				tracker.mutex.Lock()
+				tracker.connects++
+				tracker.mutex.Unlock()
+
+				resp = binary.BigEndian.AppendUint32(nil, udpActionConnect)
+				resp = append(resp, transactionID...)
+				resp = binary.BigEndian.AppendUint64(resp, fakeUDPConnectionID)
+
+			case action == udpActionAnnounce && n >= 98:
+				tracker.mutex.Lock()
+				tracker.announces = append(tracker.announces, req)
+				tracker.sources = append(tracker.sources, addr)
+				tracker.mutex.Unlock()
+
+				resp = binary.BigEndian.AppendUint32(nil, udpActionAnnounce)
+				resp = append(resp, transactionID...)
+				resp = binary.BigEndian.AppendUint32(resp, 900)
+				resp = binary.BigEndian.AppendUint32(resp, 3)
+				resp = binary.BigEndian.AppendUint32(resp, 2)
+				resp = append(resp, 10, 0, 0, 2, 0x1a, 0xe2)
+
+			default:
+				continue
+			}
+
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	return tracker
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// announceURL returns the tracker's announce URL.
+func (Tracker *fakeUDPTracker) announceURL() string {
+	return "udp://" + Tracker.conn.LocalAddr().String() + "/announce"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// trackerStat returns a copy of a tracker's state.
+func trackerStat(Torrent *TorrentFile, announceURL string) TrackerStat {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	return *Torrent.trackerState(announceURL)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// assertAround fails the test unless got lies within a second of want.
+func assertAround(t *testing.T, name string, got, want time.Time) {
+	t.Helper()
+
+	if diff := got.Sub(want); diff < -time.Second || diff > time.Second {
+		t.Errorf("%s = %v, want about %v (off by %v)", name, got, want, diff)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestHTTPAnnounceQuery(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, 1800, 0)
+	tracker.response["tracker id"] = "abc"
+
+	Torrent := newTestTorrent(tracker.announceURL())
+	Torrent.Config.NumWant = 80
+
+	resp, ok := Torrent.announceTracker(context.Background(), tracker.announceURL(), EventNone)
+	if !ok {
+		t.Fatalf("announce failed: %s", trackerStat(Torrent, tracker.announceURL()).LastError)
+	}
+
+	if resp.Interval != 1800 || resp.peerCount() != 1 {
+		t.Errorf("response interval %d with %d peers, want 1800 with 1", resp.Interval, resp.peerCount())
+	}
+
+	query := tracker.lastQuery(t)
+	peerID, _ := Torrent.PeerID()
+
+	want := map[string]string{
+		"info_hash":  string(testInfoHash[:]),
+		"peer_id":    peerID,
+		"port":       "51413",
+		"uploaded":   "0",
+		"downloaded": "0",
+		"left":       strconv.Itoa(4 * 16384),
+		"key":        fmt.Sprintf("%08X", Torrent.AnnounceKey()),
+		"compact":    "1",
+		"event":      "started",
+		"numwant":    "80",
+	}
+
+	for name, value := range want {
+		if got := query.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	if query.Has("trackerid") {
+		t.Errorf("first announce sent trackerid %q", query.Get("trackerid"))
+	}
+
+	// The tracker acknowledged started, so the next announce has no event but the tracker id
+	_, ok = Torrent.announceTracker(context.Background(), tracker.announceURL(), EventNone)
+	if !ok {
+		t.Fatalf("second announce failed")
+	}
+
+	query = tracker.lastQuery(t)
+	if query.Has("event") {
+		t.Errorf("second announce sent event %q", query.Get("event"))
+	}
+
+	if query.Get("trackerid") != "abc" {
+		t.Errorf("trackerid = %q, want %q", query.Get("trackerid"), "abc")
+	}
+
+	if query.Get("peer_id") != peerID {
+		t.Errorf("peer_id changed from %q to %q", peerID, query.Get("peer_id"))
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestHTTPAnnounceCompactFallback(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, 1800, 0)
+	tracker.response["peers"] = ""
+
+	compactQueries := func() []string {
+		tracker.mutex.Lock()
+		defer tracker.mutex.Unlock()
+
+		var compact []string
+		for _, query := range tracker.queries {
+			compact = append(compact, query.Get("compact"))
+		}
+
+		tracker.queries = nil
+
+		return compact
+	}
+
+	// Stopped announces are never retried
+	Torrent := newTestTorrent(tracker.announceURL())
+
+	_, err := Torrent.httpAnnounce(context.Background(), tracker.announceURL(), EventStopped)
+	if err != nil {
+		t.Fatalf("stopped announce: %v", err)
+	}
+
+	if got := compactQueries(); strings.Join(got, ",") != "1" {
+		t.Errorf("stopped announce sent compact=%v, want only 1", got)
+	}
+
+	// An empty compact=0 answer is retried once, then never for this tracker
+	_, err = Torrent.httpAnnounce(context.Background(), tracker.announceURL(), EventStarted)
+	if err != nil {
+		t.Fatalf("started announce: %v", err)
+	}
+
+	if got := compactQueries(); strings.Join(got, ",") != "1,0" {
+		t.Errorf("first empty announce sent compact=%v, want 1 then 0", got)
+	}
+
+	Torrent.TrackersMutex.Lock()
+	noFallback := Torrent.trackerState(tracker.announceURL()).noFallback
+	Torrent.TrackersMutex.Unlock()
+
+	if !noFallback {
+		t.Errorf("empty compact=0 answer not recorded")
+	}
+
+	_, err = Torrent.httpAnnounce(context.Background(), tracker.announceURL(), EventNone)
+	if err != nil {
+		t.Fatalf("regular announce: %v", err)
+	}
+
+	if got := compactQueries(); strings.Join(got, ",") != "1" {
+		t.Errorf("announce after an empty compact=0 answer sent compact=%v, want only 1", got)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestUDPAnnounceBoundPort(t *testing.T) {
+	trackers := []*fakeUDPTracker{newFakeUDPTracker(t), newFakeUDPTracker(t)}
+	Torrent := newTestTorrent(trackers[0].announceURL(), trackers[1].announceURL())
+	Torrent.Config.BindTrackerPort = true
+
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	Torrent.Config.ListenPort = uint16(probe.LocalAddr().(*net.UDPAddr).Port)
+	probe.Close()
+
+	// Concurrent announces take turns on the port instead of falling back to ephemeral ones
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(tracker *fakeUDPTracker) {
+			defer wg.Done()
+			Torrent.announceTracker(context.Background(), tracker.announceURL(), EventNone)
+		}(trackers[i%2])
+	}
+	wg.Wait()
+
+	for i, tracker := range trackers {
+		tracker.mutex.Lock()
+
+		if len(tracker.sources) != 3 {
+			t.Errorf("tracker %d saw %d announces, want 3", i, len(tracker.sources))
+		}
+
+		for _, source := range tracker.sources {
+			if source.Port != int(Torrent.Config.ListenPort) {
+				t.Errorf("tracker %d got an announce from port %d, want %d", i, source.Port, Torrent.Config.ListenPort)
+			}
+		}
+
+		tracker.mutex.Unlock()
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestUDPAnnounce(t *testing.T) {
+	tracker := newFakeUDPTracker(t)
+	Torrent := newTestTorrent(tracker.announceURL())
+	Torrent.Config.NumWant = 30
+
+	for i := 0; i < 2; i++ {
+		resp, ok := Torrent.announceTracker(context.Background(), tracker.announceURL(), EventNone)
+		if !ok {
+			t.Fatalf("announce %d failed: %s", i+1, trackerStat(Torrent, tracker.announceURL()).LastError)
+		}
+
+		peers, err := Torrent.responsePeers(resp)
+		if err != nil || len(peers) != 1 || peers[0].ListenAddr() != "10.0.0.2:6882" {
+			t.Errorf("announce %d returned peers %v (%v), want 10.0.0.2:6882", i+1, peers, err)
+		}
+
+		if resp.Interval != 900 || resp.Leechers != 3 || resp.Seeders != 2 {
+			t.Errorf("announce %d returned %+v", i+1, resp)
+		}
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	// The connection ID is cached, so only the first announce connects
+	if tracker.connects != 1 || len(tracker.announces) != 2 {
+		t.Fatalf("tracker saw %d connects and %d announces, want 1 and 2", tracker.connects, len(tracker.announces))
+	}
+
+	peerID, _ := Torrent.PeerID()
+
+	for i, req := range tracker.announces {
+		wantEvent := uint32(EventStarted)
+		if i > 0 {
+			wantEvent = uint32(EventNone)
+		}
+
+		switch {
+		case binary.BigEndian.Uint64(req[0:8]) != fakeUDPConnectionID:
+			t.Errorf("announce %d used connection ID %x", i+1, req[0:8])
+		case !bytes.Equal(req[16:36], testInfoHash[:]):
+			t.Errorf("announce %d sent info hash %x", i+1, req[16:36])
+		case string(req[36:56]) != peerID:
+			t.Errorf("announce %d sent peer_id %q, want %q", i+1, req[36:56], peerID)
+		case binary.BigEndian.Uint64(req[64:72]) != 4*16384:
+			t.Errorf("announce %d sent left %d", i+1, binary.BigEndian.Uint64(req[64:72]))
+		case binary.BigEndian.Uint32(req[80:84]) != wantEvent:
+			t.Errorf("announce %d sent event %d, want %d", i+1, binary.BigEndian.Uint32(req[80:84]), wantEvent)
+		case binary.BigEndian.Uint32(req[88:92]) != Torrent.AnnounceKey():
+			t.Errorf("announce %d sent key %x", i+1, req[88:92])
+		case int32(binary.BigEndian.Uint32(req[92:96])) != 30:
+			t.Errorf("announce %d sent num_want %d", i+1, int32(binary.BigEndian.Uint32(req[92:96])))
+		case binary.BigEndian.Uint16(req[96:98]) != 51413:
+			t.Errorf("announce %d sent port %d", i+1, binary.BigEndian.Uint16(req[96:98]))
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAnnounceSchedule(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, 1800, 300)
+	Torrent := newTestTorrent(tracker.announceURL())
+
+	_, ok := Torrent.announceTracker(context.Background(), tracker.announceURL(), EventNone)
+	if !ok {
+		t.Fatalf("announce failed")
+	}
+
+	state := trackerStat(Torrent, tracker.announceURL())
+	if state.Status != TrackerWorking || state.Interval != 1800*time.Second || state.MinInterval != 300*time.Second {
+		t.Fatalf("state after announce: %+v", state)
+	}
+
+	assertAround(t, "NextAnnounce", state.NextAnnounce, state.LastAnnounce.Add(1800*time.Second))
+
+	// Regular announces wait for the min interval, lifecycle events do not
+	if Torrent.trackerUsable(tracker.announceURL(), EventNone) {
+		t.Errorf("regular announce allowed within the min interval")
+	}
+
+	if !Torrent.trackerUsable(tracker.announceURL(), EventCompleted) {
+		t.Errorf("completed announce held back by the min interval")
+	}
+
+	Torrent.scheduleTracker(tracker.announceURL(), time.Second)
+	assertAround(t, "rescheduled NextAnnounce", trackerStat(Torrent, tracker.announceURL()).NextAnnounce,
+		state.LastAnnounce.Add(300*time.Second))
+
+	Torrent.announceSoon()
+	assertAround(t, "NextAnnounce after announceSoon", trackerStat(Torrent, tracker.announceURL()).NextAnnounce,
+		state.LastAnnounce.Add(300*time.Second))
+
+	due, listed := Torrent.trackerDue(tracker.announceURL())
+	if !listed || due < 299*time.Second {
+		t.Errorf("trackerDue = %v, %v; want about 300s, true", due, listed)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAnnounceScarcePeers(t *testing.T) {
+	Torrent := newTestTorrent()
+	Torrent.Config.MinHealthyPeers = 10
+	resp := &TrackerResponse{Interval: 1800, MinInterval: 30}
+
+	wantNumWant := []int32{50, 100, 200, 200}
+	for i, want := range wantNumWant {
+		if delay := Torrent.nextAnnounceDelay(resp); delay != 2*time.Minute {
+			t.Errorf("scarce announce %d delayed %v, want 2m", i+1, delay)
+		}
+
+		if got := Torrent.announceNumWant(); got != want {
+			t.Errorf("scarce announce %d asks for %d peers, want %d", i+1, got, want)
+		}
+	}
+
+	Torrent.counters.connectedPeers.Store(10)
+
+	if delay := Torrent.nextAnnounceDelay(resp); delay != 1800*time.Second {
+		t.Errorf("healthy announce delayed %v, want 30m", delay)
+	}
+
+	if got := Torrent.announceNumWant(); got != 0 {
+		t.Errorf("healthy announce asks for %d peers, want 0", got)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAnnounceBackoff(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, 1800, 0)
+	tracker.response = map[string]interface{}{"failure reason": "unregistered torrent"}
+
+	Torrent := newTestTorrent(tracker.announceURL())
+	announce := tracker.announceURL()
+
+	for failures := 1; failures <= 3; failures++ {
+		before := time.Now()
+
+		_, ok := Torrent.announceTracker(context.Background(), announce, EventNone)
+		if ok {
+			t.Fatalf("announce %d succeeded", failures)
+		}
+
+		state := trackerStat(Torrent, announce)
+		if state.Status != TrackerFailing || state.Failures != failures {
+			t.Fatalf("state after failure %d: %+v", failures, state)
+		}
+
+		retry := trackerRetryBase << (failures - 1)
+		assertAround(t, "RetryAt", state.RetryAt, before.Add(retry))
+		assertAround(t, "NextAnnounce", state.NextAnnounce, before.Add(retry))
+
+		// Failing trackers are skipped until RetryAt, even for lifecycle events
+		if Torrent.trackerUsable(announce, EventStarted) {
+			t.Errorf("failing tracker usable before RetryAt")
+		}
+
+		Torrent.TrackersMutex.Lock()
+		Torrent.trackerState(announce).RetryAt = time.Now().Add(-time.Second)
+		Torrent.TrackersMutex.Unlock()
+	}
+
+	tracker.mutex.Lock()
+	tracker.status = http.StatusServiceUnavailable
+	tracker.header.Set("Retry-After", "7200")
+	tracker.mutex.Unlock()
+
+	before := time.Now()
+	Torrent.announceTracker(context.Background(), announce, EventNone)
+
+	state := trackerStat(Torrent, announce)
+	if state.Status != TrackerBackoff || state.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("state after 503: %+v", state)
+	}
+
+	assertAround(t, "RetryAt after 503", state.RetryAt, before.Add(2*time.Hour))
+
+	Torrent.TrackersMutex.Lock()
+	Torrent.trackerState(announce).RetryAt = time.Now().Add(-time.Second)
+	Torrent.TrackersMutex.Unlock()
+
+	tracker.mutex.Lock()
+	tracker.status = http.StatusGone
+	tracker.mutex.Unlock()
+
+	Torrent.announceTracker(context.Background(), announce, EventNone)
+
+	if _, listed := Torrent.trackerDue(announce); listed {
+		t.Errorf("tracker answering 410 still scheduled: %+v", trackerStat(Torrent, announce))
+	}
+
+	// A success ends the backoff and resets the streak
+	Torrent.TrackersMutex.Lock()
+	Torrent.trackerState(announce).Status = TrackerFailing
+	Torrent.trackerState(announce).RetryAt = time.Time{}
+	Torrent.TrackersMutex.Unlock()
+
+	tracker.mutex.Lock()
+	tracker.status = http.StatusOK
+	tracker.response = map[string]interface{}{"interval": 60, "peers": string([]byte{10, 0, 0, 1, 0x1a, 0xe1})}
+	tracker.mutex.Unlock()
+
+	_, ok := Torrent.announceTracker(context.Background(), announce, EventNone)
+	state = trackerStat(Torrent, announce)
+	if !ok || state.Status != TrackerWorking || state.streak != 0 || !state.RetryAt.IsZero() {
+		t.Errorf("state after recovering: %+v", state)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestAnnounceTiers(t *testing.T) {
+	failing := newFakeHTTPTracker(t, 1800, 0)
+	failing.status = http.StatusInternalServerError
+
+	working := newFakeHTTPTracker(t, 1800, 0)
+	other := newFakeHTTPTracker(t, 1800, 0)
+
+	Torrent := newTestTorrent()
+	Torrent.AnnounceList = [][]string{{failing.announceURL(), working.announceURL()}, {other.announceURL()}}
+
+	// Pin the order the tier is tried in, as trackerTiers shuffles it once
+	Torrent.trackerTiers()
+	Torrent.TrackersMutex.Lock()
+	Torrent.tiers[0] = []string{failing.announceURL(), working.announceURL()}
+	Torrent.TrackersMutex.Unlock()
+
+	resp, err := Torrent.announce(EventNone)
+	if err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+
+	// Both trackers return the same peer
+	if resp.peerCount() != 1 {
+		t.Errorf("merged response has %d peers, want 1", resp.peerCount())
+	}
+
+	for _, tracker := range []*fakeHTTPTracker{failing, working, other} {
+		tracker.mutex.Lock()
+		count := len(tracker.queries)
+		tracker.mutex.Unlock()
+
+		if count != 1 {
+			t.Errorf("tracker %s received %d announces, want 1", tracker.announceURL(), count)
+		}
+	}
+
+	// The tracker that answered moves to the front of its tier, and the one behind it stands by
+	if tiers := Torrent.trackerTiers(); tiers[0][0] != working.announceURL() {
+		t.Errorf("first tier is %v, want %s first", tiers[0], working.announceURL())
+	}
+
+	if Torrent.trackerActive(failing.announceURL()) {
+		t.Errorf("tracker behind a working one is active")
+	}
+
+	if !Torrent.trackerActive(other.announceURL()) {
+		t.Errorf("only tracker of its tier is not active")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestBaseTiers(t *testing.T) {
+	Torrent := newTestTorrent("http://own.example/announce")
+
+	// Spare capacity would let an in-place append overwrite what comes after the defaults
+	defaults := make([]string, 1, 4)
+	defaults[0] = "udp://default.example:6969"
+	backing := defaults[:cap(defaults)]
+
+	Torrent.Config.DefaultTrackers = defaults
+	Torrent.Config.ExtraTrackers = []string{"http://extra.example/announce"}
+
+	want := [][]string{{"http://own.example/announce"}, {"udp://default.example:6969", "http://extra.example/announce"}}
+	if got := Torrent.baseTiers(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("tiers %v, want %v", got, want)
+	}
+
+	if backing[1] != "" || len(Torrent.Config.DefaultTrackers) != 1 {
+		t.Errorf("baseTiers modified Config.DefaultTrackers: %q", backing)
+	}
+
+	Torrent.Info.Private = 1
+
+	if got := Torrent.trackerURLs(); !slices.Equal(got, []string{"http://own.example/announce"}) {
+		t.Errorf("trackers of a private torrent %v", got)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestTrackerActivePeerPoor(t *testing.T) {
+	const (
+		first  = "http://first.example/announce"
+		second = "http://second.example/announce"
+		third  = "udp://third.example:6969/announce"
+	)
+
+	Torrent := newTestTorrent()
+	Torrent.AnnounceList = [][]string{{first, second, third}}
+
+	Torrent.trackerTiers()
+	Torrent.TrackersMutex.Lock()
+	Torrent.tiers[0] = []string{first, second, third}
+	*Torrent.trackerState(first) = TrackerStat{URL: first, Status: TrackerWorking, Yield: 3, peerPoor: true}
+	Torrent.TrackersMutex.Unlock()
+
+	active := func() []bool {
+		return []bool{Torrent.trackerActive(first), Torrent.trackerActive(second), Torrent.trackerActive(third)}
+	}
+
+	// With enough peers the working tracker holds the tier alone
+	if got := active(); !slices.Equal(got, []bool{true, false, false}) {
+		t.Errorf("active with enough peers = %v", got)
+	}
+
+	// While peers are scarce the next tracker of the tier is asked as well
+	Torrent.numWant.Store(100)
+
+	if got := active(); !slices.Equal(got, []bool{true, true, false}) {
+		t.Errorf("active while scarce = %v", got)
+	}
+
+	// Among the trackers standing by, the one that returned the most peers goes first
+	Torrent.TrackersMutex.Lock()
+	*Torrent.trackerState(second) = TrackerStat{URL: second, Status: TrackerWorking, Yield: 10}
+	*Torrent.trackerState(third) = TrackerStat{URL: third, Status: TrackerWorking, Yield: 40}
+	Torrent.TrackersMutex.Unlock()
+
+	if got := active(); !slices.Equal(got, []bool{true, false, true}) {
+		t.Errorf("active by yield = %v", got)
+	}
+
+	// Failed trackers are passed over, and retried once all of the tier failed
+	Torrent.TrackersMutex.Lock()
+	for _, announce := range []string{first, second, third} {
+		Torrent.trackerState(announce).Status = TrackerFailing
+	}
+	Torrent.TrackersMutex.Unlock()
+
+	if got := active(); !slices.Equal(got, []bool{true, true, true}) {
+		t.Errorf("active with every tracker failing = %v", got)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestWebTorrentTrackerDead(t *testing.T) {
+	Torrent := newTestTorrent("wss://tracker.example")
+
+	for i := 0; i < 2; i++ {
+		_, ok := Torrent.announceTracker(context.Background(), "wss://tracker.example", EventStarted)
+		if ok {
+			t.Fatalf("announce to a WebTorrent tracker succeeded")
+		}
+	}
+
+	stat := trackerStat(Torrent, "wss://tracker.example")
+	if stat.Status != TrackerDead || stat.LastError != errWebTorrentTracker.Error() {
+		t.Errorf("WebTorrent tracker state %v %q, want dead with errWebTorrentTracker", stat.Status, stat.LastError)
+	}
+
+	if _, due := Torrent.trackerDue("wss://tracker.example"); due {
+		t.Errorf("WebTorrent tracker still scheduled for announces")
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+func TestTrackerSources(t *testing.T) {
+	tracker := newFakeHTTPTracker(t, 900, 0)
+
+	announceOnly := newTestTorrent()
+	announceOnly.Announce = tracker.announceURL()
+
+	listOnly := newTestTorrent(tracker.announceURL())
+
+	for name, Torrent := range map[string]*TorrentFile{"announce only": announceOnly, "announce-list only": listOnly} {
+		if got := Torrent.trackerURLs(); !slices.Equal(got, []string{tracker.announceURL()}) {
+			t.Errorf("%s: trackers %v", name, got)
+		}
+
+		response, err := Torrent.SendTrackerResponse()
+		if err != nil || response == nil {
+			t.Errorf("%s: announce = %v, %v", name, response, err)
+		}
+	}
+
+	// Without any tracker the error says so, unless the DHT can be used instead
+	none := newTestTorrent()
+
+	_, err := none.SendTrackerResponse()
+	if !errors.Is(err, errNoTrackers) {
+		t.Errorf("announce without trackers = %v, want errNoTrackers", err)
+	}
+
+	_, err = FindConnections(none)
+	if err == nil || !strings.Contains(err.Error(), "DHT is disabled") {
+		t.Errorf("FindConnections without trackers = %v", err)
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
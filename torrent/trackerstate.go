@@ -0,0 +1,520 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+TrackerStatus describes the health of a single tracker as seen by the client.
+
+Values:
+  - TrackerUnknown: The tracker has not been contacted yet.
+  - TrackerWorking: The last announce succeeded.
+  - TrackerFailing: The last announce failed with a transient error; it is retried at RetryAt.
+  - TrackerBackoff: The tracker asked us to slow down (429/503); it is skipped until RetryAt.
+  - TrackerDead: The tracker returned a permanent error (e.g. 410 Gone) and is no longer contacted.
+*/
+type TrackerStatus int
+
+const (
+	TrackerUnknown TrackerStatus = iota
+	TrackerWorking
+	TrackerFailing
+	TrackerBackoff
+	TrackerDead
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+String returns a human-readable name for the tracker status.
+
+Returns:
+  - string: Lowercase status name.
+*/
+func (Status TrackerStatus) String() string {
+	switch Status {
+	case TrackerWorking:
+		return "working"
+	case TrackerFailing:
+		return "failing"
+	case TrackerBackoff:
+		return "backoff"
+	case TrackerDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+TrackerStat is the per-tracker state reported by TrackerStats.
+
+Fields:
+  - URL: Announce URL of the tracker.
+  - Status: Current health of the tracker.
+  - LastError: Message of the last failure (empty after a success).
+  - Warning: Warning message of the last successful announce (empty if none).
+  - TrackerID: "tracker id" the tracker sent last, echoed in later HTTP announces.
+  - StatusCode: HTTP status code of the last failed HTTP announce (0 if not applicable).
+  - RetryAt: Earliest time the tracker may be contacted again while failing or in backoff.
+  - Successes: Number of successful announces.
+  - Failures: Number of failed announces.
+  - Seeders: Seeders reported by the last successful announce.
+  - Leechers: Leechers reported by the last successful announce.
+  - Peers: Peers returned by the last successful announce.
+  - Yield: Running average of the peers returned per successful announce; the tracker of a
+    tier with the highest yield is the one announced to (see trackerActive).
+  - LastAnnounce: Time of the last successful announce.
+  - Interval: Regular announce interval requested by the tracker.
+  - MinInterval: Minimum time the tracker wants between two announces (0 if not given).
+  - NextAnnounce: Time the announcer will next contact the tracker.
+  - streak: Number of consecutive failed announces, for the exponential backoff.
+  - peerPoor: The last announce returned far fewer peers than we asked for.
+  - started: The tracker acknowledged a started event and has not been sent stopped since.
+  - completed: The tracker acknowledged a completed event.
+  - noFallback: A compact=0 retry returned no peers either, so it is not tried again.
+*/
+type TrackerStat struct {
+	URL          string
+	Status       TrackerStatus
+	LastError    string
+	Warning      string
+	TrackerID    string
+	StatusCode   int
+	RetryAt      time.Time
+	Successes    int
+	Failures     int
+	Seeders      int
+	Leechers     int
+	Peers        int
+	Yield        float64
+	LastAnnounce time.Time
+	Interval     time.Duration
+	MinInterval  time.Duration
+	NextAnnounce time.Time
+	streak       int
+	peerPoor     bool
+	started      bool
+	completed    bool
+	noFallback   bool
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+TrackerHTTPError is returned when an HTTP tracker answers with a non-200 status code.
+
+Fields:
+  - StatusCode: HTTP status code returned by the tracker.
+  - RetryAfter: Delay requested by the Retry-After header (0 if absent).
+*/
+type TrackerHTTPError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Error implements the error interface.
+
+Returns:
+  - string: Description including the status code.
+*/
+func (Err *TrackerHTTPError) Error() string {
+	return fmt.Sprintf("Tracker status code error: %d %s", Err.StatusCode, http.StatusText(Err.StatusCode))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Permanent reports whether the status code means the tracker will never accept our announces.
+
+Returns:
+  - bool: True for 401, 403, 404, and 410.
+*/
+func (Err *TrackerHTTPError) Permanent() bool {
+	switch Err.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+
+	return false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+RateLimited reports whether the tracker asked us to back off.
+
+Returns:
+  - bool: True for 429 and 503.
+*/
+func (Err *TrackerHTTPError) RateLimited() bool {
+	return Err.StatusCode == http.StatusTooManyRequests || Err.StatusCode == http.StatusServiceUnavailable
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+parseRetryAfter parses a Retry-After header value.
+Both the delay-seconds and HTTP-date forms are accepted.
+
+Parameters:
+  - value: Raw header value.
+
+Returns:
+  - time.Duration: Requested delay, or 0 if the header is absent or malformed.
+*/
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	date, err := http.ParseTime(value)
+	if err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// trackerRetryBase is the delay before retrying a tracker after its first failed announce; it
+// doubles with every further failure up to trackerRetryMax.
+const (
+	trackerRetryBase = time.Minute
+	trackerRetryMax  = time.Hour
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerRetryDelay computes the exponential backoff after a number of consecutive failures.
+
+Parameters:
+  - failures: Consecutive failed announces (at least 1).
+
+Returns:
+  - time.Duration: trackerRetryBase doubled for every failure after the first, at most trackerRetryMax.
+*/
+func trackerRetryDelay(failures int) time.Duration {
+	delay := trackerRetryBase
+	for i := 1; i < failures && delay < trackerRetryMax; i++ {
+		delay *= 2
+	}
+
+	return min(delay, trackerRetryMax)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerState returns the state entry for a tracker, creating it on first use.
+It must be called with Torrent.TrackersMutex held.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+
+Returns:
+  - *TrackerStat: Mutable state entry for the tracker.
+*/
+func (Torrent *TorrentFile) trackerState(announceURL string) *TrackerStat {
+	if Torrent.trackers == nil {
+		Torrent.trackers = make(map[string]*TrackerStat)
+	}
+
+	state, ok := Torrent.trackers[announceURL]
+	if !ok {
+		state = &TrackerStat{URL: announceURL}
+		Torrent.trackers[announceURL] = state
+	}
+
+	return state
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerUsable reports whether a tracker may be announced to right now.
+Dead trackers are never used and failing trackers or trackers in backoff are skipped until
+RetryAt. Regular announces are also held back until the tracker's min interval has passed
+since the last successful one; started, completed and stopped events are not.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+  - event: Event that would be sent.
+
+Returns:
+  - bool: True if the tracker should be contacted.
+*/
+func (Torrent *TorrentFile) trackerUsable(announceURL string, event AnnounceEvent) bool {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	state := Torrent.trackerState(announceURL)
+	now := time.Now()
+
+	switch state.Status {
+	case TrackerDead:
+		return false
+	case TrackerFailing, TrackerBackoff:
+		if now.Before(state.RetryAt) {
+			return false
+		}
+	}
+
+	return event != EventNone || !now.Before(state.LastAnnounce.Add(state.MinInterval))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerEvent chooses the event to send to one tracker so that every tracker sees the BEP-3
+sequence: started on the first announce, then no event, completed at most once, and stopped
+only if it was told we started.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+  - event: Event requested by the caller (EventNone or EventStarted for regular announces).
+
+Returns:
+  - AnnounceEvent: Event to send.
+  - bool: False if nothing should be sent to this tracker.
+*/
+func (Torrent *TorrentFile) trackerEvent(announceURL string, event AnnounceEvent) (AnnounceEvent, bool) {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	state := Torrent.trackerState(announceURL)
+
+	switch {
+	case event == EventStopped:
+		return EventStopped, state.started
+	case !state.started:
+		return EventStarted, true
+	case event == EventCompleted && !state.completed:
+		return EventCompleted, true
+	default:
+		return EventNone, true
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+recordTrackerResult updates a tracker's state after an announce.
+Failed trackers are retried with an exponential backoff (see trackerRetryDelay). Rate-limited
+HTTP errors put the tracker into backoff for at least the requested delay, permanent ones
+mark it dead.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - announceURL: Announce URL of the tracker.
+  - event: Event that was sent.
+  - resp: Response of a successful announce, for the swarm counts.
+  - err: Result of the announce (nil on success).
+*/
+func (Torrent *TorrentFile) recordTrackerResult(announceURL string, event AnnounceEvent, resp *TrackerResponse, err error) {
+	const (
+		defaultBackoff = 5 * time.Minute
+		defaultNumWant = 50
+		yieldWeight    = 0.3
+	)
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	state := Torrent.trackerState(announceURL)
+
+	if err == nil {
+		state.Status = TrackerWorking
+		state.LastError = ""
+		state.StatusCode = 0
+		state.RetryAt = time.Time{}
+		state.streak = 0
+		state.Successes++
+
+		if resp != nil {
+			state.Seeders = resp.Seeders
+			state.Leechers = resp.Leechers
+			state.Peers = resp.peerCount()
+			state.Warning = resp.Warning
+
+			if resp.TrackerID != "" {
+				state.TrackerID = resp.TrackerID
+			}
+			state.LastAnnounce = time.Now()
+			state.Interval = time.Duration(resp.Interval) * time.Second
+			state.MinInterval = time.Duration(resp.MinInterval) * time.Second
+			state.NextAnnounce = state.LastAnnounce.Add(announceInterval(resp))
+
+			if state.Successes == 1 {
+				state.Yield = float64(state.Peers)
+			} else {
+				state.Yield += yieldWeight * (float64(state.Peers) - state.Yield)
+			}
+
+			numWant := int(Torrent.announceNumWant())
+			if numWant <= 0 {
+				numWant = defaultNumWant
+			}
+
+			state.peerPoor = state.Peers*4 < numWant
+		}
+
+		Torrent.emit(Event{Type: TrackerAnnounced, Piece: -1, Tracker: announceURL})
+
+		switch event {
+		case EventStarted:
+			state.started = true
+		case EventCompleted:
+			state.completed = true
+		case EventStopped:
+			state.started = false
+		}
+
+		return
+	}
+
+	state.Status = TrackerFailing
+	state.LastError = err.Error()
+	state.StatusCode = 0
+	state.Failures++
+	state.streak++
+
+	backoff := trackerRetryDelay(state.streak)
+	state.RetryAt = time.Now().Add(backoff)
+
+	var httpErr *TrackerHTTPError
+	if errors.As(err, &httpErr) {
+		state.StatusCode = httpErr.StatusCode
+
+		switch {
+		case httpErr.Permanent():
+			state.Status = TrackerDead
+
+		case httpErr.RateLimited():
+			delay := httpErr.RetryAfter
+			if delay <= 0 {
+				delay = defaultBackoff
+			}
+
+			state.Status = TrackerBackoff
+			state.RetryAt = time.Now().Add(max(delay, backoff))
+		}
+	}
+
+	state.NextAnnounce = state.RetryAt
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+nextTrackerRetry returns how long RefreshPeer waits after no tracker answered: until the first
+tracker that is not dead may be announced to again, but at least trackerRetryFloor.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+
+Returns:
+  - time.Duration: Delay before the next announce attempt (trackerRetryBase if no tracker is known).
+*/
+func (Torrent *TorrentFile) nextTrackerRetry() time.Duration {
+	const trackerRetryFloor = 15 * time.Second
+
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	now := time.Now()
+	delay := time.Duration(-1)
+
+	for _, state := range Torrent.trackers {
+		if state.Status == TrackerDead {
+			continue
+		}
+
+		wait := max(state.RetryAt.Sub(now), state.LastAnnounce.Add(state.MinInterval).Sub(now), trackerRetryFloor)
+		if delay < 0 || wait < delay {
+			delay = wait
+		}
+	}
+
+	if delay < 0 {
+		return trackerRetryBase
+	}
+
+	return delay
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+TrackerStats returns a snapshot of the state of every tracker contacted so far,
+sorted by URL.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+
+Returns:
+  - []TrackerStat: Copy of the per-tracker state.
+*/
+func (Torrent *TorrentFile) TrackerStats() []TrackerStat {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	stats := make([]TrackerStat, 0, len(Torrent.trackers))
+	for _, state := range Torrent.trackers {
+		stats = append(stats, *state)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].URL < stats[j].URL
+	})
+
+	return stats
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+restoreTrackerStats replaces the per-tracker state with a previously saved snapshot,
+so dead trackers and pending backoffs survive a restart.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile owning the tracker state.
+  - stats: Snapshot as returned by TrackerStats.
+*/
+func (Torrent *TorrentFile) restoreTrackerStats(stats []TrackerStat) {
+	Torrent.TrackersMutex.Lock()
+	defer Torrent.TrackersMutex.Unlock()
+
+	Torrent.trackers = make(map[string]*TrackerStat, len(stats))
+	for _, stat := range stats {
+		state := stat
+		Torrent.trackers[stat.URL] = &state
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// trackerTimeout bounds a single HTTP tracker request (announce or scrape).
+const trackerTimeout = 15 * time.Second
+
+// --------------------------------------------------------------------------------------------- //
+
+// trackerTransports holds one HTTP transport per Config.TrackerTLS in use, so that announces
+// with the same TLS settings share connections the way those using the defaults do.
+var (
+	trackerTransports      = make(map[*tls.Config]*http.Transport)
+	trackerTransportsMutex sync.Mutex
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+LoadTrackerTLS builds the TLS settings of HTTPS trackers for Config.TrackerTLS.
+The CA bundle is added to the system roots rather than replacing them, so public HTTPS
+trackers keep working alongside a private tracker using an internal CA.
+
+Parameters:
+  - caFile: PEM file of additional trusted CA certificates ("" for the system roots only).
+  - certFile: PEM file of the client certificate ("" for none).
+  - keyFile: PEM file of the client certificate's private key ("" if certFile holds it too).
+  - insecure: Accept any server certificate. This defeats HTTPS and is only meant for testing
+    trackers with self-signed certificates; adding the certificate as CA is the safe way.
+
+Returns:
+  - *tls.Config: The TLS settings.
+  - error: Non-nil if a file cannot be read or holds no usable certificate or key.
+*/
+func LoadTrackerTLS(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Reading tracker CA bundle: %v\n", err)
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("Tracker CA bundle %s holds no PEM certificate\n", caFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" {
+			return nil, fmt.Errorf("Tracker client key %s given without a certificate\n", keyFile)
+		}
+
+		if keyFile == "" {
+			keyFile = certFile
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Loading tracker client certificate %s: %v\n", certFile, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if insecure {
+		log.Printf("[INFO]\tHTTPS tracker certificates are not verified\n")
+	}
+
+	return config, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+trackerClient returns the HTTP client for tracker announces and scrapes. With
+Config.TrackerTLS set, its requests use a transport configured with those TLS settings.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the config.
+
+Returns:
+  - *http.Client: Client with trackerTimeout as timeout.
+*/
+func (Torrent *TorrentFile) trackerClient() *http.Client {
+	client := &http.Client{Timeout: trackerTimeout}
+
+	config := Torrent.Config.TrackerTLS
+	if config == nil {
+		return client
+	}
+
+	trackerTransportsMutex.Lock()
+	defer trackerTransportsMutex.Unlock()
+
+	transport, ok := trackerTransports[config]
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		trackerTransports[config] = transport
+	}
+
+	client.Transport = transport
+
+	return client
+}
+
+// --------------------------------------------------------------------------------------------- //
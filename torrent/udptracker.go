@@ -0,0 +1,303 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// udpProtocolID is the magic constant of BEP-15 connect requests; the udpAction constants are
+// the actions of requests and responses.
+const (
+	udpProtocolID     = 0x41727101980
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// udpConnectionTTL is how long a connection ID may be used after it was received (BEP-15), and
+// udpBaseTimeout the wait for a response before the first retransmission.
+const (
+	udpConnectionTTL = time.Minute
+	udpBaseTimeout   = 15 * time.Second
+)
+
+// udpMaxResponse is the size of the buffer UDP tracker responses are read into.
+const udpMaxResponse = 8192
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+udpConnection is a connection ID received from a UDP tracker.
+
+Fields:
+  - id: Connection ID to put in announce and scrape requests.
+  - expires: Time after which a new one must be requested.
+*/
+type udpConnection struct {
+	id      uint64
+	expires time.Time
+}
+
+// udpConnections caches connection IDs by tracker address. Trackers tie them to our IP address,
+// not to a torrent or a socket, so all torrents share them.
+var (
+	udpConnections      = make(map[string]udpConnection)
+	udpConnectionsMutex sync.Mutex
+)
+
+// boundUDPSlot is held by the UDP tracker exchange sending from Config.ListenPort: only one
+// socket can be bound to the port at a time, so with Config.BindTrackerPort they take turns.
+var boundUDPSlot = make(chan struct{}, 1)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+cachedUDPConnection returns the connection ID of a tracker if it is still valid.
+
+Parameters:
+  - addr: Resolved tracker address ("ip:port").
+
+Returns:
+  - uint64: Connection ID.
+  - bool: False if there is none or it expired.
+*/
+func cachedUDPConnection(addr string) (uint64, bool) {
+	udpConnectionsMutex.Lock()
+	defer udpConnectionsMutex.Unlock()
+
+	connection, ok := udpConnections[addr]
+	if !ok || !time.Now().Before(connection.expires) {
+		delete(udpConnections, addr)
+		return 0, false
+	}
+
+	return connection.id, true
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+storeUDPConnection caches a connection ID a tracker just sent for udpConnectionTTL.
+
+Parameters:
+  - addr: Resolved tracker address ("ip:port").
+  - id: Connection ID.
+*/
+func storeUDPConnection(addr string, id uint64) {
+	udpConnectionsMutex.Lock()
+	udpConnections[addr] = udpConnection{id: id, expires: time.Now().Add(udpConnectionTTL)}
+	udpConnectionsMutex.Unlock()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+forgetUDPConnection drops the cached connection ID of a tracker, so the next request connects
+again.
+
+Parameters:
+  - addr: Resolved tracker address ("ip:port").
+*/
+func forgetUDPConnection(addr string) {
+	udpConnectionsMutex.Lock()
+	delete(udpConnections, addr)
+	udpConnectionsMutex.Unlock()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+readUDPResponse waits for the tracker's response to a request. Packets carrying another
+transaction ID, such as late answers to an earlier request, are skipped rather than treated
+as errors.
+
+Parameters:
+  - ctx: Context bounding the exchange; udpRequest interrupts the read when it is done.
+  - conn: Socket connected to the tracker.
+  - transactionID: Transaction ID of the request.
+  - timeout: Time to wait for the response.
+
+Returns:
+  - []byte: The response, at least 8 bytes long.
+  - error: Non-nil if no matching response arrived in time or ctx is done.
+*/
+func readUDPResponse(ctx context.Context, conn *net.UDPConn, transactionID uint32, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	conn.SetReadDeadline(deadline)
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	buf := make([]byte, udpMaxResponse)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			log.Printf("[INFO]\tIgnoring UDP tracker packet of %d bytes for another transaction\n", n)
+			continue
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+udpRequest performs a BEP-15 request (announce or scrape) with a UDP tracker. A connect
+exchange is only made when no valid connection ID is cached for the tracker. Unanswered
+requests are retransmitted up to Config.UDPTrackerRetries times, the n-th retransmission
+after waiting 15·2^n seconds; a tracker rejecting a cached connection ID is connected to again.
+The exchange is abandoned as soon as ctx is done. With Config.BindTrackerPort, exchanges
+of all torrents are serialized so each can bind ListenPort (see boundUDPSlot).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - ctx: Context bounding the exchange.
+  - announceURL: URL of the UDP tracker to contact.
+  - action: Action of the request, and of the response expected.
+  - build: Builds the request from a connection ID and transaction ID.
+
+Returns:
+  - []byte: The tracker's response.
+  - *net.UDPAddr: Resolved tracker address.
+  - error: Non-nil if the tracker cannot be reached, answers with an error or a malformed response.
+*/
+func (Torrent *TorrentFile) udpRequest(
+	ctx context.Context,
+	announceURL string,
+	action uint32,
+	build func(connectionID uint64, transactionID uint32) []byte,
+) ([]byte, *net.UDPAddr, error) {
+	if Torrent.Config.BindTrackerPort {
+		select {
+		case boundUDPSlot <- struct{}{}:
+			defer func() { <-boundUDPSlot }()
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	conn, addr, err := Torrent.dialUDPTracker(announceURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	interrupt := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer interrupt()
+
+	key := addr.String()
+
+	connectTransactionID, err := Torrent.GenerateTransactionID()
+	if err != nil {
+		return nil, addr, err
+	}
+
+	transactionID, err := Torrent.GenerateTransactionID()
+	if err != nil {
+		return nil, addr, err
+	}
+
+	connectReq := make([]byte, 16)
+	binary.BigEndian.PutUint64(connectReq[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(connectReq[8:12], udpActionConnect)
+	binary.BigEndian.PutUint32(connectReq[12:16], connectTransactionID)
+
+	retries := max(Torrent.Config.UDPTrackerRetries, 0)
+
+	for attempt := 0; attempt <= retries && ctx.Err() == nil; attempt++ {
+		timeout := udpBaseTimeout << min(attempt, 8)
+
+		connectionID, cached := cachedUDPConnection(key)
+		if !cached {
+			log.Printf("[INFO]\tSending Connect to %s, transaction_id: %d\n", addr, connectTransactionID)
+
+			_, err = conn.Write(connectReq)
+			if err != nil {
+				log.Printf("[FAIL]\tAttempt %d failed to send connect: %v\n", attempt+1, err)
+				continue
+			}
+
+			resp, err := readUDPResponse(ctx, conn, connectTransactionID, timeout)
+			if err != nil {
+				log.Printf("[FAIL]\tAttempt %d failed to read connect response: %v\n", attempt+1, err)
+				continue
+			}
+
+			switch binary.BigEndian.Uint32(resp[0:4]) {
+			case udpActionConnect:
+			case udpActionError:
+				return nil, addr, fmt.Errorf("Tracker failure: %s\n", resp[8:])
+			default:
+				return nil, addr, fmt.Errorf("Invalid connect action: %d\n", binary.BigEndian.Uint32(resp[0:4]))
+			}
+
+			if len(resp) < 16 {
+				return nil, addr, fmt.Errorf("Invalid connect response length: %d\n", len(resp))
+			}
+
+			connectionID = binary.BigEndian.Uint64(resp[8:16])
+			storeUDPConnection(key, connectionID)
+		}
+
+		_, err = conn.Write(build(connectionID, transactionID))
+		if err != nil {
+			log.Printf("[FAIL]\tAttempt %d failed to send request: %v\n", attempt+1, err)
+			continue
+		}
+
+		resp, err := readUDPResponse(ctx, conn, transactionID, timeout)
+		if err != nil {
+			log.Printf("[FAIL]\tAttempt %d failed to read response: %v\n", attempt+1, err)
+			continue
+		}
+
+		switch got := binary.BigEndian.Uint32(resp[0:4]); got {
+		case action:
+			return resp, addr, nil
+
+		case udpActionError:
+			if cached {
+				// The tracker may have forgotten the connection ID earlier than BEP-15 requires
+				log.Printf("[INFO]\tTracker %s rejected a cached connection ID: %s\n", announceURL, resp[8:])
+				forgetUDPConnection(key)
+
+				continue
+			}
+
+			return nil, addr, fmt.Errorf("Tracker failure: %s\n", resp[8:])
+
+		default:
+			return nil, addr, fmt.Errorf("Invalid response action: %d\n", got)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, addr, ctx.Err()
+	}
+
+	forgetUDPConnection(key)
+
+	return nil, addr, fmt.Errorf("No response after %d attempts\n", retries+1)
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,388 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// ssdpAddr is the SSDP multicast group UPnP devices are discovered on, and ssdpTimeout how
+// long discovery waits for gateways to answer.
+const (
+	ssdpAddr    = "239.255.255.250:1900"
+	ssdpTimeout = 3 * time.Second
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// upnpErrorPermanentLease is the UPnP error code of gateways only accepting permanent leases.
+const upnpErrorPermanentLease = 725
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+upnpDevice is a device of a UPnP device description, with its services and embedded devices.
+
+Fields:
+  - DeviceType: URN of the device type.
+  - Services: Services the device offers.
+  - Devices: Embedded devices.
+*/
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+upnpService is a service of a UPnP device.
+
+Fields:
+  - ServiceType: URN of the service type.
+  - ControlURL: URL SOAP actions are posted to, possibly relative.
+*/
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+findWANService searches a device and its embedded devices for the WAN connection service
+port mappings are made with.
+
+Parameters:
+  - device: Device to search.
+
+Returns:
+  - upnpService: The WANIPConnection or WANPPPConnection service.
+  - bool: False if the device has no such service.
+*/
+func findWANService(device upnpDevice) (upnpService, bool) {
+	for _, service := range device.Services {
+		if strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+			strings.HasPrefix(service.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+			return service, true
+		}
+	}
+
+	for _, embedded := range device.Devices {
+		service, ok := findWANService(embedded)
+		if ok {
+			return service, true
+		}
+	}
+
+	return upnpService{}, false
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+upnpIGD maps ports with a UPnP Internet Gateway Device. The gateway is discovered with SSDP
+on the first Add.
+
+Fields:
+  - controlURL: Absolute control URL of the WAN connection service.
+  - serviceType: URN of the WAN connection service.
+  - local: Our address on the gateway's network.
+  - client: HTTP client for the description and SOAP requests.
+*/
+type upnpIGD struct {
+	controlURL  string
+	serviceType string
+	local       net.IP
+	client      *http.Client
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+// Name returns "UPnP".
+func (Mapper *upnpIGD) Name() string {
+	return "UPnP"
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+discover finds an Internet Gateway Device with an SSDP search and reads the control URL of its
+WAN connection service from its device description.
+
+Parameters:
+  - Mapper: Pointer to the upnpIGD mapper to fill in.
+
+Returns:
+  - error: Non-nil if no gateway with a WAN connection service answered.
+*/
+func (Mapper *upnpIGD) discover() error {
+	Mapper.client = &http.Client{Timeout: 5 * time.Second}
+
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return fmt.Errorf("Opening SSDP socket: %v", err)
+	}
+	defer conn.Close()
+
+	for _, target := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	} {
+		search := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"ST: " + target + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+
+		_, err = conn.WriteToUDP([]byte(search), group)
+		if err != nil {
+			return fmt.Errorf("Sending SSDP search: %v", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ssdpTimeout))
+	buf := make([]byte, 2048)
+	tried := make(map[string]bool)
+
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("No UPnP gateway found")
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		location := resp.Header.Get("Location")
+		if location == "" || tried[location] {
+			continue
+		}
+
+		tried[location] = true
+
+		if Mapper.describe(location) == nil {
+			return nil
+		}
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+describe fetches a device description and takes the WAN connection service from it.
+
+Parameters:
+  - Mapper: Pointer to the upnpIGD mapper to fill in.
+  - location: URL of the device description from the SSDP answer.
+
+Returns:
+  - error: Non-nil if the description cannot be read or has no WAN connection service.
+*/
+func (Mapper *upnpIGD) describe(location string) error {
+	base, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+
+	resp, err := Mapper.client.Get(location)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var root struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+
+	err = xml.NewDecoder(resp.Body).Decode(&root)
+	if err != nil {
+		return fmt.Errorf("Decoding device description: %v", err)
+	}
+
+	service, ok := findWANService(root.Device)
+	if !ok {
+		return fmt.Errorf("Device has no WAN connection service")
+	}
+
+	if root.URLBase != "" {
+		base, err = url.Parse(root.URLBase)
+		if err != nil {
+			return err
+		}
+	}
+
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return err
+	}
+
+	host, err := net.ResolveIPAddr("ip4", control.Hostname())
+	if err != nil {
+		return err
+	}
+
+	Mapper.local, err = localAddrTo(host.IP)
+	if err != nil {
+		return err
+	}
+
+	Mapper.controlURL = control.String()
+	Mapper.serviceType = service.ServiceType
+
+	return nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+soap invokes an action of the WAN connection service.
+
+Parameters:
+  - Mapper: Pointer to the discovered upnpIGD mapper.
+  - action: Action name.
+  - args: Argument names and values, in the order the action defines them.
+
+Returns:
+  - int: UPnP error code if the gateway returned a fault (0 otherwise).
+  - error: Non-nil if the request failed or the gateway returned a fault.
+*/
+func (Mapper *upnpIGD) soap(action string, args [][2]string) (int, error) {
+	var body strings.Builder
+
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" ` +
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, Mapper.serviceType)
+
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", Mapper.controlURL, strings.NewReader(body.String()))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+Mapper.serviceType+"#"+action+`"`)
+
+	resp, err := Mapper.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+
+	var fault struct {
+		Code        int    `xml:"Body>Fault>detail>UPnPError>errorCode"`
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+
+	xml.NewDecoder(resp.Body).Decode(&fault)
+
+	return fault.Code, fmt.Errorf("%s returned %s: error %d %s", action, resp.Status, fault.Code, fault.Description)
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Add creates the mapping with AddPortMapping. Gateways only accepting permanent leases are
+asked again for one, leaving Close to remove the mapping.
+
+Parameters:
+  - Mapper: Pointer to the upnpIGD mapper.
+  - internal: Local port to forward.
+  - external: External port to forward.
+  - lifetime: Requested lease.
+
+Returns:
+  - uint16: External port mapped (UPnP always maps the requested one).
+  - time.Duration: Lease granted (0 for a permanent mapping).
+  - error: Non-nil if no gateway was found or it refused the mapping.
+*/
+func (Mapper *upnpIGD) Add(internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	if Mapper.controlURL == "" {
+		err := Mapper.discover()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	args := func(lease time.Duration) [][2]string {
+		return [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", Mapper.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "BitTorrent"},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		}
+	}
+
+	code, err := Mapper.soap("AddPortMapping", args(lifetime))
+	if code == upnpErrorPermanentLease {
+		lifetime = 0
+		_, err = Mapper.soap("AddPortMapping", args(lifetime))
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return external, lifetime, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Remove deletes the mapping with DeletePortMapping.
+
+Parameters:
+  - Mapper: Pointer to the upnpIGD mapper.
+  - internal: Local port of the mapping (unused).
+  - external: External port of the mapping.
+
+Returns:
+  - error: Non-nil if the gateway refused.
+*/
+func (Mapper *upnpIGD) Remove(internal, external uint16) error {
+	_, err := Mapper.soap("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", "TCP"},
+	})
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
@@ -3,12 +3,13 @@ package torrent
 import (
 	crand "crypto/rand"
 	"encoding/binary"
-	"encoding/json"
+	"encoding/hex"
 	"fmt"
-	"io"
-	"net/http"
+	"log"
+	"net"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // --------------------------------------------------------------------------------------------- //
@@ -44,6 +45,79 @@ func (Torrent *TorrentFile) ParsePeers(peers string) ([]Peer, error) {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+ParsePeers6 converts a compact IPv6 peer list (BEP-7 "peers6") into a slice of Peer structs.
+Each peer is represented by 18 bytes (16 for IP, 2 for port).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile (implicitly used for method context).
+  - peers: String containing the compact IPv6 peer list.
+
+Returns:
+  - []Peer: Slice of Peer structs with IP and port information.
+  - error: Non-nil if the peer list length is invalid (not a multiple of 18).
+*/
+func (Torrent *TorrentFile) ParsePeers6(peers string) ([]Peer, error) {
+	peerBytes := []byte(peers)
+	if len(peerBytes)%18 != 0 {
+		return nil, fmt.Errorf("Invalid peers6 length: %d (must be multiple of 18)\n", len(peerBytes))
+	}
+
+	var result []Peer
+
+	for i := 0; i < len(peerBytes); i += 18 {
+		ip := net.IP(peerBytes[i : i+16]).String()
+		port := binary.BigEndian.Uint16(peerBytes[i+16 : i+18])
+		result = append(result, Peer{IP: ip, Port: port})
+	}
+
+	return result, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+responsePeers returns the IPv4 and IPv6 peers of a tracker response.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile (implicitly used for method context).
+  - resp: Tracker response.
+
+Returns:
+  - []Peer: Peers from Peers followed by peers from Peers6.
+  - error: Non-nil if either compact list has an invalid length.
+*/
+func (Torrent *TorrentFile) responsePeers(resp *TrackerResponse) ([]Peer, error) {
+	peers, err := Torrent.ParsePeers(resp.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	peers6, err := Torrent.ParsePeers6(resp.Peers6)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(peers, peers6...), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+peerCount returns the number of peers in a tracker response, IPv4 and IPv6 combined.
+
+Parameters:
+  - Response: Tracker response.
+
+Returns:
+  - int: Number of compact peer entries.
+*/
+func (Response *TrackerResponse) peerCount() int {
+	return len(Response.Peers)/6 + len(Response.Peers6)/18
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 GetInfoHash retrieves the SHA-1 hash of the torrent's info dictionary.
 It returns the precomputed InfoHash stored in the TorrentFile.
@@ -61,6 +135,125 @@ func (Torrent *TorrentFile) GetInfoHash() ([20]byte, error) {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+GetInfoHashV2 retrieves the SHA-256 hash of the torrent's info dictionary.
+It is only populated for v2 and hybrid torrents ("meta version" 2).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the InfoHashV2.
+
+Returns:
+  - [32]byte: The 32-byte SHA-256 hash of the info dictionary.
+  - error: Non-nil if the torrent has no v2 metadata.
+*/
+func (Torrent *TorrentFile) GetInfoHashV2() ([32]byte, error) {
+	if !Torrent.IsV2() {
+		return [32]byte{}, fmt.Errorf("Torrent has no v2 info hash\n")
+	}
+
+	return Torrent.Info.InfoHashV2, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+GetShortInfoHashV2 retrieves the v2 info hash truncated to 20 bytes.
+This is the form used by trackers and in the peer wire handshake for v2 swarms.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the InfoHashV2.
+
+Returns:
+  - [20]byte: The first 20 bytes of the SHA-256 info hash.
+  - error: Non-nil if the torrent has no v2 metadata.
+*/
+func (Torrent *TorrentFile) GetShortInfoHashV2() ([20]byte, error) {
+	full, err := Torrent.GetInfoHashV2()
+	if err != nil {
+		return [20]byte{}, err
+	}
+
+	var short [20]byte
+	copy(short[:], full[:20])
+
+	return short, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+IsV2 reports whether the torrent carries BEP-52 (v2) metadata.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to inspect.
+
+Returns:
+  - bool: True if "meta version" is 2.
+*/
+func (Torrent *TorrentFile) IsV2() bool {
+	return Torrent.Info.MetaVersion == 2
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+IsHybrid reports whether the torrent is a hybrid v1/v2 torrent.
+Hybrid torrents carry both the v1 "pieces" string and the v2 "file tree".
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to inspect.
+
+Returns:
+  - bool: True if both v1 and v2 metadata are present.
+*/
+func (Torrent *TorrentFile) IsHybrid() bool {
+	return Torrent.IsV2() && len(Torrent.Info.Pieces) > 0
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+MatchesInfoHash checks whether a 20-byte hash identifies this torrent.
+It accepts the v1 SHA-1 hash and, for v2/hybrid torrents, the truncated v2 hash.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to match against.
+  - hash: The 20-byte hash received from a tracker, magnet link, or peer.
+
+Returns:
+  - bool: True if the hash matches either identifier.
+*/
+func (Torrent *TorrentFile) MatchesInfoHash(hash [20]byte) bool {
+	if hash == Torrent.Info.InfoHash {
+		return true
+	}
+
+	short, err := Torrent.GetShortInfoHashV2()
+
+	return err == nil && hash == short
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Created returns the torrent's "creation date" as a time.Time.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile containing the creation date.
+
+Returns:
+  - time.Time: Creation time in UTC, or the zero time if the field is absent or not positive.
+*/
+func (Torrent *TorrentFile) Created() time.Time {
+	if Torrent.CreationDate <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(Torrent.CreationDate, 0).UTC()
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 GeneratePeerID creates a unique peer ID for the client.
 It combines a fixed prefix with random characters to form a 20-byte ID.
@@ -70,17 +263,29 @@ Parameters:
 
 Returns:
   - string: A 20-character peer ID starting with "-GT0001-".
-  - error: Non-nil if random byte generation fails.
+  - error: Non-nil if random byte generation fails three times in a row.
 */
 func (Torrent *TorrentFile) GeneratePeerID() (string, error) {
 	const (
 		prefix       = "-GT0001-"
 		peerIDLength = 20
 		randomLength = peerIDLength - len(prefix)
+		attempts     = 3
 	)
 
 	randomBytes := make([]byte, randomLength)
-	_, err := crand.Read(randomBytes)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		_, err = crand.Read(randomBytes)
+		if err == nil {
+			break
+		}
+
+		log.Printf("[FAIL]\tAttempt %d to read random bytes for peer ID failed: %v\n", attempt, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
 	if err != nil {
 		return "", fmt.Errorf("Generating random bytes error: %v\n", err)
 	}
@@ -95,9 +300,40 @@ func (Torrent *TorrentFile) GeneratePeerID() (string, error) {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+PeerID returns the peer ID the torrent uses in every announce and handshake. It is generated
+with GeneratePeerID on first use and then kept, so trackers can match our started, completed
+and stopped announces to one peer, and peers see the same ID as the trackers list.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - string: The 20-character peer ID.
+  - error: Non-nil if the ID has not been generated yet and generating it fails.
+*/
+func (Torrent *TorrentFile) PeerID() (string, error) {
+	Torrent.peerIDMutex.Lock()
+	defer Torrent.peerIDMutex.Unlock()
+
+	if Torrent.peerID == "" {
+		peerID, err := Torrent.GeneratePeerID()
+		if err != nil {
+			return "", err
+		}
+
+		Torrent.peerID = peerID
+	}
+
+	return Torrent.peerID, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 GetTotalSize calculates the total size of the torrent's content.
 For single-file torrents, it returns the file length; for multi-file torrents, it sums the file lengths.
+For v2-only torrents the lengths are taken from the file tree.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing file metadata.
@@ -107,6 +343,16 @@ Returns:
   - error: Always nil (included for interface compatibility).
 */
 func (Torrent *TorrentFile) GetTotalSize() (uint64, error) {
+	if len(Torrent.Info.Files) == 0 && Torrent.Info.Length == 0 && len(Torrent.Info.FileTree) > 0 {
+		var total uint64 = 0
+
+		for _, file := range walkFileTree(Torrent.Info.FileTree, nil) {
+			total += uint64(file.length)
+		}
+
+		return total, nil
+	}
+
 	if len(Torrent.Info.Files) == 0 {
 		return uint64(Torrent.Info.Length), nil
 	}
@@ -154,23 +400,43 @@ func isUDP(url string) bool {
 
 // --------------------------------------------------------------------------------------------- //
 
+/*
+isWebSocket checks if a URL uses the WebSocket protocol.
+WebTorrent trackers use it to hand out WebRTC offers, which the client cannot answer:
+peers are only reached over TCP, so these trackers are marked dead (see announceTracker).
+
+Parameters:
+  - url: The URL string to check.
+
+Returns:
+  - bool: True if the URL starts with "ws://" or "wss://", false otherwise.
+*/
+func isWebSocket(url string) bool {
+	return strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
 /*
 GenerateTransactionID creates a random 32-bit transaction ID for tracker requests.
 It uses cryptographically secure random bytes to ensure uniqueness.
+Transaction IDs only match responses to requests, so if the system entropy source fails
+it falls back to math/rand instead of aborting the announce.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile (implicitly used for method context).
 
 Returns:
   - uint32: A random 32-bit transaction ID.
-  - error: Non-nil if random byte generation fails.
+  - error: Always nil (included for interface compatibility).
 */
 func (Torrent *TorrentFile) GenerateTransactionID() (uint32, error) {
 	var buf [4]byte
 
 	_, err := crand.Read(buf[:])
 	if err != nil {
-		return 0, fmt.Errorf("Generating transaction ID error: %v\n", err)
+		log.Printf("[FAIL]\tcrypto/rand failed for transaction ID, falling back to math/rand: %v\n", err)
+		return randUint32(), nil
 	}
 
 	return binary.BigEndian.Uint32(buf[:]), nil
@@ -181,13 +447,16 @@ func (Torrent *TorrentFile) GenerateTransactionID() (uint32, error) {
 /*
 BuildFileInfo constructs the FileInfo slice for the torrent's files.
 It creates file paths and offsets for single-file or multi-file torrents.
+Entries resolving to the same path are rejected or renamed according to Config.DuplicatePaths,
+so two entries never share a file handle. Padding files and symlinks are marked so they are
+never created as regular files, and executable files so their mode is set once written.
 
 Parameters:
   - Torrent: Pointer to the TorrentFile containing file metadata.
   - outputDir: Directory where the files will be saved.
 
 Returns:
-  - error: Always nil (no error conditions are currently checked).
+  - error: Non-nil if duplicate paths are found and the policy is DuplicatePathsError.
 */
 func (Torrent *TorrentFile) BuildFileInfo(outputDir string) error {
 	Torrent.Files = nil
@@ -200,6 +469,7 @@ func (Torrent *TorrentFile) BuildFileInfo(outputDir string) error {
 		})
 	} else {
 		baseDir := filepath.Join(outputDir, Torrent.Info.Name)
+		seen := make(map[string]struct{})
 		var offset int64 = 0
 
 		for _, fileEntry := range Torrent.Info.Files {
@@ -207,10 +477,28 @@ func (Torrent *TorrentFile) BuildFileInfo(outputDir string) error {
 			parts = append(parts, fileEntry.Path...)
 			fullPath := filepath.Join(parts...)
 
+			if _, duplicate := seen[fullPath]; duplicate {
+				if Torrent.Config.DuplicatePaths != DuplicatePathsRename {
+					log.Printf("[ERROR]\tDuplicate file path in torrent: %s\n", fullPath)
+					Torrent.Files = nil
+
+					return fmt.Errorf("Duplicate file path in torrent: %s\n", fullPath)
+				}
+
+				renamed := disambiguatePath(fullPath, seen)
+				log.Printf("[INFO]\tDuplicate file path %s renamed to %s\n", fullPath, renamed)
+				fullPath = renamed
+			}
+
+			seen[fullPath] = struct{}{}
+
 			Torrent.Files = append(Torrent.Files, FileInfo{
-				Path:   fullPath,
-				Length: fileEntry.Length,
-				Offset: offset,
+				Path:       fullPath,
+				Length:     fileEntry.Length,
+				Offset:     offset,
+				Pad:        isPadFile(fileEntry),
+				Symlink:    isSymlinkEntry(fileEntry),
+				Executable: strings.Contains(fileEntry.Attr, "x"),
 			})
 
 			offset += fileEntry.Length
@@ -223,38 +511,140 @@ func (Torrent *TorrentFile) BuildFileInfo(outputDir string) error {
 // --------------------------------------------------------------------------------------------- //
 
 /*
-GetExternalIP retrieves the client's external IP address.
-It queries an external service (httpbin.org) to obtain the public IP.
+sanitizeName makes Info.Name usable as a file or directory name. Path separators are
+replaced so the name cannot point outside the output directory, and a name that is empty
+or only "." or ".." falls back to the hex info hash, with a warning.
 
 Parameters:
-  - None: No parameters are required.
+  - Torrent: Pointer to the TorrentFile whose info hash has been computed.
+*/
+func (Torrent *TorrentFile) sanitizeName() {
+	name := strings.TrimSpace(Torrent.Info.Name)
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "").Replace(name)
+
+	if name == "" || name == "." || name == ".." {
+		name = hex.EncodeToString(Torrent.Info.InfoHash[:])
+		log.Printf("[FAIL]\tTorrent has no usable name (%q), using %s\n", Torrent.Info.Name, name)
+	} else if name != Torrent.Info.Name {
+		log.Printf("[FAIL]\tTorrent name %q is not a valid file name, using %q\n", Torrent.Info.Name, name)
+	}
+
+	Torrent.Info.Name = name
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+disambiguatePath finds a free variant of a path by inserting a numeric suffix before the extension.
+
+Parameters:
+  - path: The colliding path.
+  - seen: Set of paths already in use.
 
 Returns:
-  - string: The external IP address as a string.
-  - error: Non-nil if the HTTP request, response reading, or JSON parsing fails.
+  - string: The first "name (N).ext" variant not present in seen.
 */
-func GetExternalIP() (string, error) {
-	resp, err := http.Get("http://httpbin.org/ip")
-	if err != nil {
-		return "", fmt.Errorf("[ERROR]\tFailed to get external IP: %v\n", err)
+func disambiguatePath(path string, seen map[string]struct{}) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if _, taken := seen[candidate]; !taken {
+			return candidate
+		}
 	}
-	defer resp.Body.Close()
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("[ERROR]\tFailed to read response body: %v\n", err)
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ExternalIP returns our public IP address as last reported by a tracker (see setExternalIP).
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - string: Our external IP address, or "" if no tracker reported it yet.
+*/
+func (Torrent *TorrentFile) ExternalIP() string {
+	Torrent.extIPMutex.Lock()
+	defer Torrent.extIPMutex.Unlock()
+
+	return Torrent.extIP
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+setExternalIP records the address a tracker saw our announce come from, sent as the
+"external ip" key of HTTP announce responses (BEP-24). UDP announce responses (BEP-15)
+have no such field.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - raw: 4-byte IPv4 or 16-byte IPv6 address in network byte order.
+*/
+func (Torrent *TorrentFile) setExternalIP(raw string) {
+	if len(raw) != net.IPv4len && len(raw) != net.IPv6len {
+		return
+	}
+
+	ip := net.IP(raw).String()
+
+	Torrent.extIPMutex.Lock()
+	defer Torrent.extIPMutex.Unlock()
+
+	if Torrent.extIP != ip {
+		log.Printf("[INFO]\tTracker reports our external IP as %s\n", ip)
+		Torrent.extIP = ip
+	}
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+isSelf reports whether a peer address is our own endpoint: our external IP with the port we
+announce, or a local interface address with the port we listen on.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - peer: Peer to check.
+
+Returns:
+  - bool: True if connecting to the peer would connect to ourselves.
+*/
+func (Torrent *TorrentFile) isSelf(peer Peer) bool {
+	ip := net.ParseIP(peer.IP)
+	if ip == nil {
+		return false
 	}
 
-	var result struct {
-		Origin string `json:"origin"`
+	if peer.Port == Torrent.Config.announcePort() && ip.Equal(net.ParseIP(Torrent.ExternalIP())) {
+		return true
 	}
 
-	err = json.Unmarshal(body, &result)
+	if peer.Port != Torrent.Config.ListenPort {
+		return false
+	}
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return "", fmt.Errorf("[ERROR]\tFailed to parse JSON: %v\n", err)
+		return false
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(ip) {
+			return true
+		}
 	}
 
-	return result.Origin, nil
+	return false
 }
 
 // --------------------------------------------------------------------------------------------- //
@@ -0,0 +1,291 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadBlock reads a range of bytes within a piece back from the files on disk.
+The range may span several files; each overlapping part is read with ReadAt,
+which is safe for concurrent use on the same handle.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - index: Index of the piece.
+  - begin: Offset of the first byte within the piece.
+  - length: Number of bytes to read.
+
+Returns:
+  - []byte: The requested bytes.
+  - error: Non-nil if the range is out of bounds, a file is not open, or a read fails.
+*/
+func (Torrent *TorrentFile) ReadBlock(index int, begin, length int64) ([]byte, error) {
+	if index < 0 || index >= Torrent.NumPieces || begin < 0 || length < 0 || begin+length > Torrent.PieceSize(index) {
+		return nil, fmt.Errorf("Block out of range: piece %d, begin %d, length %d\n", index, begin, length)
+	}
+
+	Torrent.touchPiece(index)
+
+	blockStart := int64(index)*Torrent.PieceLength + begin
+	blockEnd := blockStart + length
+	data := make([]byte, length)
+
+	for _, file := range Torrent.Files {
+		start := max(blockStart, file.Offset)
+		end := min(blockEnd, file.Offset+file.Length)
+
+		if start >= end {
+			continue
+		}
+
+		if file.Handle == nil {
+			return nil, fmt.Errorf("File %s is not open\n", file.Path)
+		}
+
+		_, err := file.Handle.ReadAt(data[start-blockStart:end-blockStart], start-file.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("Reading piece %d from %s: %v\n", index, file.Path, err)
+		}
+	}
+
+	return data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+ReadPiece reads the full data of a piece back from the files on disk.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - index: Index of the piece to read.
+
+Returns:
+  - []byte: The piece data.
+  - error: Non-nil if the piece could not be read.
+*/
+func (Torrent *TorrentFile) ReadPiece(index int) ([]byte, error) {
+	return Torrent.ReadBlock(index, 0, Torrent.PieceSize(index))
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+VerifyPiece re-reads a piece from disk and checks it against its SHA-1 hash.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+  - index: Index of the piece to verify.
+
+Returns:
+  - bool: True if the on-disk data matches the expected hash.
+  - error: Non-nil if the piece could not be read.
+*/
+func (Torrent *TorrentFile) VerifyPiece(index int) (bool, error) {
+	data, err := Torrent.ReadPiece(index)
+	if err != nil {
+		return false, err
+	}
+
+	hash := sha1.Sum(data)
+
+	return Torrent.pieceHashValid(index, hash), nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+VerifyDownload re-hashes every wanted piece from disk and updates Torrent.Downloaded accordingly.
+Pieces that fail to read or hash are cleared so they can be downloaded again.
+Pieces entirely within deselected files are skipped. Config.VerifyWorkers pieces are
+read and hashed concurrently, each worker holding a single piece in memory at a time.
+Progress is printed according to Config.ProgressMode.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile with open file handles.
+
+Returns:
+  - []int: Indices of pieces that failed verification, in ascending order.
+*/
+func (Torrent *TorrentFile) VerifyDownload() []int {
+	workers := Torrent.Config.VerifyWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var wanted []int
+	for i := 0; i < Torrent.NumPieces; i++ {
+		if Torrent.Wanted.Has(i) {
+			wanted = append(wanted, i)
+		}
+	}
+
+	type verifyResult struct {
+		index int
+		ok    bool
+	}
+
+	jobs := make(chan int)
+	results := make(chan verifyResult)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for index := range jobs {
+				ok, err := Torrent.VerifyPiece(index)
+				if err != nil {
+					logPeerf(nil, index, "[ERROR]\tVerification of piece %d failed: %v", index, err)
+				}
+
+				results <- verifyResult{index: index, ok: ok}
+			}
+		}()
+	}
+
+	go func() {
+		for _, index := range wanted {
+			jobs <- index
+		}
+
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var failed []int
+	checked := 0
+	progress := Torrent.progressRenderer()
+
+	for result := range results {
+		Torrent.DownloadMutex.Lock()
+		if result.ok {
+			Torrent.Downloaded.Set(result.index)
+		} else {
+			Torrent.Downloaded.Clear(result.index)
+			failed = append(failed, result.index)
+		}
+		Torrent.DownloadMutex.Unlock()
+
+		checked++
+		progress.update(
+			fmt.Sprintf("[%s]\tVerifying: %d/%d pieces", Torrent.Info.Name, checked, len(wanted)),
+			fmt.Sprintf("%s: verified %d/%d pieces", Torrent.Info.Name, checked, len(wanted)),
+			checked == len(wanted),
+		)
+	}
+
+	progress.finish()
+
+	if Torrent.merkle != nil && len(failed) > 0 {
+		failed = Torrent.settleMerkle(failed)
+	}
+
+	sort.Ints(failed)
+
+	log.Printf("[INFO]\tVerification finished: %d/%d pieces ok (%d workers)\n", checked-len(failed), checked, workers)
+
+	return failed
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+Repair rechecks an existing download and re-downloads only the pieces that are corrupt or
+missing, writing them in place over the bad data. Peers must already be connected, as for
+StartDownload. A stale resume file is replaced by the result of the recheck first, so pieces
+it wrongly claims are fetched again.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile to repair.
+  - outputDir: Directory the torrent was downloaded to.
+
+Returns:
+  - error: Non-nil if the files cannot be checked or the re-download fails.
+*/
+func (Torrent *TorrentFile) Repair(outputDir string) error {
+	err := Torrent.InitializePieces()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize pieces: %v", err)
+	}
+
+	err = Torrent.BuildFileInfo(outputDir)
+	if err != nil {
+		return err
+	}
+
+	for i := range Torrent.Files {
+		file := &Torrent.Files[i]
+		if file.Pad {
+			file.Handle = padHandle{}
+			continue
+		}
+
+		if file.Symlink {
+			continue
+		}
+
+		f, err := os.Open(file.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("[INFO]\t%s is missing, its pieces will be downloaded again\n", file.Path)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to open %s for recheck: %v\n", file.Path, err)
+		}
+
+		file.Handle = f
+	}
+
+	failed := Torrent.VerifyDownload()
+
+	for i := range Torrent.Files {
+		if Torrent.Files[i].Handle != nil {
+			Torrent.Files[i].Handle.Close()
+			Torrent.Files[i].Handle = nil
+		}
+	}
+
+	if len(failed) == 0 {
+		Torrent.progressRenderer().message("[%s]\tRepair: all pieces are intact", Torrent.Info.Name)
+		return nil
+	}
+
+	err = Torrent.SaveResume(outputDir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO]\tRepairing %d corrupt or missing pieces of %s\n", len(failed), Torrent.Info.Name)
+
+	err = Torrent.StartDownload(outputDir)
+
+	repaired := 0
+
+	Torrent.DownloadMutex.Lock()
+	for _, index := range failed {
+		if Torrent.Downloaded.Has(index) {
+			repaired++
+		}
+	}
+	Torrent.DownloadMutex.Unlock()
+
+	Torrent.progressRenderer().message("[%s]\tRepair: %d/%d pieces repaired", Torrent.Info.Name, repaired, len(failed))
+	log.Printf("[INFO]\tRepaired %d/%d pieces of %s\n", repaired, len(failed), Torrent.Info.Name)
+
+	return err
+}
+
+// --------------------------------------------------------------------------------------------- //
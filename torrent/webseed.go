@@ -0,0 +1,287 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+// webSeedTimeout bounds a single HTTP request to a web seed, and webSeedMaxFailures is the
+// number of consecutive failed pieces after which a web seed is given up.
+const (
+	webSeedTimeout     = 60 * time.Second
+	webSeedMaxFailures = 5
+)
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+WebSeeds returns the HTTP(S) web seed URLs (BEP-19) of the torrent, without duplicates.
+It is empty if Config.WebSeeds is disabled.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+
+Returns:
+  - []string: Web seed base URLs from the torrent's url-list.
+*/
+func (Torrent *TorrentFile) WebSeeds() []string {
+	if !Torrent.Config.WebSeeds {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var seeds []string
+
+	for _, seedURL := range Torrent.URLList {
+		u, err := url.Parse(seedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || seen[seedURL] {
+			continue
+		}
+
+		seen[seedURL] = true
+		seeds = append(seeds, seedURL)
+	}
+
+	return seeds
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+webSeedFileURL builds the URL of one file of the torrent on a web seed. For single-file
+torrents a base URL ending in "/" gets the torrent name appended; for multi-file torrents
+the name and the file's path are always appended.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile.
+  - base: Web seed base URL.
+  - file: Index into Torrent.Files.
+
+Returns:
+  - string: URL of the file.
+*/
+func (Torrent *TorrentFile) webSeedFileURL(base string, file int) string {
+	if len(Torrent.Info.Files) == 0 {
+		if strings.HasSuffix(base, "/") {
+			return base + url.PathEscape(Torrent.Info.Name)
+		}
+
+		return base
+	}
+
+	parts := []string{url.PathEscape(Torrent.Info.Name)}
+	for _, part := range Torrent.Info.Files[file].Path {
+		parts = append(parts, url.PathEscape(part))
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(parts, "/")
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fetchWebSeedRange downloads a byte range of one file with an HTTP range request.
+Servers that ignore the Range header and send the whole file are tolerated by skipping
+to the requested offset.
+
+Parameters:
+  - client: HTTP client to use.
+  - fileURL: URL of the file.
+  - offset: Offset of the range within the file.
+  - length: Length of the range.
+
+Returns:
+  - []byte: The requested bytes.
+  - error: Non-nil if the request fails or the response is too short.
+*/
+func fetchWebSeedRange(client *http.Client, fileURL string, offset, length int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Creating web seed request error: %v\n", err)
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Web seed request error: %v\n", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		_, err = io.CopyN(io.Discard, resp.Body, offset)
+		if err != nil {
+			return nil, fmt.Errorf("Skipping to offset %d of %s error: %v\n", offset, fileURL, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("Web seed returned %s for %s\n", resp.Status, fileURL)
+	}
+
+	data := make([]byte, length)
+
+	_, err = io.ReadFull(resp.Body, data)
+	if err != nil {
+		return nil, fmt.Errorf("Reading %d bytes at offset %d of %s error: %v\n", length, offset, fileURL, err)
+	}
+
+	return data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+fetchWebSeedPiece downloads a piece from a web seed, with one range request per file the
+piece overlaps.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile whose Files have been built.
+  - client: HTTP client to use.
+  - base: Web seed base URL.
+  - index: Piece index.
+
+Returns:
+  - []byte: Piece data (not yet verified).
+  - error: Non-nil if any range request fails.
+*/
+func (Torrent *TorrentFile) fetchWebSeedPiece(client *http.Client, base string, index int) ([]byte, error) {
+	start := int64(index) * Torrent.PieceLength
+	end := start + Torrent.PieceSize(index)
+	data := make([]byte, 0, end-start)
+
+	for i := range Torrent.Files {
+		file := &Torrent.Files[i]
+
+		from := max(start, file.Offset)
+		to := min(end, file.Offset+file.Length)
+		if from >= to {
+			continue
+		}
+
+		if file.Pad {
+			data = append(data, make([]byte, to-from)...)
+			continue
+		}
+
+		chunk, err := fetchWebSeedRange(client, Torrent.webSeedFileURL(base, i), from-file.Offset, to-from)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, chunk...)
+	}
+
+	if int64(len(data)) != end-start {
+		return nil, fmt.Errorf("Web seed data for piece %d is %d bytes, expected %d\n", index, len(data), end-start)
+	}
+
+	return data, nil
+}
+
+// --------------------------------------------------------------------------------------------- //
+
+/*
+downloadFromWebSeed downloads pieces from a web seed alongside the peers. Pieces are claimed
+through Torrent.Picker like a peer having every piece, verified against their hash, and sent to
+pieceChan. While the remaining pieces are all claimed by peers, the web seed waits in case one
+of them is released. It gives up after webSeedMaxFailures consecutive failed pieces.
+
+Parameters:
+  - Torrent: Pointer to the TorrentFile being downloaded.
+  - base: Web seed base URL.
+  - pieceChan: Channel to send downloaded pieces to.
+  - wg: WaitGroup to signal completion.
+*/
+func (Torrent *TorrentFile) downloadFromWebSeed(base string, pieceChan chan<- PieceResult, wg *sync.WaitGroup) {
+	defer func() {
+		wg.Done()
+		log.Printf("[INFO]\tWeb seed %s: download completed\n", base)
+	}()
+
+	seed := &Peer{IP: base, Bitfield: Torrent.fullBitfield(true), Seeder: true, State: newPeerState()}
+	client := &http.Client{Timeout: webSeedTimeout}
+	failures := 0
+
+	log.Printf("[INFO]\tWeb seed %s: starting download\n", base)
+
+	for failures < webSeedMaxFailures {
+		Torrent.DownloadMutex.Lock()
+		changed := Torrent.piecesSignal()
+		maxPieces := Torrent.Config.MaxConcurrentPieces
+		busy := maxPieces > 0 && Torrent.InProgress.Count() >= maxPieces
+
+		pieceIndex, ok := 0, false
+		if !busy {
+			pieceIndex, ok = Torrent.Picker.Pick(seed, Torrent.InProgress, Torrent.settledPieces(seed))
+			if ok {
+				Torrent.InProgress.Set(pieceIndex)
+			}
+		}
+
+		finished := Torrent.wantedDone() == Torrent.Wanted.Count()
+		Torrent.DownloadMutex.Unlock()
+
+		if finished || Torrent.canceled.Load() {
+			if ok {
+				Torrent.DownloadMutex.Lock()
+				Torrent.releasePiece(pieceIndex)
+				Torrent.DownloadMutex.Unlock()
+			}
+
+			return
+		}
+
+		if !ok {
+			<-changed
+			continue
+		}
+
+		networkStart := time.Now()
+		data, err := Torrent.fetchWebSeedPiece(client, base, pieceIndex)
+		Torrent.counters.networkNanos.Add(int64(time.Since(networkStart)))
+
+		if err == nil {
+			hashStart := time.Now()
+			hash := sha1.Sum(data)
+			Torrent.counters.hashNanos.Add(int64(time.Since(hashStart)))
+
+			if !Torrent.pieceHashValid(pieceIndex, hash) {
+				Torrent.counters.hashFailures.Add(1)
+				Torrent.emit(Event{Type: PieceFailed, Peer: base, Piece: pieceIndex})
+				err = fmt.Errorf("Piece %d hash mismatch\n", pieceIndex)
+			}
+		}
+
+		if err != nil {
+			failures++
+			log.Printf("[FAIL]\tWeb seed %s: %v", base, err)
+
+			Torrent.DownloadMutex.Lock()
+			Torrent.releasePiece(pieceIndex)
+			Torrent.DownloadMutex.Unlock()
+
+			time.Sleep(time.Duration(failures) * time.Second)
+			continue
+		}
+
+		failures = 0
+		logPeerf(nil, pieceIndex, "[INFO]\tWeb seed %s: downloaded piece %d (length=%d)\n", base, pieceIndex, len(data))
+
+		pieceChan <- PieceResult{Index: pieceIndex, Data: data}
+	}
+
+	log.Printf("[ERROR]\tWeb seed %s: giving up after %d failed pieces\n", base, failures)
+}
+
+// --------------------------------------------------------------------------------------------- //